@@ -4,13 +4,30 @@ import 'bootstrap/dist/css/bootstrap.min.css';
 import './global.css'
 import { Button, Container, Navbar } from 'react-bootstrap';
 import Script from 'next/script';
-import { BatteryCharging, HelpCircle } from 'react-feather';
+import { BatteryCharging, HelpCircle, LogOut } from 'react-feather';
+import { useEffect, useState } from 'react';
+import { getAPI, postAPI } from './util';
 
 export default function RootLayout({
   children,
 }: {
   children: React.ReactNode
 }) {
+  const [loggedIn, setLoggedIn] = useState(false)
+
+  useEffect(() => {
+    const fetchData = async () => {
+      const status = await getAPI("/api/1/auth/status");
+      setLoggedIn(status.user !== null);
+    }
+    fetchData();
+  }, []);
+
+  async function logout() {
+    await postAPI("/api/1/auth/logout", {});
+    window.location.href = '/login/';
+  }
+
   return (
     <html lang="en" data-bs-theme="auto">
       <head>
@@ -47,6 +64,7 @@ export default function RootLayout({
             <Navbar.Brand href="/"><BatteryCharging /> chargebot.io</Navbar.Brand>
             <Navbar.Text className="justify-content-end">
               <Button variant='link' href='https://chargebot.io/help/' target='_blank'><HelpCircle className='feather-button' /></Button>
+              <Button variant='link' onClick={() => logout()} hidden={!loggedIn}><LogOut className='feather-button' /></Button>
             </Navbar.Text>
           </Container>
         </Navbar>
@@ -0,0 +1,69 @@
+'use client'
+
+import { useEffect, useState } from "react";
+import { getAPI, postAPI } from "../util";
+import Loading from "../loading";
+import { useRouter } from "next/navigation";
+import { Alert, Button, Container, Form } from "react-bootstrap";
+
+export default function PageLogin() {
+  const [isLoading, setLoading] = useState(true)
+  const [setupRequired, setSetupRequired] = useState(false)
+  const [username, setUsername] = useState("")
+  const [password, setPassword] = useState("")
+  const [error, setError] = useState("")
+  const router = useRouter();
+
+  useEffect(() => {
+    const fetchData = async () => {
+      const status = await getAPI("/api/1/auth/status");
+      if (status.authenticated || !status.auth_enabled) {
+        router.push("/");
+        return;
+      }
+      setSetupRequired(status.setup_required);
+      setLoading(false);
+    }
+    fetchData();
+  }, [router]);
+
+  function submit(e: any) {
+    e.preventDefault();
+    const fetchData = async () => {
+      setError("");
+      const json = await postAPI(setupRequired ? "/api/1/auth/setup" : "/api/1/auth/login", {
+        username: username,
+        password: password,
+      });
+      if (json.error) {
+        setError(json.error);
+        return;
+      }
+      router.push("/");
+    };
+    fetchData();
+  }
+
+  if (isLoading) {
+    return <Loading />
+  }
+
+  return (
+    <Container fluid="sm" className="pt-5 container-max-width min-height">
+      <h2 className="pb-3">{setupRequired ? "Create account" : "Log in"}</h2>
+      <p hidden={!setupRequired}>No user account exists yet. Create the first account for accessing this chargebot.io node.</p>
+      <Alert variant='danger' hidden={error === ""}>{error}</Alert>
+      <Form onSubmit={submit}>
+        <Form.Group className="mb-3">
+          <Form.Label>Username</Form.Label>
+          <Form.Control type="text" autoComplete="username" required={true} value={username} onChange={e => setUsername(e.target.value)} />
+        </Form.Group>
+        <Form.Group className="mb-3">
+          <Form.Label>Password</Form.Label>
+          <Form.Control type="password" autoComplete={setupRequired ? "new-password" : "current-password"} required={true} minLength={setupRequired ? 8 : undefined} value={password} onChange={e => setPassword(e.target.value)} />
+        </Form.Group>
+        <Button type="submit">{setupRequired ? "Create account" : "Log in"}</Button>
+      </Form>
+    </Container>
+  );
+}
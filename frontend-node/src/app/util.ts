@@ -8,12 +8,20 @@ export function getBaseUrl() {
   return '';
 }
 
+function checkUnauthorized(res: Response) {
+  if ((res.status === 401) && (typeof window !== "undefined") && (window.location.pathname !== '/login/')) {
+    window.location.href = '/login/';
+    throw new Error('unauthorized');
+  }
+}
+
 export async function getAPI(endpoint: string): Promise<any> {
   const res = await fetch(getBaseUrl() + endpoint, {
     method: 'GET',
     headers: {
     }
   });
+  checkUnauthorized(res);
   const json = await res.json();
   return json;
 }
@@ -24,6 +32,7 @@ export async function deleteAPI(endpoint: string): Promise<any> {
     headers: {
     }
   });
+  checkUnauthorized(res);
   const json = await res.json();
   return json;
 }
@@ -36,6 +45,7 @@ export async function postAPI(endpoint: string, data: any): Promise<any> {
     },
     body: JSON.stringify(data),
   });
+  checkUnauthorized(res);
   const json = await res.json();
   return json;
 }
@@ -48,6 +58,7 @@ export async function putAPI(endpoint: string, data: any): Promise<any> {
     },
     body: JSON.stringify(data),
   });
+  checkUnauthorized(res);
   const json = await res.json();
   return json;
 }
@@ -29,6 +29,9 @@ export default function PageVehicle() {
   const [maxPrice, setMaxPrice] = useState(0)
   const [departDays, setDepartDays] = useState([1, 2, 3, 4, 5])
   const [departTime, setDepartTime] = useState('07:00')
+  const [gridFallbackHours, setGridFallbackHours] = useState(0)
+  const [gridOptimization, setGridOptimization] = useState('cost')
+  const [carbonWeight, setCarbonWeight] = useState(50)
   const [tibberToken, setTibberToken] = useState('')
   const [vehicleState, setVehicleState] = useState({} as any)
   const [chargingEvents, setChargingEvents] = useState([] as any)
@@ -78,6 +81,9 @@ export default function PageVehicle() {
     setGridStrategy(e.gridStrategy);
     setDepartDays([...e.departDays].map(i => Number(i)));
     setDepartTime(e.departTime);
+    setGridFallbackHours(e.gridFallbackHours);
+    setGridOptimization(e.gridOptimization ? e.gridOptimization : 'cost');
+    setCarbonWeight(e.carbonWeight);
     setTibberToken(e.tibber_token);
   }
 
@@ -108,6 +114,9 @@ export default function PageVehicle() {
         "gridStrategy": gridStrategy,
         "departDays": departDays.join(''),
         "departTime": departTime,
+        "gridFallbackHours": gridFallbackHours,
+        "gridOptimization": gridOptimization,
+        "carbonWeight": carbonWeight,
         "max_price": maxPrice,
         "tibber_token": tibberToken
       };
@@ -140,6 +149,8 @@ export default function PageVehicle() {
     if (id === 7) return 'Set target SoC';
     if (id === 8) return 'Set charge amps';
     if (id === 9) return 'Set scheduled charging';
+    if (id === 10) return 'Surplus data stale';
+    if (id === 11) return 'Surplus data recovered';
     return 'Unknown';
   }
 
@@ -298,6 +309,24 @@ export default function PageVehicle() {
           </Form.Select>
         </Col>
       </Form.Group>
+      <Form.Group as={Row}>
+        <Form.Label column={true} className="sm-4">Optimize for:</Form.Label>
+        <Col sm={8}>
+          <Form.Select
+            aria-label="Optimize for"
+            disabled={!chargeOnTibber}
+            value={gridOptimization}
+            onChange={e => setGridOptimization(e.target.value)}>
+            <option value="cost">lowest cost</option>
+            <option value="carbon">lowest CO2 emissions</option>
+            <option value="mixed">weighted mix of cost and CO2</option>
+          </Form.Select>
+        </Col>
+      </Form.Group>
+      <Form.Group as={Row} hidden={gridOptimization !== 'mixed'}>
+        <Form.Label column={true} className="sm-4">CO2 weight: {carbonWeight} %</Form.Label>
+        <Col sm={8} style={{ 'paddingTop': '7px', 'paddingBottom': '7px' }}><Form.Range disabled={!chargeOnTibber} min={0} max={100} value={carbonWeight} onChange={e => setCarbonWeight(Number(e.target.value))} /></Col>
+      </Form.Group>
       <Form.Group as={Row} hidden={gridStrategy === 3}>
         <Form.Label column={true} className="sm-4">Max. price: {maxPrice} Cents</Form.Label>
         <Col sm={8} style={{ 'paddingTop': '7px', 'paddingBottom': '7px' }}><Form.Range required={chargeOnTibber} disabled={!chargeOnTibber} min={1} max={100} value={maxPrice} onChange={e => setMaxPrice(Number(e.target.value))} /></Col>
@@ -328,6 +357,10 @@ export default function PageVehicle() {
           />
         </Col>
       </Form.Group>
+      <Form.Group as={Row} hidden={gridStrategy === 1}>
+        <Form.Label column={true} className="sm-4">Without complete prices, charge {gridFallbackHours === 0 ? 'never' : gridFallbackHours + ' hours before departure'}</Form.Label>
+        <Col sm={8} style={{ 'paddingTop': '7px', 'paddingBottom': '7px' }}><Form.Range disabled={!chargeOnTibber} min={0} max={24} value={gridFallbackHours} onChange={e => setGridFallbackHours(Number(e.target.value))} /></Col>
+      </Form.Group>
       <Form.Group as={Row} hidden={gridProvider !== 'tibber'}>
         <Form.Label column={true} className="sm-4">Tibber Token</Form.Label>
         <Col sm={8}>
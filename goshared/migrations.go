@@ -0,0 +1,58 @@
+package goshared
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func MigrateExec(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// MigrateSteps runs several migration steps in order within the same transaction
+func MigrateSteps(steps ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// MigrateAddColumn adds a column unless it exists already,
+// as databases created before schema versioning might contain it
+func MigrateAddColumn(table string, column string, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var num int
+		if err := tx.QueryRow("select count(*) from pragma_table_info(?) where name = ?", table, column).Scan(&num); err != nil {
+			return err
+		}
+		if num > 0 {
+			return nil
+		}
+		_, err := tx.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+		return err
+	}
+}
+
+// ApplyMigration applies a migration and records its version in the schema_version table in one transaction
+func ApplyMigration(conn *sql.DB, version int, description string, up func(tx *sql.Tx) error, appliedAt string) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("insert into schema_version (version, description, applied_at) values (?, ?, ?)",
+		version, description, appliedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
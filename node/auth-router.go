@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type AuthRouter struct {
+}
+
+type AuthStatusResponse struct {
+	AuthEnabled   bool        `json:"auth_enabled"`
+	SetupRequired bool        `json:"setup_required"`
+	Authenticated bool        `json:"authenticated"`
+	User          *User       `json:"user"`
+	Scope         APIKeyScope `json:"scope"`
+}
+
+type AuthCredentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type AuthPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+type AuthCreateAPIKeyRequest struct {
+	Name  string      `json:"name"`
+	Scope APIKeyScope `json:"scope"`
+}
+
+type AuthCreateAPIKeyResponse struct {
+	Key    string  `json:"key"`
+	APIKey *APIKey `json:"api_key"`
+}
+
+type AuthErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (router *AuthRouter) SetupRoutes(s *mux.Router) {
+	s.HandleFunc("/status", router.status).Methods("GET")
+	s.HandleFunc("/setup", router.setup).Methods("POST")
+	s.HandleFunc("/login", router.login).Methods("POST")
+	s.HandleFunc("/logout", router.logout).Methods("POST")
+	s.HandleFunc("/password", router.changePassword).Methods("PUT")
+	s.HandleFunc("/users", router.listUsers).Methods("GET")
+	s.HandleFunc("/users", router.createUser).Methods("POST")
+	s.HandleFunc("/users/{id}", router.deleteUser).Methods("DELETE")
+	s.HandleFunc("/api_keys", router.listAPIKeys).Methods("GET")
+	s.HandleFunc("/api_keys", router.createAPIKey).Methods("POST")
+	s.HandleFunc("/api_keys/{id}", router.deleteAPIKey).Methods("DELETE")
+}
+
+func (router *AuthRouter) status(w http.ResponseWriter, r *http.Request) {
+	res := &AuthStatusResponse{
+		AuthEnabled:   GetConfig().AuthEnabled,
+		SetupRequired: GetDB().GetNumUsers() == 0,
+	}
+	if auth := GetAuthFromRequest(r); auth != nil {
+		res.Authenticated = true
+		res.User = auth.User
+		res.Scope = auth.Scope()
+	}
+	SendJSON(w, res)
+}
+
+// setup creates the first user account, which is only possible as long as there is none
+func (router *AuthRouter) setup(w http.ResponseWriter, r *http.Request) {
+	if GetDB().GetNumUsers() > 0 {
+		SendForbidden(w)
+		return
+	}
+	var m AuthCredentialsRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	user, err := CreateUser(m.Username, m.Password)
+	if err != nil {
+		router.sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	setSessionCookie(w, r, CreateSession(user))
+	SendJSON(w, user)
+}
+
+func (router *AuthRouter) login(w http.ResponseWriter, r *http.Request) {
+	var m AuthCredentialsRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	token, user, err := Login(m.Username, m.Password)
+	if err != nil {
+		router.sendError(w, http.StatusUnauthorized, err)
+		return
+	}
+	setSessionCookie(w, r, token)
+	SendJSON(w, user)
+}
+
+func (router *AuthRouter) logout(w http.ResponseWriter, r *http.Request) {
+	if token := GetSessionTokenFromRequest(r); token != "" {
+		GetDB().DeleteSession(GetSHA256Hash(token))
+	}
+	clearSessionCookie(w, r)
+	SendJSON(w, true)
+}
+
+func (router *AuthRouter) changePassword(w http.ResponseWriter, r *http.Request) {
+	auth := GetAuthFromRequest(r)
+	if auth == nil || auth.User == nil {
+		SendForbidden(w)
+		return
+	}
+	var m AuthPasswordRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	if err := ChangePassword(auth.User, m.Password); err != nil {
+		router.sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	// all sessions have been closed, so keep the current one alive with a new token
+	setSessionCookie(w, r, CreateSession(auth.User))
+	SendJSON(w, true)
+}
+
+func (router *AuthRouter) listUsers(w http.ResponseWriter, r *http.Request) {
+	if !router.isUserManagementAllowed(r) {
+		SendForbidden(w)
+		return
+	}
+	SendJSON(w, GetDB().GetUsers())
+}
+
+func (router *AuthRouter) createUser(w http.ResponseWriter, r *http.Request) {
+	if !router.isUserManagementAllowed(r) {
+		SendForbidden(w)
+		return
+	}
+	var m AuthCredentialsRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	user, err := CreateUser(m.Username, m.Password)
+	if err != nil {
+		router.sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	SendJSON(w, user)
+}
+
+func (router *AuthRouter) deleteUser(w http.ResponseWriter, r *http.Request) {
+	if !router.isUserManagementAllowed(r) {
+		SendForbidden(w)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		SendBadRequest(w)
+		return
+	}
+	if err := DeleteUser(id); err != nil {
+		if err == ErrUserNotFound {
+			SendNotFound(w)
+			return
+		}
+		router.sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	SendJSON(w, true)
+}
+
+func (router *AuthRouter) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !router.isUserManagementAllowed(r) {
+		SendForbidden(w)
+		return
+	}
+	SendJSON(w, GetDB().GetAPIKeys())
+}
+
+func (router *AuthRouter) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !router.isUserManagementAllowed(r) {
+		SendForbidden(w)
+		return
+	}
+	var m AuthCreateAPIKeyRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	key, e, err := CreateAPIKey(m.Name, m.Scope)
+	if err != nil {
+		router.sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	SendJSON(w, &AuthCreateAPIKeyResponse{
+		Key:    key,
+		APIKey: e,
+	})
+}
+
+func (router *AuthRouter) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !router.isUserManagementAllowed(r) {
+		SendForbidden(w)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		SendBadRequest(w)
+		return
+	}
+	if !GetDB().DeleteAPIKey(id) {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, true)
+}
+
+// isUserManagementAllowed checks that users and API keys are managed by a logged in user, not by an API key
+func (router *AuthRouter) isUserManagementAllowed(r *http.Request) bool {
+	if !GetConfig().AuthEnabled {
+		return true
+	}
+	auth := GetAuthFromRequest(r)
+	return auth != nil && auth.User != nil
+}
+
+func (router *AuthRouter) sendError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&AuthErrorResponse{Error: err.Error()})
+}
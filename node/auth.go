@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SessionCookieName = "chargebot_session"
+	APIKeyPrefix      = "cb_"
+	MinPasswordLength = 8
+)
+
+const (
+	AuthAnonymousSurplusAuto   = "auto"
+	AuthAnonymousSurplusAlways = "1"
+	AuthAnonymousSurplusNever  = "0"
+)
+
+type contextKey string
+
+var contextKeyAuth = contextKey("Auth")
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrPasswordTooShort   = errors.New("password must be at least 8 characters long")
+	ErrUsernameTaken      = errors.New("username already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrLastUser           = errors.New("the last user can't be deleted")
+)
+
+// used for comparing passwords of unknown users, so failed logins take the same time
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("chargebot"), bcrypt.DefaultCost)
+
+// AuthInfo describes who issued a request, either a logged in user or an API key
+type AuthInfo struct {
+	User   *User
+	APIKey *APIKey
+}
+
+// Scope returns the permissions of the request. Users always have full control.
+func (a *AuthInfo) Scope() APIKeyScope {
+	if a.APIKey != nil {
+		return a.APIKey.Scope
+	}
+	return APIKeyScopeFull
+}
+
+// Allows checks whether the scope grants access to routes requiring the given scope.
+// A read key can't push surplus data and a surplus key can't read anything.
+func (scope APIKeyScope) Allows(required APIKeyScope) bool {
+	return scope == APIKeyScopeFull || scope == required
+}
+
+func IsValidAPIKeyScope(scope APIKeyScope) bool {
+	return scope == APIKeyScopeRead || scope == APIKeyScopeSurplus || scope == APIKeyScopeFull
+}
+
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", ErrPasswordTooShort
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func generateToken(length int) string {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicln(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func CreateUser(username string, password string) (*User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+	if GetDB().GetUserByName(username) != nil {
+		return nil, ErrUsernameTaken
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return GetDB().CreateUser(username, hash), nil
+}
+
+// ChangePassword sets a new password and logs out all of the user's sessions
+func ChangePassword(user *User, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	GetDB().SetUserPassword(user.ID, hash)
+	GetDB().DeleteUserSessions(user.ID)
+	return nil
+}
+
+// DeleteUser removes a user and its sessions.
+// The last user can't be deleted, as this would allow anyone to run the setup again.
+func DeleteUser(id int) error {
+	if GetDB().GetUserByID(id) == nil {
+		return ErrUserNotFound
+	}
+	if GetDB().GetNumUsers() <= 1 {
+		return ErrLastUser
+	}
+	GetDB().DeleteUser(id)
+	return nil
+}
+
+// Login checks the credentials and returns a new session token
+func Login(username string, password string) (string, *User, error) {
+	user := GetDB().GetUserByName(strings.TrimSpace(username))
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return "", nil, ErrInvalidCredentials
+	}
+	return CreateSession(user), user, nil
+}
+
+func CreateSession(user *User) string {
+	token := generateToken(32)
+	expires := GetDB().Time.UTCNow().AddDate(0, 0, GetConfig().AuthSessionDays)
+	GetDB().CreateSession(GetSHA256Hash(token), user.ID, expires)
+	return token
+}
+
+// CreateAPIKey creates a new API key. The key itself is only returned once, only its hash is stored.
+func CreateAPIKey(name string, scope APIKeyScope) (string, *APIKey, error) {
+	if !IsValidAPIKeyScope(scope) {
+		return "", nil, errors.New("scope must be 'read', 'surplus' or 'full'")
+	}
+	key := APIKeyPrefix + generateToken(20)
+	e := GetDB().CreateAPIKey(strings.TrimSpace(name), GetSHA256Hash(key), scope)
+	return key, e, nil
+}
+
+// getAPIKeyFromRequest reads an API key from the Authorization or X-API-Key header.
+// For scripts and devices which can only be configured with a URL, the api_key query parameter is accepted, too.
+func getAPIKeyFromRequest(r *http.Request) string {
+	if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		return strings.TrimPrefix(bearer, "Bearer ")
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// AuthenticateRequest returns the session's user or the API key of the request, or nil if there is none
+func AuthenticateRequest(r *http.Request) *AuthInfo {
+	if key := getAPIKeyFromRequest(r); key != "" {
+		e := GetDB().GetAPIKeyByHash(GetSHA256Hash(key))
+		if e == nil {
+			return nil
+		}
+		GetDB().SetAPIKeyLastUsed(e.ID)
+		return &AuthInfo{APIKey: e}
+	}
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	user := GetDB().GetSessionUser(GetSHA256Hash(cookie.Value))
+	if user == nil {
+		return nil
+	}
+	return &AuthInfo{User: user}
+}
+
+func GetAuthFromRequest(r *http.Request) *AuthInfo {
+	auth := r.Context().Value(contextKeyAuth)
+	if auth == nil {
+		return nil
+	}
+	return auth.(*AuthInfo)
+}
+
+// HasFullScope checks for full control, required for reading data containing credentials
+func HasFullScope(r *http.Request) bool {
+	if !GetConfig().AuthEnabled {
+		return true
+	}
+	auth := GetAuthFromRequest(r)
+	return auth != nil && auth.Scope() == APIKeyScopeFull
+}
+
+func GetSessionTokenFromRequest(r *http.Request) string {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// getRequiredScope returns the scope needed for an API request:
+// pushing data to /api/1/user/ requires the surplus scope, reading requires the read scope, everything else full control.
+func getRequiredScope(r *http.Request) APIKeyScope {
+	if strings.HasPrefix(r.URL.Path, "/api/1/user/") && r.Method == http.MethodPost {
+		return APIKeyScopeSurplus
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return APIKeyScopeRead
+	}
+	return APIKeyScopeFull
+}
+
+func isPublicRoute(r *http.Request) bool {
+	if r.URL.Path == "/metrics" {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		// static frontend files including the login page
+		return true
+	}
+	publicURLs := []string{
+		"/api/1/auth/status",
+		"/api/1/auth/login",
+		"/api/1/auth/logout",
+		"/api/1/auth/setup",
+	}
+	for _, url := range publicURLs {
+		if r.URL.Path == url {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAnonymousSurplusAllowed returns if surplus and plug state can be pushed without an API key.
+// By default, existing scripts keep working on nodes upgraded from a version without authentication,
+// and on new nodes until the first user or API key has been created.
+func IsAnonymousSurplusAllowed() bool {
+	switch GetConfig().AuthAnonymousSurplus {
+	case AuthAnonymousSurplusAlways:
+		return true
+	case AuthAnonymousSurplusNever:
+		return false
+	}
+	if GetDB().GetSetting(SettingAnonymousSurplus) == "1" {
+		return true
+	}
+	return GetDB().GetNumUsers() == 0 && len(GetDB().GetAPIKeys()) == 0
+}
+
+func VerifyAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := AuthenticateRequest(r)
+		if GetConfig().AuthEnabled && !isPublicRoute(r) {
+			required := getRequiredScope(r)
+			if auth == nil {
+				if !(required == APIKeyScopeSurplus && IsAnonymousSurplusAllowed()) {
+					SendUnauthorized(w)
+					return
+				}
+			} else if !auth.Scope().Allows(required) {
+				SendForbidden(w)
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), contextKeyAuth, auth)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().AddDate(0, 0, GetConfig().AuthSessionDays),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func resetAuthConfig(t *testing.T) {
+	enabled, anonymous := GetConfig().AuthEnabled, GetConfig().AuthAnonymousSurplus
+	t.Cleanup(func() {
+		GetConfig().AuthEnabled = enabled
+		GetConfig().AuthAnonymousSurplus = anonymous
+	})
+}
+
+func getSessionCookie(res *http.Response) *http.Cookie {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == SessionCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestAuth_Unauthorized(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	GetConfig().AuthAnonymousSurplus = AuthAnonymousSurplusNever
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/my_vehicles", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/ctrl/123/testDrive", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", "", strings.NewReader(`{"surplus_watts": 1000}`)))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/my_vehicles", "cb_invalid", nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/auth/status", "", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"setup_required":true`)
+	assert.Contains(t, res.Body.String(), `"authenticated":false`)
+}
+
+func TestAuth_SetupAndLogin(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+
+	res := executeTestRequest(newHTTPRequest("POST", "/api/1/auth/setup", "", strings.NewReader(`{"username": "admin", "password": "short"}`)))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/auth/setup", "", strings.NewReader(`{"username": "admin", "password": "secret123"}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.NotNil(t, getSessionCookie(res.Result()))
+	assert.NotContains(t, res.Body.String(), "secret123")
+
+	// setup is only possible once
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/auth/setup", "", strings.NewReader(`{"username": "evil", "password": "secret123"}`)))
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Nil(t, GetDB().GetUserByName("evil"))
+
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/auth/login", "", strings.NewReader(`{"username": "admin", "password": "wrong1234"}`)))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/auth/login", "", strings.NewReader(`{"username": "admin", "password": "secret123"}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	cookie := getSessionCookie(res.Result())
+	assert.NotNil(t, cookie)
+	assert.True(t, cookie.HttpOnly)
+
+	req := newHTTPRequest("GET", "/api/1/tesla/my_vehicles", "", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, executeTestRequest(req).Code)
+	req = newHTTPRequest("DELETE", "/api/1/auth/users/1", "", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusBadRequest, executeTestRequest(req).Code)
+
+	req = newHTTPRequest("POST", "/api/1/auth/logout", "", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, executeTestRequest(req).Code)
+	req = newHTTPRequest("GET", "/api/1/tesla/my_vehicles", "", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusUnauthorized, executeTestRequest(req).Code)
+}
+
+func TestAuth_SessionExpired(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	user, err := CreateUser("admin", "secret123")
+	assert.Nil(t, err)
+	token := CreateSession(user)
+
+	req := newHTTPRequest("GET", "/api/1/tesla/my_vehicles", "", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: token})
+	assert.Equal(t, http.StatusOK, executeTestRequest(req).Code)
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.AddDate(0, 0, GetConfig().AuthSessionDays+1)
+	assert.Equal(t, http.StatusUnauthorized, executeTestRequest(req).Code)
+	assert.Equal(t, int64(1), GetDB().DeleteExpiredSessions(GlobalMockTime.CurTime))
+}
+
+func TestAuth_ChangePassword(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	user, err := CreateUser("admin", "secret123")
+	assert.Nil(t, err)
+	token := CreateSession(user)
+
+	assert.Equal(t, ErrPasswordTooShort, ChangePassword(user, "short"))
+	assert.Nil(t, ChangePassword(user, "newsecret123"))
+	assert.Nil(t, GetDB().GetSessionUser(GetSHA256Hash(token)))
+	_, _, err = Login("admin", "secret123")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, _, err = Login("admin", "newsecret123")
+	assert.Nil(t, err)
+	_, _, err = Login("unknown", "newsecret123")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestAuth_APIKeyScopes(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, err := CreateAPIKey("dashboard", APIKeyScopeRead)
+	assert.Nil(t, err)
+	surplusKey, _, err := CreateAPIKey("inverter script", APIKeyScopeSurplus)
+	assert.Nil(t, err)
+	fullKey, _, err := CreateAPIKey("home automation", APIKeyScopeFull)
+	assert.Nil(t, err)
+	_, _, err = CreateAPIKey("invalid", "admin")
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(readKey, APIKeyPrefix))
+
+	surplus := func() *strings.Reader { return strings.NewReader(`{"surplus_watts": 1000}`) }
+
+	assert.Equal(t, http.StatusOK, executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/surplus", readKey, nil)).Code)
+	assert.Equal(t, http.StatusForbidden, executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", readKey, surplus())).Code)
+	assert.Equal(t, http.StatusForbidden, executeTestRequest(newHTTPRequest("POST", "/api/1/tesla/resolve_permanent_error", readKey, nil)).Code)
+
+	assert.Equal(t, http.StatusForbidden, executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/surplus", surplusKey, nil)).Code)
+	assert.Equal(t, http.StatusOK, executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", surplusKey, surplus())).Code)
+	assert.Equal(t, http.StatusForbidden, executeTestRequest(newHTTPRequest("POST", "/api/1/tesla/resolve_permanent_error", surplusKey, nil)).Code)
+
+	assert.Equal(t, http.StatusOK, executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/surplus", fullKey, nil)).Code)
+	assert.Equal(t, http.StatusOK, executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", fullKey, surplus())).Code)
+	assert.Equal(t, http.StatusOK, executeTestRequest(newHTTPRequest("POST", "/api/1/tesla/resolve_permanent_error", fullKey, nil)).Code)
+
+	// API keys can't manage users or API keys
+	assert.Equal(t, http.StatusForbidden, executeTestRequest(newHTTPRequest("GET", "/api/1/auth/api_keys", fullKey, nil)).Code)
+
+	// scripts which can only be configured with a URL
+	req := newHTTPRequest("POST", "/api/1/user/surplus?api_key="+surplusKey, "", surplus())
+	assert.Equal(t, http.StatusOK, executeTestRequest(req).Code)
+	req = newHTTPRequest("POST", "/api/1/user/surplus", "", surplus())
+	req.Header.Set("X-API-Key", surplusKey)
+	assert.Equal(t, http.StatusOK, executeTestRequest(req).Code)
+	assert.Len(t, GetDB().GetLatestSurplusRecords(10), 4)
+	assert.NotNil(t, GetDB().GetAPIKeys()[1].LastUsed)
+}
+
+func TestAuth_ReadKeyHidesTibberToken(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("dashboard", APIKeyScopeRead)
+	fullKey, _, _ := CreateAPIKey("home automation", APIKeyScopeFull)
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "123", DisplayName: "Model 3", TibberToken: "tibber-secret"})
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/my_vehicles", readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.NotContains(t, res.Body.String(), "tibber-secret")
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/my_vehicle/123", readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.NotContains(t, res.Body.String(), "tibber-secret")
+
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/my_vehicle/123", fullKey, nil))
+	assert.Contains(t, res.Body.String(), `"tibber_token":"tibber-secret"`)
+}
+
+func TestAuth_ManageAPIKeys(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	user, err := CreateUser("admin", "secret123")
+	assert.Nil(t, err)
+	cookie := &http.Cookie{Name: SessionCookieName, Value: CreateSession(user)}
+
+	req := newHTTPRequest("POST", "/api/1/auth/api_keys", "", strings.NewReader(`{"name": "inverter", "scope": "surplus"}`))
+	req.AddCookie(cookie)
+	res := executeTestRequest(req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"key":"cb_`)
+	assert.Len(t, GetDB().GetAPIKeys(), 1)
+
+	req = newHTTPRequest("DELETE", "/api/1/auth/api_keys/1", "", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, executeTestRequest(req).Code)
+	assert.Len(t, GetDB().GetAPIKeys(), 0)
+}
+
+func TestAuth_AnonymousSurplus(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	GetConfig().AuthAnonymousSurplus = AuthAnonymousSurplusAlways
+	CreateAPIKey("inverter script", APIKeyScopeSurplus)
+
+	res := executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", "", strings.NewReader(`{"surplus_watts": 1000}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/surplus", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestAuth_AnonymousSurplusAuto(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	GetConfig().AuthAnonymousSurplus = AuthAnonymousSurplusAuto
+	surplus := func() *strings.Reader { return strings.NewReader(`{"surplus_watts": 1000}`) }
+
+	// new node until the first user or API key is created
+	assert.Equal(t, http.StatusOK, executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", "", surplus())).Code)
+	CreateUser("admin", "secret123")
+	assert.Equal(t, http.StatusUnauthorized, executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", "", surplus())).Code)
+
+	// node upgraded from a version without authentication
+	GetDB().SetSetting(SettingAnonymousSurplus, "1")
+	assert.Equal(t, http.StatusOK, executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", "", surplus())).Code)
+	GetConfig().AuthAnonymousSurplus = AuthAnonymousSurplusNever
+	assert.Equal(t, http.StatusUnauthorized, executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", "", surplus())).Code)
+}
+
+func TestAuth_Disabled(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = false
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/my_vehicles", "", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/user/surplus", "", strings.NewReader(`{"surplus_watts": 1000}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+}
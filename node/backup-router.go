@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type BackupRouter struct {
+}
+
+type BackupExportRequest struct {
+	Passphrase string `json:"passphrase"`
+	History    bool   `json:"history"`
+}
+
+type BackupImportRequest struct {
+	Passphrase string         `json:"passphrase"`
+	Archive    *BackupArchive `json:"archive"`
+}
+
+type BackupErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (router *BackupRouter) SetupRoutes(s *mux.Router) {
+	s.HandleFunc("/export", router.export).Methods("POST")
+	s.HandleFunc("/import", router.restore).Methods("POST")
+}
+
+func (router *BackupRouter) export(w http.ResponseWriter, r *http.Request) {
+	var m BackupExportRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	archive, err := CreateBackupArchive(m.Passphrase, m.History)
+	if err != nil {
+		log.Println(err)
+		SendInternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+BackupArchiveFileName(archive)+"\"")
+	SendJSON(w, archive)
+}
+
+func (router *BackupRouter) restore(w http.ResponseWriter, r *http.Request) {
+	var m BackupImportRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	res, err := RestoreBackupArchive(m.Archive, m.Passphrase)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&BackupErrorResponse{Error: err.Error()})
+		return
+	}
+	SendJSON(w, res)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const BackupFormatVersion = 1
+
+// backupKeyCheck is encrypted with the passphrase, so a wrong passphrase is detected on import
+const backupKeyCheck = "chargebot.io"
+
+// settings which are only meaningful for the node that created them
+var backupExcludedSettings = []string{SettingsPermanentError, SettingLastVacuum, SettingCryptKeyCheck, SettingLastDigestDaily, SettingLastDigestWeekly}
+
+var backupDepartTimeRegexp = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+var backupDepartDaysRegexp = regexp.MustCompile(`^[1-7]*$`)
+
+// BackupArchive is the portable export of a node's configuration.
+// Secrets (Tesla refresh token, Tibber tokens, webhook secrets and headers) are not bound to CRYPT_KEY,
+// but encrypted with a key derived from a user-provided passphrase.
+type BackupArchive struct {
+	FormatVersion int               `json:"format_version"`
+	SchemaVersion int               `json:"schema_version"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Salt          string            `json:"salt,omitempty"`
+	KeyCheck      string            `json:"key_check,omitempty"`
+	Settings      map[string]string `json:"settings"`
+	Secrets       map[string]string `json:"secrets,omitempty"`
+	Vehicles      []*Vehicle        `json:"vehicles"`
+	Webhooks      []*Webhook        `json:"webhooks,omitempty"`
+	History       *BackupHistory    `json:"history,omitempty"`
+}
+
+type BackupHistory struct {
+	ChargingEvents    []*BackupChargingEvent    `json:"charging_events"`
+	Surpluses         []*SurplusRecord          `json:"surpluses"`
+	SurplusAggregates []*BackupSurplusAggregate `json:"surplus_aggregates"`
+}
+
+type BackupChargingEvent struct {
+	VIN string `json:"vin"`
+	ChargingEvent
+}
+
+type BackupSurplusAggregate struct {
+	Resolution string `json:"resolution"`
+	SurplusAggregate
+}
+
+type BackupImportResult struct {
+	Vehicles          int `json:"vehicles"`
+	Settings          int `json:"settings"`
+	Webhooks          int `json:"webhooks"`
+	ChargingEvents    int `json:"charging_events"`
+	Surpluses         int `json:"surpluses"`
+	SurplusAggregates int `json:"surplus_aggregates"`
+}
+
+func backupVehicleSecretKey(vin string) string {
+	return "vehicle:" + vin + ":tibber_token"
+}
+
+func backupSettingSecretKey(key string) string {
+	return "setting:" + key
+}
+
+func backupWebhookSecretKey(id int) string {
+	return "webhook:" + strconv.Itoa(id) + ":secret"
+}
+
+func backupWebhookHeadersKey(id int) string {
+	return "webhook:" + strconv.Itoa(id) + ":headers"
+}
+
+// CreateBackupArchive exports vehicles, webhooks and settings, and optionally the charging and surplus history.
+// Without a passphrase, secrets are left out.
+func CreateBackupArchive(passphrase string, history bool) (*BackupArchive, error) {
+	archive := &BackupArchive{
+		FormatVersion: BackupFormatVersion,
+		SchemaVersion: GetDB().GetSchemaVersion(),
+		CreatedAt:     time.Now().UTC(),
+		Settings:      make(map[string]string),
+		Secrets:       make(map[string]string),
+		Vehicles:      []*Vehicle{},
+		Webhooks:      []*Webhook{},
+	}
+
+	var key []byte
+	if passphrase != "" {
+		salt, err := NewSalt()
+		if err != nil {
+			return nil, err
+		}
+		key, err = DeriveKeyFromPassphrase(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		archive.Salt = base64.StdEncoding.EncodeToString(salt)
+		if archive.KeyCheck, err = EncryptAESGCM(key, backupKeyCheck); err != nil {
+			return nil, err
+		}
+	}
+	addSecret := func(name string, value string) error {
+		if key == nil || value == "" {
+			return nil
+		}
+		encrypted, err := EncryptAESGCM(key, value)
+		if err != nil {
+			return err
+		}
+		archive.Secrets[name] = encrypted
+		return nil
+	}
+
+	for _, name := range GetDB().GetSettingKeys() {
+		if slices.Contains(backupExcludedSettings, name) {
+			continue
+		}
+		value := GetDB().GetSetting(name)
+		if slices.Contains(secretSettings, name) {
+			if err := addSecret(backupSettingSecretKey(name), value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		archive.Settings[name] = value
+	}
+
+	for _, vehicle := range GetDB().GetVehicles() {
+		if err := addSecret(backupVehicleSecretKey(vehicle.VIN), vehicle.TibberToken); err != nil {
+			return nil, err
+		}
+		vehicle.TibberToken = ""
+		archive.Vehicles = append(archive.Vehicles, vehicle)
+	}
+
+	// custom headers might contain credentials, so they are treated like the secret
+	for _, webhook := range GetDB().GetWebhooks() {
+		if err := addSecret(backupWebhookSecretKey(webhook.ID), webhook.Secret); err != nil {
+			return nil, err
+		}
+		if err := addSecret(backupWebhookHeadersKey(webhook.ID), GetDB().marshalWebhookHeaders(webhook.Headers)); err != nil {
+			return nil, err
+		}
+		webhook.Secret = ""
+		webhook.HasSecret = false
+		webhook.Headers = map[string]string{}
+		archive.Webhooks = append(archive.Webhooks, webhook)
+	}
+
+	if history {
+		archive.History = createBackupHistory(archive.Vehicles)
+	}
+	return archive, nil
+}
+
+func createBackupHistory(vehicles []*Vehicle) *BackupHistory {
+	res := &BackupHistory{
+		ChargingEvents:    []*BackupChargingEvent{},
+		Surpluses:         GetDB().GetAllSurplusRecords(),
+		SurplusAggregates: []*BackupSurplusAggregate{},
+	}
+	for _, vehicle := range vehicles {
+		for _, e := range GetDB().GetAllChargingEvents(vehicle.VIN) {
+			res.ChargingEvents = append(res.ChargingEvents, &BackupChargingEvent{VIN: vehicle.VIN, ChargingEvent: *e})
+		}
+	}
+	for _, resolution := range []string{SurplusResolutionMinute, SurplusResolutionHour} {
+		for _, e := range GetDB().GetSurplusAggregates(resolution, time.Time{}, time.Now().UTC().AddDate(1, 0, 0)) {
+			res.SurplusAggregates = append(res.SurplusAggregates, &BackupSurplusAggregate{Resolution: resolution, SurplusAggregate: *e})
+		}
+	}
+	return res
+}
+
+// ValidateBackupArchive checks an archive before anything is imported and returns its decrypted secrets
+func ValidateBackupArchive(archive *BackupArchive, passphrase string) (map[string]string, error) {
+	if archive == nil {
+		return nil, errors.New("archive is empty")
+	}
+	if archive.FormatVersion < 1 || archive.FormatVersion > BackupFormatVersion {
+		return nil, fmt.Errorf("unsupported archive format version %d", archive.FormatVersion)
+	}
+	if archive.SchemaVersion > GetLatestSchemaVersion() {
+		return nil, fmt.Errorf("archive was created by a newer release with schema version %d", archive.SchemaVersion)
+	}
+	vins := []string{}
+	for _, vehicle := range archive.Vehicles {
+		if vehicle == nil || vehicle.VIN == "" {
+			return nil, errors.New("vehicle without VIN")
+		}
+		if slices.Contains(vins, vehicle.VIN) {
+			return nil, fmt.Errorf("duplicate vehicle %s", vehicle.VIN)
+		}
+		vins = append(vins, vehicle.VIN)
+		if !backupDepartTimeRegexp.MatchString(vehicle.DepartTime) || !backupDepartDaysRegexp.MatchString(vehicle.DepartDays) {
+			return nil, fmt.Errorf("invalid departure schedule for vehicle %s", vehicle.VIN)
+		}
+	}
+	webhookIDs := []int{}
+	for _, webhook := range archive.Webhooks {
+		if webhook == nil {
+			return nil, errors.New("empty webhook")
+		}
+		if slices.Contains(webhookIDs, webhook.ID) {
+			return nil, fmt.Errorf("duplicate webhook %d", webhook.ID)
+		}
+		webhookIDs = append(webhookIDs, webhook.ID)
+		if err := ValidateWebhook(&Webhook{Name: webhook.Name, URL: webhook.URL, Events: webhook.Events}); err != nil {
+			return nil, fmt.Errorf("invalid webhook %d: %s", webhook.ID, err.Error())
+		}
+	}
+	if archive.History != nil {
+		for _, e := range archive.History.SurplusAggregates {
+			if e.Resolution != SurplusResolutionMinute && e.Resolution != SurplusResolutionHour {
+				return nil, fmt.Errorf("invalid surplus aggregate resolution '%s'", e.Resolution)
+			}
+		}
+	}
+
+	secrets := make(map[string]string)
+	if archive.KeyCheck == "" {
+		if len(archive.Secrets) > 0 {
+			return nil, errors.New("archive contains secrets without key check")
+		}
+		return secrets, nil
+	}
+	if passphrase == "" {
+		return nil, errors.New("archive contains secrets, passphrase required")
+	}
+	salt, err := base64.StdEncoding.DecodeString(archive.Salt)
+	if err != nil {
+		return nil, errors.New("invalid salt")
+	}
+	key, err := DeriveKeyFromPassphrase(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if check, err := DecryptAESGCM(key, archive.KeyCheck); err != nil || check != backupKeyCheck {
+		return nil, errors.New("invalid passphrase")
+	}
+	for name, value := range archive.Secrets {
+		decrypted, err := DecryptAESGCM(key, value)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt secret %s", name)
+		}
+		secrets[name] = decrypted
+	}
+	for _, webhook := range archive.Webhooks {
+		if _, err := getBackupWebhookHeaders(secrets, webhook.ID); err != nil {
+			return nil, fmt.Errorf("invalid headers of webhook %d", webhook.ID)
+		}
+	}
+	return secrets, nil
+}
+
+// getBackupWebhookHeaders returns the webhook's decrypted headers, or nil if the archive doesn't contain them
+func getBackupWebhookHeaders(secrets map[string]string, id int) (map[string]string, error) {
+	value, ok := secrets[backupWebhookHeadersKey(id)]
+	if !ok {
+		return nil, nil
+	}
+	headers := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &headers); err != nil {
+		return nil, err
+	}
+	if err := ValidateWebhook(&Webhook{URL: "https://localhost", Headers: headers}); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// RestoreBackupArchive validates an archive and merges it into the database.
+// Existing vehicles, settings and webhooks with the same URL are overwritten, history is added unless already present.
+func RestoreBackupArchive(archive *BackupArchive, passphrase string) (*BackupImportResult, error) {
+	secrets, err := ValidateBackupArchive(archive, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	res := &BackupImportResult{}
+
+	for name, value := range archive.Settings {
+		if slices.Contains(backupExcludedSettings, name) || slices.Contains(secretSettings, name) {
+			continue
+		}
+		GetDB().SetSetting(name, value)
+		res.Settings++
+	}
+	for _, name := range secretSettings {
+		if value, ok := secrets[backupSettingSecretKey(name)]; ok {
+			GetDB().SetSetting(name, value)
+			res.Settings++
+		}
+	}
+
+	for _, vehicle := range archive.Vehicles {
+		if token, ok := secrets[backupVehicleSecretKey(vehicle.VIN)]; ok {
+			vehicle.TibberToken = token
+		} else if existing := GetDB().GetVehicleByVIN(vehicle.VIN); existing != nil {
+			// keep the token if the archive doesn't contain secrets
+			vehicle.TibberToken = existing.TibberToken
+		}
+		GetDB().CreateUpdateVehicle(vehicle)
+		GetMqttPublisher().PublishDiscovery(vehicle)
+		GetMqttPublisher().PublishVehicle(vehicle.VIN)
+		res.Vehicles++
+	}
+
+	existingWebhooks := GetDB().GetWebhooks()
+	for _, e := range archive.Webhooks {
+		webhook := &Webhook{Headers: map[string]string{}}
+		if i := slices.IndexFunc(existingWebhooks, func(existing *Webhook) bool { return existing.URL == e.URL }); i >= 0 {
+			// keep secret and headers if the archive doesn't contain secrets
+			webhook = existingWebhooks[i]
+		}
+		webhook.Name, webhook.URL, webhook.Events, webhook.Enabled = e.Name, e.URL, e.Events, e.Enabled
+		if secret, ok := secrets[backupWebhookSecretKey(e.ID)]; ok {
+			webhook.Secret = secret
+		}
+		if headers, _ := getBackupWebhookHeaders(secrets, e.ID); headers != nil {
+			webhook.Headers = headers
+		}
+		if webhook.ID == 0 {
+			GetDB().CreateWebhook(webhook)
+		} else {
+			GetDB().UpdateWebhook(webhook)
+		}
+		res.Webhooks++
+	}
+
+	if archive.History != nil {
+		for _, e := range archive.History.ChargingEvents {
+			if GetDB().InsertChargingEvent(e.VIN, &e.ChargingEvent) {
+				res.ChargingEvents++
+			}
+		}
+		for _, e := range archive.History.Surpluses {
+			if GetDB().InsertSurplusRecord(e) {
+				res.Surpluses++
+			}
+		}
+		for _, e := range archive.History.SurplusAggregates {
+			if GetDB().InsertSurplusAggregate(e.Resolution, &e.SurplusAggregate) {
+				res.SurplusAggregates++
+			}
+		}
+	}
+	return res, nil
+}
+
+var TickerBackup *time.Ticker = nil
+
+func InitPeriodicBackup() {
+	if GetConfig().BackupDir == "" || GetConfig().BackupInterval <= 0 {
+		return
+	}
+	TickerBackup = time.NewTicker(time.Hour * time.Duration(GetConfig().BackupInterval))
+	go func() {
+		for {
+			<-TickerBackup.C
+			if _, err := CreateLocalBackup(GetConfig().BackupDir, GetConfig().BackupKeep); err != nil {
+				log.Println("Could not create database backup:", err)
+			}
+		}
+	}()
+}
+
+// CreateLocalBackup writes a copy of the database to dir and removes the oldest copies exceeding keep
+func CreateLocalBackup(dir string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, "chargebot-"+time.Now().UTC().Format("20060102-150405")+".db")
+	if err := GetDB().Backup(target); err != nil {
+		return "", err
+	}
+	log.Printf("Database backed up to %s\n", target)
+	if keep > 0 {
+		files, err := filepath.Glob(filepath.Join(dir, "chargebot-*.db"))
+		if err != nil {
+			return target, err
+		}
+		// file names contain the timestamp, so the oldest come first
+		sort.Strings(files)
+		for len(files) > keep {
+			if err := os.Remove(files[0]); err != nil {
+				return target, err
+			}
+			files = files[1:]
+		}
+	}
+	return target, nil
+}
+
+func BackupArchiveFileName(archive *BackupArchive) string {
+	return "chargebot-backup-" + archive.CreatedAt.Format("20060102-150405") + ".json"
+}
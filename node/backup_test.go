@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createBackupTestData() *Vehicle {
+	v := &Vehicle{
+		VIN:         "123",
+		DisplayName: "Car",
+		Enabled:     true,
+		TargetSoC:   80,
+		MaxAmps:     16,
+		NumPhases:   3,
+		DepartDays:  "135",
+		DepartTime:  "06:30",
+		TibberToken: "tibber-secret",
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetSetting(SettingRefreshToken, "refresh-secret")
+	GetDB().SetSetting(SettingsPermanentError, "1")
+	GetDB().LogChargingEvent(v.VIN, LogEventChargeStart, "")
+	GetDB().RecordSurplus(1500)
+	GetDB().CreateWebhook(&Webhook{
+		Name:    "Home Assistant",
+		URL:     "https://ha.local/api/webhook/chargebot",
+		Secret:  "webhook-secret",
+		Events:  []WebhookEvent{WebhookEventChargeStarted},
+		Headers: map[string]string{"X-Token": "header-secret"},
+		Enabled: true,
+	})
+	return v
+}
+
+// roundtrip simulates writing the archive to a file and reading it on another node
+func roundtripBackupArchive(t *testing.T, archive *BackupArchive) *BackupArchive {
+	data, err := json.Marshal(archive)
+	assert.Nil(t, err)
+	var res *BackupArchive
+	assert.Nil(t, json.Unmarshal(data, &res))
+	return res
+}
+
+func TestBackup_ExportImport(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := createBackupTestData()
+
+	archive, err := CreateBackupArchive("secret passphrase", true)
+	assert.Nil(t, err)
+	assert.Equal(t, BackupFormatVersion, archive.FormatVersion)
+	assert.Equal(t, GetLatestSchemaVersion(), archive.SchemaVersion)
+	assert.Len(t, archive.Vehicles, 1)
+	// secrets are not contained in plain text
+	assert.Equal(t, "", archive.Vehicles[0].TibberToken)
+	data, _ := json.Marshal(archive)
+	assert.NotContains(t, string(data), "tibber-secret")
+	assert.NotContains(t, string(data), "refresh-secret")
+	assert.NotContains(t, string(data), "webhook-secret")
+	assert.NotContains(t, string(data), "header-secret")
+	assert.Len(t, archive.Webhooks, 1)
+	_, ok := archive.Settings[SettingsPermanentError]
+	assert.False(t, ok)
+
+	// restore on an empty node
+	archive = roundtripBackupArchive(t, archive)
+	ResetTestDB()
+	res, err := RestoreBackupArchive(archive, "secret passphrase")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, res.Vehicles)
+	assert.Equal(t, 1, res.Settings)
+	assert.Equal(t, 1, res.ChargingEvents)
+	assert.Equal(t, 1, res.Surpluses)
+	assert.Equal(t, 1, res.Webhooks)
+
+	webhooks := GetDB().GetWebhooks()
+	assert.Len(t, webhooks, 1)
+	assert.Equal(t, "Home Assistant", webhooks[0].Name)
+	assert.Equal(t, "https://ha.local/api/webhook/chargebot", webhooks[0].URL)
+	assert.Equal(t, "webhook-secret", webhooks[0].Secret)
+	assert.Equal(t, map[string]string{"X-Token": "header-secret"}, webhooks[0].Headers)
+	assert.Equal(t, []WebhookEvent{WebhookEventChargeStarted}, webhooks[0].Events)
+	assert.True(t, webhooks[0].Enabled)
+
+	v2 := GetDB().GetVehicleByVIN(v.VIN)
+	assert.NotNil(t, v2)
+	assert.Equal(t, "tibber-secret", v2.TibberToken)
+	assert.Equal(t, "135", v2.DepartDays)
+	assert.Equal(t, "06:30", v2.DepartTime)
+	assert.Equal(t, 80, v2.TargetSoC)
+	assert.Equal(t, "refresh-secret", GetDB().GetSetting(SettingRefreshToken))
+	assert.Equal(t, "", GetDB().GetSetting(SettingsPermanentError))
+	assert.Len(t, GetDB().GetLatestChargingEvents(v.VIN, 10), 1)
+	assert.Len(t, GetDB().GetLatestSurplusRecords(10), 1)
+
+	// importing again merges without duplicating history
+	res, err = RestoreBackupArchive(archive, "secret passphrase")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.ChargingEvents)
+	assert.Equal(t, 0, res.Surpluses)
+	assert.Len(t, GetDB().GetLatestChargingEvents(v.VIN, 10), 1)
+	assert.Len(t, GetDB().GetWebhooks(), 1)
+}
+
+func TestBackup_WrongPassphrase(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	createBackupTestData()
+
+	archive, err := CreateBackupArchive("secret passphrase", false)
+	assert.Nil(t, err)
+	assert.Nil(t, archive.History)
+
+	_, err = RestoreBackupArchive(archive, "wrong passphrase")
+	assert.EqualError(t, err, "invalid passphrase")
+	_, err = RestoreBackupArchive(archive, "")
+	assert.NotNil(t, err)
+}
+
+func TestBackup_WithoutSecrets(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := createBackupTestData()
+
+	archive, err := CreateBackupArchive("", false)
+	assert.Nil(t, err)
+	assert.Len(t, archive.Secrets, 0)
+	archive = roundtripBackupArchive(t, archive)
+
+	// existing secrets are kept when merging an archive without secrets
+	archive.Vehicles[0].TargetSoC = 90
+	archive.Webhooks[0].Enabled = false
+	_, err = RestoreBackupArchive(archive, "")
+	assert.Nil(t, err)
+	webhook := GetDB().GetWebhooks()[0]
+	assert.False(t, webhook.Enabled)
+	assert.Equal(t, "webhook-secret", webhook.Secret)
+	assert.Equal(t, "header-secret", webhook.Headers["X-Token"])
+	v2 := GetDB().GetVehicleByVIN(v.VIN)
+	assert.Equal(t, 90, v2.TargetSoC)
+	assert.Equal(t, "tibber-secret", v2.TibberToken)
+	assert.Equal(t, "refresh-secret", GetDB().GetSetting(SettingRefreshToken))
+}
+
+func TestBackup_Validate(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	createBackupTestData()
+
+	archive, _ := CreateBackupArchive("", false)
+	archive.FormatVersion = BackupFormatVersion + 1
+	_, err := ValidateBackupArchive(archive, "")
+	assert.NotNil(t, err)
+
+	archive, _ = CreateBackupArchive("", false)
+	archive.SchemaVersion = GetLatestSchemaVersion() + 1
+	_, err = ValidateBackupArchive(archive, "")
+	assert.NotNil(t, err)
+
+	archive, _ = CreateBackupArchive("", false)
+	archive.Vehicles[0].DepartTime = "25:00"
+	_, err = RestoreBackupArchive(archive, "")
+	assert.NotNil(t, err)
+	// nothing is imported from an invalid archive
+	assert.Equal(t, "06:30", GetDB().GetVehicleByVIN("123").DepartTime)
+}
+
+func TestBackup_LocalBackup(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	createBackupTestData()
+	dir := t.TempDir()
+
+	// older backups exceeding the limit are removed
+	for _, name := range []string{"chargebot-20240101-000000.db", "chargebot-20240102-000000.db"} {
+		os.WriteFile(filepath.Join(dir, name), []byte{}, 0600)
+	}
+	target, err := CreateLocalBackup(dir, 2)
+	assert.Nil(t, err)
+	files, _ := filepath.Glob(filepath.Join(dir, "chargebot-*.db"))
+	assert.Equal(t, []string{filepath.Join(dir, "chargebot-20240102-000000.db"), target}, files)
+
+	// the backup is a complete database
+	db := &DB{Time: GlobalMockTime}
+	dbFile := GetConfig().DBFile
+	GetConfig().DBFile = target
+	db.Connect()
+	GetConfig().DBFile = dbFile
+	defer db.GetConnection().Close()
+	assert.Equal(t, GetLatestSchemaVersion(), db.GetSchemaVersion())
+	assert.NotNil(t, db.GetVehicleByVIN("123"))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const CarbonIntensityUpdateInterval time.Duration = time.Hour * 1
+
+type CarbonIntensity struct {
+	Intensity float32   `json:"carbonIntensity"`
+	StartsAt  time.Time `json:"datetime"`
+}
+
+type CarbonIntensityProvider interface {
+	GetForecast(zone string) ([]*CarbonIntensity, error)
+}
+
+type ElectricityMapsForecastResponse struct {
+	Zone     string             `json:"zone"`
+	Forecast []*CarbonIntensity `json:"forecast"`
+}
+
+type ElectricityMapsProvider struct {
+	Endpoint string
+	Token    string
+}
+
+var CarbonIntensityProviderInstance CarbonIntensityProvider
+var carbonIntensityLastUpdate time.Time
+
+func GetCarbonIntensityProvider() CarbonIntensityProvider {
+	return CarbonIntensityProviderInstance
+}
+
+func InitCarbonIntensityProvider() {
+	switch GetConfig().CarbonProvider {
+	case "":
+		return
+	case "electricitymaps":
+		CarbonIntensityProviderInstance = &ElectricityMapsProvider{
+			Endpoint: GetConfig().CarbonEndpoint,
+			Token:    GetConfig().CarbonToken,
+		}
+	default:
+		log.Panicf("Unknown CARBON_PROVIDER: %s\n", GetConfig().CarbonProvider)
+	}
+}
+
+func (p *ElectricityMapsProvider) GetForecast(zone string) ([]*CarbonIntensity, error) {
+	target := p.Endpoint + "/carbon-intensity/forecast?zone=" + zone
+	r, _ := http.NewRequest("GET", target, nil)
+	r.Header.Add("auth-token", p.Token)
+
+	resp, err := RetryHTTPRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+
+	var m ElectricityMapsForecastResponse
+	if err := UnmarshalBody(resp.Body, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Forecast) == 0 {
+		return nil, errors.New("no carbon intensity forecast found")
+	}
+	return m.Forecast, nil
+}
+
+func PeriodicCarbonIntensityUpdateControl() {
+	if GetCarbonIntensityProvider() == nil {
+		return
+	}
+	now := GetDB().Time.UTCNow()
+	if now.Sub(carbonIntensityLastUpdate) < CarbonIntensityUpdateInterval {
+		return
+	}
+	log.Printf("Updating carbon intensity forecast for zone %s ...\n", GetConfig().CarbonZone)
+	forecast, err := GetCarbonIntensityProvider().GetForecast(GetConfig().CarbonZone)
+	if err != nil {
+		log.Printf("Could not update carbon intensity forecast: %s\n", err.Error())
+		return
+	}
+	for _, e := range forecast {
+		ts := e.StartsAt.UTC()
+		GetDB().SetCarbonIntensity(GetConfig().CarbonZone, ts.Year(), int(ts.Month()), ts.Day(), ts.Hour(), e.Intensity)
+	}
+	carbonIntensityLastUpdate = now
+}
+
+// EstimateEmissionsGrams returns the estimated emissions for charging with the given amps
+// between start and end, based on the stored hourly carbon intensity.
+func EstimateEmissionsGrams(vehicle *Vehicle, amps int, start time.Time, end time.Time) (float64, bool) {
+	watts := float64(amps * 230 * vehicle.NumPhases)
+	res := 0.0
+	found := false
+	for ts := start; ts.Before(end); {
+		next := time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), 0, 0, 0, ts.Location()).Add(time.Hour)
+		if next.After(end) {
+			next = end
+		}
+		intensity, ok := GetDB().GetCarbonIntensity(GetConfig().CarbonZone, ts.Year(), int(ts.Month()), ts.Day(), ts.Hour())
+		if ok {
+			kWh := watts / 1000 * next.Sub(ts).Hours()
+			res += kWh * float64(intensity)
+			found = true
+		}
+		ts = next
+	}
+	return res, found
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type CarbonIntensityProviderMock struct {
+	mock.Mock
+}
+
+func (p *CarbonIntensityProviderMock) GetForecast(zone string) ([]*CarbonIntensity, error) {
+	args := p.Called(zone)
+	if resp, ok := args.Get(0).([]*CarbonIntensity); !ok {
+		panic("assert: arguments wasn't correct type")
+	} else {
+		return resp, args.Error(1)
+	}
+}
+
+func TestCarbonIntensity_PeriodicUpdateControl(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	now := GlobalMockTime.CurTime
+	hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.UTC)
+
+	provider := new(CarbonIntensityProviderMock)
+	provider.On("GetForecast", GetConfig().CarbonZone).Return([]*CarbonIntensity{
+		{Intensity: 310, StartsAt: hour},
+		{Intensity: 120, StartsAt: hour.Add(time.Hour)},
+	}, nil)
+	CarbonIntensityProviderInstance = provider
+	carbonIntensityLastUpdate = time.Time{}
+	defer func() { CarbonIntensityProviderInstance = nil }()
+
+	PeriodicCarbonIntensityUpdateControl()
+	provider.AssertNumberOfCalls(t, "GetForecast", 1)
+
+	l := GetDB().GetUpcomingCarbonIntensities(GetConfig().CarbonZone)
+	assert.Len(t, l, 2)
+	assert.Equal(t, float32(310), l[0].Intensity)
+	assert.Equal(t, float32(120), l[1].Intensity)
+
+	// no further update within the update interval
+	PeriodicCarbonIntensityUpdateControl()
+	provider.AssertNumberOfCalls(t, "GetForecast", 1)
+}
+
+func TestCarbonIntensity_applyGridOptimizationTarget(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	now := GlobalMockTime.CurTime
+	hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.UTC)
+	v := &Vehicle{
+		VIN:              "123",
+		GridProvider:     GridProviderTibber,
+		GridOptimization: GridOptimizationCost,
+	}
+	SetTibberTestPrice(v.VIN, hour, 0.20)
+	SetTibberTestPrice(v.VIN, hour.Add(time.Hour), 0.30)
+	SetTibberTestPrice(v.VIN, hour.Add(2*time.Hour), 0.25)
+	zone := GetConfig().CarbonZone
+	GetDB().SetCarbonIntensity(zone, hour.Year(), int(hour.Month()), hour.Day(), hour.Hour(), 400)
+	next := hour.Add(time.Hour)
+	GetDB().SetCarbonIntensity(zone, next.Year(), int(next.Month()), next.Day(), next.Hour(), 100)
+	next = hour.Add(2 * time.Hour)
+	GetDB().SetCarbonIntensity(zone, next.Year(), int(next.Month()), next.Day(), next.Hour(), 200)
+
+	cc := NewTestChargeController()
+
+	prices := cc.getUpcomingGridPrices(v)
+	assert.Len(t, prices, 3)
+	assert.Equal(t, hour, prices[0].StartsAt)
+
+	v.GridOptimization = GridOptimizationCarbon
+	prices = cc.getUpcomingGridPrices(v)
+	assert.Equal(t, hour.Add(time.Hour), prices[0].StartsAt)
+	assert.Equal(t, float32(100), *prices[0].CarbonIntensity)
+	assert.Equal(t, float32(0.20), cc.getLowestGridPrice(prices).Total)
+
+	v.GridOptimization = GridOptimizationMixed
+	v.CarbonWeight = 50
+	prices = cc.getUpcomingGridPrices(v)
+	assert.Equal(t, hour.Add(2*time.Hour), prices[0].StartsAt)
+}
+
+func TestCarbonIntensity_EstimateEmissionsGrams(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := &Vehicle{
+		VIN:       "123",
+		NumPhases: 3,
+	}
+	start := time.Date(2024, 6, 1, 10, 30, 0, 0, time.UTC)
+	zone := GetConfig().CarbonZone
+	GetDB().SetCarbonIntensity(zone, 2024, 6, 1, 10, 200)
+	GetDB().SetCarbonIntensity(zone, 2024, 6, 1, 11, 100)
+
+	// 16 A on 3 phases = 11.04 kW, 0.5 h at 200 g/kWh plus 1 h at 100 g/kWh
+	res, ok := EstimateEmissionsGrams(v, 16, start, start.Add(90*time.Minute))
+	assert.True(t, ok)
+	assert.InDelta(t, 11.04*0.5*200+11.04*100, res, 0.001)
+
+	_, ok = EstimateEmissionsGrams(v, 16, start.AddDate(0, 0, 1), start.AddDate(0, 0, 1).Add(time.Hour))
+	assert.False(t, ok)
+}
@@ -13,6 +13,7 @@ import (
 
 const MaxVehicleDataUpdateIntervalMinutes int = 5
 const MaxChargeStartFailCounts int = 10
+const MaxSurplusSampleAgeMinutes int = 5
 
 var DelayBetweenAPICommands time.Duration = time.Second * 2
 
@@ -49,6 +50,7 @@ func (c *ChargeController) Init() {
 
 func (c *ChargeController) OnTick() {
 	permanentError := (GetDB().GetSetting(SettingsPermanentError) == "1")
+	GetMqttPublisher().PublishPermanentError(permanentError)
 	if permanentError {
 		log.Println("ACTION REQUIRED: Permanent error after recurring charge failures. Check Web UI to resolve.")
 		return
@@ -85,16 +87,25 @@ func (c *ChargeController) isInTick(vin string) bool {
 }
 
 func (c *ChargeController) processVehicle(vehicle *Vehicle) {
+	defer GetMqttPublisher().PublishVehicle(vehicle.VIN)
+
 	state := GetDB().GetVehicleState(vehicle.VIN)
 	if state == nil {
 		// no state yet, so nothing to do
 		return
 	}
 
+	if state.ChargeNow && state.ChargeNowSoC > 0 {
+		// one-shot target SoC requested together with charge now
+		vehicle.TargetSoC = state.ChargeNowSoC
+	}
+
 	if !state.PluggedIn {
 		// nothing to do for an unplugged vehicle
 		return
 	}
+	// the open session includes the current charging
+	defer RefreshChargingSession(vehicle)
 
 	if !vehicle.Enabled && state.Charging == ChargeStateNotCharging {
 		// nothing to do for a disabled vehicle which is not charging
@@ -103,21 +114,36 @@ func (c *ChargeController) processVehicle(vehicle *Vehicle) {
 
 	if c.isInTick(vehicle.VIN) {
 		// skip this round if vehicle is still processing
+		MetricsSkippedTick(vehicle.VIN)
 		return
 	}
 
 	c.setInTick(vehicle.VIN)
 	defer c.unsetInTick(vehicle.VIN)
+	defer MetricsTick(time.Now())
 
-	if !vehicle.Enabled && state.Charging != ChargeStateNotCharging {
+	surplusOutdated := c.isSurplusOutdated()
+	if state.SurplusStale && !surplusOutdated {
+		c.onSurplusRecovered(vehicle, state)
+	}
+
+	if c.isPaused(state) {
+		// Charging has been paused by the user, so stop if still charging and don't start
+		if state.Charging != ChargeStateNotCharging {
+			c.stopCharging(vehicle, state)
+		}
+	} else if !vehicle.Enabled && state.Charging != ChargeStateNotCharging {
 		// Stop charging if vehicle is still charging but not enabled anymore
 		c.stopCharging(vehicle, state)
 	} else if !vehicle.SurplusCharging && state.Charging == ChargeStateChargingOnSolar {
 		// Stop charging if vehicle is still charging on solar but surplus charging is not enabled anymore
 		c.stopCharging(vehicle, state)
-	} else if !vehicle.LowcostCharging && state.Charging == ChargeStateChargingOnGrid {
+	} else if !vehicle.LowcostCharging && !state.ChargeNow && state.Charging == ChargeStateChargingOnGrid {
 		// Stop charging if vehicle is still charging on grid but grid charging is not enabled anymore
 		c.stopCharging(vehicle, state)
+	} else if vehicle.Enabled && state.Charging == ChargeStateChargingOnSolar && surplusOutdated && GetConfig().SurplusStaleMinutes > 0 {
+		// No recent surplus data, so let the watchdog hold the charging process or put it into its safe state
+		c.checkStaleSurplus(vehicle, state)
 	} else if vehicle.Enabled && state.Charging == ChargeStateNotCharging {
 		// Check if we need to start charging
 		c.checkStartCharging(vehicle, state)
@@ -127,11 +153,16 @@ func (c *ChargeController) processVehicle(vehicle *Vehicle) {
 	}
 }
 
-func (c *ChargeController) stopCharging(vehicle *Vehicle, state *VehicleState) {
+// isPaused checks whether charging has been paused, charge now takes precedence over a pause
+func (c *ChargeController) isPaused(state *VehicleState) bool {
+	return state.PausedUntil != nil && c.Time.UTCNow().Before(*state.PausedUntil) && !state.ChargeNow
+}
+
+func (c *ChargeController) stopCharging(vehicle *Vehicle, state *VehicleState) bool {
 	/*
 		err := GetTeslaAPI().Wakeup(vehicle.VIN)
 		if err != nil {
-			GetDB().LogChargingEvent(vehicle.VIN, LogEventChargeStop, fmt.Sprintf("could not init session with car: %s", err.Error()))
+			LogChargingEvent(vehicle.VIN, LogEventChargeStop, fmt.Sprintf("could not init session with car: %s", err.Error()))
 			return
 		}
 
@@ -141,18 +172,50 @@ func (c *ChargeController) stopCharging(vehicle *Vehicle, state *VehicleState) {
 	if err := GetTeslaAPI().ChargeStop(vehicle.VIN); err != nil {
 		// Doesn't matter if vehicle is asleep, can't be charging then
 		if !strings.Contains(err.Error(), "asleep") {
-			GetDB().LogChargingEvent(vehicle.VIN, LogEventChargeStop, fmt.Sprintf("could not stop charging: %s", err.Error()))
-			return
+			LogChargingEvent(vehicle.VIN, LogEventChargeStop, fmt.Sprintf("could not stop charging: %s", err.Error()))
+			return false
 		}
 	}
 
 	GetDB().SetVehicleStateCharging(vehicle.VIN, ChargeStateNotCharging)
-	GetDB().LogChargingEvent(vehicle.VIN, LogEventChargeStop, "charging stopped")
+	EndChargingInterval(vehicle)
+	if state.ChargeNow {
+		// charge now is a one-shot request
+		GetDB().SetVehicleStateChargeNow(vehicle.VIN, false)
+	}
+
+	// the session's emissions include all grid intervals charged since plugging in
+	session := RefreshChargingSession(vehicle)
+	emissionsText := ""
+	data := map[string]any{"soc": state.SoC}
+	if session != nil && session.Emissions != nil {
+		emissionsText = fmt.Sprintf("%.2f kg CO2", *session.Emissions/1000)
+		data["emissions_grams"] = *session.Emissions
+	}
+	msg := fmt.Sprintf("%s stopped charging at %d %% SoC.", vehicle.DisplayName, state.SoC)
+	if emissionsText == "" {
+		LogChargingEvent(vehicle.VIN, LogEventChargeStop, "charging stopped")
+	} else {
+		LogChargingEvent(vehicle.VIN, LogEventChargeStop, "charging stopped, estimated session emissions "+emissionsText)
+		msg += fmt.Sprintf(" Estimated session emissions: %s.", emissionsText)
+	}
+	SendPushNotification(NotificationCategoryCharging, msg)
+	SendWebhookEvent(WebhookEventChargeStopped, vehicle, msg, data)
+	return true
+}
 
-	SendPushNotification(fmt.Sprintf("%s stopped charging at %d %% SoC.", vehicle.DisplayName, state.SoC))
+func (c *ChargeController) stopChargingTargetReached(vehicle *Vehicle, state *VehicleState) {
+	if c.stopCharging(vehicle, state) {
+		SendWebhookEvent(WebhookEventTargetReached, vehicle, fmt.Sprintf("%s reached its target SoC of %d %%.", vehicle.DisplayName, vehicle.TargetSoC),
+			map[string]any{"soc": state.SoC, "target_soc": vehicle.TargetSoC})
+	}
 }
 
 func (c *ChargeController) checkTargetState(vehicle *Vehicle, state *VehicleState) (ChargeState, int) {
+	if state.ChargeNow {
+		// charge immediately with max amps, regardless of surplus and prices
+		return ChargeStateChargingOnGrid, vehicle.MaxAmps
+	}
 	targetState := ChargeStateNotCharging
 	startCharging, amps := c.checkStartOnSolar(vehicle, state)
 	if startCharging {
@@ -173,6 +236,11 @@ func (c *ChargeController) isChargingRequired(currentSoC int, targetSoC int) boo
 func (c *ChargeController) checkStartCharging(vehicle *Vehicle, state *VehicleState) {
 	if !c.isChargingRequired(state.SoC, vehicle.TargetSoC) {
 		// nothing to do if target SoC is already reached
+		if state.ChargeNow {
+			// charge now is a one-shot request, so it's fulfilled already
+			log.Printf("Target SoC %d %% of vehicle %s already reached, clearing charge now\n", vehicle.TargetSoC, vehicle.VIN)
+			GetDB().SetVehicleStateChargeNow(vehicle.VIN, false)
+		}
 		return
 	}
 
@@ -187,8 +255,11 @@ func (c *ChargeController) activateCharging(vehicle *Vehicle, state *VehicleStat
 	if c.ChargeStartFailCount > 0 {
 		if c.ChargeStartFailCount >= MaxChargeStartFailCounts {
 			log.Printf("Activate charging failed for %d times, giving up and setting permanent error\n", c.ChargeStartFailCount)
-			SendPushNotification(fmt.Sprintf("ACTION REQUIRED: Activate charging failed for %d times, giving up and setting permanent error. Resolve issue and release permanent error in Web UI.", c.ChargeStartFailCount))
+			msg := fmt.Sprintf("ACTION REQUIRED: Activate charging failed for %d times, giving up and setting permanent error. Resolve issue and release permanent error in Web UI.", c.ChargeStartFailCount)
+			SendPushNotification(NotificationCategoryError, msg)
+			SendWebhookEvent(WebhookEventPermanentError, vehicle, msg, map[string]any{"failed_attempts": c.ChargeStartFailCount})
 			GetDB().SetSetting(SettingsPermanentError, "1")
+			GetMqttPublisher().PublishPermanentError(true)
 			c.ChargeStartFailCount = 0
 			return false
 		}
@@ -204,20 +275,20 @@ func (c *ChargeController) activateCharging(vehicle *Vehicle, state *VehicleStat
 
 	err := GetTeslaAPI().Wakeup(vehicle.VIN)
 	if err != nil {
-		GetDB().LogChargingEvent(vehicle.VIN, LogEventWakeVehicle, "could not wake vehicle: "+err.Error())
+		LogChargingEvent(vehicle.VIN, LogEventWakeVehicle, "could not wake vehicle: "+err.Error())
 		return false
 	}
-	GetDB().LogChargingEvent(vehicle.VIN, LogEventWakeVehicle, "")
+	LogChargingEvent(vehicle.VIN, LogEventWakeVehicle, "")
 
 	time.Sleep(DelayBetweenAPICommands) // delay
 
 	// set the charge limit
 	if state.ChargeLimit != vehicle.TargetSoC {
 		if err := GetTeslaAPI().SetChargeLimit(vehicle.VIN, vehicle.TargetSoC); err != nil {
-			GetDB().LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, "could not set target SoC: "+err.Error())
+			LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, "could not set target SoC: "+err.Error())
 			return false
 		}
-		GetDB().LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, fmt.Sprintf("target SoC set to %d", vehicle.TargetSoC))
+		LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, fmt.Sprintf("target SoC set to %d", vehicle.TargetSoC))
 		GetDB().SetVehicleStateChargeLimit(vehicle.VIN, vehicle.TargetSoC)
 		time.Sleep(DelayBetweenAPICommands) // delay
 	}
@@ -225,28 +296,31 @@ func (c *ChargeController) activateCharging(vehicle *Vehicle, state *VehicleStat
 	// set amps to charge
 	if state.Amps != amps {
 		if err := GetTeslaAPI().SetChargeAmps(vehicle.VIN, amps); err != nil {
-			GetDB().LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, "could not set charge amps: "+err.Error())
+			LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, "could not set charge amps: "+err.Error())
 			return false
 		}
-		GetDB().LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("charge amps set to %d", amps))
+		LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("charge amps set to %d", amps))
 		GetDB().SetVehicleStateAmps(vehicle.VIN, amps)
 		time.Sleep(DelayBetweenAPICommands) // delay
 	}
 
 	if err := GetTeslaAPI().ChargeStart(vehicle.VIN); err != nil {
-		GetDB().LogChargingEvent(vehicle.VIN, LogEventChargeStart, "could not start charging: "+err.Error())
+		LogChargingEvent(vehicle.VIN, LogEventChargeStart, "could not start charging: "+err.Error())
 		c.ChargeStartFailCount++
 		return false
 	}
 	c.ChargeStartFailCount = 0
-	GetDB().LogChargingEvent(vehicle.VIN, LogEventChargeStart, "")
-	GetDB().SetVehicleStateCharging(vehicle.VIN, source)
-
 	sourceText := "solar power"
 	if source == ChargeStateChargingOnGrid {
 		sourceText = "grid"
 	}
-	SendPushNotification(fmt.Sprintf("%s started charging on %s with %d amps at %d %% SoC.", vehicle.DisplayName, sourceText, amps, state.SoC))
+	LogChargingEvent(vehicle.VIN, LogEventChargeStart, fmt.Sprintf("charging started on %s with %d amps", sourceText, amps))
+	GetDB().SetVehicleStateCharging(vehicle.VIN, source)
+	StartChargingInterval(vehicle, source, amps)
+
+	msg := fmt.Sprintf("%s started charging on %s with %d amps at %d %% SoC.", vehicle.DisplayName, sourceText, amps, state.SoC)
+	SendPushNotification(NotificationCategoryCharging, msg)
+	SendWebhookEvent(WebhookEventChargeStarted, vehicle, msg, map[string]any{"source": webhookChargeSource(source), "amps": amps, "soc": state.SoC})
 
 	// charging should start now
 	return true
@@ -297,11 +371,80 @@ func (c *ChargeController) getEstimatedChargeDurationMinutes(vehicle *Vehicle, s
 func (c *ChargeController) getUpcomingGridPrices(vehicle *Vehicle) []*GridPrice {
 	if vehicle.GridProvider == GridProviderTibber {
 		prices := GetDB().GetUpcomingTibberPrices(vehicle.VIN, true)
+		c.applyGridOptimizationTarget(vehicle, prices)
 		return prices
 	}
 	return []*GridPrice{}
 }
 
+func (c *ChargeController) getCarbonWeight(vehicle *Vehicle) float32 {
+	switch vehicle.GridOptimization {
+	case GridOptimizationCarbon:
+		return 1
+	case GridOptimizationMixed:
+		return float32(vehicle.CarbonWeight) / 100
+	}
+	return 0
+}
+
+func (c *ChargeController) applyGridOptimizationTarget(vehicle *Vehicle, prices []*GridPrice) {
+	for _, price := range prices {
+		price.Score = price.Total
+	}
+	weight := c.getCarbonWeight(vehicle)
+	if weight <= 0 || len(prices) == 0 {
+		return
+	}
+
+	intensities := map[int64]float32{}
+	for _, e := range GetDB().GetUpcomingCarbonIntensities(GetConfig().CarbonZone) {
+		intensities[e.StartsAt.Unix()] = e.Intensity
+	}
+	if len(intensities) == 0 {
+		// without any carbon data, keep optimizing for cost
+		return
+	}
+
+	minPrice, maxPrice := prices[0].Total, prices[0].Total
+	minCarbon, maxCarbon := float32(math.MaxFloat32), float32(0)
+	for _, price := range prices {
+		minPrice = min(minPrice, price.Total)
+		maxPrice = max(maxPrice, price.Total)
+		if intensity, ok := intensities[price.StartsAt.Unix()]; ok {
+			price.CarbonIntensity = &intensity
+			minCarbon = min(minCarbon, intensity)
+			maxCarbon = max(maxCarbon, intensity)
+		}
+	}
+	normalize := func(value, lower, upper float32) float32 {
+		if upper <= lower {
+			return 0
+		}
+		return (value - lower) / (upper - lower)
+	}
+	for _, price := range prices {
+		// hours without carbon forecast are assumed to be the dirtiest ones
+		carbon := maxCarbon
+		if price.CarbonIntensity != nil {
+			carbon = *price.CarbonIntensity
+		}
+		price.Score = (1-weight)*normalize(price.Total, minPrice, maxPrice) + weight*normalize(carbon, minCarbon, maxCarbon)
+	}
+	sort.SliceStable(prices, func(i, j int) bool {
+		return prices[i].Score < prices[j].Score
+	})
+}
+
+func (c *ChargeController) getLowestGridPrice(prices []*GridPrice) *GridPrice {
+	var res *GridPrice = nil
+	for _, price := range prices {
+		if res == nil || price.Total < res.Total {
+			res = price
+		}
+	}
+	return res
+}
+
 func (c *ChargeController) checkStartOnGrid_NoDeparturePriceLimit(vehicle *Vehicle, state *VehicleState, prices []*GridPrice) bool {
 	now := c.Time.UTCNow()
 	if GetDB().IsSelectedGridHourblock(vehicle.VIN, now.Year(), int(now.Month()), now.Day(), now.Hour()) {
@@ -309,7 +452,7 @@ func (c *ChargeController) checkStartOnGrid_NoDeparturePriceLimit(vehicle *Vehic
 	}
 
 	// check if lowest price is above user-defined maximum
-	if prices[0].Total*100 > float32(vehicle.MaxPrice) {
+	if c.getLowestGridPrice(prices).Total*100 > float32(vehicle.MaxPrice) {
 		return false
 	}
 
@@ -322,8 +465,8 @@ func (c *ChargeController) checkStartOnGrid_NoDeparturePriceLimit(vehicle *Vehic
 		return false
 	}
 
-	// check if current price is lowest of all known prices
-	if currentPrice.Total == prices[0].Total {
+	// check if current price is the best of all known prices
+	if currentPrice.Score == prices[0].Score {
 		return true
 	}
 
@@ -436,7 +579,8 @@ func (c *ChargeController) checkStartOnGrid_DepartureWithPriceLimit(vehicle *Veh
 	pricesFiltered := c.getGridPricesBefore(prices, *departure)
 
 	// check if lowest price is above user-defined maximum
-	if pricesFiltered[0].Total*100 > float32(vehicle.MaxPrice) {
+	lowestPrice := c.getLowestGridPrice(pricesFiltered)
+	if lowestPrice == nil || lowestPrice.Total*100 > float32(vehicle.MaxPrice) {
 		return false
 	}
 
@@ -449,8 +593,8 @@ func (c *ChargeController) checkStartOnGrid_DepartureWithPriceLimit(vehicle *Veh
 		return false
 	}
 
-	// check if current price is lowest of all known prices
-	if currentPrice.Total == pricesFiltered[0].Total {
+	// check if current price is the best of all known prices
+	if currentPrice.Score == pricesFiltered[0].Score {
 		return true
 	}
 
@@ -488,28 +632,76 @@ func (c *ChargeController) checkStartOnGrid(vehicle *Vehicle, state *VehicleStat
 
 	// get upcoming grid prices sorted by ascending price
 	prices := c.getUpcomingGridPrices(vehicle)
-	if len(prices) == 0 {
-		return false, 0
-	}
 
 	// check whether to start charging depending on grid strategy
 	res := false
-	switch vehicle.GridStrategy {
-	case GridStrategyNoDeparturePriceLimit:
-		res = c.checkStartOnGrid_NoDeparturePriceLimit(vehicle, state, prices)
-	case GridStrategyDepartureNoPriceLimit:
-		res = c.checkStartOnGrid_DepartureNoPriceLimit(vehicle, state, prices)
-	case GridStrategyDepartureWithPriceLimit:
-		res = c.checkStartOnGrid_DepartureWithPriceLimit(vehicle, state, prices)
+	if len(prices) > 0 {
+		switch vehicle.GridStrategy {
+		case GridStrategyNoDeparturePriceLimit:
+			res = c.checkStartOnGrid_NoDeparturePriceLimit(vehicle, state, prices)
+		case GridStrategyDepartureNoPriceLimit:
+			res = c.checkStartOnGrid_DepartureNoPriceLimit(vehicle, state, prices)
+		case GridStrategyDepartureWithPriceLimit:
+			res = c.checkStartOnGrid_DepartureWithPriceLimit(vehicle, state, prices)
+		}
 	}
 
 	if res {
 		return true, vehicle.MaxAmps
 	}
 
+	// price data may be missing, outdated or incomplete, i.e. if the price source fails,
+	// so fall back to charging before departure if configured
+	if !c.hasSufficientGridPrices(vehicle, prices) && c.checkStartOnGrid_Fallback(vehicle) {
+		return true, vehicle.MaxAmps
+	}
+
 	return false, 0
 }
 
+// hasSufficientGridPrices checks whether the known prices allow the grid strategy to decide:
+// the current hour's price must be known and, for strategies with a departure time, the prices until departure.
+func (c *ChargeController) hasSufficientGridPrices(vehicle *Vehicle, prices []*GridPrice) bool {
+	if c.getCurrentGridPrice(prices) == nil {
+		return false
+	}
+	if vehicle.GridStrategy == GridStrategyNoDeparturePriceLimit {
+		return true
+	}
+	departure, err := c.getNextDeparture(vehicle)
+	if err != nil {
+		// the fallback requires a departure time, too
+		return true
+	}
+	return c.containsPricesUntilDeparture(c.getGridPricesBefore(prices, *departure), *departure)
+}
+
+func (c *ChargeController) checkStartOnGrid_Fallback(vehicle *Vehicle) bool {
+	if vehicle.GridFallbackHours <= 0 {
+		return false
+	}
+
+	now := c.Time.UTCNow()
+	if GetDB().IsSelectedGridHourblock(vehicle.VIN, now.Year(), int(now.Month()), now.Day(), now.Hour()) {
+		return true
+	}
+
+	departure, err := c.getNextDeparture(vehicle)
+	if err != nil {
+		log.Printf("could not get next departure date for vehicle %s: %s\n", vehicle.VIN, err.Error())
+		return false
+	}
+
+	fallbackStart := departure.Add(time.Hour * time.Duration(vehicle.GridFallbackHours) * -1)
+	if now.Before(fallbackStart) {
+		return false
+	}
+
+	log.Printf("Grid prices for vehicle %s are missing or incomplete, using fallback %d hours before departure\n", vehicle.VIN, vehicle.GridFallbackHours)
+	GetDB().RecordSelectedGridHourblock(vehicle.VIN, now.Year(), int(now.Month()), now.Day(), now.Hour())
+	return true
+}
+
 func (c *ChargeController) getGridPricesBefore(prices []*GridPrice, limit time.Time) []*GridPrice {
 	res := []*GridPrice{}
 	for _, price := range prices {
@@ -587,10 +779,8 @@ func (c *ChargeController) getActualSurplus(vehicle *Vehicle, state *VehicleStat
 		res := 0
 		allAbove := true
 		for _, surplus := range surpluses {
-			if surplus.Timestamp.After(now.Add(-5 * time.Minute)) {
-				if state.Charging == ChargeStateChargingOnSolar {
-					surplus.SurplusWatts += (state.Amps * 230 * vehicle.NumPhases)
-				}
+			if surplus.Timestamp.After(now.Add(time.Minute * time.Duration(MaxSurplusSampleAgeMinutes) * -1)) {
+				surplus.SurplusWatts = c.getAvailableSurplus(vehicle, state, surplus)
 				if surplus.SurplusWatts >= vehicle.MinSurplus {
 					if surplus.SurplusWatts > res && allAbove {
 						res = surplus.SurplusWatts
@@ -606,10 +796,8 @@ func (c *ChargeController) getActualSurplus(vehicle *Vehicle, state *VehicleStat
 	// if aleady charging on solar, at least one sample must be above threshold
 	res := 0
 	for _, surplus := range surpluses {
-		if surplus.Timestamp.After(now.Add(-5 * time.Minute)) {
-			if state.Charging == ChargeStateChargingOnSolar {
-				surplus.SurplusWatts += (state.Amps * 230 * vehicle.NumPhases)
-			}
+		if surplus.Timestamp.After(now.Add(time.Minute * time.Duration(MaxSurplusSampleAgeMinutes) * -1)) {
+			surplus.SurplusWatts = c.getAvailableSurplus(vehicle, state, surplus)
 			if surplus.SurplusWatts > res {
 				res = surplus.SurplusWatts
 			}
@@ -618,20 +806,40 @@ func (c *ChargeController) getActualSurplus(vehicle *Vehicle, state *VehicleStat
 	return res - vehicle.SurplusBuffer
 }
 
+// getAvailableSurplus returns the surplus available to the vehicle, including its own draw if charging on solar
+func (c *ChargeController) getAvailableSurplus(vehicle *Vehicle, state *VehicleState, surplus *SurplusRecord) int {
+	if surplus.VehicleWatts != nil {
+		// grid meter mode: the draw of all vehicles charging on solar has been added when recording,
+		// but only the vehicle's own draw is available to it
+		res := surplus.SurplusWatts - *surplus.VehicleWatts
+		if state.Charging == ChargeStateChargingOnSolar {
+			res += surplus.VehicleDraws[vehicle.VIN]
+		}
+		return res
+	}
+	if state.Charging == ChargeStateChargingOnSolar {
+		return surplus.SurplusWatts + (state.Amps * 230 * vehicle.NumPhases)
+	}
+	return surplus.SurplusWatts
+}
+
 func (c *ChargeController) chargeProcessAdjustSolarAmps(vehicle *Vehicle, state *VehicleState, targetAmps int) {
 	if state.Charging == ChargeStateChargingOnSolar && targetAmps > 0 && targetAmps != state.Amps {
 		// ...and only if the last amps adjustment occured before the latest surplus data came in
 		if c.canAdjustSolarAmps(vehicle) {
 			err := GetTeslaAPI().Wakeup(vehicle.VIN)
 			if err != nil {
-				GetDB().LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("could not init session with car: %s", err.Error()))
+				LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("could not init session with car: %s", err.Error()))
 			} else {
 				if err := GetTeslaAPI().SetChargeAmps(vehicle.VIN, targetAmps); err != nil {
-					GetDB().LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, "could not set charge amps: "+err.Error())
+					LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, "could not set charge amps: "+err.Error())
 				} else {
 					GetDB().SetVehicleStateAmps(vehicle.VIN, targetAmps)
-					GetDB().LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("charge amps set to %d", targetAmps))
-					SendPushNotification(fmt.Sprintf("Adjusted %s's current to %d amps.", vehicle.DisplayName, targetAmps))
+					StartChargingInterval(vehicle, state.Charging, targetAmps)
+					LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("charge amps set to %d", targetAmps))
+					msg := fmt.Sprintf("Adjusted %s's current to %d amps.", vehicle.DisplayName, targetAmps)
+					SendPushNotification(NotificationCategoryAmps, msg)
+					SendWebhookEvent(WebhookEventAmpsChanged, vehicle, msg, map[string]any{"amps": targetAmps, "previous_amps": state.Amps})
 				}
 			}
 		}
@@ -642,9 +850,9 @@ func (c *ChargeController) checkChargeProcess(vehicle *Vehicle, state *VehicleSt
 	// check if target SoC has been changed in the meantime
 	if state.ChargeLimit != vehicle.TargetSoC {
 		if err := GetTeslaAPI().SetChargeLimit(vehicle.VIN, vehicle.TargetSoC); err != nil {
-			GetDB().LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, "could not set target SoC: "+err.Error())
+			LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, "could not set target SoC: "+err.Error())
 		} else {
-			GetDB().LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, fmt.Sprintf("target SoC set to %d", vehicle.TargetSoC))
+			LogChargingEvent(vehicle.VIN, LogEventSetTargetSoC, fmt.Sprintf("target SoC set to %d", vehicle.TargetSoC))
 			GetDB().SetVehicleStateChargeLimit(vehicle.VIN, vehicle.TargetSoC)
 			time.Sleep(DelayBetweenAPICommands) // delay
 		}
@@ -652,7 +860,7 @@ func (c *ChargeController) checkChargeProcess(vehicle *Vehicle, state *VehicleSt
 
 	// if target SoC is reached: stop charging
 	if state.SoC >= vehicle.TargetSoC {
-		c.stopCharging(vehicle, state)
+		c.stopChargingTargetReached(vehicle, state)
 		return
 	}
 
@@ -1110,6 +1110,267 @@ func TestChargeControl_TibberChargingDepartureWithPriceLimit(t *testing.T) {
 	UpdateTeslaAPIMockData(api, "123", 73, "")
 }
 
+func TestChargeControl_checkStartOnGrid_Fallback(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := &Vehicle{
+		VIN:               "123",
+		TargetSoC:         70,
+		MaxAmps:           16,
+		NumPhases:         3,
+		LowcostCharging:   true,
+		GridProvider:      GridProviderTibber,
+		GridStrategy:      GridStrategyDepartureNoPriceLimit,
+		DepartDays:        "1",
+		DepartTime:        "07:00",
+		GridFallbackHours: 2,
+	}
+	s := &VehicleState{
+		SoC: 50,
+	}
+	cc := NewTestChargeController()
+
+	// no prices and not within fallback window yet
+	GlobalMockTime.CurTime = GetNextMondayMidnight().Add(time.Hour * 4)
+	res, _ := cc.checkStartOnGrid(v, s)
+	assert.False(t, res)
+
+	// no prices and within fallback window
+	GlobalMockTime.CurTime = GetNextMondayMidnight().Add(time.Hour * 5)
+	res, amps := cc.checkStartOnGrid(v, s)
+	assert.True(t, res)
+	assert.Equal(t, 16, amps)
+
+	// fallback disabled
+	v.GridFallbackHours = 0
+	GlobalMockTime.CurTime = GetNextMondayMidnight().Add(time.Hour * 6)
+	res, _ = cc.checkStartOnGrid(v, s)
+	assert.False(t, res)
+}
+
+func TestChargeControl_ChargeNow(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+
+	v := &Vehicle{
+		VIN:             "123",
+		Enabled:         true,
+		TargetSoC:       70,
+		MaxAmps:         16,
+		NumPhases:       3,
+		SurplusCharging: false,
+		LowcostCharging: false,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 50)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateNotCharging)
+	cc := NewTestChargeController()
+
+	api, _ := TeslaAPIInstance.(*TeslaAPIMock)
+	api.On("SetChargeLimit", mock.Anything, mock.Anything).Return(nil)
+	api.On("SetChargeAmps", mock.Anything, mock.Anything).Return(nil)
+	api.On("ChargeStart", mock.Anything).Return(nil)
+	api.On("ChargeStop", mock.Anything).Return(nil)
+	api.On("Wakeup", mock.Anything).Return(nil)
+	UpdateTeslaAPIMockData(api, "123", 50, "")
+
+	// neither surplus nor low cost charging enabled
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+
+	// charge now starts charging on grid with max amps
+	GetDB().SetVehicleStateChargeNow(v.VIN, true)
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnGrid, state.Charging)
+	assert.Equal(t, 16, state.Amps)
+
+	// keeps charging although low cost charging is disabled
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(10 * time.Minute)
+	UpdateTeslaAPIMockData(api, "123", 60, "Charging")
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnGrid, state.Charging)
+
+	// target reached, charge now is reset
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(10 * time.Minute)
+	UpdateTeslaAPIMockData(api, "123", 70, "Charging")
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+	assert.False(t, state.ChargeNow)
+}
+
+func TestChargeControl_ChargeNowSoC(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+
+	v := &Vehicle{
+		VIN:       "123",
+		Enabled:   true,
+		TargetSoC: 70,
+		MaxAmps:   16,
+		NumPhases: 3,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 50)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateNotCharging)
+	cc := NewTestChargeController()
+
+	api, _ := TeslaAPIInstance.(*TeslaAPIMock)
+	api.On("SetChargeLimit", mock.Anything, mock.Anything).Return(nil)
+	api.On("SetChargeAmps", mock.Anything, mock.Anything).Return(nil)
+	api.On("ChargeStart", mock.Anything).Return(nil)
+	api.On("ChargeStop", mock.Anything).Return(nil)
+	api.On("Wakeup", mock.Anything).Return(nil)
+	UpdateTeslaAPIMockData(api, "123", 50, "")
+
+	GetDB().SetVehicleStateChargeNowSoC(v.VIN, true, 90)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnGrid, state.Charging)
+	assert.Equal(t, 90, state.ChargeLimit)
+
+	// keeps charging beyond the vehicle's target SoC
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(10 * time.Minute)
+	UpdateTeslaAPIMockData(api, "123", 75, "Charging")
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnGrid, state.Charging)
+
+	// one-shot target reached, the vehicle's target SoC applies again
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(10 * time.Minute)
+	UpdateTeslaAPIMockData(api, "123", 90, "Charging")
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+	assert.False(t, state.ChargeNow)
+	assert.Equal(t, 0, state.ChargeNowSoC)
+	assert.Equal(t, 70, GetDB().GetVehicleByVIN(v.VIN).TargetSoC)
+}
+
+func TestChargeControl_ChargeNowTargetReached(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+
+	v := &Vehicle{
+		VIN:       "123",
+		Enabled:   true,
+		TargetSoC: 70,
+		MaxAmps:   16,
+		NumPhases: 3,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 70)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateNotCharging)
+	cc := NewTestChargeController()
+
+	// charge now with a one-shot target below the current SoC is fulfilled already
+	GetDB().SetVehicleStateChargeNowSoC(v.VIN, true, 60)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+	assert.False(t, state.ChargeNow)
+	assert.Equal(t, 0, state.ChargeNowSoC)
+
+	// a pause applies again afterwards
+	until := GlobalMockTime.CurTime.Add(time.Hour)
+	GetDB().SetVehicleStatePausedUntil(v.VIN, &until)
+	assert.True(t, cc.isPaused(GetDB().GetVehicleState(v.VIN)))
+}
+
+func TestChargeControl_Paused(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+
+	v := &Vehicle{
+		VIN:             "123",
+		Enabled:         true,
+		TargetSoC:       70,
+		MaxAmps:         16,
+		NumPhases:       3,
+		SurplusCharging: true,
+		MinSurplus:      2000,
+		MinChargeTime:   0,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 50)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateChargingOnSolar)
+	GetDB().SetVehicleStateAmps(v.VIN, 5)
+	GetDB().RecordSurplus(4000)
+	cc := NewTestChargeController()
+
+	api, _ := TeslaAPIInstance.(*TeslaAPIMock)
+	api.On("SetChargeLimit", mock.Anything, mock.Anything).Return(nil)
+	api.On("SetChargeAmps", mock.Anything, mock.Anything).Return(nil)
+	api.On("ChargeStart", mock.Anything).Return(nil)
+	api.On("ChargeStop", mock.Anything).Return(nil)
+	api.On("Wakeup", mock.Anything).Return(nil)
+	UpdateTeslaAPIMockData(api, "123", 50, "Charging")
+
+	// pausing stops charging
+	until := GlobalMockTime.CurTime.Add(2 * time.Hour)
+	GetDB().SetVehicleStatePausedUntil(v.VIN, &until)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+
+	// doesn't start while paused
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Hour)
+	GetDB().RecordSurplus(4000)
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+
+	// starts again once the pause is over
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Hour)
+	GetDB().RecordSurplus(4000)
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnSolar, state.Charging)
+}
+
+func TestChargeControl_checkStartOnGrid_FallbackIncompletePrices(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := &Vehicle{
+		VIN:               "123",
+		TargetSoC:         70,
+		MaxAmps:           16,
+		NumPhases:         3,
+		LowcostCharging:   true,
+		GridProvider:      GridProviderTibber,
+		GridStrategy:      GridStrategyDepartureWithPriceLimit,
+		MaxPrice:          20,
+		DepartDays:        "1",
+		DepartTime:        "07:00",
+		GridFallbackHours: 2,
+	}
+	s := &VehicleState{
+		SoC: 50,
+	}
+	cc := NewTestChargeController()
+
+	// the only known price is above the limit and prices until departure are missing
+	GlobalMockTime.CurTime = GetNextMondayMidnight().Add(time.Hour * 4)
+	SetTibberTestPrice(v.VIN, GlobalMockTime.CurTime, 0.35)
+	res, _ := cc.checkStartOnGrid(v, s)
+	assert.False(t, res)
+
+	GlobalMockTime.CurTime = GetNextMondayMidnight().Add(time.Hour * 5)
+	SetTibberTestPrice(v.VIN, GlobalMockTime.CurTime, 0.35)
+	res, amps := cc.checkStartOnGrid(v, s)
+	assert.True(t, res)
+	assert.Equal(t, 16, amps)
+
+	// prices until departure are known, so the price limit applies
+	v.VIN = "456"
+	for i := 5; i < 8; i++ {
+		SetTibberTestPrice(v.VIN, GetNextMondayMidnight().Add(time.Hour*time.Duration(i)), 0.35)
+	}
+	res, _ = cc.checkStartOnGrid(v, s)
+	assert.False(t, res)
+}
+
 func TestChargeControl_containsPricesUntilDeparture_true(t *testing.T) {
 	t.Cleanup(ResetTestDB)
 
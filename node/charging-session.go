@@ -0,0 +1,259 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// ChargingSessionMaxMeasureGap is the longest gap between two telemetry readings which is counted as charging time
+const ChargingSessionMaxMeasureGap time.Duration = time.Minute * 5
+
+// chargingEnergy is the estimated energy of charging intervals.
+// The cost is only known if there is a price for all grid energy, emissions if there is a carbon intensity for some of it.
+type chargingEnergy struct {
+	Solar          float64
+	Grid           float64
+	Cost           float64
+	CostKnown      bool
+	Emissions      float64
+	EmissionsKnown bool
+}
+
+// StartChargingSession opens a session when the vehicle is plugged in, a session left open is ended first
+func StartChargingSession(vehicle *Vehicle, soc int) *ChargingSession {
+	now := GetDB().Time.UTCNow()
+	if session := GetDB().GetOpenChargingSession(vehicle.VIN); session != nil {
+		finishChargingSession(vehicle, session, now, -1)
+	}
+	return GetDB().CreateChargingSession(vehicle.VIN, now, soc)
+}
+
+// EndChargingSession closes the open session when the vehicle is unplugged
+func EndChargingSession(vehicle *Vehicle, soc int) {
+	if session := GetDB().GetOpenChargingSession(vehicle.VIN); session != nil {
+		finishChargingSession(vehicle, session, GetDB().Time.UTCNow(), soc)
+	}
+}
+
+func finishChargingSession(vehicle *Vehicle, session *ChargingSession, endedAt time.Time, soc int) {
+	session.EndedAt = &endedAt
+	session.EndSoC = soc
+	UpdateChargingSession(vehicle, session)
+}
+
+// OpenChargingSessions starts a session for each vehicle which is plugged in without an open session,
+// i.e. as it has been plugged in before the node started
+func OpenChargingSessions() {
+	for _, vehicle := range GetDB().GetVehicles() {
+		state := GetDB().GetVehicleState(vehicle.VIN)
+		if state == nil || !state.PluggedIn || GetDB().GetOpenChargingSession(vehicle.VIN) != nil {
+			continue
+		}
+		log.Printf("Starting charging session for vehicle %s which is already plugged in\n", vehicle.VIN)
+		StartChargingSession(vehicle, state.SoC)
+	}
+}
+
+// RefreshChargingSession updates energy and cost of the open session, called by the charge controller's tick and after charging stopped
+func RefreshChargingSession(vehicle *Vehicle) *ChargingSession {
+	splitChargingInterval(vehicle)
+	session := GetDB().GetOpenChargingSession(vehicle.VIN)
+	if session != nil {
+		UpdateChargingSession(vehicle, session)
+	}
+	return session
+}
+
+// UpdateChargingSession calculates energy and cost from the session's charging intervals and stores them.
+// If the vehicle reported its charging current, the measured energy replaces the estimate and the estimate's solar/grid split is applied to it.
+// Ended sessions must not be updated after their intervals have been removed by the maintenance.
+func UpdateChargingSession(vehicle *Vehicle, session *ChargingSession) {
+	end := GetDB().Time.UTCNow()
+	if session.EndedAt != nil {
+		end = *session.EndedAt
+	}
+	referencePrice := GetReferencePrice(vehicle.VIN, session.StartedAt, end)
+	intervals := clipChargingIntervals(GetDB().GetChargingIntervalsOfSession(session.ID), session.StartedAt, end)
+	energy := estimateChargingEnergy(vehicle, intervals, referencePrice)
+	session.Measured = session.EnergyMeasured > 0
+	if session.Measured {
+		estimated := energy.Solar + energy.Grid
+		if estimated > 0 {
+			factor := session.EnergyMeasured / estimated
+			energy.Solar *= factor
+			energy.Grid *= factor
+			energy.Cost *= factor
+			energy.Emissions *= factor
+		} else {
+			// charged without chargebot starting it, so the source is unknown
+			energy.Grid = session.EnergyMeasured
+			energy.Cost = session.EnergyMeasured * referencePrice
+			energy.CostKnown = referencePrice > 0
+		}
+	}
+	session.EnergySolar = energy.Solar
+	session.EnergyGrid = energy.Grid
+	session.Cost = nil
+	session.GridPrice = nil
+	session.Emissions = nil
+	if energy.EmissionsKnown {
+		session.Emissions = &energy.Emissions
+	}
+	if energy.CostKnown {
+		session.Cost = &energy.Cost
+		if energy.Grid > 0 {
+			price := energy.Cost / energy.Grid
+			session.GridPrice = &price
+		}
+	}
+	GetDB().UpdateChargingSession(session)
+}
+
+// RecordChargingSessionMeasurement adds the energy charged since the previous reading of the vehicle's charging current
+func RecordChargingSessionMeasurement(vehicle *Vehicle, amps int, ts time.Time) {
+	session := GetDB().GetOpenChargingSession(vehicle.VIN)
+	if session == nil {
+		return
+	}
+	if session.MeasuredAt != nil && ts.After(*session.MeasuredAt) {
+		if d := ts.Sub(*session.MeasuredAt); d <= ChargingSessionMaxMeasureGap {
+			session.EnergyMeasured += float64(amps*230*vehicle.NumPhases) / 1000 * d.Hours()
+		}
+	}
+	if session.MeasuredAt == nil || ts.After(*session.MeasuredAt) {
+		session.MeasuredAt = &ts
+		GetDB().UpdateChargingSession(session)
+	}
+}
+
+// GetReferencePrice returns DIGEST_REFERENCE_PRICE, or the average grid price of the period if not set
+func GetReferencePrice(vin string, from time.Time, to time.Time) float64 {
+	if price := GetConfig().DigestReferencePrice; price > 0 {
+		return price
+	}
+	if price, ok := GetDB().GetAverageTibberPrice(vin, from, to); ok {
+		return float64(price)
+	}
+	return 0
+}
+
+// StartChargingInterval records that the vehicle charges from the source with the amps from now on,
+// called whenever the charge controller starts charging or adjusts the amps
+func StartChargingInterval(vehicle *Vehicle, source ChargeState, amps int) {
+	now := GetDB().Time.UTCNow()
+	EndChargingInterval(vehicle)
+	sessionID := 0
+	if session := GetDB().GetOpenChargingSession(vehicle.VIN); session != nil {
+		sessionID = session.ID
+	}
+	GetDB().CreateChargingInterval(&ChargingInterval{
+		SessionID: sessionID,
+		VIN:       vehicle.VIN,
+		StartedAt: now,
+		Source:    source,
+		Amps:      amps,
+		Price:     getChargingIntervalPrice(vehicle, source, now),
+	})
+}
+
+// EndChargingInterval ends the vehicle's open interval, i.e. when charging stopped
+func EndChargingInterval(vehicle *Vehicle) {
+	if interval := splitChargingInterval(vehicle); interval != nil {
+		GetDB().EndChargingInterval(interval.ID, GetDB().Time.UTCNow())
+	}
+}
+
+// splitChargingInterval ends an open grid interval at each full hour and continues it with the next hour's price.
+// Returns the open interval, or nil if the vehicle is not charging.
+func splitChargingInterval(vehicle *Vehicle) *ChargingInterval {
+	interval := GetDB().GetOpenChargingInterval(vehicle.VIN)
+	if interval == nil || interval.Source != ChargeStateChargingOnGrid {
+		return interval
+	}
+	now := GetDB().Time.UTCNow()
+	for {
+		next := interval.StartedAt.Truncate(time.Hour).Add(time.Hour)
+		if next.After(now) {
+			return interval
+		}
+		GetDB().EndChargingInterval(interval.ID, next)
+		interval = &ChargingInterval{
+			SessionID: interval.SessionID,
+			VIN:       interval.VIN,
+			StartedAt: next,
+			Source:    interval.Source,
+			Amps:      interval.Amps,
+			Price:     getChargingIntervalPrice(vehicle, interval.Source, next),
+		}
+		GetDB().CreateChargingInterval(interval)
+	}
+}
+
+// getChargingIntervalPrice returns the grid price per kWh of the hour, nil for solar or if the price is unknown
+func getChargingIntervalPrice(vehicle *Vehicle, source ChargeState, ts time.Time) *float64 {
+	if source != ChargeStateChargingOnGrid {
+		return nil
+	}
+	price, ok := GetDB().GetTibberPrice(vehicle.VIN, ts.Year(), int(ts.Month()), ts.Day(), ts.Hour())
+	if !ok {
+		return nil
+	}
+	res := float64(price)
+	return &res
+}
+
+// getChargingIntervals returns the vehicle's intervals clipped to the period
+func getChargingIntervals(vehicle *Vehicle, from time.Time, to time.Time) []*ChargingInterval {
+	return clipChargingIntervals(GetDB().GetChargingIntervalsBetween(vehicle.VIN, from, to), from, to)
+}
+
+// clipChargingIntervals returns copies of the intervals limited to the period, intervals still open end now
+func clipChargingIntervals(intervals []*ChargingInterval, from time.Time, to time.Time) []*ChargingInterval {
+	res := []*ChargingInterval{}
+	now := GetDB().Time.UTCNow()
+	for _, interval := range intervals {
+		e := *interval
+		end := now
+		if e.EndedAt != nil {
+			end = *e.EndedAt
+		}
+		if e.StartedAt.Before(from) {
+			e.StartedAt = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(e.StartedAt) {
+			e.EndedAt = &end
+			res = append(res, &e)
+		}
+	}
+	return res
+}
+
+// estimateChargingEnergy sums up the energy of the clipped intervals. Grid energy is priced with the interval's price,
+// or the reference price if the price is unknown, and its emissions use the hourly carbon intensity.
+// Solar energy is considered free and emission-free.
+func estimateChargingEnergy(vehicle *Vehicle, intervals []*ChargingInterval, referencePrice float64) *chargingEnergy {
+	res := &chargingEnergy{CostKnown: true}
+	for _, interval := range intervals {
+		kWh := float64(interval.Amps*230*vehicle.NumPhases) / 1000 * interval.EndedAt.Sub(interval.StartedAt).Hours()
+		if interval.Source == ChargeStateChargingOnSolar {
+			res.Solar += kWh
+			continue
+		}
+		res.Grid += kWh
+		if grams, ok := EstimateEmissionsGrams(vehicle, interval.Amps, interval.StartedAt, *interval.EndedAt); ok {
+			res.Emissions += grams
+			res.EmissionsKnown = true
+		}
+		if interval.Price != nil {
+			res.Cost += kWh * *interval.Price
+		} else if referencePrice > 0 {
+			res.Cost += kWh * referencePrice
+		} else {
+			res.CostKnown = false
+		}
+	}
+	return res
+}
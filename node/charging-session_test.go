@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newChargingSessionTestController() *ChargeController {
+	api, _ := TeslaAPIInstance.(*TeslaAPIMock)
+	api.On("SetChargeLimit", mock.Anything, mock.Anything).Return(nil)
+	api.On("SetChargeAmps", mock.Anything, mock.Anything).Return(nil)
+	api.On("ChargeStart", mock.Anything).Return(nil)
+	api.On("ChargeStop", mock.Anything).Return(nil)
+	api.On("Wakeup", mock.Anything).Return(nil)
+	return NewTestChargeController()
+}
+
+func startTestCharging(cc *ChargeController, v *Vehicle, source ChargeState, amps int, ts time.Time) {
+	GlobalMockTime.CurTime = ts
+	cc.activateCharging(v, GetDB().GetVehicleState(v.VIN), amps, source)
+}
+
+func adjustTestChargingAmps(cc *ChargeController, v *Vehicle, amps int, ts time.Time) {
+	GlobalMockTime.CurTime = ts
+	// amps are only adjusted after new surplus data came in
+	GetDB().RecordSurplus(10000)
+	cc.chargeProcessAdjustSolarAmps(v, GetDB().GetVehicleState(v.VIN), amps)
+}
+
+func stopTestCharging(cc *ChargeController, v *Vehicle, ts time.Time) {
+	GlobalMockTime.CurTime = ts
+	cc.stopCharging(v, GetDB().GetVehicleState(v.VIN))
+}
+
+func TestChargingSession_Lifecycle(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	setDigestReferencePrice(t, 0)
+	start := time.Date(2024, 6, 10, 1, 30, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = start
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+
+	session := StartChargingSession(v, 40)
+	assert.Equal(t, 40, session.StartSoC)
+	assert.Equal(t, session.ID, GetDB().GetOpenChargingSession(v.VIN).ID)
+
+	// 30 minutes at 0.20 and 30 minutes at 0.40
+	SetTibberTestPrice(v.VIN, time.Date(2024, 6, 10, 1, 0, 0, 0, time.UTC), 0.20)
+	SetTibberTestPrice(v.VIN, time.Date(2024, 6, 10, 2, 0, 0, 0, time.UTC), 0.40)
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, start)
+	stopTestCharging(cc, v, start.Add(time.Hour))
+	// one hour on solar
+	startTestCharging(cc, v, ChargeStateChargingOnSolar, 8, start.Add(2*time.Hour))
+	stopTestCharging(cc, v, start.Add(3*time.Hour))
+
+	// the grid interval is split at the full hour to keep each hour's price
+	intervals := GetDB().GetChargingIntervalsOfSession(session.ID)
+	assert.Len(t, intervals, 3)
+	assert.InDelta(t, 0.20, *intervals[0].Price, 0.001)
+	assert.InDelta(t, 0.40, *intervals[1].Price, 0.001)
+	assert.Equal(t, ChargeStateChargingOnSolar, intervals[2].Source)
+	assert.Equal(t, 8, intervals[2].Amps)
+	assert.Nil(t, intervals[2].Price)
+
+	GlobalMockTime.CurTime = start.Add(4 * time.Hour)
+	EndChargingSession(v, 80)
+	assert.Nil(t, GetDB().GetOpenChargingSession(v.VIN))
+
+	session = GetDB().GetChargingSession(session.ID)
+	assert.Equal(t, start.Add(4*time.Hour), *session.EndedAt)
+	assert.Equal(t, 80, session.EndSoC)
+	assert.InDelta(t, 11.04, session.EnergyGrid, 0.001)
+	assert.InDelta(t, 5.52, session.EnergySolar, 0.001)
+	assert.False(t, session.Measured)
+	assert.InDelta(t, 5.52*0.20+5.52*0.40, *session.Cost, 0.001)
+	assert.InDelta(t, 0.30, *session.GridPrice, 0.001)
+
+	// charging before the vehicle was plugged in again doesn't count
+	GlobalMockTime.CurTime = start.Add(5 * time.Hour)
+	StartChargingSession(v, 70)
+	session = RefreshChargingSession(v)
+	assert.Equal(t, 0.0, session.EnergySolar+session.EnergyGrid)
+	assert.Nil(t, session.GridPrice)
+}
+
+func TestChargingSession_Emissions(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	start := time.Date(2024, 6, 10, 10, 30, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = start
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+	zone := GetConfig().CarbonZone
+	GetDB().SetCarbonIntensity(zone, 2024, 6, 10, 10, 200)
+	GetDB().SetCarbonIntensity(zone, 2024, 6, 10, 11, 100)
+	GetDB().SetCarbonIntensity(zone, 2024, 6, 10, 12, 50)
+	session := StartChargingSession(v, 40)
+
+	// 16 amps across the full hour, then 8 amps after a restart
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, start)
+	stopTestCharging(cc, v, start.Add(time.Hour))
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 8, start.Add(90*time.Minute))
+	stopTestCharging(cc, v, start.Add(150*time.Minute))
+
+	session = GetDB().GetChargingSession(session.ID)
+	assert.InDelta(t, 5.52*200+5.52*100+5.52*50, *session.Emissions, 0.001)
+	stop := GetDB().GetLatestChargingEvent(v.VIN, LogEventChargeStop)
+	assert.Equal(t, "charging stopped, estimated session emissions 1.93 kg CO2", stop.Data)
+
+	// solar charging is emission-free, so no estimate without grid intensities
+	GlobalMockTime.CurTime = start.Add(4 * time.Hour)
+	session = StartChargingSession(v, 60)
+	startTestCharging(cc, v, ChargeStateChargingOnSolar, 8, start.Add(4*time.Hour))
+	stopTestCharging(cc, v, start.Add(5*time.Hour))
+	assert.Nil(t, GetDB().GetChargingSession(session.ID).Emissions)
+}
+
+func TestChargingSession_EndsOpenSession(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	GlobalMockTime.CurTime = time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	v := createDigestTestVehicle()
+
+	first := StartChargingSession(v, 40)
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Hour)
+	second := StartChargingSession(v, 50)
+
+	first = GetDB().GetChargingSession(first.ID)
+	assert.Equal(t, GlobalMockTime.CurTime, *first.EndedAt)
+	assert.Equal(t, -1, first.EndSoC)
+	assert.Equal(t, second.ID, GetDB().GetOpenChargingSession(v.VIN).ID)
+}
+
+func TestChargingSession_Measured(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	setDigestReferencePrice(t, 0.30)
+	start := time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = start
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+	session := StartChargingSession(v, 40)
+
+	// the estimate assumes 1 hour on solar with 16 amps, i.e. 11.04 kWh
+	startTestCharging(cc, v, ChargeStateChargingOnSolar, 16, start)
+	stopTestCharging(cc, v, start.Add(time.Hour))
+
+	// the vehicle actually reports 10 amps for 1 hour, the readings after a gap are only a starting point
+	for i := 0; i <= 60; i++ {
+		RecordChargingSessionMeasurement(v, 10, start.Add(time.Duration(i)*time.Minute))
+	}
+	RecordChargingSessionMeasurement(v, 10, start.Add(2*time.Hour))
+	RecordChargingSessionMeasurement(v, 10, start.Add(time.Minute))
+
+	GlobalMockTime.CurTime = start.Add(3 * time.Hour)
+	EndChargingSession(v, 60)
+	session = GetDB().GetChargingSession(session.ID)
+	assert.True(t, session.Measured)
+	assert.InDelta(t, 6.9, session.EnergySolar, 0.001)
+	assert.Equal(t, 0.0, session.EnergyGrid)
+	assert.Equal(t, 0.0, *session.Cost)
+	assert.Nil(t, session.GridPrice)
+}
+
+func TestChargingSession_MeasuredWithoutEstimate(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	setDigestReferencePrice(t, 0.30)
+	start := time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = start
+	v := createDigestTestVehicle()
+	session := StartChargingSession(v, 40)
+
+	// charging not started by chargebot is considered to be on grid
+	RecordChargingSessionMeasurement(v, 16, start)
+	RecordChargingSessionMeasurement(v, 16, start.Add(5*time.Minute))
+	session = RefreshChargingSession(v)
+	assert.True(t, session.Measured)
+	assert.InDelta(t, 0.92, session.EnergyGrid, 0.001)
+	assert.InDelta(t, 0.276, *session.Cost, 0.001)
+	assert.InDelta(t, 0.30, *session.GridPrice, 0.001)
+}
+
+func TestChargingSession_Unplugged(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	start := time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = start
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	StartChargingSession(v, 40)
+	startTestCharging(cc, v, ChargeStateChargingOnSolar, 8, start)
+
+	GlobalMockTime.CurTime = start.Add(time.Hour)
+	OnVehicleUnplugged(v, GetDB().GetVehicleState(v.VIN))
+	sessions := GetDB().GetChargingSessions(v.VIN, 10, 0)
+	assert.Len(t, sessions, 1)
+	assert.NotNil(t, sessions[0].EndedAt)
+	assert.Equal(t, 75, sessions[0].EndSoC)
+	assert.InDelta(t, 5.52, sessions[0].EnergySolar, 0.001)
+	assert.Nil(t, GetDB().GetOpenChargingInterval(v.VIN))
+}
+
+func TestChargingSession_OpenOnStartup(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := createDigestTestVehicle()
+	unplugged := &Vehicle{VIN: "456", DisplayName: "Model Y", Enabled: true, TargetSoC: 80, MaxAmps: 16, NumPhases: 3}
+	GetDB().CreateUpdateVehicle(unplugged)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+
+	OpenChargingSessions()
+	session := GetDB().GetOpenChargingSession(v.VIN)
+	assert.NotNil(t, session)
+	assert.Equal(t, 75, session.StartSoC)
+	assert.Nil(t, GetDB().GetOpenChargingSession(unplugged.VIN))
+
+	// the open session is kept on the next start
+	OpenChargingSessions()
+	assert.Equal(t, 1, GetDB().GetNumChargingSessions(v.VIN))
+	assert.Equal(t, session.ID, GetDB().GetOpenChargingSession(v.VIN).ID)
+}
+
+func TestChargingSession_RouterReadOnly(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	setDigestReferencePrice(t, 0.30)
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	start := time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = start
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+	session := StartChargingSession(v, 40)
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, start.Add(30*time.Minute))
+
+	// requesting the sessions doesn't update the open session
+	GlobalMockTime.CurTime = start.Add(2*time.Hour + 15*time.Minute)
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions/"+v.VIN, readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	var page ChargingSessionPage
+	json.Unmarshal(res.Body.Bytes(), &page)
+	assert.Len(t, page.Sessions, 1)
+	assert.Equal(t, 0.0, page.Sessions[0].EnergyGrid)
+	assert.Len(t, GetDB().GetChargingIntervalsOfSession(session.ID), 1)
+
+	// the controller's tick does
+	RefreshChargingSession(v)
+	assert.Len(t, GetDB().GetChargingIntervalsOfSession(session.ID), 3)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions/"+v.VIN, readKey, nil))
+	json.Unmarshal(res.Body.Bytes(), &page)
+	assert.InDelta(t, 19.32, page.Sessions[0].EnergyGrid, 0.001)
+}
+
+func TestChargingSession_Router(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	v := createDigestTestVehicle()
+	start := GlobalMockTime.CurTime
+	for i := 0; i < 3; i++ {
+		GlobalMockTime.CurTime = start.Add(time.Duration(i) * time.Hour)
+		StartChargingSession(v, 40+i)
+	}
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions/"+v.VIN+"?per_page=2", readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	var page ChargingSessionPage
+	json.Unmarshal(res.Body.Bytes(), &page)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 1, page.Page)
+	assert.Len(t, page.Sessions, 2)
+	// latest first
+	assert.Equal(t, 42, page.Sessions[0].StartSoC)
+	assert.Nil(t, page.Sessions[0].EndedAt)
+	assert.NotNil(t, page.Sessions[1].EndedAt)
+
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions/"+v.VIN+"?per_page=2&page=2", readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	json.Unmarshal(res.Body.Bytes(), &page)
+	assert.Len(t, page.Sessions, 1)
+	assert.Equal(t, 40, page.Sessions[0].StartSoC)
+
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions/"+v.VIN+"?page=0", readKey, nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions/unknown", readKey, nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RunCommand executes a CLI subcommand and returns the process exit code
+func RunCommand(args []string) int {
+	if len(args) == 0 {
+		return runCommandUsage()
+	}
+	var err error
+	switch args[0] {
+	case "export":
+		err = runExportCommand(args[1:])
+	case "import":
+		err = runImportCommand(args[1:])
+	case "backup":
+		err = runBackupCommand(args[1:])
+	case "reencrypt":
+		err = runReencryptCommand(args[1:])
+	case "user":
+		err = runUserCommand(args[1:])
+	case "apikey":
+		err = runAPIKeyCommand(args[1:])
+	default:
+		return runCommandUsage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func runCommandUsage() int {
+	fmt.Fprintln(os.Stderr, "Usage: chargebot [export|import|backup|reencrypt|user|apikey] [options]")
+	fmt.Fprintln(os.Stderr, "  export [-passphrase p] [-history] [-out file]  export vehicles and settings to a JSON archive")
+	fmt.Fprintln(os.Stderr, "  import [-passphrase p] file                   validate a JSON archive and merge it into the database")
+	fmt.Fprintln(os.Stderr, "  backup [-dir dir] [-keep n]                   copy the database file using SQLite's online backup")
+	fmt.Fprintln(os.Stderr, "  reencrypt                                     encrypt all secrets with the current CRYPT_KEY and CRYPT_KEY_VERSION")
+	fmt.Fprintln(os.Stderr, "  user [add|passwd] [-password p] name          create a user or set a user's password")
+	fmt.Fprintln(os.Stderr, "  user [list|delete name]                       list or delete users")
+	fmt.Fprintln(os.Stderr, "  apikey add [-scope read|surplus|full] name    create an API key")
+	fmt.Fprintln(os.Stderr, "  apikey [list|delete id]                       list or delete API keys")
+	fmt.Fprintln(os.Stderr, "The passphrase defaults to the BACKUP_PASSPHRASE environment variable.")
+	return 2
+}
+
+func initCommandDB() error {
+	GetConfig().ReadConfig()
+	GetDB().Connect()
+	GetDB().InitDBStructure()
+	return VerifyCryptKey()
+}
+
+func runExportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	passphrase := fs.String("passphrase", os.Getenv("BACKUP_PASSPHRASE"), "passphrase for encrypting secrets, secrets are not exported if empty")
+	history := fs.Bool("history", false, "include charging events and surplus history")
+	out := fs.String("out", "-", "output file, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := initCommandDB(); err != nil {
+		return err
+	}
+	archive, err := CreateBackupArchive(*passphrase, *history)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(archive)
+}
+
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	passphrase := fs.String("passphrase", os.Getenv("BACKUP_PASSPHRASE"), "passphrase the archive's secrets were encrypted with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one archive file")
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var archive *BackupArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return err
+	}
+	if err := initCommandDB(); err != nil {
+		return err
+	}
+	res, err := RestoreBackupArchive(archive, *passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d vehicles, %d settings, %d charging events, %d surplus records and %d surplus aggregates.\n",
+		res.Vehicles, res.Settings, res.ChargingEvents, res.Surpluses, res.SurplusAggregates)
+	return nil
+}
+
+func runBackupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := fs.String("dir", GetConfig().BackupDir, "target directory")
+	keep := fs.Int("keep", GetConfig().BackupKeep, "number of backups to keep, 0 keeps all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("no target directory, set -dir or BACKUP_DIR")
+	}
+	if err := initCommandDB(); err != nil {
+		return err
+	}
+	target, err := CreateLocalBackup(*dir, *keep)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Database backed up to", target)
+	return nil
+}
+
+func runReencryptCommand(args []string) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := initCommandDB(); err != nil {
+		return err
+	}
+	num, err := ReencryptSecrets()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Re-encrypted %d secrets with key version %d.\n", num, GetConfig().CryptKeyVersion)
+	return nil
+}
+
+func runUserCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing action, use add, passwd, list or delete")
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	password := fs.String("password", "", "password, read from stdin if empty")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := initCommandDB(); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		for _, user := range GetDB().GetUsers() {
+			fmt.Printf("%s\t(created %s)\n", user.Username, user.CreatedAt.Format(time.DateTime))
+		}
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one username")
+	}
+	username := fs.Arg(0)
+	switch args[0] {
+	case "add":
+		pw, err := readCommandPassword(*password)
+		if err != nil {
+			return err
+		}
+		if _, err := CreateUser(username, pw); err != nil {
+			return err
+		}
+		fmt.Println("User created:", username)
+	case "passwd":
+		user := GetDB().GetUserByName(username)
+		if user == nil {
+			return ErrUserNotFound
+		}
+		pw, err := readCommandPassword(*password)
+		if err != nil {
+			return err
+		}
+		if err := ChangePassword(user, pw); err != nil {
+			return err
+		}
+		fmt.Println("Password changed for user:", username)
+	case "delete":
+		user := GetDB().GetUserByName(username)
+		if user == nil {
+			return ErrUserNotFound
+		}
+		if err := DeleteUser(user.ID); err != nil {
+			return err
+		}
+		fmt.Println("User deleted:", username)
+	default:
+		return fmt.Errorf("unknown action '%s'", args[0])
+	}
+	return nil
+}
+
+func readCommandPassword(password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runAPIKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing action, use add, list or delete")
+	}
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	scope := fs.String("scope", string(APIKeyScopeSurplus), "read, surplus or full")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := initCommandDB(); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		for _, e := range GetDB().GetAPIKeys() {
+			lastUsed := "never"
+			if e.LastUsed != nil {
+				lastUsed = e.LastUsed.Format(time.DateTime)
+			}
+			fmt.Printf("%d\t%s\t%s\t(last used %s)\n", e.ID, e.Name, e.Scope, lastUsed)
+		}
+	case "add":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("expected exactly one name")
+		}
+		key, _, err := CreateAPIKey(fs.Arg(0), APIKeyScope(*scope))
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+	case "delete":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("expected exactly one id")
+		}
+		id, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if !GetDB().DeleteAPIKey(id) {
+			return fmt.Errorf("API key %d not found", id)
+		}
+		fmt.Println("API key deleted:", id)
+	default:
+		return fmt.Errorf("unknown action '%s'", args[0])
+	}
+	return nil
+}
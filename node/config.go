@@ -10,26 +10,109 @@ import (
 )
 
 type Config struct {
-	TeslaClientID          string
-	TeslaRefreshToken      string
-	DBFile                 string
-	Port                   int
-	Token                  string
-	TokenPassword          string
-	TelemetryEndpoint      string
-	CmdEndpoint            string
-	DevProxy               bool
-	CryptKey               string
-	TelegramToken          string
-	TelegramChatID         string
-	PlugStateAutodetection bool
-	InitDBOnly             bool
-	DemoMode               bool
-	MqttBroker             string
-	MqttClientID           string
-	MqttUsername           string
-	MqttPassword           string
-	MqttTopicSurplus       string
+	TeslaClientID            string
+	TeslaRefreshToken        string
+	DBFile                   string
+	Port                     int
+	Token                    string
+	TokenPassword            string
+	TelemetryEndpoint        string
+	CmdEndpoint              string
+	DevProxy                 bool
+	CryptKey                 string
+	CryptKeyVersion          int
+	CryptKeysOld             string
+	TelegramToken            string
+	TelegramChatID           string
+	TelegramBot              bool
+	NtfyURL                  string
+	NtfyToken                string
+	GotifyURL                string
+	GotifyToken              string
+	PushoverToken            string
+	PushoverUser             string
+	SmtpHost                 string
+	SmtpPort                 int
+	SmtpUsername             string
+	SmtpPassword             string
+	SmtpFrom                 string
+	SmtpTo                   string
+	MatrixHomeserver         string
+	MatrixToken              string
+	MatrixRoomID             string
+	DiscordWebhookURL        string
+	SlackWebhookURL          string
+	NotifyCharging           string
+	NotifyAmps               string
+	NotifyError              string
+	NotifyPlug               string
+	NotifyDigest             string
+	NotifyInfo               string
+	DigestDaily              string
+	DigestWeekly             string
+	DigestReferencePrice     float64
+	PlugStateAutodetection   bool
+	InitDBOnly               bool
+	DemoMode                 bool
+	MqttBroker               string
+	MqttClientID             string
+	MqttUsername             string
+	MqttPassword             string
+	MqttTopicSurplus         string
+	MqttQoS                  int
+	MqttKeepAlive            int
+	MqttMaxReconnectInterval int
+	MqttTLSCA                string
+	MqttTLSCert              string
+	MqttTLSKey               string
+	MqttTLSInsecure          bool
+	MqttSurplusInputs        string
+	MqttSurplusMergeWindow   int
+	MqttSurplusMaxAge        int
+	MqttPublish              bool
+	MqttCommands             bool
+	MqttTopicPrefix          string
+	MqttHADiscovery          bool
+	MqttHADiscoveryPrefix    string
+	TibberPulse              bool
+	TibberPulseToken         string
+	TibberPulseHomeID        string
+	TibberPulseInterval      int
+	PriceCoverageMinHours    int
+	CarbonProvider           string
+	CarbonEndpoint           string
+	CarbonToken              string
+	CarbonZone               string
+	ModbusHost               string
+	ModbusInverterUnitID     int
+	ModbusMeterUnitID        int
+	ModbusBaseAddress        int
+	ModbusInterval           int
+	ModbusMode               string
+	ModbusMeterInvert        bool
+	HTTPPollValues           string
+	HTTPPollFormula          string
+	HTTPPollInterval         int
+	HTTPPollGridMeter        bool
+	GridMeterMode            bool
+	SurplusStaleMinutes      int
+	SurplusStaleAction       string
+	SurplusStaleMinAmps      int
+	MaintenanceInterval      int
+	RetentionSurplusRawHours int
+	RetentionSurplusMinDays  int
+	RetentionSurplusHourDays int
+	RetentionLogsDays        int
+	RetentionPricesDays      int
+	VacuumIntervalDays       int
+	BackupDir                string
+	BackupInterval           int
+	BackupKeep               int
+	AuthEnabled              bool
+	AuthSessionDays          int
+	AuthAnonymousSurplus     string
+	WebhookMaxAttempts       int
+	WebhookTimeout           int
 }
 
 var _configInstance *Config
@@ -60,8 +143,37 @@ func (c *Config) ReadConfig() {
 	c.CmdEndpoint = strings.ReplaceAll(c.CmdEndpoint, "{token}", c.Token)
 	c.DevProxy = (c.getEnv("DEV_PROXY", "0") == "1")
 	c.CryptKey = c.getEnv("CRYPT_KEY", "")
+	c.CryptKeyVersion = c.getEnvInt("CRYPT_KEY_VERSION", "1")
+	c.CryptKeysOld = c.getEnv("CRYPT_KEYS_OLD", "")
 	c.TelegramToken = c.getEnv("TELEGRAM_TOKEN", "")
 	c.TelegramChatID = c.getEnv("TELEGRAM_CHAT_ID", "")
+	c.TelegramBot = (c.getEnv("TELEGRAM_BOT", "0") == "1")
+	c.NtfyURL = c.getEnv("NTFY_URL", "")
+	c.NtfyToken = c.getEnv("NTFY_TOKEN", "")
+	c.GotifyURL = c.getEnv("GOTIFY_URL", "")
+	c.GotifyToken = c.getEnv("GOTIFY_TOKEN", "")
+	c.PushoverToken = c.getEnv("PUSHOVER_TOKEN", "")
+	c.PushoverUser = c.getEnv("PUSHOVER_USER", "")
+	c.SmtpHost = c.getEnv("SMTP_HOST", "")
+	c.SmtpPort = c.getEnvInt("SMTP_PORT", "587")
+	c.SmtpUsername = c.getEnv("SMTP_USERNAME", "")
+	c.SmtpPassword = c.getEnv("SMTP_PASSWORD", "")
+	c.SmtpFrom = c.getEnv("SMTP_FROM", "")
+	c.SmtpTo = c.getEnv("SMTP_TO", "")
+	c.MatrixHomeserver = c.getEnv("MATRIX_HOMESERVER", "")
+	c.MatrixToken = c.getEnv("MATRIX_TOKEN", "")
+	c.MatrixRoomID = c.getEnv("MATRIX_ROOM_ID", "")
+	c.DiscordWebhookURL = c.getEnv("DISCORD_WEBHOOK_URL", "")
+	c.SlackWebhookURL = c.getEnv("SLACK_WEBHOOK_URL", "")
+	c.NotifyCharging = c.getEnv("NOTIFY_CHARGING", "")
+	c.NotifyAmps = c.getEnv("NOTIFY_AMPS", "")
+	c.NotifyError = c.getEnv("NOTIFY_ERROR", "")
+	c.NotifyPlug = c.getEnv("NOTIFY_PLUG", "")
+	c.NotifyDigest = c.getEnv("NOTIFY_DIGEST", "")
+	c.NotifyInfo = c.getEnv("NOTIFY_INFO", "")
+	c.DigestDaily = c.getEnv("DIGEST_DAILY", "")
+	c.DigestWeekly = c.getEnv("DIGEST_WEEKLY", "")
+	c.DigestReferencePrice = c.getEnvFloat("DIGEST_REFERENCE_PRICE", "0")
 	c.PlugStateAutodetection = (c.getEnv("PLUG_AUTODETECT", "1") == "1")
 	c.InitDBOnly = (c.getEnv("INIT_DB_ONLY", "0") == "1")
 	c.DemoMode = (c.getEnv("DEMO_MODE", "0") == "1")
@@ -70,6 +182,80 @@ func (c *Config) ReadConfig() {
 	c.MqttUsername = c.getEnv("MQTT_USERNAME", "")
 	c.MqttPassword = c.getEnv("MQTT_PASSWORD", "")
 	c.MqttTopicSurplus = c.getEnv("MQTT_TOPIC_SURPLUS", "chargebot/surplus")
+	c.MqttQoS = c.getEnvInt("MQTT_QOS", "0")
+	if c.MqttQoS < 0 || c.MqttQoS > 2 {
+		log.Panicln("MQTT_QOS must be 0, 1 or 2")
+	}
+	c.MqttKeepAlive = c.getEnvInt("MQTT_KEEPALIVE", "30")
+	c.MqttMaxReconnectInterval = c.getEnvInt("MQTT_MAX_RECONNECT_INTERVAL", "300")
+	c.MqttTLSCA = c.getEnv("MQTT_TLS_CA", "")
+	c.MqttTLSCert = c.getEnv("MQTT_TLS_CERT", "")
+	c.MqttTLSKey = c.getEnv("MQTT_TLS_KEY", "")
+	c.MqttTLSInsecure = (c.getEnv("MQTT_TLS_INSECURE", "0") == "1")
+	c.MqttSurplusInputs = c.getEnv("MQTT_SURPLUS_INPUTS", "")
+	c.MqttSurplusMergeWindow = c.getEnvInt("MQTT_SURPLUS_MERGE_WINDOW", "2000")
+	c.MqttSurplusMaxAge = c.getEnvPositiveInt("MQTT_SURPLUS_MAX_AGE", "120")
+	c.MqttPublish = (c.getEnv("MQTT_PUBLISH", "1") == "1")
+	c.MqttCommands = (c.getEnv("MQTT_COMMANDS", "0") == "1")
+	c.MqttTopicPrefix = c.getEnv("MQTT_TOPIC_PREFIX", "chargebot")
+	c.MqttHADiscovery = (c.getEnv("MQTT_HA_DISCOVERY", "0") == "1")
+	c.MqttHADiscoveryPrefix = c.getEnv("MQTT_HA_DISCOVERY_PREFIX", "homeassistant")
+	c.TibberPulse = (c.getEnv("TIBBER_PULSE", "0") == "1")
+	c.TibberPulseToken = c.getEnv("TIBBER_PULSE_TOKEN", "")
+	c.TibberPulseHomeID = c.getEnv("TIBBER_PULSE_HOME_ID", "")
+	tibberPulseInterval, err := strconv.Atoi(c.getEnv("TIBBER_PULSE_INTERVAL", "30"))
+	if err != nil {
+		log.Panicln("TIBBER_PULSE_INTERVAL must be numeric")
+	}
+	c.TibberPulseInterval = tibberPulseInterval
+	priceCoverageMinHours, err := strconv.Atoi(c.getEnv("PRICE_COVERAGE_MIN_HOURS", "4"))
+	if err != nil {
+		log.Panicln("PRICE_COVERAGE_MIN_HOURS must be numeric")
+	}
+	c.PriceCoverageMinHours = priceCoverageMinHours
+	c.CarbonProvider = c.getEnv("CARBON_PROVIDER", "")
+	c.CarbonEndpoint = c.getEnv("CARBON_ENDPOINT", "https://api.electricitymap.org/v3")
+	c.CarbonToken = c.getEnv("CARBON_TOKEN", "")
+	c.CarbonZone = c.getEnv("CARBON_ZONE", "DE")
+	c.ModbusHost = c.getEnv("MODBUS_HOST", "")
+	c.ModbusInverterUnitID = c.getEnvInt("MODBUS_INVERTER_UNIT_ID", "1")
+	c.ModbusMeterUnitID = c.getEnvInt("MODBUS_METER_UNIT_ID", "1")
+	c.ModbusBaseAddress = c.getEnvInt("MODBUS_BASE_ADDRESS", "40000")
+	c.ModbusInterval = c.getEnvPositiveInt("MODBUS_INTERVAL", "30")
+	c.ModbusMode = c.getEnv("MODBUS_MODE", ModbusSurplusModeGrid)
+	if c.ModbusMode != ModbusSurplusModeGrid && c.ModbusMode != ModbusSurplusModeConsumption {
+		log.Panicln("MODBUS_MODE must be 'grid' or 'consumption'")
+	}
+	c.ModbusMeterInvert = (c.getEnv("MODBUS_METER_INVERT", "0") == "1")
+	c.HTTPPollValues = c.getEnv("HTTP_POLL_VALUES", "")
+	c.HTTPPollFormula = c.getEnv("HTTP_POLL_FORMULA", "")
+	c.HTTPPollInterval = c.getEnvPositiveInt("HTTP_POLL_INTERVAL", "30")
+	c.HTTPPollGridMeter = (c.getEnv("HTTP_POLL_GRID_METER", "0") == "1")
+	c.GridMeterMode = (c.getEnv("GRID_METER_MODE", "0") == "1")
+	c.SurplusStaleMinutes = c.getEnvInt("SURPLUS_STALE_MINUTES", "10")
+	c.SurplusStaleAction = c.getEnv("SURPLUS_STALE_ACTION", SurplusStaleActionStop)
+	if c.SurplusStaleAction != SurplusStaleActionStop && c.SurplusStaleAction != SurplusStaleActionHold && c.SurplusStaleAction != SurplusStaleActionMinimum {
+		log.Panicln("SURPLUS_STALE_ACTION must be 'stop', 'hold' or 'min'")
+	}
+	c.SurplusStaleMinAmps = c.getEnvInt("SURPLUS_STALE_MIN_AMPS", "5")
+	c.MaintenanceInterval = c.getEnvInt("MAINTENANCE_INTERVAL", "6")
+	c.RetentionSurplusRawHours = c.getEnvInt("RETENTION_SURPLUS_RAW_HOURS", "48")
+	c.RetentionSurplusMinDays = c.getEnvInt("RETENTION_SURPLUS_MINUTE_DAYS", "30")
+	c.RetentionSurplusHourDays = c.getEnvInt("RETENTION_SURPLUS_HOUR_DAYS", "730")
+	c.RetentionLogsDays = c.getEnvInt("RETENTION_LOGS_DAYS", "365")
+	c.RetentionPricesDays = c.getEnvInt("RETENTION_PRICES_DAYS", "90")
+	c.VacuumIntervalDays = c.getEnvInt("VACUUM_INTERVAL_DAYS", "7")
+	c.BackupDir = c.getEnv("BACKUP_DIR", "")
+	c.BackupInterval = c.getEnvInt("BACKUP_INTERVAL", "24")
+	c.BackupKeep = c.getEnvInt("BACKUP_KEEP", "7")
+	c.AuthEnabled = (c.getEnv("AUTH_ENABLED", "1") == "1")
+	c.AuthSessionDays = c.getEnvInt("AUTH_SESSION_DAYS", "30")
+	c.AuthAnonymousSurplus = c.getEnv("AUTH_ANONYMOUS_SURPLUS", AuthAnonymousSurplusAuto)
+	if c.AuthAnonymousSurplus != AuthAnonymousSurplusAuto && c.AuthAnonymousSurplus != AuthAnonymousSurplusAlways && c.AuthAnonymousSurplus != AuthAnonymousSurplusNever {
+		log.Panicln("AUTH_ANONYMOUS_SURPLUS must be 'auto', '1' or '0'")
+	}
+	c.WebhookMaxAttempts = c.getEnvInt("WEBHOOK_MAX_ATTEMPTS", "8")
+	c.WebhookTimeout = c.getEnvInt("WEBHOOK_TIMEOUT", "10")
 }
 
 func (c *Config) Print() {
@@ -84,3 +270,28 @@ func (c *Config) getEnv(key, defaultValue string) string {
 	}
 	return res
 }
+
+func (c *Config) getEnvInt(key, defaultValue string) int {
+	res, err := strconv.Atoi(c.getEnv(key, defaultValue))
+	if err != nil {
+		log.Panicf("%s must be numeric\n", key)
+	}
+	return res
+}
+
+// getEnvPositiveInt is for values which must be greater than zero, i.e. intervals
+func (c *Config) getEnvPositiveInt(key, defaultValue string) int {
+	res := c.getEnvInt(key, defaultValue)
+	if res <= 0 {
+		log.Panicf("%s must be positive\n", key)
+	}
+	return res
+}
+
+func (c *Config) getEnvFloat(key, defaultValue string) float64 {
+	res, err := strconv.ParseFloat(c.getEnv(key, defaultValue), 64)
+	if err != nil {
+		log.Panicf("%s must be numeric\n", key)
+	}
+	return res
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	. "github.com/virtualzone/chargebot/goshared"
+)
+
+type DBMigration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// DBMigrations lists all schema changes in the order they are applied.
+// Never modify or reorder existing migrations, always append new ones.
+var DBMigrations = []*DBMigration{
+	{1, "initial schema", MigrateExec(`
+create table if not exists settings(key text primary key, value text default '');
+create table if not exists vehicles(vin text primary key, display_name text, enabled int, target_soc int, max_amps int, surplus_charging int, min_surplus int, min_chargetime int, lowcost_charging int, max_price int, tibber_token text, num_phases int default 3, grid_provider text default 'tibber', grid_strategy int default 1, depart_days text default '12345', depart_time text default '07:00', telemetry_enroll_date string default '');
+create table if not exists surpluses(ts text, surplus_watts int);
+create table if not exists logs(vehicle_vin text, ts text, event_id int, details text);
+create table if not exists vehicle_states(vehicle_vin text primary key, plugged_in int default 0, charging int default 0, soc int default -1, charge_amps int default 0, charge_limit int default 0, is_home int default 0);
+create table if not exists tibber_prices(vehicle_vin text not null, hourstamp int not null, price real, primary key(vehicle_vin, hourstamp));
+create table if not exists grid_hourblocks(vehicle_vin int text null, hourstamp int not null, primary key(vehicle_vin, hourstamp));
+`)},
+	{2, "add vehicles.surplus_buffer", MigrateAddColumn("vehicles", "surplus_buffer", "int default 0")},
+	{3, "add vehicles.grid_fallback_hours", MigrateAddColumn("vehicles", "grid_fallback_hours", "int default 0")},
+	{4, "add price_source_health", MigrateExec(`
+create table if not exists price_source_health(vehicle_vin text primary key, grid_provider text, last_success text default '', last_error_ts text default '', last_error text default '', fail_count int default 0, coverage_notified int default 0);
+`)},
+	{5, "add carbon_intensities", MigrateExec(`
+create table if not exists carbon_intensities(zone text not null, hourstamp int not null, intensity real, primary key(zone, hourstamp));
+`)},
+	{6, "add vehicles.grid_optimization", MigrateAddColumn("vehicles", "grid_optimization", "text default 'cost'")},
+	{7, "add vehicles.carbon_weight", MigrateAddColumn("vehicles", "carbon_weight", "int default 50")},
+	{8, "add vehicle_states.charge_now", MigrateAddColumn("vehicle_states", "charge_now", "int default 0")},
+	{9, "add surpluses.vehicle_watts", MigrateAddColumn("surpluses", "vehicle_watts", "int default null")},
+	{10, "add vehicle_states.surplus_stale", MigrateAddColumn("vehicle_states", "surplus_stale", "int default 0")},
+	{11, "add surplus_aggregates", MigrateExec(`
+create table if not exists surplus_aggregates(resolution text not null, ts text not null, avg_watts int, min_watts int, max_watts int, samples int, primary key(resolution, ts));
+create index if not exists idx_surpluses_ts on surpluses(ts);
+`)},
+	{12, "add users, sessions and api_keys", MigrateExec(`
+create table if not exists users(id integer primary key autoincrement, username text not null unique, password_hash text not null, created_at text);
+create table if not exists sessions(token_hash text primary key, user_id int not null, created_at text, expires_at text);
+create table if not exists api_keys(id integer primary key autoincrement, name text, key_hash text not null unique, scope text not null, created_at text, last_used text default '');
+`)},
+	{13, "add webhooks and webhook_deliveries", MigrateExec(`
+create table if not exists webhooks(id integer primary key autoincrement, name text, url text not null, secret text default '', events text default '', headers text default '', enabled int default 1, created_at text);
+create table if not exists webhook_deliveries(id integer primary key autoincrement, webhook_id int not null, event text, payload text, status text not null, attempts int default 0, response_code int default 0, error text default '', created_at text, last_attempt text default '', next_attempt text default '');
+create index if not exists idx_webhook_deliveries_status on webhook_deliveries(status, next_attempt);
+`)},
+	{14, "add vehicle_states.charge_now_soc", MigrateAddColumn("vehicle_states", "charge_now_soc", "int default 0")},
+	{15, "add vehicle_states.paused_until", MigrateAddColumn("vehicle_states", "paused_until", "text default ''")},
+	{16, "add charging_sessions", MigrateExec(`
+create table if not exists charging_sessions(id integer primary key autoincrement, vehicle_vin text not null, started_at text not null, ended_at text default '', start_soc int default -1, end_soc int default -1, energy_solar real default 0, energy_grid real default 0, cost real default null, energy_measured real default 0, measured_at text default '');
+create index if not exists idx_charging_sessions_vin on charging_sessions(vehicle_vin, started_at);
+`)},
+	{17, "key price_source_health by price source", MigrateSteps(MigrateExec(`
+drop table if exists price_source_health;
+create table price_source_health(source text primary key, grid_provider text, last_success text default '', last_error_ts text default '', last_error text default '', fail_count int default 0);
+`), MigrateAddColumn("vehicle_states", "price_coverage_notified", "int default 0"))},
+	{18, "add surpluses.vehicle_draws", MigrateAddColumn("surpluses", "vehicle_draws", "text default ''")},
+	{19, "add surplus_aggregates.avg_vehicle_watts", MigrateAddColumn("surplus_aggregates", "avg_vehicle_watts", "int")},
+	{20, "add charging_intervals", MigrateExec(`
+create table if not exists charging_intervals(id integer primary key autoincrement, session_id int default 0, vehicle_vin text not null, started_at text not null, ended_at text default '', source int, amps int, price real default null);
+create index if not exists idx_charging_intervals_vin on charging_intervals(vehicle_vin, started_at);
+create index if not exists idx_charging_intervals_session on charging_intervals(session_id);
+`)},
+	// nodes which were in use before authentication keep accepting surplus pushes of existing scripts
+	{21, "keep anonymous surplus pushes on upgraded databases", MigrateExec(`
+insert or replace into settings (key, value) select 'auth_anonymous_surplus', '1'
+where not exists (select 1 from users) and not exists (select 1 from api_keys)
+and (exists (select 1 from vehicles) or exists (select 1 from surpluses));
+`)},
+	{22, "add charging_sessions.emissions", MigrateAddColumn("charging_sessions", "emissions", "real default null")},
+}
+
+func GetLatestSchemaVersion() int {
+	return DBMigrations[len(DBMigrations)-1].Version
+}
+
+func (db *DB) GetSchemaVersion() int {
+	var version sql.NullInt64
+	if err := db.GetConnection().QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		log.Panicln(err)
+	}
+	return int(version.Int64)
+}
+
+// isEmpty checks whether the database doesn't contain any tables yet, except for the schema version
+func (db *DB) isEmpty() bool {
+	var num int
+	if err := db.GetConnection().QueryRow("select count(*) from sqlite_master where type = 'table' and name != 'schema_version'").Scan(&num); err != nil {
+		log.Panicln(err)
+	}
+	return num == 0
+}
+
+// Migrate applies all pending migrations, each in its own transaction.
+// Before migrating an existing database, a backup copy of the database file is created.
+func (db *DB) Migrate() {
+	if _, err := db.GetConnection().Exec("create table if not exists schema_version(version int primary key, description text, applied_at text)"); err != nil {
+		log.Panicln(err)
+	}
+	version := db.GetSchemaVersion()
+	latest := GetLatestSchemaVersion()
+	if version > latest {
+		log.Panicf("Database schema version %d is newer than version %d supported by this release, please upgrade chargebot\n", version, latest)
+	}
+	if version == latest {
+		return
+	}
+	if !db.isEmpty() {
+		if err := db.backupBeforeMigration(version); err != nil {
+			log.Panicf("Could not back up database before migrating: %s\n", err.Error())
+		}
+	}
+	for _, m := range DBMigrations {
+		if m.Version <= version {
+			continue
+		}
+		log.Printf("Migrating database to schema version %d (%s)...\n", m.Version, m.Description)
+		if err := db.applyMigration(m); err != nil {
+			log.Panicf("Migration to schema version %d failed: %s\n", m.Version, err.Error())
+		}
+	}
+}
+
+func (db *DB) backupBeforeMigration(version int) error {
+	file := GetConfig().DBFile
+	if file == "" || strings.HasPrefix(file, ":memory:") {
+		return nil
+	}
+	target := fmt.Sprintf("%s.v%d-%s.bak", file, version, db.Time.UTCNow().Format("20060102150405"))
+	log.Printf("Backing up database to %s...\n", target)
+	return db.Backup(target)
+}
+
+func (db *DB) applyMigration(m *DBMigration) error {
+	return ApplyMigration(db.GetConnection(), m.Version, m.Description, m.Up, db.formatSqliteDatetime(db.Time.UTCNow()))
+}
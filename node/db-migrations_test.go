@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	. "github.com/virtualzone/chargebot/goshared"
+)
+
+func newMigrationTestDB(t *testing.T) *DB {
+	dbFile := GetConfig().DBFile
+	GetConfig().DBFile = filepath.Join(t.TempDir(), "chargebot.db")
+	db := &DB{Time: GlobalMockTime}
+	db.Connect()
+	t.Cleanup(func() {
+		db.GetConnection().Close()
+		GetConfig().DBFile = dbFile
+	})
+	return db
+}
+
+func TestDBMigrations_Empty(t *testing.T) {
+	db := newMigrationTestDB(t)
+	db.Migrate()
+	assert.Equal(t, GetLatestSchemaVersion(), db.GetSchemaVersion())
+	var num int
+	db.GetConnection().QueryRow("select count(*) from settings where key = ?", SettingAnonymousSurplus).Scan(&num)
+	assert.Equal(t, 0, num)
+
+	// no backup for a new database
+	files, _ := filepath.Glob(GetConfig().DBFile + ".*.bak")
+	assert.Len(t, files, 0)
+
+	// running again doesn't change anything
+	db.Migrate()
+	assert.Equal(t, GetLatestSchemaVersion(), db.GetSchemaVersion())
+}
+
+func TestDBMigrations_Legacy(t *testing.T) {
+	db := newMigrationTestDB(t)
+	// database created before schema versioning, containing some of the later columns
+	_, err := db.GetConnection().Exec(`
+create table settings(key text primary key, value text default '');
+create table vehicles(vin text primary key, display_name text, enabled int, target_soc int, max_amps int, surplus_charging int, min_surplus int, min_chargetime int, lowcost_charging int, max_price int, tibber_token text, num_phases int default 3, grid_provider text default 'tibber', grid_strategy int default 1, depart_days text default '12345', depart_time text default '07:00', telemetry_enroll_date string default '', surplus_buffer int default 0);
+create table surpluses(ts text, surplus_watts int);
+create table vehicle_states(vehicle_vin text primary key, plugged_in int default 0, charging int default 0, soc int default -1, charge_amps int default 0, charge_limit int default 0, is_home int default 0, price_coverage_notified int default 0);
+insert into vehicles (vin, display_name, surplus_buffer) values ('123', 'Car', 500);
+`)
+	assert.Nil(t, err)
+
+	db.Migrate()
+	assert.Equal(t, GetLatestSchemaVersion(), db.GetSchemaVersion())
+
+	var surplusBuffer, carbonWeight int
+	err = db.GetConnection().QueryRow("select surplus_buffer, carbon_weight from vehicles where vin = '123'").Scan(&surplusBuffer, &carbonWeight)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, surplusBuffer)
+	assert.Equal(t, 50, carbonWeight)
+
+	var num int
+	db.GetConnection().QueryRow("select count(*) from pragma_table_info('vehicle_states') where name = 'price_coverage_notified'").Scan(&num)
+	assert.Equal(t, 1, num)
+
+	// existing surplus scripts keep working without an API key
+	var anonymousSurplus string
+	err = db.GetConnection().QueryRow("select value from settings where key = ?", SettingAnonymousSurplus).Scan(&anonymousSurplus)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", anonymousSurplus)
+
+	files, _ := filepath.Glob(GetConfig().DBFile + ".v0-*.bak")
+	assert.Len(t, files, 1)
+}
+
+func TestDBMigrations_NewerVersion(t *testing.T) {
+	db := newMigrationTestDB(t)
+	db.Migrate()
+	_, err := db.GetConnection().Exec("insert into schema_version (version, description, applied_at) values (?, 'future', '')", GetLatestSchemaVersion()+1)
+	assert.Nil(t, err)
+	assert.Panics(t, func() {
+		db.Migrate()
+	})
+}
+
+func TestDBMigrations_Rollback(t *testing.T) {
+	db := newMigrationTestDB(t)
+	db.Migrate()
+	migrations := DBMigrations
+	t.Cleanup(func() {
+		DBMigrations = migrations
+	})
+	DBMigrations = append(migrations, &DBMigration{GetLatestSchemaVersion() + 1, "failing", MigrateExec(`
+create table test_rollback(id int);
+insert into unknown_table values (1);
+`)})
+	assert.Panics(t, func() {
+		db.Migrate()
+	})
+	assert.Equal(t, migrations[len(migrations)-1].Version, db.GetSchemaVersion())
+	var num int
+	db.GetConnection().QueryRow("select count(*) from sqlite_master where name = 'test_rollback'").Scan(&num)
+	assert.Equal(t, 0, num)
+}
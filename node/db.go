@@ -1,47 +1,61 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"context"
 	"database/sql"
-	"encoding/base64"
-	"io"
+	"encoding/json"
+	"errors"
 	"log"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 )
 
 var SQLITE_DATETIME_LAYOUT string = "2006-01-02 15:04:05"
 
 type Vehicle struct {
-	VIN                 string       `json:"vin"`
-	DisplayName         string       `json:"display_name"`
-	Enabled             bool         `json:"enabled"`
-	TargetSoC           int          `json:"target_soc"`
-	MaxAmps             int          `json:"max_amps"`
-	NumPhases           int          `json:"num_phases"`
-	SurplusCharging     bool         `json:"surplus_charging"`
-	MinSurplus          int          `json:"min_surplus"`
-	SurplusBuffer       int          `json:"surplus_buffer"`
-	MinChargeTime       int          `json:"min_chargetime"`
-	LowcostCharging     bool         `json:"lowcost_charging"`
-	MaxPrice            int          `json:"max_price"`
-	GridProvider        GridProvider `json:"gridProvider"`
-	GridStrategy        GridStrategy `json:"gridStrategy"`
-	DepartDays          string       `json:"departDays"`
-	DepartTime          string       `json:"departTime"`
-	TibberToken         string       `json:"tibber_token"`
-	TelemetryEnrollDate *time.Time   `json:"telemetry_enroll_date"`
+	VIN                 string                 `json:"vin"`
+	DisplayName         string                 `json:"display_name"`
+	Enabled             bool                   `json:"enabled"`
+	TargetSoC           int                    `json:"target_soc"`
+	MaxAmps             int                    `json:"max_amps"`
+	NumPhases           int                    `json:"num_phases"`
+	SurplusCharging     bool                   `json:"surplus_charging"`
+	MinSurplus          int                    `json:"min_surplus"`
+	SurplusBuffer       int                    `json:"surplus_buffer"`
+	MinChargeTime       int                    `json:"min_chargetime"`
+	LowcostCharging     bool                   `json:"lowcost_charging"`
+	MaxPrice            int                    `json:"max_price"`
+	GridProvider        GridProvider           `json:"gridProvider"`
+	GridStrategy        GridStrategy           `json:"gridStrategy"`
+	DepartDays          string                 `json:"departDays"`
+	DepartTime          string                 `json:"departTime"`
+	GridFallbackHours   int                    `json:"gridFallbackHours"`
+	GridOptimization    GridOptimizationTarget `json:"gridOptimization"`
+	CarbonWeight        int                    `json:"carbonWeight"`
+	TibberToken         string                 `json:"tibber_token"`
+	TelemetryEnrollDate *time.Time             `json:"telemetry_enroll_date"`
 }
 
 type SurplusRecord struct {
 	Timestamp    time.Time `json:"ts"`
 	SurplusWatts int       `json:"surplus_watts"`
+	VehicleWatts *int      `json:"vehicle_watts,omitempty"` // solar charging draw already included in SurplusWatts (grid meter mode)
+	// VehicleDraws is each vehicle's share of VehicleWatts by VIN
+	VehicleDraws map[string]int `json:"-"`
+}
+
+type SurplusAggregate struct {
+	Timestamp time.Time `json:"ts"`
+	AvgWatts  int       `json:"avg_watts"`
+	MinWatts  int       `json:"min_watts"`
+	MaxWatts  int       `json:"max_watts"`
+	Samples   int       `json:"samples"`
+	// AvgVehicleWatts is the average solar charging draw included in AvgWatts (grid meter mode)
+	AvgVehicleWatts *int `json:"avg_vehicle_watts,omitempty"`
 }
 
 type ChargeState int
@@ -66,14 +80,41 @@ const (
 	GridProviderTibber GridProvider = "tibber"
 )
 
+// PriceSourceHealth is tracked per price source, i.e. per Tibber token, as vehicles may share a source.
+// VIN, CoverageHours and CoverageNotified refer to the vehicle the health was retrieved for.
+type PriceSourceHealth struct {
+	Source           string       `json:"source"`
+	VIN              string       `json:"vehicle_vin"`
+	GridProvider     GridProvider `json:"gridProvider"`
+	LastSuccess      *time.Time   `json:"last_success"`
+	LastErrorTime    *time.Time   `json:"last_error_ts"`
+	LastError        string       `json:"last_error"`
+	FailCount        int          `json:"fail_count"`
+	CoverageHours    int          `json:"coverage_hours"`
+	CoverageNotified bool         `json:"coverage_notified"`
+}
+
+type GridOptimizationTarget string
+
+const (
+	GridOptimizationCost   GridOptimizationTarget = "cost"
+	GridOptimizationCarbon GridOptimizationTarget = "carbon"
+	GridOptimizationMixed  GridOptimizationTarget = "mixed"
+)
+
 type VehicleState struct {
-	VIN         string      `json:"vehicle_vin"`
-	PluggedIn   bool        `json:"pluggedIn"`
-	Charging    ChargeState `json:"chargingState"`
-	SoC         int         `json:"soc"`
-	Amps        int         `json:"amps"`
-	ChargeLimit int         `json:"chargeLimit"`
-	IsHome      bool        `json:"is_home"`
+	VIN          string      `json:"vehicle_vin"`
+	PluggedIn    bool        `json:"pluggedIn"`
+	Charging     ChargeState `json:"chargingState"`
+	SoC          int         `json:"soc"`
+	Amps         int         `json:"amps"`
+	ChargeLimit  int         `json:"chargeLimit"`
+	IsHome       bool        `json:"is_home"`
+	ChargeNow    bool        `json:"chargeNow"`
+	SurplusStale bool        `json:"surplusStale"`
+	// ChargeNowSoC overrides the vehicle's target SoC while charging now, 0 if not set
+	ChargeNowSoC int        `json:"chargeNowSoc"`
+	PausedUntil  *time.Time `json:"pausedUntil"`
 }
 
 type ChargingEvent struct {
@@ -92,13 +133,130 @@ const (
 	LogEventSetTargetSoC         = 7
 	LogEventSetChargingAmps      = 8
 	LogEventSetScheduledCharging = 9
+	LogEventSurplusStale         = 10
+	LogEventSurplusRecovered     = 11
+)
+
+const (
+	SettingRefreshToken     = "refresh_token"
+	SettingsPermanentError  = "permanent_error"
+	SettingLastVacuum       = "last_vacuum"
+	SettingLastDigestDaily  = "last_digest_daily"
+	SettingLastDigestWeekly = "last_digest_weekly"
+	SettingAnonymousSurplus = "auth_anonymous_surplus"
+)
+
+const (
+	SurplusResolutionMinute = "minute"
+	SurplusResolutionHour   = "hour"
+)
+
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type APIKeyScope string
+
+const (
+	APIKeyScopeRead    APIKeyScope = "read"
+	APIKeyScopeSurplus APIKeyScope = "surplus"
+	APIKeyScopeFull    APIKeyScope = "full"
+)
+
+type APIKey struct {
+	ID        int         `json:"id"`
+	Name      string      `json:"name"`
+	Scope     APIKeyScope `json:"scope"`
+	CreatedAt time.Time   `json:"created_at"`
+	LastUsed  *time.Time  `json:"last_used"`
+}
+
+type WebhookEvent string
+
+const (
+	WebhookEventPluggedIn        WebhookEvent = "plugged_in"
+	WebhookEventUnplugged        WebhookEvent = "unplugged"
+	WebhookEventChargeStarted    WebhookEvent = "charge_started"
+	WebhookEventChargeStopped    WebhookEvent = "charge_stopped"
+	WebhookEventAmpsChanged      WebhookEvent = "amps_changed"
+	WebhookEventTargetReached    WebhookEvent = "target_reached"
+	WebhookEventPermanentError   WebhookEvent = "permanent_error"
+	WebhookEventSurplusStale     WebhookEvent = "surplus_stale"
+	WebhookEventSurplusRecovered WebhookEvent = "surplus_recovered"
+	WebhookEventPriceCoverage    WebhookEvent = "price_coverage"
+	WebhookEventTest             WebhookEvent = "test"
 )
 
+type Webhook struct {
+	ID        int               `json:"id"`
+	Name      string            `json:"name"`
+	URL       string            `json:"url"`
+	Secret    string            `json:"-"`
+	HasSecret bool              `json:"has_secret"`
+	Events    []WebhookEvent    `json:"events"`
+	Headers   map[string]string `json:"headers"`
+	Enabled   bool              `json:"enabled"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type WebhookDeliveryStatus string
+
 const (
-	SettingRefreshToken    = "refresh_token"
-	SettingsPermanentError = "permanent_error"
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
 )
 
+type WebhookDelivery struct {
+	ID           int                   `json:"id"`
+	WebhookID    int                   `json:"webhook_id"`
+	Event        WebhookEvent          `json:"event"`
+	Payload      string                `json:"payload"`
+	Status       WebhookDeliveryStatus `json:"status"`
+	Attempts     int                   `json:"attempts"`
+	ResponseCode int                   `json:"response_code"`
+	Error        string                `json:"error"`
+	CreatedAt    time.Time             `json:"created_at"`
+	LastAttempt  *time.Time            `json:"last_attempt"`
+	NextAttempt  *time.Time            `json:"next_attempt"`
+}
+
+// ChargingSession lasts from plugging in to unplugging the vehicle.
+// SoCs are -1 if unknown, the cost is nil if no price is known for the grid energy.
+type ChargingSession struct {
+	ID             int        `json:"id"`
+	VIN            string     `json:"vin"`
+	StartedAt      time.Time  `json:"started_at"`
+	EndedAt        *time.Time `json:"ended_at"`
+	StartSoC       int        `json:"start_soc"`
+	EndSoC         int        `json:"end_soc"`
+	EnergySolar    float64    `json:"energy_solar_kwh"`
+	EnergyGrid     float64    `json:"energy_grid_kwh"`
+	Measured       bool       `json:"measured"`
+	Cost           *float64   `json:"cost"`
+	GridPrice      *float64   `json:"grid_price"`
+	Emissions      *float64   `json:"emissions_grams"`
+	EnergyMeasured float64    `json:"-"`
+	MeasuredAt     *time.Time `json:"-"`
+}
+
+// ChargingInterval is a period of charging from one source with constant amps, recorded by the charge controller.
+// Grid intervals don't span more than one hour, so the price per kWh is known for the whole interval.
+// The price is nil for solar intervals or if no grid price is known.
+type ChargingInterval struct {
+	ID        int
+	SessionID int
+	VIN       string
+	StartedAt time.Time
+	EndedAt   *time.Time
+	Source    ChargeState
+	Amps      int
+	Price     *float64
+}
+
 type DB struct {
 	Connection *sql.DB
 	Time       Time
@@ -131,6 +289,39 @@ func (db *DB) GetConnection() *sql.DB {
 	return db.Connection
 }
 
+// Backup copies the database to the target file using SQLite's online backup,
+// so other connections can continue reading and writing in the meantime
+func (db *DB) Backup(target string) error {
+	con, err := db.GetConnection().Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+	return con.Raw(func(driverConn any) error {
+		c, ok := driverConn.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("database driver doesn't support online backups")
+		}
+		backup, err := c.NewBackup(target)
+		if err != nil {
+			return err
+		}
+		for {
+			more, err := backup.Step(100)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			if !more {
+				break
+			}
+		}
+		return backup.Finish()
+	})
+}
+
 func (db *DB) ResetDBStructure() {
 	log.Println("Resetting database...")
 	_, err := db.GetConnection().Exec(`
@@ -141,6 +332,17 @@ drop table if exists logs;
 drop table if exists vehicle_states;
 drop table if exists tibber_prices;
 drop table if exists grid_hourblocks;
+drop table if exists price_source_health;
+drop table if exists carbon_intensities;
+drop table if exists surplus_aggregates;
+drop table if exists users;
+drop table if exists sessions;
+drop table if exists api_keys;
+drop table if exists webhooks;
+drop table if exists webhook_deliveries;
+drop table if exists charging_sessions;
+drop table if exists charging_intervals;
+drop table if exists schema_version;
 `)
 	if err != nil {
 		log.Panicln(err)
@@ -149,27 +351,17 @@ drop table if exists grid_hourblocks;
 
 func (db *DB) InitDBStructure() {
 	log.Println("Initializing database structure...")
-	_, err := db.GetConnection().Exec(`
-create table if not exists settings(key text primary key, value text default '');
-create table if not exists vehicles(vin text primary key, display_name text, enabled int, target_soc int, max_amps int, surplus_charging int, min_surplus int, min_chargetime int, lowcost_charging int, max_price int, tibber_token text, num_phases int default 3, grid_provider text default 'tibber', grid_strategy int default 1, depart_days text default '12345', depart_time text default '07:00', telemetry_enroll_date string default '');
-create table if not exists surpluses(ts text, surplus_watts int);
-create table if not exists logs(vehicle_vin text, ts text, event_id int, details text);
-create table if not exists vehicle_states(vehicle_vin text primary key, plugged_in int default 0, charging int default 0, soc int default -1, charge_amps int default 0, charge_limit int default 0, is_home int default 0);
-create table if not exists tibber_prices(vehicle_vin text not null, hourstamp int not null, price real, primary key(vehicle_vin, hourstamp));
-create table if not exists grid_hourblocks(vehicle_vin int text null, hourstamp int not null, primary key(vehicle_vin, hourstamp));
-`)
-	if err != nil {
-		log.Panicln(err)
-	}
-	if _, err := db.GetConnection().Exec(`alter table vehicles add column surplus_buffer int default 0`); err != nil {
-		log.Println(err)
-	}
+	db.Migrate()
 }
 
 func (db *DB) SetSetting(key, value string) {
-	if key == SettingRefreshToken && GetConfig().CryptKey != "" {
-		value = "c:" + db.encrypt(value)
+	if isSecretSetting(key) {
+		value = db.encrypt(value)
 	}
+	db.setRawSetting(key, value)
+}
+
+func (db *DB) setRawSetting(key, value string) {
 	_, err := db.GetConnection().Exec("replace into settings values(?, ?)",
 		key, value)
 	if err != nil {
@@ -178,6 +370,19 @@ func (db *DB) SetSetting(key, value string) {
 }
 
 func (db *DB) GetSetting(key string) string {
+	value := db.getRawSetting(key)
+	if isSecretSetting(key) {
+		plaintext, err := db.decrypt(value)
+		if err != nil {
+			log.Printf("Could not decrypt setting %s: %s\n", key, err.Error())
+			return ""
+		}
+		value = plaintext
+	}
+	return value
+}
+
+func (db *DB) getRawSetting(key string) string {
 	var value string
 	err := db.GetConnection().QueryRow("select value from settings where key = ?", key).
 		Scan(&value)
@@ -187,20 +392,48 @@ func (db *DB) GetSetting(key string) string {
 		}
 		return ""
 	}
-	if key == SettingRefreshToken && GetConfig().CryptKey != "" && strings.Index(value, "c:") == 0 {
-		value = db.decrypt(value[2:])
-	}
 	return value
 }
 
+// getRawSecrets returns all stored credentials as they are stored in the database
+func (db *DB) getRawSecrets() []string {
+	res := []string{}
+	for _, key := range secretSettings {
+		res = append(res, db.getRawSetting(key))
+	}
+	for _, token := range db.getRawTibberTokens() {
+		res = append(res, token)
+	}
+	for _, secrets := range db.getRawWebhookSecrets() {
+		res = append(res, secrets...)
+	}
+	return res
+}
+
+func (db *DB) GetSettingKeys() []string {
+	result := []string{}
+	rows, err := db.GetConnection().Query("select key from settings order by key")
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		rows.Scan(&key)
+		result = append(result, key)
+	}
+	return result
+}
+
 func (db *DB) CreateUpdateVehicle(e *Vehicle) {
 	ts := ""
 	if e.TelemetryEnrollDate != nil {
 		ts = db.formatSqliteDatetime(*e.TelemetryEnrollDate)
 	}
-	_, err := db.GetConnection().Exec("replace into vehicles values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	_, err := db.GetConnection().Exec("replace into vehicles values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		e.VIN, e.DisplayName,
-		e.Enabled, e.TargetSoC, e.MaxAmps, e.SurplusCharging, e.MinSurplus, e.MinChargeTime, e.LowcostCharging, e.MaxPrice, e.TibberToken, e.NumPhases, e.GridProvider, e.GridStrategy, e.DepartDays, e.DepartTime, ts, &e.SurplusBuffer)
+		e.Enabled, e.TargetSoC, e.MaxAmps, e.SurplusCharging, e.MinSurplus, e.MinChargeTime, e.LowcostCharging, e.MaxPrice, db.encrypt(e.TibberToken), e.NumPhases, e.GridProvider, e.GridStrategy, e.DepartDays, e.DepartTime, ts, &e.SurplusBuffer, e.GridFallbackHours, e.GridOptimization, e.CarbonWeight)
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -210,11 +443,11 @@ func (db *DB) GetVehicleByVIN(vin string) *Vehicle {
 	e := &Vehicle{}
 	var ts string
 	err := db.GetConnection().QueryRow("select vin, display_name, "+
-		"enabled, target_soc, max_amps, num_phases, surplus_charging, min_surplus, surplus_buffer, min_chargetime, lowcost_charging, grid_provider, grid_strategy, depart_days, depart_time, max_price, tibber_token, telemetry_enroll_date "+
+		"enabled, target_soc, max_amps, num_phases, surplus_charging, min_surplus, surplus_buffer, min_chargetime, lowcost_charging, grid_provider, grid_strategy, depart_days, depart_time, grid_fallback_hours, grid_optimization, carbon_weight, max_price, tibber_token, telemetry_enroll_date "+
 		"from vehicles "+
 		"where vehicles.vin = ?",
 		vin).
-		Scan(&e.VIN, &e.DisplayName, &e.Enabled, &e.TargetSoC, &e.MaxAmps, &e.NumPhases, &e.SurplusCharging, &e.MinSurplus, &e.SurplusBuffer, &e.MinChargeTime, &e.LowcostCharging, &e.GridProvider, &e.GridStrategy, &e.DepartDays, &e.DepartTime, &e.MaxPrice, &e.TibberToken, &ts)
+		Scan(&e.VIN, &e.DisplayName, &e.Enabled, &e.TargetSoC, &e.MaxAmps, &e.NumPhases, &e.SurplusCharging, &e.MinSurplus, &e.SurplusBuffer, &e.MinChargeTime, &e.LowcostCharging, &e.GridProvider, &e.GridStrategy, &e.DepartDays, &e.DepartTime, &e.GridFallbackHours, &e.GridOptimization, &e.CarbonWeight, &e.MaxPrice, &e.TibberToken, &ts)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Println(err)
@@ -225,13 +458,14 @@ func (db *DB) GetVehicleByVIN(vin string) *Vehicle {
 		parsedDate, _ := time.Parse(SQLITE_DATETIME_LAYOUT, ts)
 		e.TelemetryEnrollDate = &parsedDate
 	}
+	e.TibberToken = db.decryptTibberToken(e.VIN, e.TibberToken)
 	return e
 }
 
 func (db *DB) GetVehicles() []*Vehicle {
 	result := []*Vehicle{}
 	rows, err := db.GetConnection().Query("select vin, display_name, " +
-		"enabled, target_soc, max_amps, num_phases, surplus_charging, min_surplus, surplus_buffer, min_chargetime, lowcost_charging, grid_provider, grid_strategy, depart_days, depart_time, max_price, tibber_token, telemetry_enroll_date " +
+		"enabled, target_soc, max_amps, num_phases, surplus_charging, min_surplus, surplus_buffer, min_chargetime, lowcost_charging, grid_provider, grid_strategy, depart_days, depart_time, grid_fallback_hours, grid_optimization, carbon_weight, max_price, tibber_token, telemetry_enroll_date " +
 		"from vehicles " +
 		"order by display_name")
 	if err != nil {
@@ -244,16 +478,48 @@ func (db *DB) GetVehicles() []*Vehicle {
 	for rows.Next() {
 		var ts string
 		e := &Vehicle{}
-		rows.Scan(&e.VIN, &e.DisplayName, &e.Enabled, &e.TargetSoC, &e.MaxAmps, &e.NumPhases, &e.SurplusCharging, &e.MinSurplus, &e.SurplusBuffer, &e.MinChargeTime, &e.LowcostCharging, &e.GridProvider, &e.GridStrategy, &e.DepartDays, &e.DepartTime, &e.MaxPrice, &e.TibberToken, &ts)
+		rows.Scan(&e.VIN, &e.DisplayName, &e.Enabled, &e.TargetSoC, &e.MaxAmps, &e.NumPhases, &e.SurplusCharging, &e.MinSurplus, &e.SurplusBuffer, &e.MinChargeTime, &e.LowcostCharging, &e.GridProvider, &e.GridStrategy, &e.DepartDays, &e.DepartTime, &e.GridFallbackHours, &e.GridOptimization, &e.CarbonWeight, &e.MaxPrice, &e.TibberToken, &ts)
 		if ts != "" {
 			parsedDate, _ := time.Parse(SQLITE_DATETIME_LAYOUT, ts)
 			e.TelemetryEnrollDate = &parsedDate
 		}
+		e.TibberToken = db.decryptTibberToken(e.VIN, e.TibberToken)
 		result = append(result, e)
 	}
 	return result
 }
 
+func (db *DB) decryptTibberToken(vin string, token string) string {
+	res, err := db.decrypt(token)
+	if err != nil {
+		log.Printf("Could not decrypt Tibber token of vehicle %s: %s\n", vin, err.Error())
+		return ""
+	}
+	return res
+}
+
+func (db *DB) SetVehicleTibberToken(vin string, token string) {
+	if _, err := db.GetConnection().Exec("update vehicles set tibber_token = ? where vin = ?", db.encrypt(token), vin); err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) getRawTibberTokens() map[string]string {
+	res := make(map[string]string)
+	rows, err := db.GetConnection().Query("select vin, ifnull(tibber_token, '') from vehicles")
+	if err != nil {
+		log.Println(err)
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var vin, token string
+		rows.Scan(&vin, &token)
+		res[vin] = token
+	}
+	return res
+}
+
 func (db *DB) DeleteVehicle(vin string) {
 	if _, err := db.GetConnection().Exec("delete from vehicles where vin = ?", vin); err != nil {
 		log.Panicln(err)
@@ -264,19 +530,30 @@ func (db *DB) DeleteVehicle(vin string) {
 	if _, err := db.GetConnection().Exec("delete from vehicle_states where vehicle_vin = ?", vin); err != nil {
 		log.Panicln(err)
 	}
+	if _, err := db.GetConnection().Exec("delete from charging_sessions where vehicle_vin = ?", vin); err != nil {
+		log.Panicln(err)
+	}
+	if _, err := db.GetConnection().Exec("delete from charging_intervals where vehicle_vin = ?", vin); err != nil {
+		log.Panicln(err)
+	}
 }
 
 func (db *DB) GetVehicleState(vin string) *VehicleState {
 	e := &VehicleState{}
-	err := db.GetConnection().QueryRow("select vehicle_vin, plugged_in, charging, soc, charge_amps, charge_limit, is_home from vehicle_states where vehicle_vin = ?",
+	var pausedUntil string
+	err := db.GetConnection().QueryRow("select vehicle_vin, plugged_in, charging, soc, charge_amps, charge_limit, is_home, charge_now, surplus_stale, charge_now_soc, paused_until from vehicle_states where vehicle_vin = ?",
 		vin).
-		Scan(&e.VIN, &e.PluggedIn, &e.Charging, &e.SoC, &e.Amps, &e.ChargeLimit, &e.IsHome)
+		Scan(&e.VIN, &e.PluggedIn, &e.Charging, &e.SoC, &e.Amps, &e.ChargeLimit, &e.IsHome, &e.ChargeNow, &e.SurplusStale, &e.ChargeNowSoC, &pausedUntil)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Println(err)
 		}
 		return nil
 	}
+	if pausedUntil != "" {
+		parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, pausedUntil)
+		e.PausedUntil = &parsedTime
+	}
 	return e
 }
 
@@ -334,6 +611,43 @@ func (db *DB) SetVehicleStateIsHome(vin string, isHome bool) {
 	}
 }
 
+func (db *DB) SetVehicleStateChargeNow(vin string, chargeNow bool) {
+	db.SetVehicleStateChargeNowSoC(vin, chargeNow, 0)
+}
+
+// SetVehicleStateChargeNowSoC sets charge now with a one-shot target SoC, 0 uses the vehicle's target SoC
+func (db *DB) SetVehicleStateChargeNowSoC(vin string, chargeNow bool, soc int) {
+	_, err := db.GetConnection().Exec("insert into vehicle_states (vehicle_vin, charge_now, charge_now_soc) values(?, ?, ?) "+
+		"on conflict(vehicle_vin) do update set charge_now = ?, charge_now_soc = ?",
+		vin, chargeNow, soc, chargeNow, soc)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// SetVehicleStatePausedUntil pauses charging until the given time, nil resumes charging
+func (db *DB) SetVehicleStatePausedUntil(vin string, until *time.Time) {
+	value := ""
+	if until != nil {
+		value = db.formatSqliteDatetime(*until)
+	}
+	_, err := db.GetConnection().Exec("insert into vehicle_states (vehicle_vin, paused_until) values(?, ?) "+
+		"on conflict(vehicle_vin) do update set paused_until = ?",
+		vin, value, value)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (db *DB) SetVehicleStateSurplusStale(vin string, stale bool) {
+	_, err := db.GetConnection().Exec("insert into vehicle_states (vehicle_vin, surplus_stale) values(?, ?) "+
+		"on conflict(vehicle_vin) do update set surplus_stale = ?",
+		vin, stale, stale)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
 func (db *DB) RecordSurplus(surplus int) {
 	_, err := db.GetConnection().Exec("insert into surpluses (ts, surplus_watts) values (?, ?)", db.formatSqliteDatetime(db.Time.UTCNow()), surplus)
 	if err != nil {
@@ -341,11 +655,40 @@ func (db *DB) RecordSurplus(surplus int) {
 	}
 }
 
+func (db *DB) RecordSurplusWithVehicleDraws(surplus int, vehicleWatts int, draws map[string]int) {
+	drawsJSON, _ := json.Marshal(draws)
+	_, err := db.GetConnection().Exec("insert into surpluses (ts, surplus_watts, vehicle_watts, vehicle_draws) values (?, ?, ?, ?)",
+		db.formatSqliteDatetime(db.Time.UTCNow()), surplus, vehicleWatts, string(drawsJSON))
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+// InsertSurplusRecord adds a surplus record with the given timestamp, unless a record with this timestamp exists
+func (db *DB) InsertSurplusRecord(e *SurplusRecord) bool {
+	ts := db.formatSqliteDatetime(e.Timestamp)
+	res, err := db.GetConnection().Exec("insert into surpluses (ts, surplus_watts, vehicle_watts) select ?, ?, ? where not exists (select 1 from surpluses where ts = ?)",
+		ts, e.SurplusWatts, e.VehicleWatts, ts)
+	if err != nil {
+		log.Panicln(err)
+	}
+	num, _ := res.RowsAffected()
+	return num > 0
+}
+
+func (db *DB) GetAllSurplusRecords() []*SurplusRecord {
+	return db.getSurplusRecords("select ts, surplus_watts, vehicle_watts from surpluses order by ts asc")
+}
+
 func (db *DB) GetLatestSurplusRecords(num int) []*SurplusRecord {
-	result := []*SurplusRecord{}
-	rows, err := db.GetConnection().Query("select ts, surplus_watts "+
+	return db.getSurplusRecords("select ts, surplus_watts, vehicle_watts, vehicle_draws "+
 		"from surpluses order by ts desc limit ?",
 		num)
+}
+
+func (db *DB) getSurplusRecords(query string, args ...any) []*SurplusRecord {
+	result := []*SurplusRecord{}
+	rows, err := db.GetConnection().Query(query, args...)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Println(err)
@@ -356,17 +699,209 @@ func (db *DB) GetLatestSurplusRecords(num int) []*SurplusRecord {
 	for rows.Next() {
 		var ts string
 		var surplus int
-		rows.Scan(&ts, &surplus)
+		var vehicleWatts sql.NullInt64
+		var draws sql.NullString
+		dest := []any{&ts, &surplus, &vehicleWatts}
+		if cols, _ := rows.Columns(); len(cols) > 3 {
+			dest = append(dest, &draws)
+		}
+		rows.Scan(dest...)
 		parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, ts)
 		e := &SurplusRecord{
 			Timestamp:    parsedTime,
 			SurplusWatts: surplus,
 		}
+		if vehicleWatts.Valid {
+			watts := int(vehicleWatts.Int64)
+			e.VehicleWatts = &watts
+		}
+		if draws.Valid && draws.String != "" {
+			json.Unmarshal([]byte(draws.String), &e.VehicleDraws)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func (db *DB) GetOldestSurplusRecordTime() *time.Time {
+	var ts sql.NullString
+	if err := db.GetConnection().QueryRow("select min(ts) from surpluses").Scan(&ts); err != nil {
+		log.Println(err)
+		return nil
+	}
+	if !ts.Valid {
+		return nil
+	}
+	parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, ts.String)
+	return &parsedTime
+}
+
+// DownsampleSurpluses aggregates all raw surplus records recorded before the given time into
+// per-minute aggregates and removes the raw records. Both steps are executed in one transaction.
+func (db *DB) DownsampleSurpluses(before time.Time) int64 {
+	tx, err := db.GetConnection().Begin()
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	defer tx.Rollback()
+	ts := db.formatSqliteDatetime(before)
+	if _, err := tx.Exec("insert into surplus_aggregates (resolution, ts, avg_watts, min_watts, max_watts, samples, avg_vehicle_watts) "+
+		"select ?, substr(ts, 1, 16) || ':00', round(avg(surplus_watts)), min(surplus_watts), max(surplus_watts), count(*), round(avg(vehicle_watts)) "+
+		"from surpluses where ts < ? group by substr(ts, 1, 16) "+
+		"on conflict(resolution, ts) do update set "+
+		"avg_watts = round((surplus_aggregates.avg_watts * surplus_aggregates.samples + excluded.avg_watts * excluded.samples) * 1.0 / (surplus_aggregates.samples + excluded.samples)), "+
+		"min_watts = min(surplus_aggregates.min_watts, excluded.min_watts), "+
+		"max_watts = max(surplus_aggregates.max_watts, excluded.max_watts), "+
+		"avg_vehicle_watts = case when surplus_aggregates.avg_vehicle_watts is null then excluded.avg_vehicle_watts "+
+		"when excluded.avg_vehicle_watts is null then surplus_aggregates.avg_vehicle_watts "+
+		"else round((surplus_aggregates.avg_vehicle_watts * surplus_aggregates.samples + excluded.avg_vehicle_watts * excluded.samples) * 1.0 / (surplus_aggregates.samples + excluded.samples)) end, "+
+		"samples = surplus_aggregates.samples + excluded.samples",
+		SurplusResolutionMinute, ts); err != nil {
+		log.Println(err)
+		return 0
+	}
+	res, err := tx.Exec("delete from surpluses where ts < ?", ts)
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return 0
+	}
+	num, _ := res.RowsAffected()
+	return num
+}
+
+// DownsampleSurplusAggregates merges all per-minute aggregates before the given time into per-hour aggregates
+func (db *DB) DownsampleSurplusAggregates(before time.Time) int64 {
+	tx, err := db.GetConnection().Begin()
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	defer tx.Rollback()
+	ts := db.formatSqliteDatetime(before)
+	if _, err := tx.Exec("insert into surplus_aggregates (resolution, ts, avg_watts, min_watts, max_watts, samples, avg_vehicle_watts) "+
+		"select ?, substr(ts, 1, 13) || ':00:00', round(sum(avg_watts * samples) * 1.0 / sum(samples)), min(min_watts), max(max_watts), sum(samples), "+
+		"round(sum(avg_vehicle_watts * samples) * 1.0 / sum(case when avg_vehicle_watts is not null then samples end)) "+
+		"from surplus_aggregates where resolution = ? and ts < ? group by substr(ts, 1, 13) "+
+		"on conflict(resolution, ts) do update set "+
+		"avg_watts = round((surplus_aggregates.avg_watts * surplus_aggregates.samples + excluded.avg_watts * excluded.samples) * 1.0 / (surplus_aggregates.samples + excluded.samples)), "+
+		"min_watts = min(surplus_aggregates.min_watts, excluded.min_watts), "+
+		"max_watts = max(surplus_aggregates.max_watts, excluded.max_watts), "+
+		"avg_vehicle_watts = case when surplus_aggregates.avg_vehicle_watts is null then excluded.avg_vehicle_watts "+
+		"when excluded.avg_vehicle_watts is null then surplus_aggregates.avg_vehicle_watts "+
+		"else round((surplus_aggregates.avg_vehicle_watts * surplus_aggregates.samples + excluded.avg_vehicle_watts * excluded.samples) * 1.0 / (surplus_aggregates.samples + excluded.samples)) end, "+
+		"samples = surplus_aggregates.samples + excluded.samples",
+		SurplusResolutionHour, SurplusResolutionMinute, ts); err != nil {
+		log.Println(err)
+		return 0
+	}
+	res, err := tx.Exec("delete from surplus_aggregates where resolution = ? and ts < ?", SurplusResolutionMinute, ts)
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return 0
+	}
+	num, _ := res.RowsAffected()
+	return num
+}
+
+func (db *DB) DeleteSurplusAggregates(resolution string, before time.Time) int64 {
+	return db.deleteBefore("delete from surplus_aggregates where resolution = ? and ts < ?", resolution, db.formatSqliteDatetime(before))
+}
+
+func (db *DB) GetSurplusAggregates(resolution string, from time.Time, to time.Time) []*SurplusAggregate {
+	result := []*SurplusAggregate{}
+	rows, err := db.GetConnection().Query("select ts, avg_watts, min_watts, max_watts, samples, avg_vehicle_watts "+
+		"from surplus_aggregates where resolution = ? and ts >= ? and ts < ? order by ts asc",
+		resolution, db.formatSqliteDatetime(from), db.formatSqliteDatetime(to))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts string
+		var vehicleWatts sql.NullInt64
+		e := &SurplusAggregate{}
+		rows.Scan(&ts, &e.AvgWatts, &e.MinWatts, &e.MaxWatts, &e.Samples, &vehicleWatts)
+		e.Timestamp, _ = time.Parse(SQLITE_DATETIME_LAYOUT, ts)
+		if vehicleWatts.Valid {
+			watts := int(vehicleWatts.Int64)
+			e.AvgVehicleWatts = &watts
+		}
 		result = append(result, e)
 	}
 	return result
 }
 
+func (db *DB) InsertSurplusAggregate(resolution string, e *SurplusAggregate) bool {
+	res, err := db.GetConnection().Exec("insert or ignore into surplus_aggregates (resolution, ts, avg_watts, min_watts, max_watts, samples, avg_vehicle_watts) values (?, ?, ?, ?, ?, ?, ?)",
+		resolution, db.formatSqliteDatetime(e.Timestamp), e.AvgWatts, e.MinWatts, e.MaxWatts, e.Samples, e.AvgVehicleWatts)
+	if err != nil {
+		log.Panicln(err)
+	}
+	num, _ := res.RowsAffected()
+	return num > 0
+}
+
+func (db *DB) DeleteChargingEvents(before time.Time) int64 {
+	return db.deleteBefore("delete from logs where ts < ?", db.formatSqliteDatetime(before))
+}
+
+func (db *DB) DeleteGridData(before time.Time) int64 {
+	hourstamp := GetHourstamp(before.Year(), int(before.Month()), before.Day(), before.Hour())
+	res := db.deleteBefore("delete from tibber_prices where hourstamp < ?", hourstamp)
+	res += db.deleteBefore("delete from grid_hourblocks where hourstamp < ?", hourstamp)
+	res += db.deleteBefore("delete from carbon_intensities where hourstamp < ?", hourstamp)
+	return res
+}
+
+func (db *DB) deleteBefore(query string, args ...any) int64 {
+	res, err := db.GetConnection().Exec(query, args...)
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	num, _ := res.RowsAffected()
+	return num
+}
+
+// GetFreePagesRatio returns the share of unused pages in the database file
+func (db *DB) GetFreePagesRatio() float64 {
+	var pageCount, freelistCount int64
+	if err := db.GetConnection().QueryRow("pragma page_count").Scan(&pageCount); err != nil {
+		log.Println(err)
+		return 0
+	}
+	if err := db.GetConnection().QueryRow("pragma freelist_count").Scan(&freelistCount); err != nil {
+		log.Println(err)
+		return 0
+	}
+	if pageCount == 0 {
+		return 0
+	}
+	return float64(freelistCount) / float64(pageCount)
+}
+
+func (db *DB) Vacuum() error {
+	_, err := db.GetConnection().Exec("vacuum")
+	return err
+}
+
+func (db *DB) Analyze() error {
+	_, err := db.GetConnection().Exec("analyze")
+	return err
+}
+
 func (db *DB) RecordSelectedGridHourblock(vin string, year int, month int, day int, hour int) {
 	hourstamp := GetHourstamp(year, month, day, hour)
 	_, err := db.GetConnection().Exec("replace into grid_hourblocks (vehicle_vin, hourstamp) values(?, ?)",
@@ -398,6 +933,34 @@ func (db *DB) SetTibberPrice(vin string, year int, month int, day int, hour int,
 	}
 }
 
+func (db *DB) GetTibberPrice(vin string, year int, month int, day int, hour int) (float32, bool) {
+	hourstamp := GetHourstamp(year, month, day, hour)
+	var price float32
+	err := db.GetConnection().QueryRow("select price from tibber_prices where vehicle_vin = ? and hourstamp = ?",
+		vin, hourstamp).Scan(&price)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return 0, false
+	}
+	return price, true
+}
+
+// GetAverageTibberPrice returns the average of the hourly prices known for the period
+func (db *DB) GetAverageTibberPrice(vin string, from time.Time, to time.Time) (float32, bool) {
+	hourstampFrom := GetHourstamp(from.Year(), int(from.Month()), from.Day(), from.Hour())
+	hourstampTo := GetHourstamp(to.Year(), int(to.Month()), to.Day(), to.Hour())
+	var price sql.NullFloat64
+	err := db.GetConnection().QueryRow("select avg(price) from tibber_prices where vehicle_vin = ? and hourstamp >= ? and hourstamp < ?",
+		vin, hourstampFrom, hourstampTo).Scan(&price)
+	if err != nil {
+		log.Println(err)
+		return 0, false
+	}
+	return float32(price.Float64), price.Valid
+}
+
 func (db *DB) GetUpcomingTibberPrices(vin string, sortByPriceAsc bool) []*GridPrice {
 	now := db.Time.UTCNow()
 	hourstampStart := GetHourstamp(now.Year(), int(now.Month()), now.Day(), now.Hour())
@@ -439,14 +1002,38 @@ func (db *DB) GetUpcomingTibberPrices(vin string, sortByPriceAsc bool) []*GridPr
 	return result
 }
 
-func (db *DB) GetVehicleVINsWithTibberTokenWithoutPricesForStarttime(startTime time.Time, limit int) []string {
-	hourstampStart := GetHourstamp(startTime.Year(), int(startTime.Month()), startTime.Day(), 0)
-	result := []string{}
-	rows, err := db.GetConnection().Query("select vehicles.vin "+
-		"from vehicles "+
-		"where vehicles.grid_provider = 'tibber' and ifnull(vehicles.tibber_token, '') != '' and (select count(*) from tibber_prices where tibber_prices.vehicle_vin = vehicles.vin and hourstamp >= ?) = 0 "+
-		"limit ?",
-		hourstampStart, limit)
+func (db *DB) SetCarbonIntensity(zone string, year int, month int, day int, hour int, intensity float32) {
+	hourstamp := GetHourstamp(year, month, day, hour)
+	_, err := db.GetConnection().Exec("replace into carbon_intensities (zone, hourstamp, intensity) values(?, ?, ?)",
+		zone, hourstamp, intensity)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) GetCarbonIntensity(zone string, year int, month int, day int, hour int) (float32, bool) {
+	hourstamp := GetHourstamp(year, month, day, hour)
+	var intensity float32
+	err := db.GetConnection().QueryRow("select intensity from carbon_intensities where zone = ? and hourstamp = ?",
+		zone, hourstamp).Scan(&intensity)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return 0, false
+	}
+	return intensity, true
+}
+
+func (db *DB) GetUpcomingCarbonIntensities(zone string) []*CarbonIntensity {
+	now := db.Time.UTCNow()
+	hourstampStart := GetHourstamp(now.Year(), int(now.Month()), now.Day(), now.Hour())
+	result := []*CarbonIntensity{}
+	rows, err := db.GetConnection().Query("select hourstamp, intensity "+
+		"from carbon_intensities "+
+		"where zone = ? and hourstamp >= ? "+
+		"order by hourstamp asc",
+		zone, hourstampStart)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Println(err)
@@ -455,12 +1042,46 @@ func (db *DB) GetVehicleVINsWithTibberTokenWithoutPricesForStarttime(startTime t
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var vin string
-		rows.Scan(&vin)
-		result = append(result, vin)
-	}
-	return result
-}
+		var hourstamp string
+		var intensity float32
+		rows.Scan(&hourstamp, &intensity)
+
+		year, _ := strconv.Atoi(hourstamp[0:4])
+		month, _ := strconv.Atoi(hourstamp[4:6])
+		day, _ := strconv.Atoi(hourstamp[6:8])
+		hour, _ := strconv.Atoi(hourstamp[8:])
+
+		e := &CarbonIntensity{
+			Intensity: intensity,
+			StartsAt:  time.Date(year, time.Month(month), day, hour, 0, 0, 0, now.Location()),
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func (db *DB) GetVehicleVINsWithTibberTokenWithoutPricesForStarttime(startTime time.Time, limit int) []string {
+	hourstampStart := GetHourstamp(startTime.Year(), int(startTime.Month()), startTime.Day(), 0)
+	result := []string{}
+	rows, err := db.GetConnection().Query("select vehicles.vin "+
+		"from vehicles "+
+		"where vehicles.grid_provider = 'tibber' and ifnull(vehicles.tibber_token, '') != '' and (select count(*) from tibber_prices where tibber_prices.vehicle_vin = vehicles.vin and hourstamp >= ?) = 0 "+
+		"limit ?",
+		hourstampStart, limit)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var vin string
+		rows.Scan(&vin)
+		result = append(result, vin)
+	}
+	return result
+}
 
 func (db *DB) GetVehicleVINsWithTibberTokenWithoutPricesForTomorrow(limit int) []string {
 	startTime := db.Time.UTCNow().AddDate(0, 0, 1)
@@ -472,6 +1093,92 @@ func (db *DB) GetVehicleVINsWithTibberTokenWithoutPricesForToday(limit int) []st
 	return db.GetVehicleVINsWithTibberTokenWithoutPricesForStarttime(startTime, limit)
 }
 
+func (db *DB) GetTibberPricesCoverageEnd(vin string) *time.Time {
+	var hourstamp sql.NullInt64
+	err := db.GetConnection().QueryRow("select max(hourstamp) from tibber_prices where vehicle_vin = ?", vin).
+		Scan(&hourstamp)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if !hourstamp.Valid {
+		return nil
+	}
+	s := strconv.FormatInt(hourstamp.Int64, 10)
+	year, _ := strconv.Atoi(s[0:4])
+	month, _ := strconv.Atoi(s[4:6])
+	day, _ := strconv.Atoi(s[6:8])
+	hour, _ := strconv.Atoi(s[8:])
+	// the last known price is valid until the end of its hour
+	res := time.Date(year, time.Month(month), day, hour, 0, 0, 0, time.UTC).Add(time.Hour)
+	return &res
+}
+
+func (db *DB) RecordPriceSourceSuccess(source string, provider GridProvider) {
+	ts := db.formatSqliteDatetime(db.Time.UTCNow())
+	_, err := db.GetConnection().Exec("insert into price_source_health (source, grid_provider, last_success, fail_count) values(?, ?, ?, 0) "+
+		"on conflict(source) do update set grid_provider = ?, last_success = ?, fail_count = 0",
+		source, provider, ts, provider, ts)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) RecordPriceSourceError(source string, provider GridProvider, text string) {
+	ts := db.formatSqliteDatetime(db.Time.UTCNow())
+	_, err := db.GetConnection().Exec("insert into price_source_health (source, grid_provider, last_error_ts, last_error, fail_count) values(?, ?, ?, ?, 1) "+
+		"on conflict(source) do update set grid_provider = ?, last_error_ts = ?, last_error = ?, fail_count = fail_count + 1",
+		source, provider, ts, text, provider, ts, text)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) GetPriceSourceHealth(source string) *PriceSourceHealth {
+	e := &PriceSourceHealth{}
+	var lastSuccess, lastError string
+	err := db.GetConnection().QueryRow("select source, grid_provider, last_success, last_error_ts, last_error, fail_count "+
+		"from price_source_health where source = ?",
+		source).
+		Scan(&e.Source, &e.GridProvider, &lastSuccess, &lastError, &e.LastError, &e.FailCount)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil
+	}
+	if lastSuccess != "" {
+		parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, lastSuccess)
+		e.LastSuccess = &parsedTime
+	}
+	if lastError != "" {
+		parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, lastError)
+		e.LastErrorTime = &parsedTime
+	}
+	return e
+}
+
+func (db *DB) SetVehicleStatePriceCoverageNotified(vin string, notified bool) {
+	_, err := db.GetConnection().Exec("insert into vehicle_states (vehicle_vin, price_coverage_notified) values(?, ?) "+
+		"on conflict(vehicle_vin) do update set price_coverage_notified = ?",
+		vin, notified, notified)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func (db *DB) IsVehicleStatePriceCoverageNotified(vin string) bool {
+	var notified bool
+	err := db.GetConnection().QueryRow("select price_coverage_notified from vehicle_states where vehicle_vin = ?", vin).Scan(&notified)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return false
+	}
+	return notified
+}
+
 func (db *DB) LogChargingEvent(vin string, eventType int, text string) {
 	log.Printf("charging event %d for vehicle id %s with data: %s\n", eventType, vin, text)
 	_, err := db.GetConnection().Exec("insert into logs values(?, ?, ?, ?)", vin, db.formatSqliteDatetime(db.Time.UTCNow()), eventType, text)
@@ -504,10 +1211,31 @@ func (db *DB) GetLatestChargingEvent(vin string, eventType int) *ChargingEvent {
 }
 
 func (db *DB) GetLatestChargingEvents(vin string, num int) []*ChargingEvent {
-	result := []*ChargingEvent{}
-	rows, err := db.GetConnection().Query("select ts, event_id, details "+
+	return db.getChargingEvents("select ts, event_id, details "+
 		"from logs where vehicle_vin = ? order by ts desc limit ?",
 		vin, num)
+}
+
+func (db *DB) GetAllChargingEvents(vin string) []*ChargingEvent {
+	return db.getChargingEvents("select ts, event_id, details from logs where vehicle_vin = ? order by ts asc", vin)
+}
+
+// InsertChargingEvent adds a charging event with the given timestamp, unless the same event exists
+func (db *DB) InsertChargingEvent(vin string, e *ChargingEvent) bool {
+	ts := db.formatSqliteDatetime(e.Timestamp)
+	res, err := db.GetConnection().Exec("insert into logs (vehicle_vin, ts, event_id, details) select ?, ?, ?, ? "+
+		"where not exists (select 1 from logs where vehicle_vin = ? and ts = ? and event_id = ? and details = ?)",
+		vin, ts, e.Event, e.Data, vin, ts, e.Event, e.Data)
+	if err != nil {
+		log.Panicln(err)
+	}
+	num, _ := res.RowsAffected()
+	return num > 0
+}
+
+func (db *DB) getChargingEvents(query string, args ...any) []*ChargingEvent {
+	result := []*ChargingEvent{}
+	rows, err := db.GetConnection().Query(query, args...)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Println(err)
@@ -531,44 +1259,580 @@ func (db *DB) GetLatestChargingEvents(vin string, num int) []*ChargingEvent {
 	return result
 }
 
+func (db *DB) CreateUser(username string, passwordHash string) *User {
+	now := db.Time.UTCNow()
+	res, err := db.GetConnection().Exec("insert into users (username, password_hash, created_at) values(?, ?, ?)",
+		username, passwordHash, db.formatSqliteDatetime(now))
+	if err != nil {
+		log.Panicln(err)
+	}
+	id, _ := res.LastInsertId()
+	return &User{
+		ID:           int(id),
+		Username:     username,
+		PasswordHash: passwordHash,
+		CreatedAt:    now,
+	}
+}
+
+func (db *DB) GetUserByID(id int) *User {
+	return db.getUser("select id, username, password_hash, created_at from users where id = ?", id)
+}
+
+func (db *DB) GetUserByName(username string) *User {
+	return db.getUser("select id, username, password_hash, created_at from users where username = ?", username)
+}
+
+func (db *DB) getUser(query string, args ...any) *User {
+	e := &User{}
+	var ts string
+	err := db.GetConnection().QueryRow(query, args...).Scan(&e.ID, &e.Username, &e.PasswordHash, &ts)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return nil
+	}
+	e.CreatedAt, _ = time.Parse(SQLITE_DATETIME_LAYOUT, ts)
+	return e
+}
+
+func (db *DB) GetUsers() []*User {
+	result := []*User{}
+	rows, err := db.GetConnection().Query("select id, username, created_at from users order by username")
+	if err != nil {
+		log.Println(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &User{}
+		var ts string
+		rows.Scan(&e.ID, &e.Username, &ts)
+		e.CreatedAt, _ = time.Parse(SQLITE_DATETIME_LAYOUT, ts)
+		result = append(result, e)
+	}
+	return result
+}
+
+func (db *DB) GetNumUsers() int {
+	var num int
+	if err := db.GetConnection().QueryRow("select count(*) from users").Scan(&num); err != nil {
+		log.Panicln(err)
+	}
+	return num
+}
+
+func (db *DB) SetUserPassword(id int, passwordHash string) {
+	_, err := db.GetConnection().Exec("update users set password_hash = ? where id = ?", passwordHash, id)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) DeleteUser(id int) {
+	db.DeleteUserSessions(id)
+	_, err := db.GetConnection().Exec("delete from users where id = ?", id)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) CreateSession(tokenHash string, userID int, expires time.Time) {
+	_, err := db.GetConnection().Exec("insert into sessions (token_hash, user_id, created_at, expires_at) values(?, ?, ?, ?)",
+		tokenHash, userID, db.formatSqliteDatetime(db.Time.UTCNow()), db.formatSqliteDatetime(expires))
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+// GetSessionUser returns the user a session belongs to, unless the session is unknown or expired
+func (db *DB) GetSessionUser(tokenHash string) *User {
+	return db.getUser("select users.id, users.username, users.password_hash, users.created_at "+
+		"from sessions inner join users on users.id = sessions.user_id "+
+		"where sessions.token_hash = ? and sessions.expires_at > ?",
+		tokenHash, db.formatSqliteDatetime(db.Time.UTCNow()))
+}
+
+func (db *DB) DeleteSession(tokenHash string) {
+	_, err := db.GetConnection().Exec("delete from sessions where token_hash = ?", tokenHash)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) DeleteUserSessions(userID int) {
+	_, err := db.GetConnection().Exec("delete from sessions where user_id = ?", userID)
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+func (db *DB) DeleteExpiredSessions(now time.Time) int64 {
+	return db.deleteBefore("delete from sessions where expires_at <= ?", db.formatSqliteDatetime(now))
+}
+
+func (db *DB) CreateAPIKey(name string, keyHash string, scope APIKeyScope) *APIKey {
+	now := db.Time.UTCNow()
+	res, err := db.GetConnection().Exec("insert into api_keys (name, key_hash, scope, created_at) values(?, ?, ?, ?)",
+		name, keyHash, scope, db.formatSqliteDatetime(now))
+	if err != nil {
+		log.Panicln(err)
+	}
+	id, _ := res.LastInsertId()
+	return &APIKey{
+		ID:        int(id),
+		Name:      name,
+		Scope:     scope,
+		CreatedAt: now,
+	}
+}
+
+func (db *DB) GetAPIKeyByHash(keyHash string) *APIKey {
+	keys := db.getAPIKeys("select id, name, scope, created_at, last_used from api_keys where key_hash = ?", keyHash)
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[0]
+}
+
+func (db *DB) GetAPIKeys() []*APIKey {
+	return db.getAPIKeys("select id, name, scope, created_at, last_used from api_keys order by id")
+}
+
+func (db *DB) getAPIKeys(query string, args ...any) []*APIKey {
+	result := []*APIKey{}
+	rows, err := db.GetConnection().Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &APIKey{}
+		var createdAt, lastUsed string
+		rows.Scan(&e.ID, &e.Name, &e.Scope, &createdAt, &lastUsed)
+		e.CreatedAt, _ = time.Parse(SQLITE_DATETIME_LAYOUT, createdAt)
+		if lastUsed != "" {
+			parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, lastUsed)
+			e.LastUsed = &parsedTime
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func (db *DB) SetAPIKeyLastUsed(id int) {
+	_, err := db.GetConnection().Exec("update api_keys set last_used = ? where id = ?", db.formatSqliteDatetime(db.Time.UTCNow()), id)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (db *DB) DeleteAPIKey(id int) bool {
+	res, err := db.GetConnection().Exec("delete from api_keys where id = ?", id)
+	if err != nil {
+		log.Panicln(err)
+	}
+	num, _ := res.RowsAffected()
+	return num > 0
+}
+
+// CreateWebhook stores a webhook, its secret and headers are encrypted as they might contain credentials
+func (db *DB) CreateWebhook(e *Webhook) {
+	e.CreatedAt = db.Time.UTCNow()
+	res, err := db.GetConnection().Exec("insert into webhooks (name, url, secret, events, headers, enabled, created_at) values(?, ?, ?, ?, ?, ?, ?)",
+		e.Name, e.URL, db.encrypt(e.Secret), db.joinWebhookEvents(e.Events), db.encrypt(db.marshalWebhookHeaders(e.Headers)), e.Enabled, db.formatSqliteDatetime(e.CreatedAt))
+	if err != nil {
+		log.Panicln(err)
+	}
+	id, _ := res.LastInsertId()
+	e.ID = int(id)
+	e.HasSecret = e.Secret != ""
+}
+
+func (db *DB) UpdateWebhook(e *Webhook) {
+	if _, err := db.GetConnection().Exec("update webhooks set name = ?, url = ?, secret = ?, events = ?, headers = ?, enabled = ? where id = ?",
+		e.Name, e.URL, db.encrypt(e.Secret), db.joinWebhookEvents(e.Events), db.encrypt(db.marshalWebhookHeaders(e.Headers)), e.Enabled, e.ID); err != nil {
+		log.Panicln(err)
+	}
+	e.HasSecret = e.Secret != ""
+}
+
+func (db *DB) GetWebhook(id int) *Webhook {
+	list := db.getWebhooks("select id, name, url, secret, events, headers, enabled, created_at from webhooks where id = ?", id)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+func (db *DB) GetWebhooks() []*Webhook {
+	return db.getWebhooks("select id, name, url, secret, events, headers, enabled, created_at from webhooks order by id")
+}
+
+func (db *DB) getWebhooks(query string, args ...any) []*Webhook {
+	result := []*Webhook{}
+	rows, err := db.GetConnection().Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &Webhook{}
+		var events, headers, createdAt string
+		rows.Scan(&e.ID, &e.Name, &e.URL, &e.Secret, &events, &headers, &e.Enabled, &createdAt)
+		e.CreatedAt, _ = time.Parse(SQLITE_DATETIME_LAYOUT, createdAt)
+		e.Events = db.splitWebhookEvents(events)
+		if e.Secret, err = db.decrypt(e.Secret); err != nil {
+			log.Printf("Could not decrypt secret of webhook %d: %s\n", e.ID, err.Error())
+		}
+		e.HasSecret = e.Secret != ""
+		e.Headers = make(map[string]string)
+		if headers, err = db.decrypt(headers); err != nil {
+			log.Printf("Could not decrypt headers of webhook %d: %s\n", e.ID, err.Error())
+		} else if headers != "" {
+			json.Unmarshal([]byte(headers), &e.Headers)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func (db *DB) getRawWebhookSecrets() map[int][]string {
+	res := make(map[int][]string)
+	rows, err := db.GetConnection().Query("select id, secret, headers from webhooks")
+	if err != nil {
+		log.Println(err)
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var secret, headers string
+		rows.Scan(&id, &secret, &headers)
+		res[id] = []string{secret, headers}
+	}
+	return res
+}
+
+func (db *DB) DeleteWebhook(id int) bool {
+	res, err := db.GetConnection().Exec("delete from webhooks where id = ?", id)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if _, err := db.GetConnection().Exec("delete from webhook_deliveries where webhook_id = ?", id); err != nil {
+		log.Panicln(err)
+	}
+	num, _ := res.RowsAffected()
+	return num > 0
+}
+
+func (db *DB) joinWebhookEvents(events []WebhookEvent) string {
+	list := make([]string, len(events))
+	for i, event := range events {
+		list[i] = string(event)
+	}
+	return strings.Join(list, ",")
+}
+
+func (db *DB) splitWebhookEvents(s string) []WebhookEvent {
+	events := []WebhookEvent{}
+	for _, event := range strings.Split(s, ",") {
+		if event != "" {
+			events = append(events, WebhookEvent(event))
+		}
+	}
+	return events
+}
+
+func (db *DB) marshalWebhookHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	res, _ := json.Marshal(headers)
+	return string(res)
+}
+
+func (db *DB) CreateWebhookDelivery(webhookID int, event WebhookEvent, payload string) *WebhookDelivery {
+	now := db.Time.UTCNow()
+	res, err := db.GetConnection().Exec("insert into webhook_deliveries (webhook_id, event, payload, status, created_at, next_attempt) values(?, ?, ?, ?, ?, ?)",
+		webhookID, event, payload, WebhookDeliveryPending, db.formatSqliteDatetime(now), db.formatSqliteDatetime(now))
+	if err != nil {
+		log.Panicln(err)
+	}
+	id, _ := res.LastInsertId()
+	return &WebhookDelivery{
+		ID:          int(id),
+		WebhookID:   webhookID,
+		Event:       event,
+		Payload:     payload,
+		Status:      WebhookDeliveryPending,
+		CreatedAt:   now,
+		NextAttempt: &now,
+	}
+}
+
+func (db *DB) GetWebhookDelivery(id int) *WebhookDelivery {
+	list := db.getWebhookDeliveries("select id, webhook_id, event, payload, status, attempts, response_code, error, created_at, last_attempt, next_attempt from webhook_deliveries where id = ?", id)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+func (db *DB) GetWebhookDeliveries(webhookID int, limit int) []*WebhookDelivery {
+	return db.getWebhookDeliveries("select id, webhook_id, event, payload, status, attempts, response_code, error, created_at, last_attempt, next_attempt from webhook_deliveries where webhook_id = ? order by id desc limit ?", webhookID, limit)
+}
+
+// GetDueWebhookDeliveries returns the pending deliveries which are to be attempted now, oldest first
+func (db *DB) GetDueWebhookDeliveries(now time.Time) []*WebhookDelivery {
+	return db.getWebhookDeliveries("select id, webhook_id, event, payload, status, attempts, response_code, error, created_at, last_attempt, next_attempt from webhook_deliveries where status = ? and next_attempt <= ? order by id",
+		WebhookDeliveryPending, db.formatSqliteDatetime(now))
+}
+
+func (db *DB) getWebhookDeliveries(query string, args ...any) []*WebhookDelivery {
+	result := []*WebhookDelivery{}
+	rows, err := db.GetConnection().Query(query, args...)
+	if err != nil {
+		log.Println(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &WebhookDelivery{}
+		var createdAt, lastAttempt, nextAttempt string
+		rows.Scan(&e.ID, &e.WebhookID, &e.Event, &e.Payload, &e.Status, &e.Attempts, &e.ResponseCode, &e.Error, &createdAt, &lastAttempt, &nextAttempt)
+		e.CreatedAt, _ = time.Parse(SQLITE_DATETIME_LAYOUT, createdAt)
+		if lastAttempt != "" {
+			parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, lastAttempt)
+			e.LastAttempt = &parsedTime
+		}
+		if nextAttempt != "" {
+			parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, nextAttempt)
+			e.NextAttempt = &parsedTime
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// SetWebhookDeliveryResult records an attempt; nextAttempt is nil if the delivery won't be retried
+func (db *DB) SetWebhookDeliveryResult(e *WebhookDelivery, lastAttempt time.Time, nextAttempt *time.Time) {
+	next := ""
+	if nextAttempt != nil {
+		next = db.formatSqliteDatetime(*nextAttempt)
+	}
+	if _, err := db.GetConnection().Exec("update webhook_deliveries set status = ?, attempts = ?, response_code = ?, error = ?, last_attempt = ?, next_attempt = ? where id = ?",
+		e.Status, e.Attempts, e.ResponseCode, e.Error, db.formatSqliteDatetime(lastAttempt), next, e.ID); err != nil {
+		log.Panicln(err)
+	}
+	e.LastAttempt = &lastAttempt
+	e.NextAttempt = nextAttempt
+}
+
+// ResetWebhookDelivery schedules a delivery for immediate redelivery with a fresh number of attempts
+func (db *DB) ResetWebhookDelivery(id int) bool {
+	res, err := db.GetConnection().Exec("update webhook_deliveries set status = ?, attempts = 0, next_attempt = ? where id = ?",
+		WebhookDeliveryPending, db.formatSqliteDatetime(db.Time.UTCNow()), id)
+	if err != nil {
+		log.Panicln(err)
+	}
+	num, _ := res.RowsAffected()
+	return num > 0
+}
+
+// DeleteWebhookDeliveries removes completed deliveries created before the given time
+func (db *DB) DeleteWebhookDeliveries(before time.Time) int64 {
+	return db.deleteBefore("delete from webhook_deliveries where status != ? and created_at < ?", WebhookDeliveryPending, db.formatSqliteDatetime(before))
+}
+
 func (db *DB) formatSqliteDatetime(ts time.Time) string {
 	return ts.Format(SQLITE_DATETIME_LAYOUT)
 }
 
 func (db *DB) encrypt(s string) string {
-	aes, err := aes.NewCipher([]byte(GetConfig().CryptKey))
+	res, err := EncryptSecret(s)
 	if err != nil {
-		panic(err)
+		log.Panicln(err)
 	}
-	gcm, err := cipher.NewGCM(aes)
+	return res
+}
+
+func (db *DB) decrypt(s string) (string, error) {
+	return DecryptSecret(s)
+}
+
+func (db *DB) CreateChargingSession(vin string, startedAt time.Time, soc int) *ChargingSession {
+	res, err := db.GetConnection().Exec("insert into charging_sessions (vehicle_vin, started_at, start_soc) values(?, ?, ?)",
+		vin, db.formatSqliteDatetime(startedAt), soc)
 	if err != nil {
-		panic(err)
+		log.Panicln(err)
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err)
+	id, _ := res.LastInsertId()
+	return &ChargingSession{
+		ID:        int(id),
+		VIN:       vin,
+		StartedAt: startedAt,
+		StartSoC:  soc,
+		EndSoC:    -1,
 	}
-	ciphertext := gcm.Seal(nonce, nonce, []byte(s), nil)
-	res := base64.StdEncoding.EncodeToString(ciphertext)
-	return res
 }
 
-func (db *DB) decrypt(s string) string {
-	ciphertext, _ := base64.StdEncoding.Strict().DecodeString(s)
-	aes, err := aes.NewCipher([]byte(GetConfig().CryptKey))
+const chargingSessionColumns = "id, vehicle_vin, started_at, ended_at, start_soc, end_soc, energy_solar, energy_grid, cost, energy_measured, measured_at, emissions"
+
+func (db *DB) GetChargingSession(id int) *ChargingSession {
+	list := db.getChargingSessions("select "+chargingSessionColumns+" from charging_sessions where id = ?", id)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// GetOpenChargingSession returns the vehicle's session which hasn't ended yet, or nil if it is not plugged in
+func (db *DB) GetOpenChargingSession(vin string) *ChargingSession {
+	list := db.getChargingSessions("select "+chargingSessionColumns+" from charging_sessions where vehicle_vin = ? and ended_at = '' order by id desc limit 1", vin)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// GetChargingSessions returns a page of the vehicle's sessions, latest first
+func (db *DB) GetChargingSessions(vin string, limit int, offset int) []*ChargingSession {
+	return db.getChargingSessions("select "+chargingSessionColumns+" from charging_sessions where vehicle_vin = ? order by started_at desc, id desc limit ? offset ?", vin, limit, offset)
+}
+
+// GetChargingSessionsBetween returns the vehicle's sessions started in the period, oldest first
+func (db *DB) GetChargingSessionsBetween(vin string, from time.Time, to time.Time) []*ChargingSession {
+	return db.getChargingSessions("select "+chargingSessionColumns+" from charging_sessions where vehicle_vin = ? and started_at >= ? and started_at < ? order by started_at asc, id asc",
+		vin, db.formatSqliteDatetime(from), db.formatSqliteDatetime(to))
+}
+
+func (db *DB) GetNumChargingSessions(vin string) int {
+	var num int
+	if err := db.GetConnection().QueryRow("select count(*) from charging_sessions where vehicle_vin = ?", vin).Scan(&num); err != nil {
+		log.Println(err)
+	}
+	return num
+}
+
+func (db *DB) getChargingSessions(query string, args ...any) []*ChargingSession {
+	result := []*ChargingSession{}
+	rows, err := db.GetConnection().Query(query, args...)
 	if err != nil {
-		panic(err)
+		log.Println(err)
+		return result
 	}
-	gcm, err := cipher.NewGCM(aes)
+	defer rows.Close()
+	for rows.Next() {
+		e := &ChargingSession{}
+		var startedAt, endedAt, measuredAt string
+		var cost, emissions sql.NullFloat64
+		rows.Scan(&e.ID, &e.VIN, &startedAt, &endedAt, &e.StartSoC, &e.EndSoC, &e.EnergySolar, &e.EnergyGrid, &cost, &e.EnergyMeasured, &measuredAt, &emissions)
+		e.StartedAt, _ = time.Parse(SQLITE_DATETIME_LAYOUT, startedAt)
+		if endedAt != "" {
+			parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, endedAt)
+			e.EndedAt = &parsedTime
+		}
+		if measuredAt != "" {
+			parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, measuredAt)
+			e.MeasuredAt = &parsedTime
+		}
+		e.Measured = e.EnergyMeasured > 0
+		if cost.Valid {
+			e.Cost = &cost.Float64
+			if e.EnergyGrid > 0 {
+				price := cost.Float64 / e.EnergyGrid
+				e.GridPrice = &price
+			}
+		}
+		if emissions.Valid {
+			e.Emissions = &emissions.Float64
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func (db *DB) CreateChargingInterval(e *ChargingInterval) {
+	res, err := db.GetConnection().Exec("insert into charging_intervals (session_id, vehicle_vin, started_at, source, amps, price) values (?, ?, ?, ?, ?, ?)",
+		e.SessionID, e.VIN, db.formatSqliteDatetime(e.StartedAt), e.Source, e.Amps, e.Price)
 	if err != nil {
-		panic(err)
+		log.Panicln(err)
+	}
+	id, _ := res.LastInsertId()
+	e.ID = int(id)
+}
+
+func (db *DB) EndChargingInterval(id int, endedAt time.Time) {
+	if _, err := db.GetConnection().Exec("update charging_intervals set ended_at = ? where id = ?", db.formatSqliteDatetime(endedAt), id); err != nil {
+		log.Panicln(err)
+	}
+}
+
+const chargingIntervalColumns = "id, session_id, vehicle_vin, started_at, ended_at, source, amps, price"
+
+// GetOpenChargingInterval returns the vehicle's interval which hasn't ended yet, or nil if it is not charging
+func (db *DB) GetOpenChargingInterval(vin string) *ChargingInterval {
+	list := db.getChargingIntervals("select "+chargingIntervalColumns+" from charging_intervals where vehicle_vin = ? and ended_at = '' order by id desc limit 1", vin)
+	if len(list) == 0 {
+		return nil
 	}
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, []byte(nonce), []byte(ciphertext), nil)
+	return list[0]
+}
+
+func (db *DB) GetChargingIntervalsOfSession(sessionID int) []*ChargingInterval {
+	return db.getChargingIntervals("select "+chargingIntervalColumns+" from charging_intervals where session_id = ? order by started_at asc, id asc", sessionID)
+}
+
+// GetChargingIntervalsBetween returns the vehicle's intervals overlapping the period, oldest first
+func (db *DB) GetChargingIntervalsBetween(vin string, from time.Time, to time.Time) []*ChargingInterval {
+	return db.getChargingIntervals("select "+chargingIntervalColumns+" from charging_intervals where vehicle_vin = ? and started_at < ? and (ended_at = '' or ended_at > ?) order by started_at asc, id asc",
+		vin, db.formatSqliteDatetime(to), db.formatSqliteDatetime(from))
+}
+
+func (db *DB) getChargingIntervals(query string, args ...any) []*ChargingInterval {
+	result := []*ChargingInterval{}
+	rows, err := db.GetConnection().Query(query, args...)
 	if err != nil {
-		panic(err)
+		log.Println(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &ChargingInterval{}
+		var startedAt, endedAt string
+		var price sql.NullFloat64
+		rows.Scan(&e.ID, &e.SessionID, &e.VIN, &startedAt, &endedAt, &e.Source, &e.Amps, &price)
+		e.StartedAt, _ = time.Parse(SQLITE_DATETIME_LAYOUT, startedAt)
+		if endedAt != "" {
+			parsedTime, _ := time.Parse(SQLITE_DATETIME_LAYOUT, endedAt)
+			e.EndedAt = &parsedTime
+		}
+		if price.Valid {
+			e.Price = &price.Float64
+		}
+		result = append(result, e)
 	}
+	return result
+}
 
-	return string(plaintext)
+func (db *DB) DeleteChargingIntervals(before time.Time) int64 {
+	return db.deleteBefore("delete from charging_intervals where ended_at != '' and ended_at < ?", db.formatSqliteDatetime(before))
+}
+
+func (db *DB) UpdateChargingSession(e *ChargingSession) {
+	endedAt, measuredAt := "", ""
+	if e.EndedAt != nil {
+		endedAt = db.formatSqliteDatetime(*e.EndedAt)
+	}
+	if e.MeasuredAt != nil {
+		measuredAt = db.formatSqliteDatetime(*e.MeasuredAt)
+	}
+	if _, err := db.GetConnection().Exec("update charging_sessions set ended_at = ?, end_soc = ?, energy_solar = ?, energy_grid = ?, cost = ?, energy_measured = ?, measured_at = ?, emissions = ? where id = ?",
+		endedAt, e.EndSoC, e.EnergySolar, e.EnergyGrid, e.Cost, e.EnergyMeasured, measuredAt, e.Emissions, e.ID); err != nil {
+		log.Panicln(err)
+	}
 }
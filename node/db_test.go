@@ -141,9 +141,68 @@ func TestDB_GetVehicleIDsWithTibberTokenWithoutPricesForTomorrow(t *testing.T) {
 	assert.Equal(t, v.VIN, l[0])
 }
 
+func TestDB_PriceSourceHealth(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+
+	v := &Vehicle{
+		VIN:          "1",
+		DisplayName:  "V 1",
+		GridProvider: GridProviderTibber,
+		TibberToken:  "123",
+	}
+	GetDB().CreateUpdateVehicle(v)
+
+	// a second vehicle sharing the Tibber token shares the price source
+	v2 := &Vehicle{
+		VIN:          "2",
+		DisplayName:  "V 2",
+		GridProvider: GridProviderTibber,
+		TibberToken:  "123",
+	}
+	GetDB().CreateUpdateVehicle(v2)
+	source := GetPriceSourceID(v)
+	assert.Equal(t, source, GetPriceSourceID(v2))
+	assert.NotContains(t, source, "123")
+
+	assert.Nil(t, GetDB().GetPriceSourceHealth(source))
+	assert.True(t, IsPriceUpdateRetryDue(source))
+
+	GetDB().RecordPriceSourceError(source, GridProviderTibber, "timeout")
+	// the first retry is not before the next but one price update
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(PriceUpdateInterval)
+	assert.False(t, IsPriceUpdateRetryDue(source))
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(PriceUpdateInterval * 2)
+	assert.True(t, IsPriceUpdateRetryDue(source))
+
+	GetDB().RecordPriceSourceError(source, GridProviderTibber, "timeout")
+	health := GetPriceSourceHealthWithCoverage(v2)
+	assert.Equal(t, v2.VIN, health.VIN)
+	assert.Equal(t, 2, health.FailCount)
+	assert.Equal(t, "timeout", health.LastError)
+	assert.NotNil(t, health.LastErrorTime)
+	assert.Nil(t, health.LastSuccess)
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(PriceUpdateMinRetryDelay)
+	assert.False(t, IsPriceUpdateRetryDue(source))
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(PriceUpdateMinRetryDelay)
+	assert.True(t, IsPriceUpdateRetryDue(source))
+
+	GetDB().RecordPriceSourceSuccess(source, GridProviderTibber)
+	health = GetDB().GetPriceSourceHealth(source)
+	assert.Equal(t, 0, health.FailCount)
+	assert.NotNil(t, health.LastSuccess)
+
+	now := GlobalMockTime.CurTime
+	for i := 0; i < 5; i++ {
+		SetTibberTestPrice(v.VIN, now.Add(time.Hour*time.Duration(i)), 0.32)
+	}
+	assert.Equal(t, 4, GetPriceCoverageHours(v))
+}
+
 func TestDB_encrypt(t *testing.T) {
 	plaintext := "this is a test"
 	in := GetDB().encrypt(plaintext)
-	out := GetDB().decrypt(in)
+	out, err := GetDB().decrypt(in)
+	assert.Nil(t, err)
 	assert.Equal(t, plaintext, out)
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DigestPeriod string
+
+const (
+	DigestPeriodDaily  DigestPeriod = "daily"
+	DigestPeriodWeekly DigestPeriod = "weekly"
+)
+
+// DigestCheckInterval is the interval in which due digests are checked
+const DigestCheckInterval time.Duration = time.Minute
+
+// DigestMaxDelay prevents sending digests which were missed long ago, i.e. while the node was down
+const DigestMaxDelay time.Duration = time.Hour
+
+var digestTimeRegexp = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):([0-5][0-9])$`)
+
+// Digest summarizes a vehicle's charging during a period.
+// Cost and savings are only set if a price is known, emissions if a carbon intensity is known.
+// Solar energy is considered free and emission-free.
+type Digest struct {
+	VIN            string       `json:"vin"`
+	DisplayName    string       `json:"display_name"`
+	Period         DigestPeriod `json:"period"`
+	From           time.Time    `json:"from"`
+	To             time.Time    `json:"to"`
+	Sessions       int          `json:"sessions"`
+	EnergySolar    float64      `json:"energy_solar_kwh"`
+	EnergyGrid     float64      `json:"energy_grid_kwh"`
+	Cost           *float64     `json:"cost"`
+	ReferencePrice *float64     `json:"reference_price"`
+	Savings        *float64     `json:"savings"`
+	Emissions      *float64     `json:"emissions_grams"`
+	SoC            *int         `json:"soc"`
+}
+
+// DigestSchedule is the local time a digest is sent at, weekly digests on a specific weekday
+type DigestSchedule struct {
+	Period  DigestPeriod
+	Weekday time.Weekday
+	Hour    int
+	Minute  int
+}
+
+var TickerDigest *time.Ticker = nil
+
+var digestSchedules []*DigestSchedule
+
+func InitPeriodicDigest() {
+	digestSchedules = []*DigestSchedule{}
+	specs := map[DigestPeriod]string{
+		DigestPeriodDaily:  GetConfig().DigestDaily,
+		DigestPeriodWeekly: GetConfig().DigestWeekly,
+	}
+	for _, period := range []DigestPeriod{DigestPeriodDaily, DigestPeriodWeekly} {
+		if specs[period] == "" {
+			continue
+		}
+		schedule, err := ParseDigestSchedule(period, specs[period])
+		if err != nil {
+			log.Printf("Invalid %s digest schedule '%s': %s\n", period, specs[period], err.Error())
+			continue
+		}
+		digestSchedules = append(digestSchedules, schedule)
+	}
+	if len(digestSchedules) == 0 {
+		return
+	}
+	TickerDigest = time.NewTicker(DigestCheckInterval)
+	go func() {
+		for {
+			<-TickerDigest.C
+			PeriodicDigest(new(RealTime))
+		}
+	}()
+}
+
+// ParseDigestSchedule parses "HH:MM" for daily and "DAY HH:MM" for weekly digests, i.e. "sun 20:00"
+func ParseDigestSchedule(period DigestPeriod, spec string) (*DigestSchedule, error) {
+	schedule := &DigestSchedule{Period: period}
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if period == DigestPeriodWeekly {
+		tokens := strings.Fields(spec)
+		if len(tokens) != 2 {
+			return nil, errors.New("expected weekday and time, i.e. 'sun 20:00'")
+		}
+		weekday, ok := parseWeekday(tokens[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday '%s'", tokens[0])
+		}
+		schedule.Weekday = weekday
+		spec = tokens[1]
+	}
+	m := digestTimeRegexp.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, errors.New("expected time as HH:MM")
+	}
+	schedule.Hour, _ = strconv.Atoi(m[1])
+	schedule.Minute, _ = strconv.Atoi(m[2])
+	return schedule, nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if s == name || s == name[:3] {
+			return day, true
+		}
+	}
+	return time.Sunday, false
+}
+
+// Previous returns the latest scheduled time which is not after now
+func (s *DigestSchedule) Previous(now time.Time) time.Time {
+	local := now.In(time.Local)
+	res := time.Date(local.Year(), local.Month(), local.Day(), s.Hour, s.Minute, 0, 0, time.Local)
+	days := 1
+	if s.Period == DigestPeriodWeekly {
+		days = 7
+		res = res.AddDate(0, 0, -((int(res.Weekday()) - int(s.Weekday) + 7) % 7))
+	}
+	if res.After(now) {
+		res = res.AddDate(0, 0, -days)
+	}
+	return res
+}
+
+func getDigestSettingKey(period DigestPeriod) string {
+	if period == DigestPeriodWeekly {
+		return SettingLastDigestWeekly
+	}
+	return SettingLastDigestDaily
+}
+
+// PeriodicDigest sends the digests which are due and haven't been sent yet
+func PeriodicDigest(t Time) {
+	now := t.UTCNow()
+	for _, schedule := range digestSchedules {
+		due := schedule.Previous(now)
+		if now.Sub(due) > DigestMaxDelay {
+			continue
+		}
+		key := getDigestSettingKey(schedule.Period)
+		if last, err := time.Parse(time.RFC3339, GetDB().GetSetting(key)); err == nil && !last.Before(due) {
+			continue
+		}
+		GetDB().SetSetting(key, due.UTC().Format(time.RFC3339))
+		for _, vehicle := range GetDB().GetVehicles() {
+			digest := ComputeDigest(vehicle, schedule.Period, due.UTC())
+			SendPushNotification(NotificationCategoryDigest, digest.Format())
+		}
+	}
+}
+
+// ComputeDigest summarizes the vehicle's charging in the daily or weekly period ending at to
+func ComputeDigest(vehicle *Vehicle, period DigestPeriod, to time.Time) *Digest {
+	from := to.AddDate(0, 0, -1)
+	if period == DigestPeriodWeekly {
+		from = to.AddDate(0, 0, -7)
+	}
+	res := &Digest{
+		VIN:         vehicle.VIN,
+		DisplayName: vehicle.DisplayName,
+		Period:      period,
+		From:        from,
+		To:          to,
+	}
+
+	referencePrice := GetReferencePrice(vehicle.VIN, from, to)
+	intervals := getChargingIntervals(vehicle, from, to)
+	energy := estimateChargingEnergy(vehicle, intervals, referencePrice)
+	res.EnergySolar = energy.Solar
+	res.EnergyGrid = energy.Grid
+	sessions := map[int]bool{}
+	for _, interval := range intervals {
+		sessions[interval.SessionID] = true
+	}
+	res.Sessions = len(sessions)
+	if energy.CostKnown {
+		res.Cost = &energy.Cost
+	}
+	if energy.EmissionsKnown {
+		res.Emissions = &energy.Emissions
+	}
+	if referencePrice > 0 {
+		res.ReferencePrice = &referencePrice
+		if res.Cost != nil {
+			savings := (res.EnergySolar+res.EnergyGrid)*referencePrice - energy.Cost
+			res.Savings = &savings
+		}
+	}
+
+	// the state is only current if the period ends now
+	if state := GetDB().GetVehicleState(vehicle.VIN); state != nil && !to.Before(GetDB().Time.UTCNow().Add(-DigestMaxDelay)) {
+		res.SoC = &state.SoC
+	}
+	return res
+}
+
+// Format returns the digest as a notification text
+func (d *Digest) Format() string {
+	title := "Daily"
+	if d.Period == DigestPeriodWeekly {
+		title = "Weekly"
+	}
+	lines := []string{
+		fmt.Sprintf("%s report for %s:", title, d.DisplayName),
+		fmt.Sprintf("Charged %.1f kWh in %d session(s), %.1f kWh from solar and %.1f kWh from grid.",
+			d.EnergySolar+d.EnergyGrid, d.Sessions, d.EnergySolar, d.EnergyGrid),
+	}
+	if d.Cost != nil {
+		line := fmt.Sprintf("Estimated cost: %.2f", *d.Cost)
+		if d.Savings != nil {
+			line += fmt.Sprintf(", saved %.2f compared to an average price of %.2f per kWh", *d.Savings, *d.ReferencePrice)
+		}
+		lines = append(lines, line+".")
+	}
+	if d.Emissions != nil {
+		lines = append(lines, fmt.Sprintf("Estimated emissions: %.2f kg CO2.", *d.Emissions/1000))
+	}
+	if d.SoC != nil {
+		lines = append(lines, fmt.Sprintf("Current SoC: %d %%.", *d.SoC))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createDigestTestVehicle() *Vehicle {
+	v := &Vehicle{
+		VIN:         "123",
+		DisplayName: "Model 3",
+		Enabled:     true,
+		TargetSoC:   80,
+		MaxAmps:     16,
+		NumPhases:   3,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 75)
+	return v
+}
+
+func setDigestReferencePrice(t *testing.T, price float64) {
+	old := GetConfig().DigestReferencePrice
+	t.Cleanup(func() {
+		GetConfig().DigestReferencePrice = old
+	})
+	GetConfig().DigestReferencePrice = price
+}
+
+func TestDigest_Compute(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	setDigestReferencePrice(t, 0.30)
+	now := time.Date(2024, 6, 10, 20, 0, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = now
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+
+	// started before the period, 30 minutes on grid are within the period without a known price
+	GlobalMockTime.CurTime = now.Add(-25 * time.Hour)
+	StartChargingSession(v, 40)
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, now.Add(-25*time.Hour))
+	stopTestCharging(cc, v, now.Add(-23*time.Hour-30*time.Minute))
+	// one hour on grid at 0.20 and 300 g/kWh
+	SetTibberTestPrice(v.VIN, time.Date(2024, 6, 10, 2, 0, 0, 0, time.UTC), 0.20)
+	GetDB().SetCarbonIntensity(GetConfig().CarbonZone, 2024, 6, 10, 2, 300)
+	GlobalMockTime.CurTime = time.Date(2024, 6, 10, 2, 0, 0, 0, time.UTC)
+	StartChargingSession(v, 50)
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, time.Date(2024, 6, 10, 2, 0, 0, 0, time.UTC))
+	stopTestCharging(cc, v, time.Date(2024, 6, 10, 3, 0, 0, 0, time.UTC))
+	// two hours on solar with 8 and 12 amps
+	GlobalMockTime.CurTime = time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC)
+	StartChargingSession(v, 60)
+	startTestCharging(cc, v, ChargeStateChargingOnSolar, 8, time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC))
+	adjustTestChargingAmps(cc, v, 12, time.Date(2024, 6, 10, 11, 0, 0, 0, time.UTC))
+	GlobalMockTime.CurTime = time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	OnVehicleUnplugged(v, GetDB().GetVehicleState(v.VIN))
+	GlobalMockTime.CurTime = now
+
+	d := ComputeDigest(v, DigestPeriodDaily, now)
+	assert.Equal(t, now.Add(-24*time.Hour), d.From)
+	assert.Equal(t, 3, d.Sessions)
+	assert.InDelta(t, 13.8, d.EnergySolar, 0.001)
+	assert.InDelta(t, 16.56, d.EnergyGrid, 0.001)
+	assert.NotNil(t, d.Cost)
+	assert.InDelta(t, 2.208+1.656, *d.Cost, 0.001)
+	assert.InDelta(t, 0.30, *d.ReferencePrice, 0.001)
+	assert.InDelta(t, 30.36*0.30-3.864, *d.Savings, 0.001)
+	assert.InDelta(t, 11.04*300, *d.Emissions, 0.001)
+	assert.Equal(t, 75, *d.SoC)
+
+	msg := d.Format()
+	assert.Contains(t, msg, "Daily report for Model 3:")
+	assert.Contains(t, msg, "Charged 30.4 kWh in 3 session(s), 13.8 kWh from solar and 16.6 kWh from grid.")
+	assert.Contains(t, msg, "Estimated cost: 3.86, saved 5.24 compared to an average price of 0.30 per kWh.")
+	assert.Contains(t, msg, "Estimated emissions: 3.31 kg CO2.")
+	assert.Contains(t, msg, "Current SoC: 75 %.")
+}
+
+func TestDigest_OngoingSessionAveragePrice(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	setDigestReferencePrice(t, 0)
+	now := time.Date(2024, 6, 10, 20, 30, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = now
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+	SetTibberTestPrice(v.VIN, time.Date(2024, 6, 10, 19, 0, 0, 0, time.UTC), 0.10)
+	SetTibberTestPrice(v.VIN, time.Date(2024, 6, 10, 18, 0, 0, 0, time.UTC), 0.30)
+
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, time.Date(2024, 6, 10, 19, 30, 0, 0, time.UTC))
+	// the controller's tick continues the interval in the next hour
+	GlobalMockTime.CurTime = now
+	RefreshChargingSession(v)
+
+	d := ComputeDigest(v, DigestPeriodWeekly, now)
+	assert.Equal(t, now.AddDate(0, 0, -7), d.From)
+	assert.Equal(t, 1, d.Sessions)
+	assert.InDelta(t, 11.04, d.EnergyGrid, 0.001)
+	assert.InDelta(t, 0.20, *d.ReferencePrice, 0.001)
+	// 30 minutes at 0.10 and 30 minutes at the average price, as the current hour's price is unknown
+	assert.InDelta(t, 5.52*0.10+5.52*0.20, *d.Cost, 0.001)
+	assert.InDelta(t, 11.04*0.20-1.656, *d.Savings, 0.001)
+}
+
+func TestDigest_NoPrices(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	setDigestReferencePrice(t, 0)
+	now := time.Date(2024, 6, 10, 20, 0, 0, 0, time.UTC)
+	GlobalMockTime.CurTime = now
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, now.Add(-2*time.Hour))
+	stopTestCharging(cc, v, now.Add(-1*time.Hour))
+	GlobalMockTime.CurTime = now
+
+	// the SoC is only reported for periods ending now
+	d := ComputeDigest(v, DigestPeriodDaily, now.Add(-3*time.Hour))
+	assert.Equal(t, 0, d.Sessions)
+	assert.Nil(t, d.SoC)
+
+	d = ComputeDigest(v, DigestPeriodDaily, now)
+	assert.InDelta(t, 11.04, d.EnergyGrid, 0.001)
+	assert.Nil(t, d.Cost)
+	assert.Nil(t, d.ReferencePrice)
+	assert.Nil(t, d.Savings)
+	assert.Nil(t, d.Emissions)
+	assert.NotContains(t, d.Format(), "Estimated cost")
+	assert.NotContains(t, d.Format(), "Estimated emissions")
+}
+
+func TestDigest_ParseSchedule(t *testing.T) {
+	s, err := ParseDigestSchedule(DigestPeriodDaily, "20:15")
+	assert.Nil(t, err)
+	assert.Equal(t, 20, s.Hour)
+	assert.Equal(t, 15, s.Minute)
+
+	s, err = ParseDigestSchedule(DigestPeriodWeekly, "Sunday 8:00")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Sunday, s.Weekday)
+	assert.Equal(t, 8, s.Hour)
+
+	_, err = ParseDigestSchedule(DigestPeriodDaily, "25:00")
+	assert.NotNil(t, err)
+	_, err = ParseDigestSchedule(DigestPeriodWeekly, "20:00")
+	assert.NotNil(t, err)
+	_, err = ParseDigestSchedule(DigestPeriodWeekly, "someday 20:00")
+	assert.NotNil(t, err)
+}
+
+func TestDigest_SchedulePrevious(t *testing.T) {
+	daily := &DigestSchedule{Period: DigestPeriodDaily, Hour: 20}
+	now := time.Date(2024, 6, 10, 19, 0, 0, 0, time.Local) // monday
+	assert.Equal(t, time.Date(2024, 6, 9, 20, 0, 0, 0, time.Local), daily.Previous(now))
+	now = time.Date(2024, 6, 10, 20, 0, 0, 0, time.Local)
+	assert.Equal(t, now, daily.Previous(now))
+
+	weekly := &DigestSchedule{Period: DigestPeriodWeekly, Weekday: time.Sunday, Hour: 20}
+	assert.Equal(t, time.Date(2024, 6, 9, 20, 0, 0, 0, time.Local), weekly.Previous(now))
+	now = time.Date(2024, 6, 9, 19, 0, 0, 0, time.Local)
+	assert.Equal(t, time.Date(2024, 6, 2, 20, 0, 0, 0, time.Local), weekly.Previous(now))
+}
+
+func TestDigest_Periodic(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetNotifyConfig(t)
+	schedules := digestSchedules
+	t.Cleanup(func() {
+		digestSchedules = schedules
+	})
+	notifier := &mockNotifier{name: "ntfy"}
+	NotifiersInstance = []Notifier{notifier}
+	GetConfig().NotifyDigest = "ntfy"
+	createDigestTestVehicle()
+
+	due := time.Date(2024, 6, 10, 20, 0, 0, 0, time.Local)
+	digestSchedules = []*DigestSchedule{{Period: DigestPeriodDaily, Hour: 20}}
+
+	GlobalMockTime.CurTime = due.Add(-time.Minute).UTC()
+	PeriodicDigest(GlobalMockTime)
+	// the previous day's digest was missed too long ago
+	assert.Len(t, notifier.messages, 0)
+
+	GlobalMockTime.CurTime = due.Add(time.Minute).UTC()
+	PeriodicDigest(GlobalMockTime)
+	assert.Len(t, notifier.messages, 1)
+	assert.Contains(t, notifier.messages[0], "digest: Daily report for Model 3:")
+
+	// sent once only
+	GlobalMockTime.CurTime = due.Add(2 * time.Minute).UTC()
+	PeriodicDigest(GlobalMockTime)
+	assert.Len(t, notifier.messages, 1)
+
+	GlobalMockTime.CurTime = due.AddDate(0, 0, 1).UTC()
+	PeriodicDigest(GlobalMockTime)
+	assert.Len(t, notifier.messages, 2)
+}
+
+func TestDigest_Router(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+	now := GlobalMockTime.CurTime
+	startTestCharging(cc, v, ChargeStateChargingOnSolar, 10, now.Add(-time.Hour))
+	stopTestCharging(cc, v, now.Add(-30*time.Minute))
+	GlobalMockTime.CurTime = now
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/digest/"+v.VIN+"?period=weekly", readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	var d Digest
+	json.Unmarshal(res.Body.Bytes(), &d)
+	assert.Equal(t, DigestPeriodWeekly, d.Period)
+	assert.Equal(t, 1, d.Sessions)
+	assert.InDelta(t, 3.45, d.EnergySolar, 0.001)
+
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/digest/"+v.VIN+"?period=monthly", readKey, nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/digest/unknown", readKey, nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Formula is a parsed arithmetic expression over named variables,
+// i.e. "-grid_power" or "pv - load". Supports + - * / and parentheses.
+type Formula struct {
+	Expression string
+	root       formulaNode
+}
+
+type formulaNode interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type formulaNumber float64
+
+type formulaVariable string
+
+type formulaUnary struct {
+	operand formulaNode
+}
+
+type formulaBinary struct {
+	op          byte
+	left, right formulaNode
+}
+
+func (n formulaNumber) eval(vars map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (n formulaVariable) eval(vars map[string]float64) (float64, error) {
+	value, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("unknown variable '%s'", string(n))
+	}
+	return value, nil
+}
+
+func (n *formulaUnary) eval(vars map[string]float64) (float64, error) {
+	value, err := n.operand.eval(vars)
+	return -value, err
+}
+
+func (n *formulaBinary) eval(vars map[string]float64) (float64, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	case '/':
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	}
+	return 0, fmt.Errorf("unknown operator '%c'", n.op)
+}
+
+type formulaParser struct {
+	input string
+	pos   int
+}
+
+func ParseFormula(expression string) (*Formula, error) {
+	p := &formulaParser{input: expression}
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipWhitespace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected '%c' at position %d", p.input[p.pos], p.pos)
+	}
+	return &Formula{Expression: expression, root: root}, nil
+}
+
+func (f *Formula) Evaluate(vars map[string]float64) (float64, error) {
+	return f.root.eval(vars)
+}
+
+// Variables returns the names of all variables the formula refers to
+func (f *Formula) Variables() []string {
+	res := []string{}
+	var walk func(node formulaNode)
+	walk = func(node formulaNode) {
+		switch n := node.(type) {
+		case formulaVariable:
+			if !slices.Contains(res, string(n)) {
+				res = append(res, string(n))
+			}
+		case *formulaUnary:
+			walk(n.operand)
+		case *formulaBinary:
+			walk(n.left)
+			walk(n.right)
+		}
+	}
+	walk(f.root)
+	return res
+}
+
+func (p *formulaParser) skipWhitespace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *formulaParser) peek() byte {
+	p.skipWhitespace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *formulaParser) parseExpression() (formulaNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *formulaParser) parseTerm() (formulaNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *formulaParser) parseFactor() (formulaNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of formula")
+	case c == '-':
+		p.pos++
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &formulaUnary{operand: operand}, nil
+	case c == '+':
+		p.pos++
+		return p.parseFactor()
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+		return node, nil
+	case (c >= '0' && c <= '9') || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && ((p.input[p.pos] >= '0' && p.input[p.pos] <= '9') || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		return formulaNumber(value), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] == '_' || unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		return formulaVariable(strings.ToLower(p.input[start:p.pos])), nil
+	}
+	return nil, fmt.Errorf("unexpected '%c' at position %d", c, p.pos)
+}
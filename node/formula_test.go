@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormula_Evaluate(t *testing.T) {
+	vars := map[string]float64{
+		"pv":         5000,
+		"load":       1200,
+		"grid_power": -800,
+	}
+	tests := map[string]float64{
+		"-grid_power":         800,
+		"pv - load":           3800,
+		"pv - load * 2":       2600,
+		"(pv - load) / 2":     1900,
+		"-(grid_power - 200)": 1000,
+		"PV * 0.5":            2500,
+		"42":                  42,
+	}
+	for expression, expected := range tests {
+		f, err := ParseFormula(expression)
+		assert.Nil(t, err, expression)
+		res, err := f.Evaluate(vars)
+		assert.Nil(t, err, expression)
+		assert.Equal(t, expected, res, expression)
+	}
+
+	for _, expression := range []string{"", "pv -", "(pv - load", "pv load", "pv $ load"} {
+		_, err := ParseFormula(expression)
+		assert.NotNil(t, err, expression)
+	}
+
+	f, _ := ParseFormula("-(pv - load) * pv + grid_power / 2")
+	assert.Equal(t, []string{"pv", "load", "grid_power"}, f.Variables())
+
+	f, _ = ParseFormula("pv - unknown")
+	_, err := f.Evaluate(vars)
+	assert.NotNil(t, err)
+
+	f, _ = ParseFormula("pv / (load - 1200)")
+	_, err = f.Evaluate(vars)
+	assert.NotNil(t, err)
+}
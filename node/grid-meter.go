@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+)
+
+// RecordGridPower records a reading of the grid connection point's meter
+// (positive values for grid import, negative values for grid export).
+//
+// In grid meter mode, the power drawn by vehicles currently charging on solar is added to
+// the surplus at the time of the reading and each vehicle's draw is recorded, so the charge
+// controller doesn't need to add back its own (possibly outdated) draw later on.
+func RecordGridPower(gridWatts int) {
+	if !GetConfig().GridMeterMode {
+		GetDB().RecordSurplus(gridWatts * -1)
+		return
+	}
+	draws := GetSolarChargingDraws()
+	vehicleWatts := 0
+	for _, watts := range draws {
+		vehicleWatts += watts
+	}
+	GetDB().RecordSurplusWithVehicleDraws(gridWatts*-1+vehicleWatts, vehicleWatts, draws)
+}
+
+// GetSolarChargingDraws returns the power drawn by each vehicle charging on solar, by VIN
+func GetSolarChargingDraws() map[string]int {
+	res := make(map[string]int)
+	for _, vehicle := range GetDB().GetVehicles() {
+		state := GetDB().GetVehicleState(vehicle.VIN)
+		if state == nil || !state.PluggedIn || state.Charging != ChargeStateChargingOnSolar || state.Amps <= 0 {
+			continue
+		}
+		res[vehicle.VIN] = state.Amps * 230 * vehicle.NumPhases
+	}
+	return res
+}
+
+// GetLatestAmpsCommand returns the time the charging amps were last commanded by chargebot
+func GetLatestAmpsCommand(vin string) *time.Time {
+	var res *time.Time
+	for _, eventType := range []int{LogEventSetChargingAmps, LogEventChargeStart} {
+		event := GetDB().GetLatestChargingEvent(vin, eventType)
+		if event != nil && (res == nil || event.Timestamp.After(*res)) {
+			res = &event.Timestamp
+		}
+	}
+	return res
+}
+
+// IsTelemetryAmpsOutdated checks whether a telemetry reading was measured before the last amps command.
+// In this case, the vehicle's draw reported by telemetry lags behind and must not replace the commanded amps.
+func IsTelemetryAmpsOutdated(vin string, measuredAt time.Time) bool {
+	latestCommand := GetLatestAmpsCommand(vin)
+	if latestCommand == nil {
+		return false
+	}
+	return measuredAt.Before(*latestCommand)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	. "github.com/virtualzone/chargebot/goshared"
+)
+
+func TestGridMeter_RecordGridPower(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := &Vehicle{
+		VIN:       "123",
+		NumPhases: 3,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateChargingOnSolar)
+	GetDB().SetVehicleStateAmps(v.VIN, 8)
+
+	// surplus mode: grid export is recorded as surplus
+	RecordGridPower(-500)
+	records := GetDB().GetLatestSurplusRecords(1)
+	assert.Equal(t, 500, records[0].SurplusWatts)
+	assert.Nil(t, records[0].VehicleWatts)
+
+	// grid meter mode: draw of vehicle charging on solar is added at the time of the reading
+	GetConfig().GridMeterMode = true
+	defer func() { GetConfig().GridMeterMode = false }()
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Minute)
+	RecordGridPower(-500)
+	records = GetDB().GetLatestSurplusRecords(1)
+	assert.Equal(t, 500+8*230*3, records[0].SurplusWatts)
+	assert.Equal(t, 8*230*3, *records[0].VehicleWatts)
+
+	// available surplus doesn't depend on the vehicle's amps at the time of evaluation
+	cc := NewTestChargeController()
+	state := GetDB().GetVehicleState(v.VIN)
+	state.Amps = 16
+	assert.Equal(t, 500+8*230*3, cc.getAvailableSurplus(v, state, records[0]))
+	state.Charging = ChargeStateNotCharging
+	assert.Equal(t, 500, cc.getAvailableSurplus(v, state, records[0]))
+
+	// vehicles not charging on solar are not considered
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateChargingOnGrid)
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Minute)
+	RecordGridPower(2000)
+	records = GetDB().GetLatestSurplusRecords(1)
+	assert.Equal(t, -2000, records[0].SurplusWatts)
+	assert.Equal(t, 0, *records[0].VehicleWatts)
+}
+
+func TestGridMeter_RecordGridPowerTwoVehicles(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	GetConfig().GridMeterMode = true
+	defer func() { GetConfig().GridMeterMode = false }()
+	v1 := &Vehicle{VIN: "123", NumPhases: 3}
+	v2 := &Vehicle{VIN: "456", NumPhases: 1}
+	for _, v := range []*Vehicle{v1, v2} {
+		GetDB().CreateUpdateVehicle(v)
+		GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+		GetDB().SetVehicleStateCharging(v.VIN, ChargeStateChargingOnSolar)
+	}
+	GetDB().SetVehicleStateAmps(v1.VIN, 8)
+	GetDB().SetVehicleStateAmps(v2.VIN, 10)
+
+	RecordGridPower(-500)
+	records := GetDB().GetLatestSurplusRecords(1)
+	assert.Equal(t, 500+8*230*3+10*230, records[0].SurplusWatts)
+	assert.Equal(t, 8*230*3+10*230, *records[0].VehicleWatts)
+	assert.Equal(t, map[string]int{v1.VIN: 8 * 230 * 3, v2.VIN: 10 * 230}, records[0].VehicleDraws)
+
+	// each vehicle is only credited with its own draw, not the other vehicle's
+	cc := NewTestChargeController()
+	assert.Equal(t, 500+8*230*3, cc.getAvailableSurplus(v1, GetDB().GetVehicleState(v1.VIN), records[0]))
+	assert.Equal(t, 500+10*230, cc.getAvailableSurplus(v2, GetDB().GetVehicleState(v2.VIN), records[0]))
+}
+
+func TestGridMeter_TelemetryAmpsOutdated(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v := &Vehicle{
+		VIN:       "123",
+		NumPhases: 3,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateChargingOnSolar)
+	GetDB().SetVehicleStateIsHome(v.VIN, true)
+	now := GlobalMockTime.CurTime.Truncate(time.Second)
+	assert.False(t, IsTelemetryAmpsOutdated(v.VIN, now))
+
+	// amps commanded by chargebot
+	GetDB().SetVehicleStateAmps(v.VIN, 10)
+	GetDB().LogChargingEvent(v.VIN, LogEventSetChargingAmps, "charge amps set to 10")
+	assert.True(t, IsTelemetryAmpsOutdated(v.VIN, now.Add(-30*time.Second)))
+	assert.False(t, IsTelemetryAmpsOutdated(v.VIN, now.Add(30*time.Second)))
+
+	// telemetry measured before the command doesn't overwrite the commanded amps
+	GetConfig().PlugStateAutodetection = false
+	defer func() { GetConfig().PlugStateAutodetection = true }()
+	poller := &TelemetryPoller{}
+	poller.processState(&PersistedTelemetryState{VIN: v.VIN, Charging: true, IsHome: true, SoC: 50, Amps: 6, UTC: now.Add(-30 * time.Second).Unix()})
+	assert.Equal(t, 10, GetDB().GetVehicleState(v.VIN).Amps)
+	poller.processState(&PersistedTelemetryState{VIN: v.VIN, Charging: true, IsHome: true, SoC: 50, Amps: 9, UTC: now.Add(30 * time.Second).Unix()})
+	assert.Equal(t, 9, GetDB().GetVehicleState(v.VIN).Amps)
+}
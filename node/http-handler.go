@@ -16,6 +16,7 @@ import (
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var httpRouter *mux.Router
@@ -104,12 +105,17 @@ func InitHTTPRouter() {
 	routers["/api/1/ctrl/"] = &ManualControlRouter{}
 	routers["/api/1/tesla/"] = &TeslaRouter{}
 	routers["/api/1/user/"] = &UserRouter{}
+	routers["/api/1/backup/"] = &BackupRouter{}
+	routers["/api/1/auth/"] = &AuthRouter{}
+	routers["/api/1/webhooks/"] = &WebhookRouter{}
 
 	for prefix, route := range routers {
 		subRouter := router.PathPrefix(prefix).Subrouter()
 		route.SetupRoutes(subRouter)
 	}
 
+	router.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})).Methods("GET")
+
 	if GetConfig().DevProxy {
 		target, _ := url.Parse("http://localhost:3001")
 		proxy := httputil.NewSingleHostReverseProxy(target)
@@ -119,6 +125,8 @@ func InitHTTPRouter() {
 		router.PathPrefix("/").Handler(fs)
 	}
 
+	router.Use(VerifyAuthMiddleware)
+
 	httpRouter = router
 }
 
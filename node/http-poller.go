@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HTTPPollValue describes a single value read from a local JSON endpoint,
+// i.e. {"name": "grid_power", "url": "http://shelly/status", "path": "$.emeters[0].power"}
+type HTTPPollValue struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+}
+
+type HTTPPoller struct {
+	Interrupt chan os.Signal
+	Values    []*HTTPPollValue
+	Formula   *Formula
+	client    *http.Client
+	ticker    *time.Ticker
+}
+
+func NewHTTPPoller() *HTTPPoller {
+	return &HTTPPoller{
+		Interrupt: make(chan os.Signal, 1),
+		client: &http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+}
+
+func (p *HTTPPoller) Init(values string, formula string) error {
+	p.Values = nil
+	if err := json.Unmarshal([]byte(values), &p.Values); err != nil {
+		return fmt.Errorf("could not parse values: %s", err.Error())
+	}
+	if len(p.Values) == 0 {
+		return errors.New("no values configured")
+	}
+	for _, v := range p.Values {
+		v.Name = strings.ToLower(v.Name)
+		if v.Name == "" || v.URL == "" || v.Path == "" {
+			return errors.New("name, url and path are required for each value")
+		}
+		if _, err := parseJSONPath(v.Path); err != nil {
+			return fmt.Errorf("invalid path for value '%s': %s", v.Name, err.Error())
+		}
+	}
+	if formula == "" && len(p.Values) == 1 {
+		formula = p.Values[0].Name
+	}
+	f, err := ParseFormula(formula)
+	if err != nil {
+		return fmt.Errorf("invalid formula: %s", err.Error())
+	}
+	for _, name := range f.Variables() {
+		if !slices.ContainsFunc(p.Values, func(v *HTTPPollValue) bool { return v.Name == name }) {
+			return fmt.Errorf("invalid formula: unknown variable '%s'", name)
+		}
+	}
+	p.Formula = f
+	return nil
+}
+
+func (p *HTTPPoller) Poll() {
+	if GetConfig().HTTPPollValues == "" {
+		return
+	}
+
+	log.Println("Initializing HTTP poller...")
+	if err := p.Init(GetConfig().HTTPPollValues, GetConfig().HTTPPollFormula); err != nil {
+		log.Panicf("Invalid HTTP poller config: %s\n", err.Error())
+	}
+
+	p.ticker = time.NewTicker(time.Second * time.Duration(GetConfig().HTTPPollInterval))
+	go func() {
+		for {
+			select {
+			case <-p.ticker.C:
+				if err := p.update(); err != nil {
+					log.Println("Error polling HTTP surplus source:", err)
+				}
+			case <-p.Interrupt:
+				p.ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (p *HTTPPoller) update() error {
+	surplus, err := p.getSurplus()
+	if err != nil {
+		return err
+	}
+	if GetConfig().HTTPPollGridMeter {
+		// formula returns the grid power
+		RecordGridPower(surplus)
+	} else {
+		GetDB().RecordSurplus(surplus)
+	}
+	return nil
+}
+
+func (p *HTTPPoller) getSurplus() (int, error) {
+	// each URL is only requested once per poll, even if several values are read from it
+	responses := make(map[string]interface{})
+	vars := make(map[string]float64)
+	for _, v := range p.Values {
+		data, ok := responses[v.URL]
+		if !ok {
+			var err error
+			data, err = p.fetch(v)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %s", v.URL, err.Error())
+			}
+			responses[v.URL] = data
+		}
+		value, err := JSONPathFloat(data, v.Path)
+		if err != nil {
+			return 0, fmt.Errorf("value '%s': %s", v.Name, err.Error())
+		}
+		vars[v.Name] = value
+	}
+	res, err := p.Formula.Evaluate(vars)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round(res)), nil
+}
+
+func (p *HTTPPoller) fetch(v *HTTPPollValue) (interface{}, error) {
+	r, err := http.NewRequest("GET", v.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range v.Headers {
+		r.Header.Set(key, value)
+	}
+	resp, err := p.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+	var data interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPPoller_JSONPath(t *testing.T) {
+	var data interface{}
+	json.Unmarshal([]byte(`{"emeters": [{"power": -812.5}, {"power": "13.2"}], "Body": {"Data": {"Site": {"P_PV": 4500}}}, "on": true}`), &data)
+
+	tests := map[string]float64{
+		"$.emeters[0].power":                -812.5,
+		"emeters[1].power":                  13.2,
+		"$.emeters[-1].power":               13.2,
+		"$['Body']['Data']['Site']['P_PV']": 4500,
+		"$.Body.Data[\"Site\"].P_PV":        4500,
+		"$.on":                              1,
+	}
+	for path, expected := range tests {
+		res, err := JSONPathFloat(data, path)
+		assert.Nil(t, err, path)
+		assert.Equal(t, expected, res, path)
+	}
+
+	for _, path := range []string{"$.emeters[2].power", "$.missing", "$.emeters", "$.on.value", "$.emeters[0", "$..power"} {
+		_, err := JSONPathFloat(data, path)
+		assert.NotNil(t, err, path)
+	}
+}
+
+func TestHTTPPoller_update(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/fronius":
+			assert.Equal(t, "secret", r.Header.Get("Authorization"))
+			w.Write([]byte(`{"Body": {"Data": {"Site": {"P_PV": 5000, "P_Load": -1200}}}}`))
+		case "/shelly":
+			w.Write([]byte(`{"emeters": [{"power": -2300.4}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// production minus consumption from a single endpoint
+	p := NewHTTPPoller()
+	values := `[
+		{"name": "pv", "url": "` + server.URL + `/fronius", "path": "$.Body.Data.Site.P_PV", "headers": {"Authorization": "secret"}},
+		{"name": "load", "url": "` + server.URL + `/fronius", "path": "$.Body.Data.Site.P_Load", "headers": {"Authorization": "secret"}}
+	]`
+	assert.Nil(t, p.Init(values, "pv + load"))
+	assert.Nil(t, p.update())
+	assert.Equal(t, 1, requests["/fronius"])
+	records := GetDB().GetLatestSurplusRecords(1)
+	assert.Equal(t, 3800, records[0].SurplusWatts)
+
+	// grid meter
+	p = NewHTTPPoller()
+	assert.Nil(t, p.Init(`[{"name": "grid_power", "url": "`+server.URL+`/shelly", "path": "$.emeters[0].power"}]`, "-grid_power"))
+	surplus, err := p.getSurplus()
+	assert.Nil(t, err)
+	assert.Equal(t, 2300, surplus)
+
+	// formula defaults to the single value
+	assert.Nil(t, p.Init(`[{"name": "grid_power", "url": "`+server.URL+`/shelly", "path": "$.emeters[0].power"}]`, ""))
+	surplus, err = p.getSurplus()
+	assert.Nil(t, err)
+	assert.Equal(t, -2300, surplus)
+
+	// unreachable values are not recorded
+	assert.Nil(t, p.Init(`[{"name": "x", "url": "`+server.URL+`/unknown", "path": "$.x"}]`, ""))
+	assert.NotNil(t, p.update())
+
+	assert.NotNil(t, p.Init(`[{"name": "x", "url": "`+server.URL+`/shelly", "path": "$.x"}]`, "x -"))
+	assert.NotNil(t, p.Init(values, "pv - laod"))
+	assert.NotNil(t, p.Init(`[]`, ""))
+	assert.NotNil(t, p.Init(`[{"name": "x", "url": "`+server.URL+`/shelly", "path": "$.x"}, {"name": "y", "url": "`+server.URL+`/shelly", "path": "$.y"}]`, ""))
+}
+
+func TestHTTPPoller_intervalConfig(t *testing.T) {
+	t.Setenv("HTTP_POLL_INTERVAL", "0")
+	c := &Config{}
+	assert.Panics(t, func() {
+		c.ReadConfig()
+	})
+	t.Setenv("HTTP_POLL_INTERVAL", "15")
+	c.ReadConfig()
+	assert.Equal(t, 15, c.HTTPPollInterval)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPathLookup resolves a simple JSONPath expression like "$.emeters[0].power"
+// or "$['Body']['Data']['Site']['P_PV']" on decoded JSON data.
+// Only child member and array index selectors are supported.
+func JSONPathLookup(data interface{}, path string) (interface{}, error) {
+	tokens, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	cur := data
+	for _, token := range tokens {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member '%s' not found", token)
+			}
+			cur = value
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil {
+				return nil, fmt.Errorf("invalid array index '%s'", token)
+			}
+			if i < 0 {
+				i += len(node)
+			}
+			if i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("array index %s out of range", token)
+			}
+			cur = node[i]
+		default:
+			return nil, fmt.Errorf("cannot select '%s' on scalar value", token)
+		}
+	}
+	return cur, nil
+}
+
+// JSONPathFloat resolves the path and converts the result into a number.
+// Numeric strings and booleans are accepted as well.
+func JSONPathFloat(data interface{}, path string) (float64, error) {
+	value, err := JSONPathLookup(data, path)
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("value at '%s' is not numeric", path)
+}
+
+func parseJSONPath(path string) ([]string, error) {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	var tokens []string
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+			start := i
+			for i < len(path) && path[i] != '.' && path[i] != '[' {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("empty member name at position %d", start)
+			}
+			tokens = append(tokens, path[start:i])
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']' at position %d", i)
+			}
+			token := strings.TrimSpace(path[i+1 : i+end])
+			if len(token) >= 2 && (token[0] == '\'' || token[0] == '"') && token[len(token)-1] == token[0] {
+				token = token[1 : len(token)-1]
+			}
+			tokens = append(tokens, token)
+			i += end + 1
+		default:
+			// path without leading "$." like "emeters[0].power"
+			if i != 0 {
+				return nil, fmt.Errorf("unexpected '%c' at position %d", path[i], i)
+			}
+			path = "." + path
+		}
+	}
+	return tokens, nil
+}
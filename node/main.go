@@ -35,10 +35,6 @@ func sanityCheck() {
 		log.Println("TESLA_REFRESH_TOKEN copied to database")
 	}
 
-	if GetConfig().CryptKey != "" && len(GetConfig().CryptKey) != 32 {
-		log.Panicln("CRYPT_KEY must be 32 bytes long")
-	}
-
 	if GetConfig().Token == "" {
 		log.Panicln("TOKEN not specified, get yours at https://chargebot.io")
 	}
@@ -55,21 +51,45 @@ func sanityCheck() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(RunCommand(os.Args[1:]))
+	}
+
 	log.Println("Starting chargebot.io worker node...")
 	GetConfig().ReadConfig()
 	GetDB().Connect()
 	GetDB().InitDBStructure()
+	if num, err := ReencryptSecrets(); err != nil {
+		log.Fatalf("Could not read secrets: %s\n", err.Error())
+	} else if num > 0 {
+		log.Printf("Re-encrypted %d secrets with key version %d\n", num, GetConfig().CryptKeyVersion)
+	}
 	if GetConfig().InitDBOnly {
 		return
 	}
 	sanityCheck()
+	if !GetConfig().AuthEnabled {
+		log.Println("WARNING: Authentication is disabled, anyone in your network can control your vehicles")
+	} else if GetDB().GetNumUsers() == 0 {
+		log.Println("No user account exists yet, open the web UI to create one")
+	}
 
+	InitNotifiers()
+	StartNotificationQueue()
 	TeslaAPIInstance = &TeslaAPIProxy{}
 
 	ChargeControllerInstance = NewChargeController()
 	GetChargeController().Init()
+	RegisterStateCollector(GetChargeController())
+	OpenChargingSessions()
 
+	InitCarbonIntensityProvider()
 	InitPeriodicPriceUpdateControl()
+	InitPeriodicMaintenance()
+	InitPeriodicBackup()
+	InitPeriodicWebhookDelivery()
+	InitPeriodicDigest()
+	InitTelegramBot()
 
 	InitHTTPRouter()
 
@@ -81,17 +101,27 @@ func main() {
 	}
 	poller.Poll()
 
-	mqttSubscriber := &MqttSubscriber{
-		Interrupt: make(chan os.Signal),
-	}
-	mqttSubscriber.Listen()
+	MqttSubscriberInstance = NewMqttSubscriber()
+	GetMqttSubscriber().Listen()
+
+	tibberPulseSubscriber := NewTibberPulseSubscriber()
+	tibberPulseSubscriber.Listen()
+
+	modbusPoller := NewModbusPoller()
+	modbusPoller.Poll()
+
+	httpPoller := NewHTTPPoller()
+	httpPoller.Poll()
 
 	ServeHTTP()
 
 	for {
 		select {
 		case <-interrupt:
-			mqttSubscriber.Interrupt <- os.Interrupt
+			GetMqttSubscriber().Interrupt <- os.Interrupt
+			tibberPulseSubscriber.Interrupt <- os.Interrupt
+			modbusPoller.Interrupt <- os.Interrupt
+			httpPoller.Interrupt <- os.Interrupt
 			poller.Interrupt <- os.Interrupt
 			log.Println("Shutting down...")
 			os.Exit(0)
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -21,12 +24,14 @@ func TestMain(m *testing.M) {
 	os.Setenv("CRYPT_KEY", "12345678901234567890123456789012")
 	GetConfig().ReadConfig()
 	DelayBetweenAPICommands = time.Second * 0
+	webhookDeliverAsync = false
 	GlobalMockTime = &MockTime{
 		CurTime: time.Now().UTC(),
 	}
 	GetDB().Time = GlobalMockTime
 	GetDB().Connect()
 	ResetTestDB()
+	RegisterStateCollector(NewTestChargeController())
 	InitHTTPRouter()
 	code := m.Run()
 	os.Exit(code)
@@ -60,3 +65,17 @@ func NewTestChargeController() *ChargeController {
 	cc.Async = false
 	return cc
 }
+
+func newHTTPRequest(method, url, bearer string, body io.Reader) *http.Request {
+	req, _ := http.NewRequest(method, url, body)
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return req
+}
+
+func executeTestRequest(req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	httpRouter.ServeHTTP(rr, req)
+	return rr
+}
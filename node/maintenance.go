@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// MinVacuumFreePagesRatio is the share of unused pages required before the database file is compacted
+const MinVacuumFreePagesRatio float64 = 0.1
+
+// MaintenanceChunk limits the raw surplus records downsampled within one transaction,
+// so other writers aren't blocked for too long
+const MaintenanceChunk time.Duration = time.Hour * 24
+
+var TickerMaintenance *time.Ticker = nil
+
+func InitPeriodicMaintenance() {
+	if GetConfig().MaintenanceInterval <= 0 {
+		return
+	}
+	TickerMaintenance = time.NewTicker(time.Hour * time.Duration(GetConfig().MaintenanceInterval))
+	go func() {
+		for {
+			PeriodicMaintenance(new(RealTime))
+			<-TickerMaintenance.C
+		}
+	}()
+}
+
+func PeriodicMaintenance(t Time) {
+	now := t.UTCNow()
+	log.Println("Running database maintenance...")
+	MaintenanceDownsampleSurpluses(now)
+	if days := GetConfig().RetentionLogsDays; days > 0 {
+		if num := GetDB().DeleteChargingEvents(now.AddDate(0, 0, days*-1)); num > 0 {
+			log.Printf("Deleted %d charging events older than %d days\n", num, days)
+		}
+		if num := GetDB().DeleteChargingIntervals(now.AddDate(0, 0, days*-1)); num > 0 {
+			log.Printf("Deleted %d charging intervals older than %d days\n", num, days)
+		}
+		if num := GetDB().DeleteWebhookDeliveries(now.AddDate(0, 0, days*-1)); num > 0 {
+			log.Printf("Deleted %d webhook deliveries older than %d days\n", num, days)
+		}
+	}
+	if days := GetConfig().RetentionPricesDays; days > 0 {
+		if num := GetDB().DeleteGridData(now.AddDate(0, 0, days*-1)); num > 0 {
+			log.Printf("Deleted %d grid prices, hour blocks and carbon intensities older than %d days\n", num, days)
+		}
+	}
+	if num := GetDB().DeleteExpiredSessions(now); num > 0 {
+		log.Printf("Deleted %d expired sessions\n", num)
+	}
+	if err := GetDB().Analyze(); err != nil {
+		log.Println("Could not analyze database:", err)
+	}
+	MaintenanceVacuum(now)
+	log.Println("Database maintenance completed.")
+}
+
+// MaintenanceDownsampleSurpluses turns raw surplus records into per-minute aggregates
+// and per-minute aggregates into per-hour aggregates once they exceed their retention
+func MaintenanceDownsampleSurpluses(now time.Time) {
+	if hours := GetConfig().RetentionSurplusRawHours; hours > 0 {
+		before := now.Add(time.Hour * time.Duration(hours) * -1).Truncate(time.Minute)
+		var num int64 = 0
+		oldest := GetDB().GetOldestSurplusRecordTime()
+		for oldest != nil && oldest.Before(before) {
+			chunkEnd := oldest.Truncate(time.Minute).Add(MaintenanceChunk)
+			if chunkEnd.After(before) {
+				chunkEnd = before
+			}
+			n := GetDB().DownsampleSurpluses(chunkEnd)
+			if n == 0 {
+				break
+			}
+			num += n
+			oldest = GetDB().GetOldestSurplusRecordTime()
+		}
+		if num > 0 {
+			log.Printf("Downsampled %d surplus records older than %d hours\n", num, hours)
+		}
+	}
+	if days := GetConfig().RetentionSurplusMinDays; days > 0 {
+		before := now.AddDate(0, 0, days*-1).Truncate(time.Hour)
+		if num := GetDB().DownsampleSurplusAggregates(before); num > 0 {
+			log.Printf("Downsampled %d per-minute surplus aggregates older than %d days\n", num, days)
+		}
+	}
+	if days := GetConfig().RetentionSurplusHourDays; days > 0 {
+		if num := GetDB().DeleteSurplusAggregates(SurplusResolutionHour, now.AddDate(0, 0, days*-1)); num > 0 {
+			log.Printf("Deleted %d per-hour surplus aggregates older than %d days\n", num, days)
+		}
+	}
+}
+
+// MaintenanceVacuum compacts the database file at most once per configured interval,
+// and only if enough space can be reclaimed
+func MaintenanceVacuum(now time.Time) {
+	days := GetConfig().VacuumIntervalDays
+	if days <= 0 {
+		return
+	}
+	if lastVacuum, err := time.Parse(SQLITE_DATETIME_LAYOUT, GetDB().GetSetting(SettingLastVacuum)); err == nil {
+		if lastVacuum.After(now.AddDate(0, 0, days*-1)) {
+			return
+		}
+	}
+	if ratio := GetDB().GetFreePagesRatio(); ratio < MinVacuumFreePagesRatio {
+		return
+	}
+	log.Println("Vacuuming database...")
+	if err := GetDB().Vacuum(); err != nil {
+		log.Println("Could not vacuum database:", err)
+		return
+	}
+	GetDB().SetSetting(SettingLastVacuum, now.Format(SQLITE_DATETIME_LAYOUT))
+}
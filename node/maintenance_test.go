@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenance_DownsampleSurpluses(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// 4 days of samples every 20 seconds
+	for ts := start; ts.Before(start.AddDate(0, 0, 4)); ts = ts.Add(time.Second * 20) {
+		GlobalMockTime.CurTime = ts
+		GetDB().RecordSurplus(ts.Minute() * 100)
+	}
+	now := start.AddDate(0, 0, 4)
+
+	MaintenanceDownsampleSurpluses(now)
+
+	// raw records within last 48 hours are kept
+	oldest := GetDB().GetOldestSurplusRecordTime()
+	assert.NotNil(t, oldest)
+	assert.Equal(t, now.Add(time.Hour*-48), *oldest)
+
+	// older records have been merged into per-minute aggregates
+	res := GetDB().GetSurplusAggregates(SurplusResolutionMinute, start, now)
+	assert.Len(t, res, 48*60)
+	assert.Equal(t, start, res[0].Timestamp)
+	assert.Equal(t, 3, res[0].Samples)
+	assert.Equal(t, 0, res[0].AvgWatts)
+	assert.Equal(t, 100, res[1].AvgWatts)
+	assert.Equal(t, 100, res[1].MinWatts)
+	assert.Equal(t, 100, res[1].MaxWatts)
+
+	// per-minute aggregates are merged into per-hour aggregates after 30 days
+	now = now.AddDate(0, 0, 31)
+	MaintenanceDownsampleSurpluses(now)
+	assert.Len(t, GetDB().GetSurplusAggregates(SurplusResolutionMinute, start, now), 0)
+	res = GetDB().GetSurplusAggregates(SurplusResolutionHour, start, now)
+	assert.Len(t, res, 4*24)
+	assert.Equal(t, start, res[0].Timestamp)
+	assert.Equal(t, 180, res[0].Samples)
+	assert.Equal(t, 2950, res[0].AvgWatts)
+	assert.Equal(t, 0, res[0].MinWatts)
+	assert.Equal(t, 5900, res[0].MaxWatts)
+
+	// per-hour aggregates are deleted after two years
+	now = now.AddDate(2, 0, 0)
+	MaintenanceDownsampleSurpluses(now)
+	assert.Len(t, GetDB().GetSurplusAggregates(SurplusResolutionHour, start, now), 0)
+}
+
+func TestMaintenance_DownsampleVehicleWatts(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	// first minute without vehicle draw, second minute charging on solar, third minute draws of 1000 and 3000 watts
+	GlobalMockTime.CurTime = start
+	GetDB().RecordSurplus(1000)
+	GlobalMockTime.CurTime = start.Add(time.Minute)
+	GetDB().RecordSurplusWithVehicleDraws(3000, 2000, map[string]int{"123": 2000})
+	GlobalMockTime.CurTime = start.Add(2 * time.Minute)
+	GetDB().RecordSurplusWithVehicleDraws(3000, 1000, map[string]int{"123": 1000})
+	GlobalMockTime.CurTime = start.Add(2*time.Minute + 30*time.Second)
+	GetDB().RecordSurplusWithVehicleDraws(3000, 3000, map[string]int{"123": 3000})
+
+	GetDB().DownsampleSurpluses(start.Add(time.Hour))
+	res := GetDB().GetSurplusAggregates(SurplusResolutionMinute, start, start.Add(time.Hour))
+	assert.Len(t, res, 3)
+	assert.Nil(t, res[0].AvgVehicleWatts)
+	assert.Equal(t, 2000, *res[1].AvgVehicleWatts)
+	assert.Equal(t, 2000, *res[2].AvgVehicleWatts)
+
+	// samples without vehicle draw don't dilute the hourly average
+	GetDB().DownsampleSurplusAggregates(start.Add(time.Hour))
+	res = GetDB().GetSurplusAggregates(SurplusResolutionHour, start, start.Add(time.Hour))
+	assert.Len(t, res, 1)
+	assert.Equal(t, 4, res[0].Samples)
+	assert.Equal(t, 2000, *res[0].AvgVehicleWatts)
+
+	// the history covers the days before the injected time
+	GlobalMockTime.CurTime = start.Add(12 * time.Hour)
+	resp := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/surplus_history/"+SurplusResolutionHour, readKey, nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var history []*SurplusAggregate
+	json.Unmarshal(resp.Body.Bytes(), &history)
+	assert.Len(t, history, 1)
+	assert.Equal(t, 2000, *history[0].AvgVehicleWatts)
+	GlobalMockTime.CurTime = start.AddDate(0, 0, 2)
+	resp = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/surplus_history/"+SurplusResolutionHour, readKey, nil))
+	json.Unmarshal(resp.Body.Bytes(), &history)
+	assert.Len(t, history, 0)
+}
+
+func TestMaintenance_Retention(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	old := now.AddDate(-1, 0, -1)
+
+	GlobalMockTime.CurTime = old
+	GetDB().LogChargingEvent("123", LogEventChargeStart, "")
+	SetTibberTestPrice("123", old, 0.2)
+	GetDB().RecordSelectedGridHourblock("123", old.Year(), int(old.Month()), old.Day(), old.Hour())
+	GlobalMockTime.CurTime = now
+	GetDB().LogChargingEvent("123", LogEventChargeStop, "")
+	SetTibberTestPrice("123", now, 0.3)
+
+	PeriodicMaintenance(GlobalMockTime)
+
+	events := GetDB().GetLatestChargingEvents("123", 10)
+	assert.Len(t, events, 1)
+	assert.Equal(t, LogEventChargeStop, events[0].Event)
+	assert.Len(t, GetDB().GetUpcomingTibberPrices("123", false), 1)
+	assert.False(t, GetDB().IsSelectedGridHourblock("123", old.Year(), int(old.Month()), old.Day(), old.Hour()))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsDurationBuckets = prometheus.ExponentialBuckets(0.1, 2, 10) // 0.1s to 51.2s
+
+var (
+	metricChargingEvents = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_charging_events_total",
+		Help: "Number of logged charging events by type.",
+	}, []string{"vin", "event"})
+	metricTeslaAPIRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_tesla_api_requests_total",
+		Help: "Number of Tesla API requests by method.",
+	}, []string{"method"})
+	metricTeslaAPIErrors = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_tesla_api_errors_total",
+		Help: "Number of failed Tesla API requests by method.",
+	}, []string{"method"})
+	metricTeslaAPIDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chargebot_tesla_api_request_duration_seconds",
+		Help:    "Latency of Tesla API requests by method.",
+		Buckets: metricsDurationBuckets,
+	}, []string{"method"})
+	metricWakeups = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_vehicle_wakeups_total",
+		Help: "Number of vehicle wake-ups.",
+	}, []string{"vin"})
+	metricTickDuration = promauto.With(metricsRegistry).NewHistogram(prometheus.HistogramOpts{
+		Name:    "chargebot_charge_controller_tick_duration_seconds",
+		Help:    "Time the charge controller needed for processing a vehicle.",
+		Buckets: metricsDurationBuckets,
+	})
+	metricSkippedTicks = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_charge_controller_skipped_ticks_total",
+		Help: "Number of ticks skipped because the vehicle was still being processed.",
+	}, []string{"vin"})
+)
+
+var chargingEventNames = map[int]string{
+	LogEventChargeStart:          "charge_start",
+	LogEventChargeStop:           "charge_stop",
+	LogEventVehiclePlugIn:        "vehicle_plug_in",
+	LogEventVehicleUnplug:        "vehicle_unplug",
+	LogEventVehicleUpdateData:    "vehicle_update_data",
+	LogEventWakeVehicle:          "wake_vehicle",
+	LogEventSetTargetSoC:         "set_target_soc",
+	LogEventSetChargingAmps:      "set_charging_amps",
+	LogEventSetScheduledCharging: "set_scheduled_charging",
+	LogEventSurplusStale:         "surplus_stale",
+	LogEventSurplusRecovered:     "surplus_recovered",
+}
+
+func init() {
+	metricsRegistry.MustRegister(collectors.NewGoCollector())
+	metricsRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// RegisterStateCollector exposes the vehicle states, using the charge controller to compute the surplus available to each vehicle
+func RegisterStateCollector(cc *ChargeController) {
+	metricsRegistry.MustRegister(&StateCollector{ChargeController: cc})
+}
+
+func MetricsChargingEvent(vin string, eventType int) {
+	name, ok := chargingEventNames[eventType]
+	if !ok {
+		name = strconv.Itoa(eventType)
+	}
+	metricChargingEvents.WithLabelValues(vin, name).Inc()
+}
+
+// MetricsTeslaAPIRequest records a request by its method, i.e. "list_vehicles" or "charge_start".
+// The method must not contain the VIN, as each label value creates a time series.
+func MetricsTeslaAPIRequest(method string, start time.Time, err error) {
+	metricTeslaAPIRequests.WithLabelValues(method).Inc()
+	metricTeslaAPIDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricTeslaAPIErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func MetricsWakeup(vin string) {
+	metricWakeups.WithLabelValues(vin).Inc()
+}
+
+func MetricsTick(start time.Time) {
+	metricTickDuration.Observe(time.Since(start).Seconds())
+}
+
+func MetricsSkippedTick(vin string) {
+	metricSkippedTicks.WithLabelValues(vin).Inc()
+}
+
+// StateCollector reads the current vehicle states, surplus and price source health from the database on each scrape
+type StateCollector struct {
+	ChargeController *ChargeController
+}
+
+var (
+	descVehicleSoC            = prometheus.NewDesc("chargebot_vehicle_soc_percent", "Vehicle's state of charge.", []string{"vin"}, nil)
+	descVehicleAmps           = prometheus.NewDesc("chargebot_vehicle_charge_amps", "Vehicle's charging amps.", []string{"vin"}, nil)
+	descVehicleChargeLimit    = prometheus.NewDesc("chargebot_vehicle_charge_limit_percent", "Vehicle's charge limit.", []string{"vin"}, nil)
+	descVehicleChargingState  = prometheus.NewDesc("chargebot_vehicle_charging_state", "Vehicle's charging state (0 = not charging, 1 = on solar, 2 = on grid).", []string{"vin"}, nil)
+	descVehiclePluggedIn      = prometheus.NewDesc("chargebot_vehicle_plugged_in", "Whether the vehicle is plugged in.", []string{"vin"}, nil)
+	descVehicleSurplus        = prometheus.NewDesc("chargebot_vehicle_surplus_filtered_watts", "Surplus available to the vehicle as used by the charge controller, including its own draw and minus the surplus buffer.", []string{"vin"}, nil)
+	descSurplus               = prometheus.NewDesc("chargebot_surplus_watts", "Latest recorded surplus.", nil, nil)
+	descSurplusAge            = prometheus.NewDesc("chargebot_surplus_age_seconds", "Age of the latest recorded surplus.", nil, nil)
+	descPriceLastSuccess      = prometheus.NewDesc("chargebot_price_source_last_success_timestamp_seconds", "Time grid prices were last retrieved successfully.", []string{"vin", "provider"}, nil)
+	descPriceFailures         = prometheus.NewDesc("chargebot_price_source_failures", "Number of consecutive failures retrieving grid prices.", []string{"vin", "provider"}, nil)
+	descPriceCoverage         = prometheus.NewDesc("chargebot_price_source_coverage_hours", "Number of upcoming hours covered by known grid prices.", []string{"vin", "provider"}, nil)
+	stateCollectorDescriptors = []*prometheus.Desc{
+		descVehicleSoC, descVehicleAmps, descVehicleChargeLimit, descVehicleChargingState, descVehiclePluggedIn, descVehicleSurplus,
+		descSurplus, descSurplusAge,
+		descPriceLastSuccess, descPriceFailures, descPriceCoverage,
+	}
+)
+
+func (sc *StateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range stateCollectorDescriptors {
+		ch <- desc
+	}
+}
+
+func (sc *StateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, vehicle := range GetDB().GetVehicles() {
+		if state := GetDB().GetVehicleState(vehicle.VIN); state != nil {
+			ch <- prometheus.MustNewConstMetric(descVehicleSoC, prometheus.GaugeValue, float64(state.SoC), vehicle.VIN)
+			ch <- prometheus.MustNewConstMetric(descVehicleAmps, prometheus.GaugeValue, float64(state.Amps), vehicle.VIN)
+			ch <- prometheus.MustNewConstMetric(descVehicleChargeLimit, prometheus.GaugeValue, float64(state.ChargeLimit), vehicle.VIN)
+			ch <- prometheus.MustNewConstMetric(descVehicleChargingState, prometheus.GaugeValue, float64(state.Charging), vehicle.VIN)
+			ch <- prometheus.MustNewConstMetric(descVehiclePluggedIn, prometheus.GaugeValue, metricsBool(state.PluggedIn), vehicle.VIN)
+			if surplus := sc.ChargeController.getActualSurplus(vehicle, state); surplus != -1 {
+				ch <- prometheus.MustNewConstMetric(descVehicleSurplus, prometheus.GaugeValue, float64(surplus), vehicle.VIN)
+			}
+		}
+		if vehicle.LowcostCharging {
+			health := GetPriceSourceHealthWithCoverage(vehicle)
+			provider := string(vehicle.GridProvider)
+			if health.LastSuccess != nil {
+				ch <- prometheus.MustNewConstMetric(descPriceLastSuccess, prometheus.GaugeValue, float64(health.LastSuccess.Unix()), vehicle.VIN, provider)
+			}
+			ch <- prometheus.MustNewConstMetric(descPriceFailures, prometheus.GaugeValue, float64(health.FailCount), vehicle.VIN, provider)
+			ch <- prometheus.MustNewConstMetric(descPriceCoverage, prometheus.GaugeValue, float64(health.CoverageHours), vehicle.VIN, provider)
+		}
+	}
+	if surpluses := GetDB().GetLatestSurplusRecords(1); len(surpluses) > 0 {
+		ch <- prometheus.MustNewConstMetric(descSurplus, prometheus.GaugeValue, float64(surpluses[0].SurplusWatts))
+		age := GetDB().Time.UTCNow().Sub(surpluses[0].Timestamp)
+		ch <- prometheus.MustNewConstMetric(descSurplusAge, prometheus.GaugeValue, age.Seconds())
+	}
+}
+
+func metricsBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_ChargingEvents(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	before := testutil.ToFloat64(metricChargingEvents.WithLabelValues("metrics1", "charge_start"))
+	LogChargingEvent("metrics1", LogEventChargeStart, "")
+	LogChargingEvent("metrics1", LogEventChargeStart, "")
+	LogChargingEvent("metrics1", 99, "")
+	assert.Equal(t, before+2, testutil.ToFloat64(metricChargingEvents.WithLabelValues("metrics1", "charge_start")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricChargingEvents.WithLabelValues("metrics1", "99")))
+}
+
+func TestMetrics_TeslaAPIRequest(t *testing.T) {
+	requests := testutil.ToFloat64(metricTeslaAPIRequests.WithLabelValues("charge_start"))
+	errs := testutil.ToFloat64(metricTeslaAPIErrors.WithLabelValues("charge_start"))
+	MetricsTeslaAPIRequest("charge_start", time.Now(), nil)
+	MetricsTeslaAPIRequest("charge_start", time.Now(), errors.New("timeout"))
+	MetricsTeslaAPIRequest("list_vehicles", time.Now(), nil)
+	assert.Equal(t, requests+2, testutil.ToFloat64(metricTeslaAPIRequests.WithLabelValues("charge_start")))
+	assert.Equal(t, errs+1, testutil.ToFloat64(metricTeslaAPIErrors.WithLabelValues("charge_start")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricTeslaAPIRequests.WithLabelValues("list_vehicles")))
+}
+
+func TestMetrics_TeslaAPIRequestWithoutVIN(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	endpoint := GetConfig().CmdEndpoint
+	t.Cleanup(func() {
+		GetConfig().CmdEndpoint = endpoint
+	})
+	GetConfig().CmdEndpoint = server.URL
+
+	requests := testutil.ToFloat64(metricTeslaAPIRequests.WithLabelValues("vehicle_add"))
+	series := testutil.CollectAndCount(metricTeslaAPIRequests)
+	_, err := (&TeslaAPIProxy{}).sendRequest("vehicle_add", "vehicle_add/LRW3E7FS2NC123456", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, requests+1, testutil.ToFloat64(metricTeslaAPIRequests.WithLabelValues("vehicle_add")))
+	assert.Equal(t, series, testutil.CollectAndCount(metricTeslaAPIRequests))
+}
+
+func TestMetrics_SkippedTick(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	vehicle := &Vehicle{VIN: "metrics2", Enabled: true, NumPhases: 3}
+	GetDB().CreateUpdateVehicle(vehicle)
+	GetDB().SetVehicleStatePluggedIn(vehicle.VIN, true)
+
+	cc := NewTestChargeController()
+	cc.setInTick(vehicle.VIN)
+	cc.processVehicle(vehicle)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricSkippedTicks.WithLabelValues(vehicle.VIN)))
+}
+
+func TestMetrics_Endpoint(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	key, _, _ := CreateAPIKey("prometheus", APIKeyScopeRead)
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "metrics3", Enabled: true, NumPhases: 3, SurplusBuffer: 100})
+	GetDB().SetVehicleStatePluggedIn("metrics3", true)
+	GetDB().SetVehicleStateSoC("metrics3", 42)
+	GetDB().SetVehicleStateAmps("metrics3", 6)
+	GetDB().SetVehicleStateCharging("metrics3", ChargeStateChargingOnSolar)
+	GetDB().RecordSurplus(1500)
+
+	res := executeTestRequest(newHTTPRequest("GET", "/metrics", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+	res = executeTestRequest(newHTTPRequest("GET", "/metrics", key, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	body := res.Body.String()
+	assert.Contains(t, body, `chargebot_vehicle_soc_percent{vin="metrics3"} 42`)
+	assert.Contains(t, body, `chargebot_vehicle_charge_amps{vin="metrics3"} 6`)
+	assert.Contains(t, body, `chargebot_vehicle_charging_state{vin="metrics3"} 1`)
+	assert.Contains(t, body, `chargebot_vehicle_plugged_in{vin="metrics3"} 1`)
+	assert.Contains(t, body, `chargebot_surplus_watts 1500`)
+	// raw surplus plus the vehicle's own draw (6 A * 230 V * 3) minus the surplus buffer
+	assert.Contains(t, body, `chargebot_vehicle_surplus_filtered_watts{vin="metrics3"} 5540`)
+	assert.Contains(t, body, "chargebot_charge_controller_tick_duration_seconds")
+	assert.Contains(t, body, "go_goroutines")
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ModbusSurplusModeGrid        = "grid"
+	ModbusSurplusModeConsumption = "consumption"
+)
+
+const (
+	SunSpecModelCommon       uint16 = 1
+	SunSpecModelEnd          uint16 = 0xFFFF
+	SunSpecMarker            uint32 = 0x53756e53 // "SunS"
+	sunSpecNotImplementedS16 int16  = -32768
+)
+
+// sunSpecValueModel holds the register offsets of total real power (W) and its scale factor
+// relative to the model's first data register
+type sunSpecValueModel struct {
+	ID      uint16
+	Offsets [2]uint16
+}
+
+// candidate models in order of preference, as a device may expose more than one
+var sunSpecInverterModels = []sunSpecValueModel{
+	{101, [2]uint16{12, 13}},
+	{102, [2]uint16{12, 13}},
+	{103, [2]uint16{12, 13}},
+}
+
+var sunSpecMeterModels = []sunSpecValueModel{
+	{201, [2]uint16{16, 20}},
+	{202, [2]uint16{16, 20}},
+	{203, [2]uint16{16, 20}},
+	{204, [2]uint16{16, 20}},
+}
+
+type ModbusTCPClient struct {
+	Address       string
+	Timeout       time.Duration
+	conn          net.Conn
+	transactionID uint16
+	mutex         sync.Mutex
+}
+
+func (c *ModbusTCPClient) Connect() error {
+	conn, err := net.DialTimeout("tcp", c.Address, c.Timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+func (c *ModbusTCPClient) Close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *ModbusTCPClient) IsConnected() bool {
+	return c.conn != nil
+}
+
+func (c *ModbusTCPClient) ReadHoldingRegisters(unitID byte, address uint16, quantity uint16) ([]uint16, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil, errors.New("not connected")
+	}
+	if quantity == 0 || quantity > 125 {
+		return nil, fmt.Errorf("invalid register quantity %d", quantity)
+	}
+
+	c.transactionID++
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], c.transactionID)
+	binary.BigEndian.PutUint16(req[2:], 0) // protocol id
+	binary.BigEndian.PutUint16(req[4:], 6) // remaining length
+	req[6] = unitID
+	req[7] = 0x03 // read holding registers
+	binary.BigEndian.PutUint16(req[8:], address)
+	binary.BigEndian.PutUint16(req[10:], quantity)
+
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header[0:]) != c.transactionID {
+		return nil, errors.New("transaction id mismatch")
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 3 {
+		return nil, fmt.Errorf("invalid response length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(c.conn, pdu); err != nil {
+		return nil, err
+	}
+	if pdu[0] == 0x83 {
+		return nil, fmt.Errorf("modbus exception code %d", pdu[1])
+	}
+	if pdu[0] != 0x03 || int(pdu[1]) != int(quantity)*2 || len(pdu) < 2+int(quantity)*2 {
+		return nil, errors.New("invalid response")
+	}
+	res := make([]uint16, quantity)
+	for i := range res {
+		res[i] = binary.BigEndian.Uint16(pdu[2+i*2:])
+	}
+	return res, nil
+}
+
+type SunSpecModel struct {
+	ID      uint16
+	Address uint16 // first data register after the model header
+	Length  uint16
+}
+
+type SunSpecDevice struct {
+	Client *ModbusTCPClient
+	UnitID byte
+	Models map[uint16]*SunSpecModel
+}
+
+func (d *SunSpecDevice) Discover(baseAddress uint16) error {
+	regs, err := d.Client.ReadHoldingRegisters(d.UnitID, baseAddress, 2)
+	if err != nil {
+		return err
+	}
+	if uint32(regs[0])<<16|uint32(regs[1]) != SunSpecMarker {
+		return fmt.Errorf("no SunSpec marker found at address %d", baseAddress)
+	}
+	d.Models = make(map[uint16]*SunSpecModel)
+	address := baseAddress + 2
+	for i := 0; i < 64; i++ {
+		header, err := d.Client.ReadHoldingRegisters(d.UnitID, address, 2)
+		if err != nil {
+			return err
+		}
+		if header[0] == SunSpecModelEnd {
+			return nil
+		}
+		d.Models[header[0]] = &SunSpecModel{
+			ID:      header[0],
+			Address: address + 2,
+			Length:  header[1],
+		}
+		address += 2 + header[1]
+	}
+	return errors.New("too many SunSpec models")
+}
+
+func (d *SunSpecDevice) ReadCommon() (string, string, error) {
+	model, ok := d.Models[SunSpecModelCommon]
+	if !ok {
+		return "", "", errors.New("no SunSpec common model found")
+	}
+	// manufacturer and model name are 16 registers each
+	regs, err := d.Client.ReadHoldingRegisters(d.UnitID, model.Address, 32)
+	if err != nil {
+		return "", "", err
+	}
+	return sunSpecString(regs[0:16]), sunSpecString(regs[16:32]), nil
+}
+
+func sunSpecString(regs []uint16) string {
+	b := make([]byte, 0, len(regs)*2)
+	for _, reg := range regs {
+		b = append(b, byte(reg>>8), byte(reg))
+	}
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+func (d *SunSpecDevice) findModel(candidates []sunSpecValueModel) (*SunSpecModel, [2]uint16) {
+	for _, candidate := range candidates {
+		if model, ok := d.Models[candidate.ID]; ok {
+			return model, candidate.Offsets
+		}
+	}
+	return nil, [2]uint16{}
+}
+
+func (d *SunSpecDevice) readScaledValue(model *SunSpecModel, offsets [2]uint16) (float64, error) {
+	regs, err := d.Client.ReadHoldingRegisters(d.UnitID, model.Address+offsets[0], offsets[1]-offsets[0]+1)
+	if err != nil {
+		return 0, err
+	}
+	value := int16(regs[0])
+	sf := int16(regs[len(regs)-1])
+	if value == sunSpecNotImplementedS16 || sf == sunSpecNotImplementedS16 {
+		return 0, fmt.Errorf("value not implemented in SunSpec model %d", model.ID)
+	}
+	return float64(value) * math.Pow10(int(sf)), nil
+}
+
+func (d *SunSpecDevice) ReadInverterPower() (float64, error) {
+	model, offsets := d.findModel(sunSpecInverterModels)
+	if model == nil {
+		return 0, errors.New("no SunSpec inverter model found")
+	}
+	return d.readScaledValue(model, offsets)
+}
+
+func (d *SunSpecDevice) ReadMeterPower() (float64, error) {
+	model, offsets := d.findModel(sunSpecMeterModels)
+	if model == nil {
+		return 0, errors.New("no SunSpec meter model found")
+	}
+	return d.readScaledValue(model, offsets)
+}
+
+type ModbusPoller struct {
+	Interrupt chan os.Signal
+	client    *ModbusTCPClient
+	inverter  *SunSpecDevice
+	meter     *SunSpecDevice
+	ticker    *time.Ticker
+}
+
+func NewModbusPoller() *ModbusPoller {
+	return &ModbusPoller{
+		Interrupt: make(chan os.Signal, 1),
+		client: &ModbusTCPClient{
+			Address: GetConfig().ModbusHost,
+			Timeout: time.Second * 5,
+		},
+	}
+}
+
+func (m *ModbusPoller) Poll() {
+	if GetConfig().ModbusHost == "" {
+		return
+	}
+
+	log.Println("Initializing Modbus poller...")
+
+	m.ticker = time.NewTicker(time.Second * time.Duration(GetConfig().ModbusInterval))
+	go func() {
+		for {
+			select {
+			case <-m.ticker.C:
+				if err := m.update(); err != nil {
+					log.Println("Error polling Modbus device:", err)
+					// reconnect and rediscover on next tick
+					m.client.Close()
+				}
+			case <-m.Interrupt:
+				m.ticker.Stop()
+				m.client.Close()
+				return
+			}
+		}
+	}()
+}
+
+func (m *ModbusPoller) connect() error {
+	if m.client.IsConnected() {
+		return nil
+	}
+	if err := m.client.Connect(); err != nil {
+		return err
+	}
+	m.meter = &SunSpecDevice{Client: m.client, UnitID: byte(GetConfig().ModbusMeterUnitID)}
+	if err := m.discover(m.meter); err != nil {
+		return err
+	}
+	m.inverter = nil
+	if GetConfig().ModbusMode == ModbusSurplusModeConsumption {
+		m.inverter = &SunSpecDevice{Client: m.client, UnitID: byte(GetConfig().ModbusInverterUnitID)}
+		if err := m.discover(m.inverter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ModbusPoller) discover(d *SunSpecDevice) error {
+	if err := d.Discover(uint16(GetConfig().ModbusBaseAddress)); err != nil {
+		return err
+	}
+	manufacturer, model, err := d.ReadCommon()
+	if err != nil {
+		log.Printf("Found SunSpec device with unit id %d\n", d.UnitID)
+	} else {
+		log.Printf("Found SunSpec device with unit id %d: %s %s\n", d.UnitID, manufacturer, model)
+	}
+	return nil
+}
+
+func (m *ModbusPoller) update() error {
+	if err := m.connect(); err != nil {
+		return err
+	}
+	surplus, err := m.getSurplus()
+	if err != nil {
+		return err
+	}
+	if GetConfig().ModbusMode == ModbusSurplusModeGrid {
+		RecordGridPower(surplus * -1)
+	} else {
+		GetDB().RecordSurplus(surplus)
+	}
+	return nil
+}
+
+func (m *ModbusPoller) getSurplus() (int, error) {
+	meterPower, err := m.meter.ReadMeterPower()
+	if err != nil {
+		return 0, err
+	}
+	if GetConfig().ModbusMeterInvert {
+		meterPower = meterPower * -1
+	}
+	if GetConfig().ModbusMode == ModbusSurplusModeConsumption {
+		// meter measures the household's consumption
+		inverterPower, err := m.inverter.ReadInverterPower()
+		if err != nil {
+			return 0, err
+		}
+		return int(math.Round(inverterPower - meterPower)), nil
+	}
+	// meter is located at the grid connection point with positive values for grid import
+	return int(math.Round(meterPower * -1)), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ModbusSimulator struct {
+	Listener  net.Listener
+	Registers map[byte]map[uint16]uint16
+}
+
+func NewModbusSimulator(t *testing.T) *ModbusSimulator {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ModbusSimulator{
+		Listener:  l,
+		Registers: make(map[byte]map[uint16]uint16),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *ModbusSimulator) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req := make([]byte, 12)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		unitID := req[6]
+		address := binary.BigEndian.Uint16(req[8:])
+		quantity := binary.BigEndian.Uint16(req[10:])
+		res := make([]byte, 9+quantity*2)
+		copy(res[0:4], req[0:4])
+		binary.BigEndian.PutUint16(res[4:], 3+quantity*2)
+		res[6] = unitID
+		res[7] = 0x03
+		res[8] = byte(quantity * 2)
+		for i := uint16(0); i < quantity; i++ {
+			binary.BigEndian.PutUint16(res[9+i*2:], s.Registers[unitID][address+i])
+		}
+		conn.Write(res)
+	}
+}
+
+// AddSunSpecDevice creates a SunSpec register map with common, inverter and meter models
+func (s *ModbusSimulator) AddSunSpecDevice(unitID byte, inverterWatts int16, meterWatts int16) {
+	regs := make(map[uint16]uint16)
+	address := uint16(40000)
+	regs[address] = 0x5375
+	regs[address+1] = 0x6e53
+	address += 2
+	addModel := func(id uint16, length uint16, data map[uint16]uint16) {
+		regs[address] = id
+		regs[address+1] = length
+		for offset, value := range data {
+			regs[address+2+offset] = value
+		}
+		address += 2 + length
+	}
+	addModel(1, 66, map[uint16]uint16{0: 0x5465, 1: 0x7374, 16: 0x5349, 17: 0x4d00})
+	addModel(103, 50, map[uint16]uint16{12: uint16(inverterWatts), 13: 0})
+	addModel(203, 105, map[uint16]uint16{16: uint16(meterWatts / 10), 20: 1})
+	regs[address] = SunSpecModelEnd
+	s.Registers[unitID] = regs
+}
+
+func TestModbusPoller_SunSpecDevice(t *testing.T) {
+	sim := NewModbusSimulator(t)
+	sim.AddSunSpecDevice(1, 5000, -3000)
+
+	client := &ModbusTCPClient{Address: sim.Listener.Addr().String(), Timeout: time.Second * 2}
+	assert.Nil(t, client.Connect())
+	defer client.Close()
+
+	d := &SunSpecDevice{Client: client, UnitID: 1}
+	assert.Nil(t, d.Discover(40000))
+	assert.Len(t, d.Models, 3)
+
+	manufacturer, model, err := d.ReadCommon()
+	assert.Nil(t, err)
+	assert.Equal(t, "Test", manufacturer)
+	assert.Equal(t, "SIM", model)
+
+	inverterPower, err := d.ReadInverterPower()
+	assert.Nil(t, err)
+	assert.Equal(t, 5000.0, inverterPower)
+
+	meterPower, err := d.ReadMeterPower()
+	assert.Nil(t, err)
+	assert.Equal(t, -3000.0, meterPower)
+
+	d = &SunSpecDevice{Client: client, UnitID: 2}
+	assert.NotNil(t, d.Discover(40000))
+}
+
+func TestModbusPoller_findModel(t *testing.T) {
+	d := &SunSpecDevice{Models: map[uint16]*SunSpecModel{
+		203: {ID: 203, Address: 40300},
+		201: {ID: 201, Address: 40200},
+		103: {ID: 103, Address: 40100},
+		101: {ID: 101, Address: 40000},
+	}}
+	for i := 0; i < 10; i++ {
+		model, offsets := d.findModel(sunSpecInverterModels)
+		assert.Equal(t, uint16(101), model.ID)
+		assert.Equal(t, [2]uint16{12, 13}, offsets)
+		model, _ = d.findModel(sunSpecMeterModels)
+		assert.Equal(t, uint16(201), model.ID)
+	}
+	model, _ := (&SunSpecDevice{Models: map[uint16]*SunSpecModel{}}).findModel(sunSpecMeterModels)
+	assert.Nil(t, model)
+}
+
+func TestModbusPoller_update(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	sim := NewModbusSimulator(t)
+	sim.AddSunSpecDevice(1, 5000, -3000)
+	sim.AddSunSpecDevice(2, 0, 1200)
+
+	GetConfig().ModbusHost = sim.Listener.Addr().String()
+	GetConfig().ModbusBaseAddress = 40000
+	GetConfig().ModbusMeterUnitID = 1
+	GetConfig().ModbusMode = ModbusSurplusModeGrid
+	defer func() { GetConfig().ModbusHost = "" }()
+
+	// grid meter exports 3000 watts
+	m := NewModbusPoller()
+	assert.Nil(t, m.update())
+	records := GetDB().GetLatestSurplusRecords(1)
+	assert.Equal(t, 3000, records[0].SurplusWatts)
+	m.client.Close()
+
+	// inverter produces 5000 watts, household consumes 1200 watts
+	GetConfig().ModbusMode = ModbusSurplusModeConsumption
+	GetConfig().ModbusInverterUnitID = 1
+	GetConfig().ModbusMeterUnitID = 2
+	defer func() { GetConfig().ModbusMode = ModbusSurplusModeGrid }()
+	m = NewModbusPoller()
+	surplus, err := func() (int, error) {
+		if err := m.connect(); err != nil {
+			return 0, err
+		}
+		return m.getSurplus()
+	}()
+	m.client.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 3800, surplus)
+}
+
+func TestModbusPoller_intervalConfig(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 30, c.getEnvPositiveInt("MODBUS_INTERVAL", "30"))
+	t.Setenv("MODBUS_INTERVAL", "0")
+	assert.Panics(t, func() {
+		c.getEnvPositiveInt("MODBUS_INTERVAL", "30")
+	})
+	t.Setenv("MODBUS_INTERVAL", "-5")
+	assert.Panics(t, func() {
+		c.getEnvPositiveInt("MODBUS_INTERVAL", "30")
+	})
+	t.Setenv("MODBUS_INTERVAL", "10")
+	assert.Equal(t, 10, c.getEnvPositiveInt("MODBUS_INTERVAL", "30"))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+const (
+	MqttAvailabilityOnline  = "online"
+	MqttAvailabilityOffline = "offline"
+)
+
+type HomeAssistantDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// HomeAssistantEntityConfig is the payload of a Home Assistant MQTT discovery message
+type HomeAssistantEntityConfig struct {
+	Name              string               `json:"name"`
+	UniqueID          string               `json:"unique_id"`
+	ObjectID          string               `json:"object_id"`
+	Device            *HomeAssistantDevice `json:"device"`
+	AvailabilityTopic string               `json:"availability_topic"`
+	StateTopic        string               `json:"state_topic"`
+	ValueTemplate     string               `json:"value_template,omitempty"`
+	CommandTopic      string               `json:"command_topic,omitempty"`
+	PayloadOn         string               `json:"payload_on,omitempty"`
+	PayloadOff        string               `json:"payload_off,omitempty"`
+	DeviceClass       string               `json:"device_class,omitempty"`
+	StateClass        string               `json:"state_class,omitempty"`
+	UnitOfMeasurement string               `json:"unit_of_measurement,omitempty"`
+	Icon              string               `json:"icon,omitempty"`
+	Min               *int                 `json:"min,omitempty"`
+	Max               *int                 `json:"max,omitempty"`
+	Step              *int                 `json:"step,omitempty"`
+	Mode              string               `json:"mode,omitempty"`
+}
+
+type homeAssistantEntity struct {
+	Component string
+	Key       string
+	Config    *HomeAssistantEntityConfig
+}
+
+func (p *MqttPublisher) availabilityTopic() string {
+	return p.topic("status")
+}
+
+func (p *MqttPublisher) PublishAvailability(online bool) {
+	if p == nil {
+		return
+	}
+	if online {
+		p.publish(p.availabilityTopic(), MqttAvailabilityOnline)
+	} else {
+		p.publish(p.availabilityTopic(), MqttAvailabilityOffline)
+	}
+}
+
+func (p *MqttPublisher) discoveryTopic(component string, vin string, key string) string {
+	return p.DiscoveryPrefix + "/" + component + "/chargebot_" + strings.ToLower(vin) + "/" + key + "/config"
+}
+
+// PublishDiscovery publishes switches and numbers only if commands are accepted, else read-only sensors.
+// The configs of the other variant are cleared, as they may have been published with a different setting before.
+func (p *MqttPublisher) PublishDiscovery(vehicle *Vehicle) {
+	if p == nil || !p.Discovery {
+		return
+	}
+	published := make(map[string]bool)
+	for _, e := range p.getHomeAssistantEntities(vehicle, p.Commands) {
+		topic := p.discoveryTopic(e.Component, vehicle.VIN, e.Key)
+		p.publish(topic, e.Config)
+		published[topic] = true
+	}
+	for _, e := range p.getHomeAssistantEntities(vehicle, !p.Commands) {
+		if topic := p.discoveryTopic(e.Component, vehicle.VIN, e.Key); !published[topic] {
+			p.publish(topic, "")
+		}
+	}
+}
+
+// RemoveVehicle clears all retained topics of a vehicle, so it disappears from Home Assistant
+func (p *MqttPublisher) RemoveVehicle(vehicle *Vehicle) {
+	if p == nil {
+		return
+	}
+	if p.Discovery {
+		for _, commands := range []bool{true, false} {
+			for _, e := range p.getHomeAssistantEntities(vehicle, commands) {
+				p.publish(p.discoveryTopic(e.Component, vehicle.VIN, e.Key), "")
+			}
+		}
+	}
+	for _, topic := range []string{"state", "decision", "settings", "prices", "event"} {
+		p.publish(p.topic(vehicle.VIN, topic), "")
+	}
+	log.Printf("Removed MQTT topics of vehicle %s\n", vehicle.VIN)
+}
+
+// getHomeAssistantEntities returns the vehicle's entities, settings are switches and numbers
+// if commands are accepted and binary sensors and sensors otherwise
+func (p *MqttPublisher) getHomeAssistantEntities(vehicle *Vehicle, commands bool) []*homeAssistantEntity {
+	device := &HomeAssistantDevice{
+		Identifiers:  []string{"chargebot_" + vehicle.VIN},
+		Name:         vehicle.DisplayName,
+		Manufacturer: "Tesla",
+		Model:        "chargebot.io",
+	}
+	if device.Name == "" {
+		device.Name = vehicle.VIN
+	}
+	entity := func(component string, key string, name string, stateTopic string, valueTemplate string) *homeAssistantEntity {
+		return &homeAssistantEntity{
+			Component: component,
+			Key:       key,
+			Config: &HomeAssistantEntityConfig{
+				Name:              name,
+				UniqueID:          "chargebot_" + vehicle.VIN + "_" + key,
+				ObjectID:          "chargebot_" + strings.ToLower(vehicle.VIN) + "_" + key,
+				Device:            device,
+				AvailabilityTopic: p.availabilityTopic(),
+				StateTopic:        stateTopic,
+				ValueTemplate:     valueTemplate,
+			},
+		}
+	}
+	intPtr := func(i int) *int {
+		return &i
+	}
+	stateTopic := p.topic(vehicle.VIN, "state")
+	settingsTopic := p.topic(vehicle.VIN, "settings")
+
+	soc := entity("sensor", "soc", "SoC", stateTopic, "{{ value_json.soc }}")
+	soc.Config.DeviceClass = "battery"
+	soc.Config.StateClass = "measurement"
+	soc.Config.UnitOfMeasurement = "%"
+
+	chargeLimit := entity("sensor", "charge_limit", "Charge limit", stateTopic, "{{ value_json.chargeLimit }}")
+	chargeLimit.Config.UnitOfMeasurement = "%"
+	chargeLimit.Config.Icon = "mdi:battery-charging-high"
+
+	chargingState := entity("sensor", "charging_state", "Charging state", p.topic(vehicle.VIN, "decision"), "")
+	chargingState.Config.Icon = "mdi:ev-station"
+
+	res := []*homeAssistantEntity{soc, chargeLimit, chargingState}
+
+	switches := []struct{ key, name, icon string }{
+		{"enabled", "Enabled", "mdi:power"},
+		{"surplus_charging", "Surplus charging", "mdi:solar-power"},
+		{"lowcost_charging", "Low cost charging", "mdi:cash"},
+		{"charge_now", "Charge now", "mdi:flash"},
+	}
+	for _, s := range switches {
+		component := "binary_sensor"
+		if commands {
+			component = "switch"
+		}
+		e := entity(component, s.key, s.name, settingsTopic, "{{ 'ON' if value_json."+s.key+" else 'OFF' }}")
+		if commands {
+			e.Config.CommandTopic = p.topic(vehicle.VIN, "set", s.key)
+		}
+		e.Config.PayloadOn = "ON"
+		e.Config.PayloadOff = "OFF"
+		e.Config.Icon = s.icon
+		res = append(res, e)
+	}
+
+	numbers := []struct {
+		key, name, unit string
+		min, max, step  int
+	}{
+		{"target_soc", "Target SoC", "%", 1, 100, 1},
+		{"max_amps", "Max amps", "A", 1, 32, 1},
+		{"min_surplus", "Min surplus", "W", 0, MqttMaxMinSurplus, 100},
+	}
+	for _, n := range numbers {
+		if !commands {
+			e := entity("sensor", n.key, n.name, settingsTopic, "{{ value_json."+n.key+" }}")
+			e.Config.UnitOfMeasurement = n.unit
+			res = append(res, e)
+			continue
+		}
+		e := entity("number", n.key, n.name, settingsTopic, "{{ value_json."+n.key+" }}")
+		e.Config.CommandTopic = p.topic(vehicle.VIN, "set", n.key)
+		e.Config.UnitOfMeasurement = n.unit
+		e.Config.Min = intPtr(n.min)
+		e.Config.Max = intPtr(n.max)
+		e.Config.Step = intPtr(n.step)
+		e.Config.Mode = "box"
+		res = append(res, e)
+	}
+
+	permanentError := entity("binary_sensor", "permanent_error", "Permanent error", p.topic("permanent_error"), "")
+	permanentError.Config.PayloadOn = "true"
+	permanentError.Config.PayloadOff = "false"
+	permanentError.Config.DeviceClass = "problem"
+	res = append(res, permanentError)
+
+	return res
+}
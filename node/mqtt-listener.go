@@ -1,73 +1,258 @@
 package main
 
 import (
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"log"
 	"os"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+var MqttMinReconnectDelay time.Duration = time.Second * 5
+
+type MqttHealth struct {
+	Configured     bool       `json:"configured"`
+	Connected      bool       `json:"connected"`
+	LastConnect    *time.Time `json:"last_connect"`
+	LastDisconnect *time.Time `json:"last_disconnect"`
+	LastError      string     `json:"last_error"`
+	Reconnects     int        `json:"reconnects"`
+}
+
 type MqttSubscriber struct {
-	Interrupt chan os.Signal
+	Interrupt  chan os.Signal
+	Time       Time
+	aggregator *MqttSurplusAggregator
+	client     mqtt.Client
+	done       chan struct{}
+	health     MqttHealth
+	mutex      sync.Mutex
+}
+
+var MqttSubscriberInstance *MqttSubscriber
+
+func GetMqttSubscriber() *MqttSubscriber {
+	return MqttSubscriberInstance
+}
+
+func NewMqttSubscriber() *MqttSubscriber {
+	return &MqttSubscriber{
+		Interrupt: make(chan os.Signal, 1),
+		Time:      new(RealTime),
+		done:      make(chan struct{}),
+	}
 }
 
 func (m *MqttSubscriber) connectHandler(client mqtt.Client) {
-	if token := client.Subscribe(GetConfig().MqttTopicSurplus, 0, m.messageSurplusHandler); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
+	m.mutex.Lock()
+	now := m.Time.UTCNow()
+	m.health.Connected = true
+	m.health.LastConnect = &now
+	m.health.LastError = ""
+	m.mutex.Unlock()
+	log.Println("Connected to MQTT broker")
+
+	// subscriptions are not persisted with a clean session, so subscribe again on every (re)connect
+	go m.subscribe(client, MqttMinReconnectDelay)
+	GetMqttPublisher().PublishAll()
+}
+
+func (m *MqttSubscriber) subscribe(client mqtt.Client, retryDelay time.Duration) {
+	err := func() error {
+		for _, topic := range m.aggregator.Topics() {
+			if token := client.Subscribe(topic, byte(GetConfig().MqttQoS), m.messageSurplusHandler); token.Wait() && token.Error() != nil {
+				return token.Error()
+			}
+		}
+		return GetMqttPublisher().Subscribe()
+	}()
+	if err == nil {
+		return
+	}
+	log.Printf("Could not subscribe to MQTT topics, retrying in %s: %s\n", retryDelay, err.Error())
+	m.setError(err)
+	select {
+	case <-m.done:
+		return
+	case <-time.After(retryDelay):
+	}
+	if !client.IsConnectionOpen() {
+		// will subscribe again in connectHandler once reconnected
+		return
 	}
+	m.subscribe(client, m.nextDelay(retryDelay))
 }
 
 func (m *MqttSubscriber) connectionLostHandler(client mqtt.Client, err error) {
+	m.mutex.Lock()
+	now := m.Time.UTCNow()
+	m.health.Connected = false
+	m.health.LastDisconnect = &now
+	m.health.LastError = err.Error()
+	m.mutex.Unlock()
+	log.Printf("MQTT connection lost, reconnecting: %s\n", err.Error())
+}
+
+func (m *MqttSubscriber) reconnectingHandler(client mqtt.Client, opts *mqtt.ClientOptions) {
+	m.mutex.Lock()
+	m.health.Reconnects++
+	m.mutex.Unlock()
+}
+
+func (m *MqttSubscriber) setError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.health.LastError = err.Error()
+}
+
+func (m *MqttSubscriber) nextDelay(delay time.Duration) time.Duration {
+	delay = delay * 2
+	max := time.Second * time.Duration(GetConfig().MqttMaxReconnectInterval)
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (m *MqttSubscriber) Health() *MqttHealth {
+	if m == nil {
+		return &MqttHealth{}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	res := m.health
+	res.Configured = (GetConfig().MqttBroker != "")
+	return &res
 }
 
 func (m *MqttSubscriber) messageSurplusHandler(client mqtt.Client, msg mqtt.Message) {
-	go func() {
-		surplus, err := strconv.Atoi(string(msg.Payload()))
+	go m.aggregator.Handle(msg.Topic(), msg.Payload())
+}
+
+func (m *MqttSubscriber) initAggregator() {
+	inputs := []*MqttSurplusInput{{
+		Topic: GetConfig().MqttTopicSurplus,
+		Field: MqttSurplusFieldSurplus,
+		Scale: 1,
+	}}
+	if GetConfig().MqttSurplusInputs != "" {
+		var err error
+		inputs, err = ParseMqttSurplusInputs(GetConfig().MqttSurplusInputs)
 		if err != nil {
-			log.Printf("Could not parse surplus to int: %s\n", msg.Payload())
-			return
+			log.Panicf("Invalid MQTT_SURPLUS_INPUTS: %s\n", err.Error())
 		}
-		GetDB().RecordSurplus(surplus)
-	}()
+	}
+	m.aggregator = NewMqttSurplusAggregator(inputs,
+		time.Millisecond*time.Duration(GetConfig().MqttSurplusMergeWindow),
+		time.Second*time.Duration(GetConfig().MqttSurplusMaxAge))
 }
 
-func (m *MqttSubscriber) Listen() {
-	if GetConfig().MqttBroker == "" {
-		return
+func NewMqttTLSConfig(caFile string, certFile string, keyFile string, insecure bool) (*tls.Config, error) {
+	res := &tls.Config{
+		InsecureSkipVerify: insecure,
 	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		res.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
 
-	log.Println("Initializing MQTT subscriber...")
-
+func (m *MqttSubscriber) getClientOptions() (*mqtt.ClientOptions, error) {
 	opts := mqtt.NewClientOptions()
+	// tcp://, ssl:// and ws:// or wss:// for websocket transport
 	opts.AddBroker(GetConfig().MqttBroker)
 	opts.SetClientID(GetConfig().MqttClientID)
 	opts.SetUsername(GetConfig().MqttUsername)
 	opts.SetPassword(GetConfig().MqttPassword)
-	opts.SetKeepAlive(2 * time.Second)
-	opts.SetPingTimeout(1 * time.Second)
+	opts.SetKeepAlive(time.Second * time.Duration(GetConfig().MqttKeepAlive))
+	opts.SetPingTimeout(time.Second * 10)
+	opts.SetConnectTimeout(time.Second * 30)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(time.Second * time.Duration(GetConfig().MqttMaxReconnectInterval))
+	opts.SetCleanSession(true)
+	if GetConfig().MqttTLSCA != "" || GetConfig().MqttTLSCert != "" || GetConfig().MqttTLSInsecure {
+		tlsConfig, err := NewMqttTLSConfig(GetConfig().MqttTLSCA, GetConfig().MqttTLSCert, GetConfig().MqttTLSKey, GetConfig().MqttTLSInsecure)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if GetConfig().MqttPublish {
+		// lets Home Assistant and others know when chargebot is unavailable
+		opts.SetWill(strings.TrimSuffix(GetConfig().MqttTopicPrefix, "/")+"/status", MqttAvailabilityOffline, byte(GetConfig().MqttQoS), true)
+	}
 	opts.OnConnect = m.connectHandler
 	opts.OnConnectionLost = m.connectionLostHandler
+	opts.OnReconnecting = m.reconnectingHandler
+	return opts, nil
+}
+
+func (m *MqttSubscriber) Listen() {
+	if GetConfig().MqttBroker == "" {
+		return
+	}
+
+	log.Println("Initializing MQTT subscriber...")
+	m.initAggregator()
+
+	opts, err := m.getClientOptions()
+	if err != nil {
+		log.Printf("Invalid MQTT TLS config, MQTT disabled: %s\n", err.Error())
+		m.setError(err)
+		return
+	}
 
-	c := mqtt.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	m.client = mqtt.NewClient(opts)
+	if GetConfig().MqttPublish {
+		MqttPublisherInstance = NewMqttPublisher(m.client)
 	}
 
 	go func() {
+		defer close(m.done)
+		// paho only reconnects automatically after the first successful connect
+		delay := MqttMinReconnectDelay
 		for {
+			token := m.client.Connect()
+			token.Wait()
+			if token.Error() == nil {
+				break
+			}
+			log.Printf("Could not connect to MQTT broker, retrying in %s: %s\n", delay, token.Error().Error())
+			m.setError(token.Error())
 			select {
 			case <-m.Interrupt:
-				if token := c.Unsubscribe(GetConfig().MqttTopicSurplus); token.Wait() && token.Error() != nil {
-					fmt.Println(token.Error())
-					os.Exit(1)
-				}
-
-				c.Disconnect(250)
+				return
+			case <-time.After(delay):
 			}
+			delay = m.nextDelay(delay)
+		}
+
+		<-m.Interrupt
+		GetMqttPublisher().Unsubscribe()
+		GetMqttPublisher().PublishAvailability(false)
+		if token := m.client.Unsubscribe(m.aggregator.Topics()...); token.WaitTimeout(time.Second*2) && token.Error() != nil {
+			log.Println(token.Error())
 		}
+		m.client.Disconnect(250)
 	}()
 }
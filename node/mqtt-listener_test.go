@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMqttSubscriber_Resubscribe(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	MqttMinReconnectDelay = time.Millisecond * 100
+	defer func() { MqttMinReconnectDelay = time.Second * 5 }()
+	m := NewMqttSubscriber()
+	m.Time = GlobalMockTime
+	m.initAggregator()
+	client := NewMqttClientMock()
+	client.SubscribeErrs = []error{errors.New("not authorized")}
+
+	m.connectHandler(client)
+	health := m.Health()
+	assert.True(t, health.Connected)
+	assert.NotNil(t, health.LastConnect)
+
+	// first subscription fails, but is retried
+	assert.Eventually(t, func() bool {
+		return len(client.GetSubscriptions()) == 1
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, GetConfig().MqttTopicSurplus, client.GetSubscriptions()[0])
+
+	m.connectionLostHandler(client, errors.New("EOF"))
+	m.reconnectingHandler(client, nil)
+	health = m.Health()
+	assert.False(t, health.Connected)
+	assert.NotNil(t, health.LastDisconnect)
+	assert.Equal(t, "EOF", health.LastError)
+	assert.Equal(t, 1, health.Reconnects)
+
+	// subscribes again after reconnect
+	m.connectHandler(client)
+	assert.Eventually(t, func() bool {
+		return len(client.GetSubscriptions()) == 2
+	}, time.Second, time.Millisecond*10)
+	assert.True(t, m.Health().Connected)
+}
+
+func TestMqttSubscriber_ListenUnreachableBroker(t *testing.T) {
+	GetConfig().MqttBroker = "tcp://127.0.0.1:1"
+	defer func() { GetConfig().MqttBroker = "" }()
+
+	m := NewMqttSubscriber()
+	assert.NotPanics(t, m.Listen)
+	assert.Eventually(t, func() bool {
+		return m.Health().LastError != ""
+	}, time.Second*5, time.Millisecond*50)
+	assert.False(t, m.Health().Connected)
+	m.Interrupt <- os.Interrupt
+	<-m.done
+
+	var nilSubscriber *MqttSubscriber
+	assert.False(t, nilSubscriber.Health().Configured)
+}
+
+func TestMqttSubscriber_NewMqttTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "chargebot"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	config, err := NewMqttTLSConfig(certFile, certFile, keyFile, false)
+	assert.Nil(t, err)
+	assert.NotNil(t, config.RootCAs)
+	assert.Len(t, config.Certificates, 1)
+	assert.False(t, config.InsecureSkipVerify)
+
+	_, err = NewMqttTLSConfig(keyFile, "", "", false)
+	assert.NotNil(t, err)
+	_, err = NewMqttTLSConfig("", certFile, "", false)
+	assert.NotNil(t, err)
+	_, err = NewMqttTLSConfig(filepath.Join(dir, "missing.pem"), "", "", false)
+	assert.NotNil(t, err)
+}
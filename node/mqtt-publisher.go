@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MqttMaxMinSurplus is the highest min_surplus accepted via MQTT and advertised to Home Assistant
+const MqttMaxMinSurplus = 100000
+
+var ChargeStateDecisions = map[ChargeState]string{
+	ChargeStateNotCharging:     "idle",
+	ChargeStateChargingOnSolar: "solar",
+	ChargeStateChargingOnGrid:  "grid",
+}
+
+// VehicleSettings is the subset of a vehicle's settings published via MQTT (omitting secrets such as the Tibber token)
+type VehicleSettings struct {
+	Enabled         bool `json:"enabled"`
+	TargetSoC       int  `json:"target_soc"`
+	MaxAmps         int  `json:"max_amps"`
+	MinSurplus      int  `json:"min_surplus"`
+	SurplusCharging bool `json:"surplus_charging"`
+	LowcostCharging bool `json:"lowcost_charging"`
+	ChargeNow       bool `json:"charge_now"`
+}
+
+type MqttChargingEvent struct {
+	ChargingEvent
+	VIN string `json:"vin"`
+}
+
+// MqttPublisher publishes vehicle states, decisions, events and prices to retained topics below
+// MQTT_TOPIC_PREFIX and accepts commands on <prefix>/<vin>/set/<command>.
+// All methods are no-ops on a nil publisher, so callers don't need to check whether MQTT is configured.
+type MqttPublisher struct {
+	Client          mqtt.Client
+	Prefix          string
+	QoS             byte
+	Commands        bool
+	Discovery       bool
+	DiscoveryPrefix string
+	// the prices last published per VIN, so unchanged prices aren't published on every tick
+	prices      map[string]string
+	pricesMutex sync.Mutex
+}
+
+var MqttPublisherInstance *MqttPublisher
+
+func GetMqttPublisher() *MqttPublisher {
+	return MqttPublisherInstance
+}
+
+func NewMqttPublisher(client mqtt.Client) *MqttPublisher {
+	return &MqttPublisher{
+		Client:          client,
+		Prefix:          strings.TrimSuffix(GetConfig().MqttTopicPrefix, "/"),
+		QoS:             byte(GetConfig().MqttQoS),
+		Commands:        GetConfig().MqttCommands,
+		Discovery:       GetConfig().MqttHADiscovery,
+		DiscoveryPrefix: strings.TrimSuffix(GetConfig().MqttHADiscoveryPrefix, "/"),
+		prices:          make(map[string]string),
+	}
+}
+
+func (p *MqttPublisher) topic(parts ...string) string {
+	return p.Prefix + "/" + strings.Join(parts, "/")
+}
+
+func (p *MqttPublisher) publish(topic string, payload interface{}) {
+	var data []byte
+	switch v := payload.(type) {
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		data, err = json.Marshal(v)
+		if err != nil {
+			log.Printf("Could not marshal MQTT payload for topic %s: %s\n", topic, err.Error())
+			return
+		}
+	}
+	// don't wait for the token, publishing must never block the charge controller
+	p.Client.Publish(topic, p.QoS, true, data)
+}
+
+func (p *MqttPublisher) PublishAll() {
+	if p == nil {
+		return
+	}
+	p.PublishAvailability(true)
+	p.PublishPermanentError(GetDB().GetSetting(SettingsPermanentError) == "1")
+	for _, vehicle := range GetDB().GetVehicles() {
+		p.PublishDiscovery(vehicle)
+		p.PublishVehicle(vehicle.VIN)
+	}
+}
+
+func (p *MqttPublisher) PublishVehicle(vin string) {
+	if p == nil {
+		return
+	}
+	vehicle := GetDB().GetVehicleByVIN(vin)
+	if vehicle == nil {
+		return
+	}
+	state := GetDB().GetVehicleState(vin)
+	if state == nil {
+		state = &VehicleState{VIN: vin}
+	}
+	p.publish(p.topic(vin, "state"), state)
+	p.publish(p.topic(vin, "decision"), ChargeStateDecisions[state.Charging])
+	p.publish(p.topic(vin, "settings"), &VehicleSettings{
+		Enabled:         vehicle.Enabled,
+		TargetSoC:       vehicle.TargetSoC,
+		MaxAmps:         vehicle.MaxAmps,
+		MinSurplus:      vehicle.MinSurplus,
+		SurplusCharging: vehicle.SurplusCharging,
+		LowcostCharging: vehicle.LowcostCharging,
+		ChargeNow:       state.ChargeNow,
+	})
+	p.PublishPrices(vehicle)
+}
+
+// PublishPrices publishes the vehicle's upcoming grid prices if they changed since they were last published
+func (p *MqttPublisher) PublishPrices(vehicle *Vehicle) {
+	if p == nil {
+		return
+	}
+	prices := []*GridPrice{}
+	if vehicle.GridProvider == GridProviderTibber {
+		prices = GetDB().GetUpcomingTibberPrices(vehicle.VIN, false)
+	}
+	data, err := json.Marshal(prices)
+	if err != nil {
+		log.Printf("Could not marshal MQTT prices for vehicle %s: %s\n", vehicle.VIN, err.Error())
+		return
+	}
+	p.pricesMutex.Lock()
+	defer p.pricesMutex.Unlock()
+	if p.prices[vehicle.VIN] == string(data) {
+		return
+	}
+	p.prices[vehicle.VIN] = string(data)
+	p.publish(p.topic(vehicle.VIN, "prices"), string(data))
+}
+
+func (p *MqttPublisher) PublishChargingEvent(vin string, eventType int, text string) {
+	if p == nil {
+		return
+	}
+	p.publish(p.topic(vin, "event"), &MqttChargingEvent{
+		ChargingEvent: ChargingEvent{
+			Timestamp: GetDB().Time.UTCNow(),
+			Event:     eventType,
+			Data:      text,
+		},
+		VIN: vin,
+	})
+}
+
+func (p *MqttPublisher) PublishPermanentError(permanentError bool) {
+	if p == nil {
+		return
+	}
+	p.publish(p.topic("permanent_error"), strconv.FormatBool(permanentError))
+}
+
+func (p *MqttPublisher) Subscribe() error {
+	if p == nil || !p.Commands {
+		return nil
+	}
+	if token := p.Client.Subscribe(p.topic("+", "set", "+"), p.QoS, p.messageCommandHandler); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (p *MqttPublisher) Unsubscribe() {
+	if p == nil || !p.Commands {
+		return
+	}
+	if token := p.Client.Unsubscribe(p.topic("+", "set", "+")); token.WaitTimeout(time.Second*2) && token.Error() != nil {
+		log.Println(token.Error())
+	}
+}
+
+func (p *MqttPublisher) messageCommandHandler(client mqtt.Client, msg mqtt.Message) {
+	go func() {
+		parts := strings.Split(strings.TrimPrefix(msg.Topic(), p.Prefix+"/"), "/")
+		if len(parts) != 3 || parts[1] != "set" {
+			return
+		}
+		if err := p.ExecuteCommand(parts[0], parts[2], string(msg.Payload())); err != nil {
+			log.Printf("Could not execute MQTT command %s: %s\n", msg.Topic(), err.Error())
+		}
+	}()
+}
+
+func (p *MqttPublisher) ExecuteCommand(vin string, command string, payload string) error {
+	vehicle := GetDB().GetVehicleByVIN(vin)
+	if vehicle == nil {
+		return fmt.Errorf("unknown vehicle %s", vin)
+	}
+	payload = strings.TrimSpace(payload)
+	switch command {
+	case "enabled":
+		value, err := parseMqttBool(payload)
+		if err != nil {
+			return err
+		}
+		vehicle.Enabled = value
+	case "surplus_charging":
+		value, err := parseMqttBool(payload)
+		if err != nil {
+			return err
+		}
+		vehicle.SurplusCharging = value
+	case "lowcost_charging":
+		value, err := parseMqttBool(payload)
+		if err != nil {
+			return err
+		}
+		vehicle.LowcostCharging = value
+	case "target_soc":
+		value, err := parseMqttInt(payload, 1, 100)
+		if err != nil {
+			return err
+		}
+		vehicle.TargetSoC = value
+	case "max_amps":
+		value, err := parseMqttInt(payload, 1, 32)
+		if err != nil {
+			return err
+		}
+		vehicle.MaxAmps = value
+	case "min_surplus":
+		value, err := parseMqttInt(payload, 0, MqttMaxMinSurplus)
+		if err != nil {
+			return err
+		}
+		vehicle.MinSurplus = value
+	case "charge_now":
+		value, err := parseMqttBool(payload)
+		if err != nil {
+			return err
+		}
+		GetDB().SetVehicleStateChargeNow(vin, value)
+		log.Printf("Charge now for vehicle %s set to %t via MQTT\n", vin, value)
+		p.PublishVehicle(vin)
+		return nil
+	default:
+		return fmt.Errorf("unknown command '%s'", command)
+	}
+	GetDB().CreateUpdateVehicle(vehicle)
+	log.Printf("Updated %s of vehicle %s to %s via MQTT\n", command, vin, payload)
+	p.PublishVehicle(vin)
+	return nil
+}
+
+func parseMqttBool(payload string) (bool, error) {
+	switch strings.ToLower(payload) {
+	case "1", "true", "on":
+		return true, nil
+	case "0", "false", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean value '%s'", payload)
+}
+
+func parseMqttInt(payload string, min int, max int) (int, error) {
+	value, err := strconv.Atoi(payload)
+	if err != nil {
+		// accept floats like "80.0" as sent by some home automation systems
+		f, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return 0, errors.New("value must be numeric")
+		}
+		value = int(f)
+	}
+	if value < min || value > max {
+		return 0, fmt.Errorf("value must be between %d and %d", min, max)
+	}
+	return value, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+type MqttTokenMock struct {
+	err error
+}
+
+func (t *MqttTokenMock) Wait() bool                     { return true }
+func (t *MqttTokenMock) WaitTimeout(time.Duration) bool { return true }
+func (t *MqttTokenMock) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (t *MqttTokenMock) Error() error                   { return t.err }
+
+// MqttClientMock records retained messages; calling unimplemented methods panics
+type MqttClientMock struct {
+	mqtt.Client
+	Retained      map[string][]byte
+	Published     map[string]int
+	Subscriptions []string
+	SubscribeErrs []error
+	mutex         sync.Mutex
+}
+
+func NewMqttClientMock() *MqttClientMock {
+	return &MqttClientMock{Retained: make(map[string][]byte), Published: make(map[string]int)}
+}
+
+func (c *MqttClientMock) IsConnected() bool {
+	return true
+}
+
+func (c *MqttClientMock) IsConnectionOpen() bool {
+	return true
+}
+
+// Subscribe fails with the errors in SubscribeErrs before succeeding
+func (c *MqttClientMock) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.SubscribeErrs) > 0 {
+		err := c.SubscribeErrs[0]
+		c.SubscribeErrs = c.SubscribeErrs[1:]
+		return &MqttTokenMock{err: err}
+	}
+	c.Subscriptions = append(c.Subscriptions, topic)
+	return &MqttTokenMock{}
+}
+
+func (c *MqttClientMock) GetSubscriptions() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.Subscriptions...)
+}
+
+func (c *MqttClientMock) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Published[topic]++
+	if retained {
+		c.Retained[topic] = payload.([]byte)
+	}
+	return &MqttTokenMock{}
+}
+
+func (c *MqttClientMock) Get(topic string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return string(c.Retained[topic])
+}
+
+func TestMqttPublisher_PublishVehicle(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	client := NewMqttClientMock()
+	MqttPublisherInstance = NewMqttPublisher(client)
+	defer func() { MqttPublisherInstance = nil }()
+
+	v := &Vehicle{
+		VIN:             "123",
+		Enabled:         true,
+		TargetSoC:       80,
+		MaxAmps:         16,
+		LowcostCharging: true,
+		GridProvider:    GridProviderTibber,
+		TibberToken:     "secret",
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 55)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateChargingOnSolar)
+	now := GlobalMockTime.CurTime
+	SetTibberTestPrice(v.VIN, time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.UTC), 0.25)
+	GetDB().SetSetting(SettingsPermanentError, "1")
+
+	GetMqttPublisher().PublishAll()
+
+	var state VehicleState
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("chargebot/123/state")), &state))
+	assert.Equal(t, 55, state.SoC)
+	assert.Equal(t, "solar", client.Get("chargebot/123/decision"))
+	assert.Equal(t, "true", client.Get("chargebot/permanent_error"))
+	assert.NotContains(t, client.Get("chargebot/123/settings"), "secret")
+	var settings VehicleSettings
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("chargebot/123/settings")), &settings))
+	assert.Equal(t, 80, settings.TargetSoC)
+	var prices []*GridPrice
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("chargebot/123/prices")), &prices))
+	assert.Len(t, prices, 1)
+
+	// unchanged prices are published once only
+	GetMqttPublisher().PublishVehicle(v.VIN)
+	assert.Equal(t, 2, client.Published["chargebot/123/state"])
+	assert.Equal(t, 1, client.Published["chargebot/123/prices"])
+	SetTibberTestPrice(v.VIN, time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.UTC).Add(time.Hour), 0.30)
+	GetMqttPublisher().PublishVehicle(v.VIN)
+	assert.Equal(t, 2, client.Published["chargebot/123/prices"])
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("chargebot/123/prices")), &prices))
+	assert.Len(t, prices, 2)
+
+	LogChargingEvent(v.VIN, LogEventChargeStart, "")
+	assert.Contains(t, client.Get("chargebot/123/event"), `"event":1`)
+}
+
+func TestMqttPublisher_ExecuteCommand(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	client := NewMqttClientMock()
+	p := NewMqttPublisher(client)
+
+	v := &Vehicle{
+		VIN:       "123",
+		Enabled:   false,
+		TargetSoC: 80,
+	}
+	GetDB().CreateUpdateVehicle(v)
+
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "enabled", "ON"))
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "surplus_charging", "true"))
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "lowcost_charging", "1"))
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "target_soc", "90.0"))
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "charge_now", "1"))
+	v = GetDB().GetVehicleByVIN(v.VIN)
+	assert.True(t, v.Enabled)
+	assert.True(t, v.SurplusCharging)
+	assert.True(t, v.LowcostCharging)
+	assert.Equal(t, 90, v.TargetSoC)
+	assert.True(t, GetDB().GetVehicleState(v.VIN).ChargeNow)
+	assert.Contains(t, client.Get("chargebot/123/settings"), `"charge_now":true`)
+
+	assert.NotNil(t, p.ExecuteCommand(v.VIN, "enabled", "maybe"))
+	assert.NotNil(t, p.ExecuteCommand(v.VIN, "target_soc", "101"))
+	assert.NotNil(t, p.ExecuteCommand(v.VIN, "unknown", "1"))
+	assert.NotNil(t, p.ExecuteCommand("456", "enabled", "1"))
+}
+
+func TestMqttPublisher_Discovery(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	client := NewMqttClientMock()
+	p := NewMqttPublisher(client)
+	p.Discovery = true
+	p.Commands = true
+
+	v := &Vehicle{
+		VIN:         "ABC123",
+		DisplayName: "My Tesla",
+		TargetSoC:   80,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	MqttPublisherInstance = p
+	defer func() { MqttPublisherInstance = nil }()
+	p.PublishAll()
+
+	assert.Equal(t, MqttAvailabilityOnline, client.Get("chargebot/status"))
+	var config HomeAssistantEntityConfig
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("homeassistant/sensor/chargebot_abc123/soc/config")), &config))
+	assert.Equal(t, "chargebot/ABC123/state", config.StateTopic)
+	assert.Equal(t, "chargebot/status", config.AvailabilityTopic)
+	assert.Equal(t, "My Tesla", config.Device.Name)
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("homeassistant/switch/chargebot_abc123/surplus_charging/config")), &config))
+	assert.Equal(t, "chargebot/ABC123/set/surplus_charging", config.CommandTopic)
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("homeassistant/number/chargebot_abc123/max_amps/config")), &config))
+	assert.Equal(t, 32, *config.Max)
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("homeassistant/number/chargebot_abc123/min_surplus/config")), &config))
+	assert.Equal(t, MqttMaxMinSurplus, *config.Max)
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("homeassistant/binary_sensor/chargebot_abc123/permanent_error/config")), &config))
+	assert.Equal(t, "chargebot/permanent_error", config.StateTopic)
+
+	// commands sent by switches and numbers are accepted
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "surplus_charging", "ON"))
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "max_amps", "10.0"))
+	assert.Nil(t, p.ExecuteCommand(v.VIN, "min_surplus", "1500"))
+	assert.NotNil(t, p.ExecuteCommand(v.VIN, "min_surplus", strconv.Itoa(MqttMaxMinSurplus+1)))
+	v = GetDB().GetVehicleByVIN(v.VIN)
+	assert.True(t, v.SurplusCharging)
+	assert.Equal(t, 10, v.MaxAmps)
+	assert.Equal(t, 1500, v.MinSurplus)
+
+	// without commands, settings are read-only sensors and the controls are removed
+	p.Commands = false
+	p.PublishDiscovery(v)
+	assert.Equal(t, "", client.Get("homeassistant/switch/chargebot_abc123/surplus_charging/config"))
+	assert.Equal(t, "", client.Get("homeassistant/number/chargebot_abc123/max_amps/config"))
+	config = HomeAssistantEntityConfig{}
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("homeassistant/binary_sensor/chargebot_abc123/surplus_charging/config")), &config))
+	assert.Equal(t, "", config.CommandTopic)
+	assert.Equal(t, "chargebot/ABC123/settings", config.StateTopic)
+	config = HomeAssistantEntityConfig{}
+	assert.Nil(t, json.Unmarshal([]byte(client.Get("homeassistant/sensor/chargebot_abc123/max_amps/config")), &config))
+	assert.Equal(t, "", config.CommandTopic)
+	assert.Equal(t, "A", config.UnitOfMeasurement)
+
+	p.RemoveVehicle(v)
+	assert.Equal(t, "", client.Get("homeassistant/sensor/chargebot_abc123/soc/config"))
+	assert.Equal(t, "", client.Get("homeassistant/binary_sensor/chargebot_abc123/surplus_charging/config"))
+	_, ok := client.Retained["homeassistant/sensor/chargebot_abc123/soc/config"]
+	assert.True(t, ok)
+	assert.Equal(t, "", client.Get("chargebot/ABC123/state"))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MqttSurplusFieldSurplus             = "surplus_watts"
+	MqttSurplusFieldInverterActivePower = "inverter_active_power_watts"
+	MqttSurplusFieldConsumption         = "consumption_watts"
+	MqttSurplusFieldGridPower           = "grid_power_watts"
+)
+
+// MqttSurplusInput describes a single reading taken from an MQTT topic,
+// i.e. {"topic": "home/pv", "path": "$.pv", "field": "inverter_active_power_watts", "scale": 1000}
+type MqttSurplusInput struct {
+	Topic  string  `json:"topic"`
+	Path   string  `json:"path"`   // JSONPath expression; plain numeric payload if empty
+	Field  string  `json:"field"`  // field of SurplusRecordingRequest the value is added to
+	Scale  float64 `json:"scale"`  // multiplier to convert the reading into watts
+	Invert bool    `json:"invert"` // flip the reading's sign
+}
+
+// MqttSurplusAggregator merges readings from several topics into one surplus record.
+// A record is written as soon as every input has reported, or when the merge window
+// started by the first reading has expired. Readings older than MaxAge are not reused,
+// so no record is written until a silent input reports again.
+type MqttSurplusAggregator struct {
+	Inputs     []*MqttSurplusInput
+	Window     time.Duration
+	MaxAge     time.Duration
+	Time       Time
+	values     []float64
+	known      []bool
+	updated    []bool
+	receivedAt []time.Time
+	timer      *time.Timer
+	mutex      sync.Mutex
+}
+
+func ParseMqttSurplusInputs(s string) ([]*MqttSurplusInput, error) {
+	var inputs []*MqttSurplusInput
+	if err := json.Unmarshal([]byte(s), &inputs); err != nil {
+		return nil, err
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("no inputs configured")
+	}
+	for _, input := range inputs {
+		if input.Topic == "" {
+			return nil, errors.New("topic is required for each input")
+		}
+		if input.Field == "" {
+			input.Field = MqttSurplusFieldSurplus
+		}
+		if input.Field != MqttSurplusFieldSurplus && input.Field != MqttSurplusFieldInverterActivePower && input.Field != MqttSurplusFieldConsumption && input.Field != MqttSurplusFieldGridPower {
+			return nil, fmt.Errorf("unknown field '%s' for topic %s", input.Field, input.Topic)
+		}
+		if input.Scale == 0 {
+			input.Scale = 1
+		}
+		if input.Path != "" {
+			if _, err := parseJSONPath(input.Path); err != nil {
+				return nil, fmt.Errorf("invalid path for topic %s: %s", input.Topic, err.Error())
+			}
+		}
+	}
+	return inputs, nil
+}
+
+func NewMqttSurplusAggregator(inputs []*MqttSurplusInput, window time.Duration, maxAge time.Duration) *MqttSurplusAggregator {
+	return &MqttSurplusAggregator{
+		Inputs:     inputs,
+		Window:     window,
+		MaxAge:     maxAge,
+		Time:       new(RealTime),
+		values:     make([]float64, len(inputs)),
+		known:      make([]bool, len(inputs)),
+		updated:    make([]bool, len(inputs)),
+		receivedAt: make([]time.Time, len(inputs)),
+	}
+}
+
+func (a *MqttSurplusAggregator) Topics() []string {
+	res := []string{}
+	seen := make(map[string]bool)
+	for _, input := range a.Inputs {
+		if !seen[input.Topic] {
+			seen[input.Topic] = true
+			res = append(res, input.Topic)
+		}
+	}
+	return res
+}
+
+func (a *MqttSurplusAggregator) Handle(topic string, payload []byte) {
+	var data interface{}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	received := false
+	for i, input := range a.Inputs {
+		if input.Topic != topic {
+			continue
+		}
+		value, err := input.parse(payload, &data)
+		if err != nil {
+			log.Printf("Could not parse surplus reading from topic %s: %s\n", topic, err.Error())
+			continue
+		}
+		a.values[i] = value
+		a.known[i] = true
+		a.updated[i] = true
+		a.receivedAt[i] = a.Time.UTCNow()
+		received = true
+	}
+	if !received {
+		return
+	}
+	if a.allUpdated() || a.Window <= 0 {
+		a.flush()
+		return
+	}
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.Window, func() {
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			a.flush()
+		})
+	}
+}
+
+func (input *MqttSurplusInput) parse(payload []byte, data *interface{}) (float64, error) {
+	var value float64
+	if input.Path == "" {
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return 0, err
+		}
+		value = v
+	} else {
+		if *data == nil {
+			if err := json.Unmarshal(payload, data); err != nil {
+				return 0, err
+			}
+		}
+		v, err := JSONPathFloat(*data, input.Path)
+		if err != nil {
+			return 0, err
+		}
+		value = v
+	}
+	value = value * input.Scale
+	if input.Invert {
+		value = value * -1
+	}
+	return value, nil
+}
+
+func (a *MqttSurplusAggregator) allUpdated() bool {
+	for _, updated := range a.updated {
+		if !updated {
+			return false
+		}
+	}
+	return true
+}
+
+// flush must be called with the mutex held
+func (a *MqttSurplusAggregator) flush() {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	for i := range a.updated {
+		a.updated[i] = false
+	}
+	now := a.Time.UTCNow()
+	for i, input := range a.Inputs {
+		if a.known[i] && now.Sub(a.receivedAt[i]) > a.MaxAge {
+			log.Printf("No surplus reading from topic %s since %s, waiting for a new reading\n", input.Topic, a.receivedAt[i].Format(time.RFC3339))
+			a.known[i] = false
+		}
+	}
+	for _, known := range a.known {
+		if !known {
+			// wait until every input has reported at least once
+			return
+		}
+	}
+	fields := make(map[string]float64)
+	for i, input := range a.Inputs {
+		fields[input.Field] += a.values[i]
+	}
+	if gridPower, ok := fields[MqttSurplusFieldGridPower]; ok {
+		RecordGridPower(int(math.Round(gridPower)))
+		return
+	}
+	m := &SurplusRecordingRequest{
+		SurplusWatts:        int(math.Round(fields[MqttSurplusFieldSurplus])),
+		InverterActivePower: int(math.Round(fields[MqttSurplusFieldInverterActivePower])),
+		Consumption:         int(math.Round(fields[MqttSurplusFieldConsumption])),
+	}
+	GetDB().RecordSurplus(m.GetSurplus())
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMqttSurplusAggregator_PlainPayload(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	a := NewMqttSurplusAggregator([]*MqttSurplusInput{{Topic: "chargebot/surplus", Field: MqttSurplusFieldSurplus, Scale: 1}}, time.Second*2, time.Minute)
+	a.Handle("chargebot/surplus", []byte("1500"))
+	a.Handle("chargebot/surplus", []byte(" 1750.4\n"))
+	a.Handle("chargebot/surplus", []byte("invalid"))
+	a.Handle("other/topic", []byte("100"))
+
+	records := GetDB().GetLatestSurplusRecords(10)
+	assert.Len(t, records, 2)
+}
+
+func TestMqttSurplusAggregator_MergeTopics(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	inputs, err := ParseMqttSurplusInputs(`[
+		{"topic": "home/pv", "path": "$.pv", "field": "inverter_active_power_watts", "scale": 1000},
+		{"topic": "home/load", "path": "$.load", "field": "consumption_watts"},
+		{"topic": "home/load", "path": "$.wallbox", "field": "consumption_watts", "invert": true}
+	]`)
+	assert.Nil(t, err)
+	a := NewMqttSurplusAggregator(inputs, time.Second*2, time.Minute)
+	a.Time = GlobalMockTime
+	assert.Equal(t, []string{"home/pv", "home/load"}, a.Topics())
+
+	// both topics within the window result in one record
+	a.Handle("home/pv", []byte(`{"pv": 5.2}`))
+	assert.Len(t, GetDB().GetLatestSurplusRecords(10), 0)
+	a.Handle("home/load", []byte(`{"load": 1500, "wallbox": -300}`))
+	records := GetDB().GetLatestSurplusRecords(10)
+	assert.Len(t, records, 1)
+	assert.Equal(t, 5200-1500-300, records[0].SurplusWatts)
+
+	// a single topic is recorded with the last known values after the window expired
+	a.Window = time.Millisecond * 50
+	a.Handle("home/pv", []byte(`{"pv": 6}`))
+	assert.Len(t, GetDB().GetLatestSurplusRecords(10), 1)
+	assert.Eventually(t, func() bool {
+		return len(GetDB().GetLatestSurplusRecords(10)) == 2
+	}, time.Second, time.Millisecond*10)
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Second)
+	defer func() { GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(-time.Second) }()
+	a.Handle("home/load", []byte(`{"load": 1000, "wallbox": 0}`))
+	assert.Eventually(t, func() bool {
+		records = GetDB().GetLatestSurplusRecords(10)
+		return len(records) == 3
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, 5000, records[0].SurplusWatts)
+}
+
+func TestMqttSurplusAggregator_MaxAge(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	inputs, err := ParseMqttSurplusInputs(`[
+		{"topic": "home/pv", "field": "inverter_active_power_watts"},
+		{"topic": "home/load", "field": "consumption_watts"}
+	]`)
+	assert.Nil(t, err)
+	a := NewMqttSurplusAggregator(inputs, 0, time.Minute)
+	a.Time = GlobalMockTime
+	start := GlobalMockTime.CurTime
+	t.Cleanup(func() { GlobalMockTime.CurTime = start })
+
+	a.Handle("home/load", []byte("1000"))
+	a.Handle("home/pv", []byte("4000"))
+	assert.Len(t, GetDB().GetLatestSurplusRecords(10), 1)
+
+	// the load meter's last reading is still recent enough
+	GlobalMockTime.CurTime = start.Add(30 * time.Second)
+	a.Handle("home/pv", []byte("5000"))
+	assert.Len(t, GetDB().GetLatestSurplusRecords(10), 2)
+
+	// the load meter went silent
+	GlobalMockTime.CurTime = start.Add(2 * time.Minute)
+	a.Handle("home/pv", []byte("6000"))
+	GlobalMockTime.CurTime = start.Add(3 * time.Minute)
+	a.Handle("home/pv", []byte("6000"))
+	assert.Len(t, GetDB().GetLatestSurplusRecords(10), 2)
+
+	GlobalMockTime.CurTime = start.Add(4 * time.Minute)
+	a.Handle("home/load", []byte("2000"))
+	records := GetDB().GetLatestSurplusRecords(10)
+	assert.Len(t, records, 3)
+	assert.Equal(t, 4000, records[0].SurplusWatts)
+}
+
+func TestMqttSurplusAggregator_ParseInputs(t *testing.T) {
+	inputs, err := ParseMqttSurplusInputs(`[{"topic": "home/grid", "invert": true}]`)
+	assert.Nil(t, err)
+	assert.Equal(t, MqttSurplusFieldSurplus, inputs[0].Field)
+	assert.Equal(t, 1.0, inputs[0].Scale)
+
+	for _, s := range []string{``, `[]`, `[{"path": "$.pv"}]`, `[{"topic": "home/grid", "field": "grid"}]`, `[{"topic": "home/grid", "path": "$.a["}]`} {
+		_, err := ParseMqttSurplusInputs(s)
+		assert.NotNil(t, err, s)
+	}
+}
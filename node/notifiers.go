@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var PushoverAPIURL = "https://api.pushover.net/1/messages.json"
+
+// validateNotifierURL checks the URL of a notification channel, so a malformed URL fails on startup instead of on each notification
+func validateNotifierURL(key string, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid URL: %s", key, err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL", key)
+	}
+	return nil
+}
+
+// checkNotifierResponse closes the response and turns unsuccessful status codes into an error
+func checkNotifierResponse(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// NtfyNotifier publishes to a ntfy topic, NTFY_URL contains the topic, i.e. https://ntfy.sh/my-chargebot
+type NtfyNotifier struct {
+}
+
+func (n *NtfyNotifier) Name() string {
+	return "ntfy"
+}
+
+func (n *NtfyNotifier) Send(category NotificationCategory, msg string) error {
+	r, err := http.NewRequest("POST", GetConfig().NtfyURL, strings.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Title", NotificationTitle)
+	r.Header.Set("Tags", string(category))
+	if category == NotificationCategoryError {
+		r.Header.Set("Priority", "high")
+	}
+	if GetConfig().NtfyToken != "" {
+		r.Header.Set("Authorization", "Bearer "+GetConfig().NtfyToken)
+	}
+	return checkNotifierResponse(RetryHTTPRequest(r))
+}
+
+type GotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+type GotifyNotifier struct {
+}
+
+func (n *GotifyNotifier) Name() string {
+	return "gotify"
+}
+
+func (n *GotifyNotifier) Send(category NotificationCategory, msg string) error {
+	payload := GotifyMessage{
+		Title:    NotificationTitle,
+		Message:  msg,
+		Priority: 5,
+	}
+	if category == NotificationCategoryError {
+		payload.Priority = 8
+	}
+	json, _ := json.Marshal(payload)
+	target := strings.TrimSuffix(GetConfig().GotifyURL, "/") + "/message"
+	r, err := http.NewRequest("POST", target, bytes.NewReader(json))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("X-Gotify-Key", GetConfig().GotifyToken)
+	return checkNotifierResponse(RetryHTTPJSONRequest(r, ""))
+}
+
+type PushoverNotifier struct {
+}
+
+func (n *PushoverNotifier) Name() string {
+	return "pushover"
+}
+
+func (n *PushoverNotifier) Send(category NotificationCategory, msg string) error {
+	form := url.Values{}
+	form.Set("token", GetConfig().PushoverToken)
+	form.Set("user", GetConfig().PushoverUser)
+	form.Set("title", NotificationTitle)
+	form.Set("message", msg)
+	if category == NotificationCategoryError {
+		form.Set("priority", "1")
+	}
+	r, err := http.NewRequest("POST", PushoverAPIURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return checkNotifierResponse(RetryHTTPRequest(r))
+}
+
+// EmailNotifier sends mails via SMTP, using STARTTLS if the server supports it
+type EmailNotifier struct {
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (n *EmailNotifier) Send(category NotificationCategory, msg string) error {
+	c := GetConfig()
+	recipients := []string{}
+	for _, to := range strings.Split(c.SmtpTo, ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			recipients = append(recipients, to)
+		}
+	}
+	from := c.SmtpFrom
+	if from == "" {
+		from = c.SmtpUsername
+	}
+	var auth smtp.Auth = nil
+	if c.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", c.SmtpUsername, c.SmtpPassword, c.SmtpHost)
+	}
+	addr := c.SmtpHost + ":" + strconv.Itoa(c.SmtpPort)
+	return smtp.SendMail(addr, auth, from, recipients, buildEmailMessage(from, recipients, category, msg, time.Now()))
+}
+
+func buildEmailMessage(from string, recipients []string, category NotificationCategory, msg string, now time.Time) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + strings.Join(recipients, ", ") + "\r\n")
+	b.WriteString(fmt.Sprintf("Subject: %s: %s\r\n", NotificationTitle, category))
+	b.WriteString("Date: " + now.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg + "\r\n")
+	return b.Bytes()
+}
+
+type MatrixMessage struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+type MatrixNotifier struct {
+}
+
+func (n *MatrixNotifier) Name() string {
+	return "matrix"
+}
+
+func (n *MatrixNotifier) Send(category NotificationCategory, msg string) error {
+	payload := MatrixMessage{
+		MsgType: "m.text",
+		Body:    msg,
+	}
+	json, _ := json.Marshal(payload)
+	// the transaction ID makes retried requests idempotent
+	target := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(GetConfig().MatrixHomeserver, "/"), url.PathEscape(GetConfig().MatrixRoomID), generateToken(16))
+	r, err := http.NewRequest("PUT", target, bytes.NewReader(json))
+	if err != nil {
+		return err
+	}
+	return checkNotifierResponse(RetryHTTPJSONRequest(r, GetConfig().MatrixToken))
+}
+
+// ChatWebhookNotifier posts to incoming webhooks of chat services, which only differ in the JSON field of the text
+type ChatWebhookNotifier struct {
+	ChannelName string
+	URL         string
+	TextField   string
+}
+
+func (n *ChatWebhookNotifier) Name() string {
+	return n.ChannelName
+}
+
+func (n *ChatWebhookNotifier) Send(category NotificationCategory, msg string) error {
+	json, _ := json.Marshal(map[string]string{n.TextField: msg})
+	r, err := http.NewRequest("POST", n.URL, bytes.NewReader(json))
+	if err != nil {
+		return err
+	}
+	return checkNotifierResponse(RetryHTTPJSONRequest(r, ""))
+}
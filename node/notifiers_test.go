@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockNotifier struct {
+	name     string
+	err      error
+	messages []string
+}
+
+func (n *mockNotifier) Name() string {
+	return n.name
+}
+
+func (n *mockNotifier) Send(category NotificationCategory, msg string) error {
+	n.messages = append(n.messages, string(category)+": "+msg)
+	return n.err
+}
+
+func resetNotifyConfig(t *testing.T) {
+	config := *GetConfig()
+	notifiers := NotifiersInstance
+	t.Cleanup(func() {
+		c := GetConfig()
+		c.NotifyCharging, c.NotifyAmps, c.NotifyError, c.NotifyPlug, c.NotifyDigest, c.NotifyInfo = config.NotifyCharging, config.NotifyAmps, config.NotifyError, config.NotifyPlug, config.NotifyDigest, config.NotifyInfo
+		c.NtfyURL, c.NtfyToken = config.NtfyURL, config.NtfyToken
+		c.GotifyURL, c.GotifyToken = config.GotifyURL, config.GotifyToken
+		c.PushoverToken, c.PushoverUser = config.PushoverToken, config.PushoverUser
+		c.MatrixHomeserver, c.MatrixToken, c.MatrixRoomID = config.MatrixHomeserver, config.MatrixToken, config.MatrixRoomID
+		NotifiersInstance = notifiers
+	})
+}
+
+type notifierTestRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+func newNotifierTestServer(t *testing.T) (*[]notifierTestRequest, *httptest.Server) {
+	requests := &[]notifierTestRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*requests = append(*requests, notifierTestRequest{method: r.Method, path: r.URL.Path, header: r.Header, body: string(body)})
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	return requests, server
+}
+
+func TestNotifier_Routing(t *testing.T) {
+	resetNotifyConfig(t)
+	telegram := &mockNotifier{name: "telegram"}
+	ntfy := &mockNotifier{name: "ntfy"}
+	NotifiersInstance = []Notifier{telegram, ntfy}
+	GetConfig().NotifyCharging = ""
+	GetConfig().NotifyAmps = "ntfy"
+	GetConfig().NotifyError = "Telegram, ntfy"
+	GetConfig().NotifyPlug = "none"
+
+	assert.Nil(t, SendPushNotification(NotificationCategoryCharging, "started"))
+	assert.Nil(t, SendPushNotification(NotificationCategoryAmps, "adjusted"))
+	assert.Nil(t, SendPushNotification(NotificationCategoryError, "failed"))
+	assert.Nil(t, SendPushNotification(NotificationCategoryPlug, "plugged in"))
+
+	assert.Equal(t, []string{"charging: started", "error: failed"}, telegram.messages)
+	assert.Equal(t, []string{"charging: started", "amps: adjusted", "error: failed"}, ntfy.messages)
+}
+
+func TestNotifier_ErrorDoesNotStopOthers(t *testing.T) {
+	resetNotifyConfig(t)
+	failing := &mockNotifier{name: "telegram", err: errors.New("offline")}
+	ntfy := &mockNotifier{name: "ntfy"}
+	NotifiersInstance = []Notifier{failing, ntfy}
+	GetConfig().NotifyError = ""
+
+	err := SendPushNotification(NotificationCategoryError, "failed")
+	assert.ErrorContains(t, err, "offline")
+	assert.Len(t, ntfy.messages, 1)
+}
+
+func TestNotifier_Queue(t *testing.T) {
+	resetNotifyConfig(t)
+	sent := make(chan string, 2)
+	NotifiersInstance = []Notifier{&queueTestNotifier{sent: sent}}
+	GetConfig().NotifyInfo = ""
+	StartNotificationQueue()
+	t.Cleanup(func() {
+		close(notificationQueue)
+		notificationQueue = nil
+	})
+
+	// the caller doesn't wait for the message to be sent
+	assert.Nil(t, SendPushNotification(NotificationCategoryInfo, "prices available"))
+	assert.Nil(t, SendPushNotification(NotificationCategoryError, "failed"))
+	assert.Equal(t, "info: prices available", <-sent)
+	assert.Equal(t, "error: failed", <-sent)
+}
+
+type queueTestNotifier struct {
+	sent chan string
+}
+
+func (n *queueTestNotifier) Name() string {
+	return "telegram"
+}
+
+func (n *queueTestNotifier) Send(category NotificationCategory, msg string) error {
+	n.sent <- string(category) + ": " + msg
+	return nil
+}
+
+func TestNotifier_RetryResendsBody(t *testing.T) {
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusRequestTimeout)
+		}
+	}))
+	t.Cleanup(server.Close)
+	delay := DelayBetweenHTTPRetries
+	DelayBetweenHTTPRetries = 0
+	t.Cleanup(func() { DelayBetweenHTTPRetries = delay })
+
+	r, _ := http.NewRequest("POST", server.URL, strings.NewReader("message"))
+	resp, err := RetryHTTPRequest(r)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"message", "message"}, bodies)
+}
+
+func TestNotifier_InitFromConfig(t *testing.T) {
+	resetNotifyConfig(t)
+	GetConfig().NtfyURL = "https://ntfy.sh/chargebot"
+	GetConfig().GotifyURL = "https://gotify.local"
+	GetConfig().GotifyToken = ""
+	InitNotifiers()
+
+	names := []string{}
+	for _, n := range NotifiersInstance {
+		names = append(names, n.Name())
+	}
+	// gotify requires a token
+	assert.Equal(t, []string{"ntfy"}, names)
+}
+
+func TestNotifier_MalformedURL(t *testing.T) {
+	resetNotifyConfig(t)
+	GetConfig().NtfyURL = "http://[::1"
+	GetConfig().GotifyURL = "http://%zz"
+	GetConfig().GotifyToken = "app-token"
+	GetConfig().MatrixHomeserver = "http://%zz"
+
+	assert.NotNil(t, (&NtfyNotifier{}).Send(NotificationCategoryError, "failed"))
+	assert.NotNil(t, (&GotifyNotifier{}).Send(NotificationCategoryError, "failed"))
+	assert.NotNil(t, (&MatrixNotifier{}).Send(NotificationCategoryError, "failed"))
+	assert.NotNil(t, (&ChatWebhookNotifier{ChannelName: "discord", URL: "http://%zz", TextField: "content"}).Send(NotificationCategoryError, "failed"))
+
+	// rejected on startup
+	assert.Panics(t, InitNotifiers)
+	GetConfig().NtfyURL = "ntfy.sh/chargebot"
+	GetConfig().GotifyURL = ""
+	GetConfig().MatrixHomeserver = ""
+	assert.Panics(t, InitNotifiers)
+}
+
+func TestNotifier_Ntfy(t *testing.T) {
+	resetNotifyConfig(t)
+	requests, server := newNotifierTestServer(t)
+	GetConfig().NtfyURL = server.URL + "/chargebot"
+	GetConfig().NtfyToken = "tk_123"
+
+	assert.Nil(t, (&NtfyNotifier{}).Send(NotificationCategoryError, "permanent error"))
+	assert.Len(t, *requests, 1)
+	r := (*requests)[0]
+	assert.Equal(t, "/chargebot", r.path)
+	assert.Equal(t, "permanent error", r.body)
+	assert.Equal(t, "high", r.header.Get("Priority"))
+	assert.Equal(t, "Bearer tk_123", r.header.Get("Authorization"))
+}
+
+func TestNotifier_Gotify(t *testing.T) {
+	resetNotifyConfig(t)
+	requests, server := newNotifierTestServer(t)
+	GetConfig().GotifyURL = server.URL + "/"
+	GetConfig().GotifyToken = "app-token"
+
+	assert.Nil(t, (&GotifyNotifier{}).Send(NotificationCategoryCharging, "started"))
+	r := (*requests)[0]
+	assert.Equal(t, "/message", r.path)
+	assert.Equal(t, "app-token", r.header.Get("X-Gotify-Key"))
+	var m GotifyMessage
+	assert.Nil(t, json.Unmarshal([]byte(r.body), &m))
+	assert.Equal(t, "started", m.Message)
+	assert.Equal(t, 5, m.Priority)
+}
+
+func TestNotifier_Pushover(t *testing.T) {
+	resetNotifyConfig(t)
+	requests, server := newNotifierTestServer(t)
+	apiURL := PushoverAPIURL
+	t.Cleanup(func() {
+		PushoverAPIURL = apiURL
+	})
+	PushoverAPIURL = server.URL + "/1/messages.json"
+	GetConfig().PushoverToken = "app"
+	GetConfig().PushoverUser = "user"
+
+	assert.Nil(t, (&PushoverNotifier{}).Send(NotificationCategoryError, "failed"))
+	form, _ := url.ParseQuery((*requests)[0].body)
+	assert.Equal(t, "app", form.Get("token"))
+	assert.Equal(t, "user", form.Get("user"))
+	assert.Equal(t, "failed", form.Get("message"))
+	assert.Equal(t, "1", form.Get("priority"))
+}
+
+func TestNotifier_Matrix(t *testing.T) {
+	resetNotifyConfig(t)
+	requests, server := newNotifierTestServer(t)
+	GetConfig().MatrixHomeserver = server.URL
+	GetConfig().MatrixToken = "syt_token"
+	GetConfig().MatrixRoomID = "!room:example.com"
+
+	assert.Nil(t, (&MatrixNotifier{}).Send(NotificationCategoryPlug, "plugged in"))
+	r := (*requests)[0]
+	assert.Equal(t, "PUT", r.method)
+	assert.True(t, strings.HasPrefix(r.path, "/_matrix/client/v3/rooms/!room:example.com/send/m.room.message/"))
+	assert.Equal(t, "Bearer syt_token", r.header.Get("Authorization"))
+	assert.JSONEq(t, `{"msgtype": "m.text", "body": "plugged in"}`, r.body)
+}
+
+func TestNotifier_ChatWebhooks(t *testing.T) {
+	requests, server := newNotifierTestServer(t)
+
+	discord := &ChatWebhookNotifier{ChannelName: "discord", URL: server.URL + "/discord", TextField: "content"}
+	slack := &ChatWebhookNotifier{ChannelName: "slack", URL: server.URL + "/slack", TextField: "text"}
+	assert.Nil(t, discord.Send(NotificationCategoryAmps, "adjusted"))
+	assert.Nil(t, slack.Send(NotificationCategoryAmps, "adjusted"))
+	assert.JSONEq(t, `{"content": "adjusted"}`, (*requests)[0].body)
+	assert.JSONEq(t, `{"text": "adjusted"}`, (*requests)[1].body)
+}
+
+func TestNotifier_ErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("unknown webhook"))
+	}))
+	t.Cleanup(server.Close)
+
+	err := (&ChatWebhookNotifier{ChannelName: "discord", URL: server.URL, TextField: "content"}).Send(NotificationCategoryAmps, "adjusted")
+	assert.EqualError(t, err, "unexpected status code 404: unknown webhook")
+}
+
+func TestNotifier_EmailMessage(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	msg := string(buildEmailMessage("bot@example.com", []string{"a@example.com", "b@example.com"}, NotificationCategoryError, "failed", now))
+	assert.Contains(t, msg, "From: bot@example.com\r\n")
+	assert.Contains(t, msg, "To: a@example.com, b@example.com\r\n")
+	assert.Contains(t, msg, "Subject: chargebot.io: error\r\n")
+	assert.True(t, strings.HasSuffix(msg, "\r\n\r\nfailed\r\n"))
+}
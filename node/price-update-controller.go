@@ -1,14 +1,22 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"math"
 	"time"
 )
 
+const PriceUpdateInterval time.Duration = time.Minute * 6
+const PriceUpdateMinRetryDelay time.Duration = time.Minute * 15
+const PriceUpdateMaxRetryDelay time.Duration = time.Hour * 2
+
 var TickerPriceUpdate *time.Ticker = nil
 
 func InitPeriodicPriceUpdateControl() {
-	TickerPriceUpdate = time.NewTicker(time.Minute * 6)
+	TickerPriceUpdate = time.NewTicker(PriceUpdateInterval)
 	go func() {
 		for {
 			PeriodicPriceUpdateControl()
@@ -19,6 +27,8 @@ func InitPeriodicPriceUpdateControl() {
 
 func PeriodicPriceUpdateControl() {
 	PeriodicPriceUpdateControl_Tibber()
+	PeriodicPriceCoverageControl()
+	PeriodicCarbonIntensityUpdateControl()
 }
 
 func PeriodicPriceUpdateControl_Tibber() {
@@ -27,6 +37,9 @@ func PeriodicPriceUpdateControl_Tibber() {
 	l := GetDB().GetVehicleVINsWithTibberTokenWithoutPricesForToday(45)
 	for _, vin := range l {
 		vehicle := GetDB().GetVehicleByVIN(vin)
+		if !IsPriceUpdateRetryDue(GetPriceSourceID(vehicle)) {
+			continue
+		}
 		log.Printf("Updating today's Tibber prices for vehicle %s ...\n", vin)
 		PeriodicPriceUpdateControlProcessVehicle_Tibber(vehicle)
 	}
@@ -37,6 +50,9 @@ func PeriodicPriceUpdateControl_Tibber() {
 		l := GetDB().GetVehicleVINsWithTibberTokenWithoutPricesForTomorrow(45)
 		for _, vin := range l {
 			vehicle := GetDB().GetVehicleByVIN(vin)
+			if !IsPriceUpdateRetryDue(GetPriceSourceID(vehicle)) {
+				continue
+			}
 			log.Printf("Updating tomorrow's Tibber prices for vehicle %s ...\n", vin)
 			PeriodicPriceUpdateControlProcessVehicle_Tibber(vehicle)
 		}
@@ -46,7 +62,8 @@ func PeriodicPriceUpdateControl_Tibber() {
 func PeriodicPriceUpdateControlProcessVehicle_Tibber(vehicle *Vehicle) {
 	priceInfo, err := TibberAPIGetPrices(vehicle.TibberToken)
 	if err != nil {
-		log.Println(err)
+		log.Printf("Could not update Tibber prices for vehicle %s: %s\n", vehicle.VIN, err.Error())
+		GetDB().RecordPriceSourceError(GetPriceSourceID(vehicle), GridProviderTibber, err.Error())
 		return
 	}
 	for _, price := range priceInfo.Today {
@@ -55,9 +72,90 @@ func PeriodicPriceUpdateControlProcessVehicle_Tibber(vehicle *Vehicle) {
 	for _, price := range priceInfo.Tomorrow {
 		PeriodicPriceUpdateControlProcessPriceInfo_Tibber(vehicle, &price)
 	}
+	GetDB().RecordPriceSourceSuccess(GetPriceSourceID(vehicle), GridProviderTibber)
 }
 
 func PeriodicPriceUpdateControlProcessPriceInfo_Tibber(vehicle *Vehicle, price *GridPrice) {
 	ts := price.StartsAt.UTC()
 	GetDB().SetTibberPrice(vehicle.VIN, ts.Year(), int(ts.Month()), ts.Day(), ts.Hour(), price.Total)
 }
+
+// GetPriceSourceID identifies the vehicle's price source, so vehicles sharing a Tibber token share its health.
+// The token is hashed as it must not be stored in plain text.
+func GetPriceSourceID(vehicle *Vehicle) string {
+	hash := sha256.Sum256([]byte(vehicle.TibberToken))
+	return string(vehicle.GridProvider) + ":" + hex.EncodeToString(hash[:8])
+}
+
+// IsPriceUpdateRetryDue returns false while a failed price source is backing off.
+// The delay starts at PriceUpdateMinRetryDelay and doubles with every consecutive failure, up to PriceUpdateMaxRetryDelay.
+func IsPriceUpdateRetryDue(source string) bool {
+	health := GetDB().GetPriceSourceHealth(source)
+	if health == nil || health.FailCount == 0 || health.LastErrorTime == nil {
+		return true
+	}
+	delay := time.Duration(float64(PriceUpdateMinRetryDelay) * math.Pow(2, float64(health.FailCount-1)))
+	if delay > PriceUpdateMaxRetryDelay {
+		delay = PriceUpdateMaxRetryDelay
+	}
+	return !health.LastErrorTime.Add(delay).After(GetDB().Time.UTCNow())
+}
+
+func GetPriceCoverageHours(vehicle *Vehicle) int {
+	if vehicle.GridProvider != GridProviderTibber {
+		return 0
+	}
+	end := GetDB().GetTibberPricesCoverageEnd(vehicle.VIN)
+	if end == nil {
+		return 0
+	}
+	hours := int(math.Floor(end.Sub(GetDB().Time.UTCNow()).Hours()))
+	if hours < 0 {
+		return 0
+	}
+	return hours
+}
+
+func GetPriceSourceHealthWithCoverage(vehicle *Vehicle) *PriceSourceHealth {
+	source := GetPriceSourceID(vehicle)
+	health := GetDB().GetPriceSourceHealth(source)
+	if health == nil {
+		health = &PriceSourceHealth{
+			Source:       source,
+			GridProvider: vehicle.GridProvider,
+		}
+	}
+	health.VIN = vehicle.VIN
+	health.CoverageHours = GetPriceCoverageHours(vehicle)
+	health.CoverageNotified = GetDB().IsVehicleStatePriceCoverageNotified(vehicle.VIN)
+	return health
+}
+
+func PeriodicPriceCoverageControl() {
+	for _, vehicle := range GetDB().GetVehicles() {
+		if !vehicle.LowcostCharging || vehicle.GridProvider != GridProviderTibber || vehicle.TibberToken == "" {
+			continue
+		}
+		PeriodicPriceCoverageControlProcessVehicle(vehicle)
+	}
+}
+
+func PeriodicPriceCoverageControlProcessVehicle(vehicle *Vehicle) {
+	health := GetPriceSourceHealthWithCoverage(vehicle)
+	belowThreshold := health.CoverageHours < GetConfig().PriceCoverageMinHours
+	if belowThreshold && !health.CoverageNotified {
+		log.Printf("Grid prices for vehicle %s only cover the next %d hours\n", vehicle.VIN, health.CoverageHours)
+		msg := fmt.Sprintf("Grid prices for %s only cover the next %d hours.", vehicle.DisplayName, health.CoverageHours)
+		if health.LastError != "" && health.FailCount > 0 {
+			msg += fmt.Sprintf(" Last error: %s", health.LastError)
+		}
+		SendPushNotification(NotificationCategoryError, msg)
+		SendWebhookEvent(WebhookEventPriceCoverage, vehicle, msg, map[string]any{"coverage_hours": health.CoverageHours, "sufficient": false})
+		GetDB().SetVehicleStatePriceCoverageNotified(vehicle.VIN, true)
+	} else if !belowThreshold && health.CoverageNotified {
+		msg := fmt.Sprintf("Grid prices for %s are available again for the next %d hours.", vehicle.DisplayName, health.CoverageHours)
+		SendPushNotification(NotificationCategoryInfo, msg)
+		SendWebhookEvent(WebhookEventPriceCoverage, vehicle, msg, map[string]any{"coverage_hours": health.CoverageHours, "sufficient": true})
+		GetDB().SetVehicleStatePriceCoverageNotified(vehicle.VIN, false)
+	}
+}
@@ -3,41 +3,220 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 )
 
-type TelegramMessage struct {
-	ChatID string `json:"chat_id"`
-	Text   string `json:"text"`
+type NotificationCategory string
+
+const (
+	NotificationCategoryCharging NotificationCategory = "charging"
+	NotificationCategoryAmps     NotificationCategory = "amps"
+	NotificationCategoryError    NotificationCategory = "error"
+	NotificationCategoryPlug     NotificationCategory = "plug"
+	NotificationCategoryDigest   NotificationCategory = "digest"
+	NotificationCategoryInfo     NotificationCategory = "info"
+)
+
+// notificationQueueSize limits the number of notifications waiting to be sent, further ones are dropped
+const notificationQueueSize = 100
+
+type queuedNotification struct {
+	category NotificationCategory
+	msg      string
 }
 
-type TelegramResponse struct {
-	OK          bool   `json:"ok"`
-	ErrorCode   int    `json:"error_code"`
-	Description string `json:"description"`
+// notificationQueue decouples sending from the caller, i.e. the charge controller's tick.
+// If no queue has been started, notifications are sent right away.
+var notificationQueue chan *queuedNotification = nil
+
+// NotificationTitle is used by channels supporting a title or subject
+const NotificationTitle = "chargebot.io"
+
+// Notifier sends push notifications to a channel, i.e. Telegram or ntfy
+type Notifier interface {
+	Name() string
+	Send(category NotificationCategory, msg string) error
 }
 
-func SendPushNotification(msg string) error {
-	if GetConfig().TelegramToken != "" {
-		err := sendTelegramMessage(msg)
-		if err != nil {
-			log.Println("Could not send telegram push notification: " + err.Error())
+var NotifiersInstance []Notifier = nil
+
+// InitNotifiers sets up all channels which are configured
+func InitNotifiers() {
+	c := GetConfig()
+	urls := map[string]string{
+		"NTFY_URL":            c.NtfyURL,
+		"GOTIFY_URL":          c.GotifyURL,
+		"MATRIX_HOMESERVER":   c.MatrixHomeserver,
+		"DISCORD_WEBHOOK_URL": c.DiscordWebhookURL,
+		"SLACK_WEBHOOK_URL":   c.SlackWebhookURL,
+	}
+	for key, value := range urls {
+		if value == "" {
+			continue
 		}
-		return err
+		if err := validateNotifierURL(key, value); err != nil {
+			log.Panicln(err)
+		}
+	}
+	NotifiersInstance = []Notifier{}
+	if c.TelegramToken != "" {
+		NotifiersInstance = append(NotifiersInstance, &TelegramNotifier{})
+	}
+	if c.NtfyURL != "" {
+		NotifiersInstance = append(NotifiersInstance, &NtfyNotifier{})
+	}
+	if c.GotifyURL != "" && c.GotifyToken != "" {
+		NotifiersInstance = append(NotifiersInstance, &GotifyNotifier{})
+	}
+	if c.PushoverToken != "" && c.PushoverUser != "" {
+		NotifiersInstance = append(NotifiersInstance, &PushoverNotifier{})
+	}
+	if c.SmtpHost != "" && c.SmtpTo != "" {
+		NotifiersInstance = append(NotifiersInstance, &EmailNotifier{})
+	}
+	if c.MatrixHomeserver != "" && c.MatrixToken != "" && c.MatrixRoomID != "" {
+		NotifiersInstance = append(NotifiersInstance, &MatrixNotifier{})
+	}
+	if c.DiscordWebhookURL != "" {
+		NotifiersInstance = append(NotifiersInstance, &ChatWebhookNotifier{ChannelName: "discord", URL: c.DiscordWebhookURL, TextField: "content"})
+	}
+	if c.SlackWebhookURL != "" {
+		NotifiersInstance = append(NotifiersInstance, &ChatWebhookNotifier{ChannelName: "slack", URL: c.SlackWebhookURL, TextField: "text"})
+	}
+	names := []string{}
+	for _, notifier := range NotifiersInstance {
+		names = append(names, notifier.Name())
+	}
+	for _, category := range []NotificationCategory{NotificationCategoryCharging, NotificationCategoryAmps, NotificationCategoryError, NotificationCategoryPlug, NotificationCategoryDigest, NotificationCategoryInfo} {
+		for _, name := range getNotificationRoute(category) {
+			if name != "all" && name != "none" && !slices.Contains(names, name) {
+				log.Printf("Notification channel '%s' configured for category %s is unknown or not set up\n", name, category)
+			}
+		}
+	}
+	if len(names) > 0 {
+		log.Printf("Push notifications enabled via %s\n", strings.Join(names, ", "))
+	}
+}
+
+// StartNotificationQueue sends all further notifications in the background, one after another
+func StartNotificationQueue() {
+	queue := make(chan *queuedNotification, notificationQueueSize)
+	notificationQueue = queue
+	go func() {
+		for n := range queue {
+			sendPushNotification(n.category, n.msg)
+		}
+	}()
+}
+
+// getNotificationRoute returns the channel names configured for a category via NOTIFY_<CATEGORY>
+func getNotificationRoute(category NotificationCategory) []string {
+	route := ""
+	switch category {
+	case NotificationCategoryCharging:
+		route = GetConfig().NotifyCharging
+	case NotificationCategoryAmps:
+		route = GetConfig().NotifyAmps
+	case NotificationCategoryError:
+		route = GetConfig().NotifyError
+	case NotificationCategoryPlug:
+		route = GetConfig().NotifyPlug
+	case NotificationCategoryDigest:
+		route = GetConfig().NotifyDigest
+	case NotificationCategoryInfo:
+		route = GetConfig().NotifyInfo
+	}
+	res := []string{}
+	for _, name := range strings.Split(route, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// IsNotificationRouted checks whether a category is sent to the channel; categories without a route go to all channels
+func IsNotificationRouted(category NotificationCategory, channel string) bool {
+	route := getNotificationRoute(category)
+	if len(route) == 0 || slices.Contains(route, "all") {
+		return true
+	}
+	return slices.Contains(route, channel)
+}
+
+// SendPushNotification queues the message for all channels the category is routed to.
+// Errors are only returned if the message is sent right away, as no queue has been started.
+func SendPushNotification(category NotificationCategory, msg string) error {
+	if notificationQueue == nil {
+		return sendPushNotification(category, msg)
+	}
+	select {
+	case notificationQueue <- &queuedNotification{category: category, msg: msg}:
+	default:
+		log.Printf("Notification queue is full, dropping %s notification: %s\n", category, msg)
 	}
 	return nil
 }
 
+func sendPushNotification(category NotificationCategory, msg string) error {
+	var errs []error
+	for _, notifier := range NotifiersInstance {
+		if !IsNotificationRouted(category, notifier.Name()) {
+			continue
+		}
+		if err := notifier.Send(category, msg); err != nil {
+			log.Printf("Could not send %s push notification: %s\n", notifier.Name(), err.Error())
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var TelegramAPIURL = "https://api.telegram.org"
+
+type TelegramMessage struct {
+	ChatID      string                        `json:"chat_id"`
+	Text        string                        `json:"text"`
+	ReplyMarkup *TelegramInlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+type TelegramResponse struct {
+	OK          bool            `json:"ok"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+type TelegramNotifier struct {
+}
+
+func (n *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+func (n *TelegramNotifier) Send(category NotificationCategory, msg string) error {
+	return sendTelegramMessage(msg)
+}
+
 func sendTelegramMessage(msg string) error {
 	payload := TelegramMessage{
 		ChatID: GetConfig().TelegramChatID,
 		Text:   msg,
 	}
-	json, _ := json.Marshal(payload)
-	target := "https://api.telegram.org/bot" + GetConfig().TelegramToken + "/sendMessage"
-	r, _ := http.NewRequest("POST", target, bytes.NewReader(json))
+	return callTelegramAPI("sendMessage", payload, nil)
+}
+
+// callTelegramAPI calls a Bot API method and unmarshals its result into result, if not nil
+func callTelegramAPI(method string, payload any, result any) error {
+	body, _ := json.Marshal(payload)
+	target := TelegramAPIURL + "/bot" + GetConfig().TelegramToken + "/" + method
+	r, _ := http.NewRequest("POST", target, bytes.NewReader(body))
 	resp, err := RetryHTTPJSONRequest(r, "")
 
 	if err != nil {
@@ -50,8 +229,11 @@ func sendTelegramMessage(msg string) error {
 	}
 
 	if !m.OK {
-		return fmt.Errorf("could not send message to telegram: error code %d (%s)", m.ErrorCode, m.Description)
+		return fmt.Errorf("could not call telegram method %s: error code %d (%s)", method, m.ErrorCode, m.Description)
 	}
 
+	if result != nil {
+		return json.Unmarshal(m.Result, result)
+	}
 	return nil
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SettingCryptKeyCheck holds a known value encrypted with the current key,
+// so a wrong CRYPT_KEY is detected at startup instead of when a secret is read
+const SettingCryptKeyCheck = "crypt_key_check"
+
+const cryptKeyCheckValue = "chargebot.io"
+
+// secrets written before key versioning was introduced use this prefix and key version 1
+const legacySecretPrefix = "c:"
+
+const secretPrefix = "enc:v"
+
+var ErrWrongCryptKey = errors.New("secret can't be decrypted with the configured CRYPT_KEY")
+
+// settings containing credentials, stored encrypted if CRYPT_KEY is set
+var secretSettings = []string{SettingRefreshToken}
+
+func isSecretSetting(key string) bool {
+	return slices.Contains(secretSettings, key)
+}
+
+// GetCryptKeys returns the current key and all retired keys from CRYPT_KEYS_OLD by key version
+func GetCryptKeys() map[int][]byte {
+	res := make(map[int][]byte)
+	for _, entry := range strings.Split(GetConfig().CryptKeysOld, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		tokens := strings.SplitN(entry, ":", 2)
+		version, err := strconv.Atoi(tokens[0])
+		if len(tokens) != 2 || err != nil {
+			log.Panicln("CRYPT_KEYS_OLD must be a comma separated list of version:key")
+		}
+		res[version] = []byte(tokens[1])
+	}
+	if GetConfig().CryptKey != "" {
+		res[GetConfig().CryptKeyVersion] = []byte(GetConfig().CryptKey)
+	}
+	return res
+}
+
+// IsEncryptedSecret checks whether s has been written by EncryptSecret
+func IsEncryptedSecret(s string) bool {
+	return strings.HasPrefix(s, secretPrefix) || strings.HasPrefix(s, legacySecretPrefix)
+}
+
+// parseSecret returns the key version and ciphertext of an encrypted secret
+func parseSecret(s string) (int, string, error) {
+	if strings.HasPrefix(s, legacySecretPrefix) {
+		return 1, s[len(legacySecretPrefix):], nil
+	}
+	tokens := strings.SplitN(s[len(secretPrefix):], ":", 2)
+	version, err := strconv.Atoi(tokens[0])
+	if len(tokens) != 2 || err != nil {
+		return 0, "", errors.New("malformed secret")
+	}
+	return version, tokens[1], nil
+}
+
+// EncryptSecret encrypts s with the current key, prefixed by the key version.
+// Without CRYPT_KEY, secrets are stored in plain text.
+func EncryptSecret(s string) (string, error) {
+	if GetConfig().CryptKey == "" || s == "" {
+		return s, nil
+	}
+	ciphertext, err := EncryptAESGCM([]byte(GetConfig().CryptKey), s)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d:%s", secretPrefix, GetConfig().CryptKeyVersion, ciphertext), nil
+}
+
+// DecryptSecret decrypts s with the key of the version it has been encrypted with.
+// Values not encrypted are returned as they are.
+func DecryptSecret(s string) (string, error) {
+	if !IsEncryptedSecret(s) {
+		return s, nil
+	}
+	version, ciphertext, err := parseSecret(s)
+	if err != nil {
+		return "", err
+	}
+	key, ok := GetCryptKeys()[version]
+	if !ok {
+		return "", fmt.Errorf("no CRYPT_KEY configured for key version %d", version)
+	}
+	res, err := DecryptAESGCM(key, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("%w (key version %d)", ErrWrongCryptKey, version)
+	}
+	return res, nil
+}
+
+// IsSecretCurrent checks whether s is stored the way EncryptSecret would store it now
+func IsSecretCurrent(s string) bool {
+	if s == "" {
+		return true
+	}
+	if GetConfig().CryptKey == "" {
+		return !IsEncryptedSecret(s)
+	}
+	return strings.HasPrefix(s, fmt.Sprintf("%s%d:", secretPrefix, GetConfig().CryptKeyVersion))
+}
+
+// VerifyCryptKey makes sure all keys required for decrypting the stored secrets are configured correctly
+func VerifyCryptKey() error {
+	for version, key := range GetCryptKeys() {
+		if len(key) != 32 {
+			return fmt.Errorf("CRYPT_KEY of key version %d must be 32 bytes long", version)
+		}
+	}
+	check := GetDB().getRawSetting(SettingCryptKeyCheck)
+	if check != "" {
+		value, err := DecryptSecret(check)
+		if err != nil || value != cryptKeyCheckValue {
+			return fmt.Errorf("CRYPT_KEY doesn't match the key used for encrypting the database: %v", err)
+		}
+	}
+	// secrets might have been written with a retired key or before the key check existed
+	for _, s := range GetDB().getRawSecrets() {
+		if _, err := DecryptSecret(s); err != nil {
+			return fmt.Errorf("stored secrets can't be decrypted, check CRYPT_KEY and CRYPT_KEYS_OLD: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReencryptSecrets stores all secrets encrypted with the current key version,
+// i.e. after rotating CRYPT_KEY or after setting CRYPT_KEY for the first time
+func ReencryptSecrets() (int, error) {
+	if err := VerifyCryptKey(); err != nil {
+		return 0, err
+	}
+	num := 0
+	for _, key := range secretSettings {
+		value := GetDB().getRawSetting(key)
+		if IsSecretCurrent(value) {
+			continue
+		}
+		plaintext, err := DecryptSecret(value)
+		if err != nil {
+			return num, err
+		}
+		GetDB().SetSetting(key, plaintext)
+		num++
+	}
+	for vin, token := range GetDB().getRawTibberTokens() {
+		if IsSecretCurrent(token) {
+			continue
+		}
+		plaintext, err := DecryptSecret(token)
+		if err != nil {
+			return num, err
+		}
+		GetDB().SetVehicleTibberToken(vin, plaintext)
+		num++
+	}
+	for id, secrets := range GetDB().getRawWebhookSecrets() {
+		if IsSecretCurrent(secrets[0]) && IsSecretCurrent(secrets[1]) {
+			continue
+		}
+		webhook := GetDB().GetWebhook(id)
+		for _, secret := range secrets {
+			if _, err := DecryptSecret(secret); err != nil {
+				return num, err
+			}
+		}
+		GetDB().UpdateWebhook(webhook)
+		num++
+	}
+	check, err := EncryptSecret(cryptKeyCheckValue)
+	if err != nil {
+		return num, err
+	}
+	if GetConfig().CryptKey == "" {
+		check = ""
+	}
+	GetDB().setRawSetting(SettingCryptKeyCheck, check)
+	return num, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const secretsTestKey2 = "abcdefghijklmnopqrstuvwxyz123456"
+
+func resetCryptConfig(t *testing.T) {
+	key, version, old := GetConfig().CryptKey, GetConfig().CryptKeyVersion, GetConfig().CryptKeysOld
+	t.Cleanup(func() {
+		GetConfig().CryptKey = key
+		GetConfig().CryptKeyVersion = version
+		GetConfig().CryptKeysOld = old
+	})
+}
+
+func TestSecrets_EncryptedAtRest(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "123", TibberToken: "tibber-secret"})
+	GetDB().SetSetting(SettingRefreshToken, "refresh-secret")
+
+	assert.True(t, strings.HasPrefix(GetDB().getRawTibberTokens()["123"], "enc:v1:"))
+	assert.True(t, strings.HasPrefix(GetDB().getRawSetting(SettingRefreshToken), "enc:v1:"))
+	assert.Equal(t, "tibber-secret", GetDB().GetVehicleByVIN("123").TibberToken)
+	assert.Equal(t, "tibber-secret", GetDB().GetVehicles()[0].TibberToken)
+	assert.Equal(t, "refresh-secret", GetDB().GetSetting(SettingRefreshToken))
+}
+
+func TestSecrets_Legacy(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	// refresh token encrypted before key versioning, tibber token in plain text
+	legacy, _ := EncryptAESGCM([]byte(GetConfig().CryptKey), "refresh-secret")
+	GetDB().setRawSetting(SettingRefreshToken, "c:"+legacy)
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "123"})
+	_, err := GetDB().GetConnection().Exec("update vehicles set tibber_token = 'tibber-secret' where vin = '123'")
+	assert.Nil(t, err)
+
+	assert.Nil(t, VerifyCryptKey())
+	assert.Equal(t, "refresh-secret", GetDB().GetSetting(SettingRefreshToken))
+	assert.Equal(t, "tibber-secret", GetDB().GetVehicleByVIN("123").TibberToken)
+
+	num, err := ReencryptSecrets()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, num)
+	assert.True(t, strings.HasPrefix(GetDB().getRawTibberTokens()["123"], "enc:v1:"))
+	assert.True(t, strings.HasPrefix(GetDB().getRawSetting(SettingRefreshToken), "enc:v1:"))
+	assert.Equal(t, "refresh-secret", GetDB().GetSetting(SettingRefreshToken))
+	assert.Equal(t, "tibber-secret", GetDB().GetVehicleByVIN("123").TibberToken)
+}
+
+func TestSecrets_KeyRotation(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetCryptConfig(t)
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "123", TibberToken: "tibber-secret"})
+	GetDB().SetSetting(SettingRefreshToken, "refresh-secret")
+	_, err := ReencryptSecrets()
+	assert.Nil(t, err)
+
+	// rotate to a new key, keeping the old one for decrypting
+	GetConfig().CryptKeysOld = "1:" + GetConfig().CryptKey
+	GetConfig().CryptKey = secretsTestKey2
+	GetConfig().CryptKeyVersion = 2
+	num, err := ReencryptSecrets()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, num)
+	assert.True(t, strings.HasPrefix(GetDB().getRawTibberTokens()["123"], "enc:v2:"))
+	assert.True(t, strings.HasPrefix(GetDB().getRawSetting(SettingRefreshToken), "enc:v2:"))
+
+	// the old key isn't required anymore
+	GetConfig().CryptKeysOld = ""
+	assert.Nil(t, VerifyCryptKey())
+	assert.Equal(t, "refresh-secret", GetDB().GetSetting(SettingRefreshToken))
+	assert.Equal(t, "tibber-secret", GetDB().GetVehicleByVIN("123").TibberToken)
+}
+
+func TestSecrets_WrongKey(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetCryptConfig(t)
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "123", TibberToken: "tibber-secret"})
+	GetDB().SetSetting(SettingRefreshToken, "refresh-secret")
+	_, err := ReencryptSecrets()
+	assert.Nil(t, err)
+
+	GetConfig().CryptKey = secretsTestKey2
+	err = VerifyCryptKey()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "CRYPT_KEY doesn't match")
+	_, err = ReencryptSecrets()
+	assert.NotNil(t, err)
+
+	// reading secrets doesn't panic
+	assert.Equal(t, "", GetDB().GetSetting(SettingRefreshToken))
+	assert.Equal(t, "", GetDB().GetVehicleByVIN("123").TibberToken)
+
+	GetConfig().CryptKey = "too short"
+	assert.NotNil(t, VerifyCryptKey())
+}
+
+func TestSecrets_EnableEncryption(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetCryptConfig(t)
+	key := GetConfig().CryptKey
+	GetConfig().CryptKey = ""
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "123", TibberToken: "tibber-secret"})
+	assert.Equal(t, "tibber-secret", GetDB().getRawTibberTokens()["123"])
+
+	GetConfig().CryptKey = key
+	num, err := ReencryptSecrets()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, num)
+	assert.True(t, strings.HasPrefix(GetDB().getRawTibberTokens()["123"], "enc:v1:"))
+	assert.Equal(t, "tibber-secret", GetDB().GetVehicleByVIN("123").TibberToken)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SessionExportFormat string
+
+const (
+	SessionExportCSV  SessionExportFormat = "csv"
+	SessionExportXLSX SessionExportFormat = "xlsx"
+)
+
+const SessionExportDateLayout = "2006-01-02"
+
+const sessionExportTimeLayout = "2006-01-02 15:04"
+
+var SessionExportHeader = []string{
+	"VIN",
+	"Vehicle",
+	"Plugged in",
+	"Unplugged",
+	"Start SoC (%)",
+	"End SoC (%)",
+	"Energy (kWh)",
+	"Solar (kWh)",
+	"Grid (kWh)",
+	"Source",
+	"Grid price per kWh",
+	"Cost",
+	"Measured",
+}
+
+// ParseSessionExportRange parses the local dates of the first and the last day to export
+func ParseSessionExportRange(from string, to string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation(SessionExportDateLayout, from, time.Local)
+	if err != nil {
+		return start, start, fmt.Errorf("from must be a date formatted as %s", SessionExportDateLayout)
+	}
+	end, err := time.ParseInLocation(SessionExportDateLayout, to, time.Local)
+	if err != nil {
+		return start, end, fmt.Errorf("to must be a date formatted as %s", SessionExportDateLayout)
+	}
+	if end.Before(start) {
+		return start, end, errors.New("to must not be before from")
+	}
+	return start.UTC(), end.AddDate(0, 0, 1).UTC(), nil
+}
+
+func roundTo(f float64, decimals int) float64 {
+	factor := math.Pow(10, float64(decimals))
+	return math.Round(f*factor) / factor
+}
+
+func getSessionSource(e *ChargingSession) string {
+	switch {
+	case e.EnergySolar > 0 && e.EnergyGrid > 0:
+		return "mixed"
+	case e.EnergySolar > 0:
+		return "solar"
+	case e.EnergyGrid > 0:
+		return "grid"
+	}
+	return ""
+}
+
+// GetSessionExportRows returns one row per session plugged in during the period, in the order of SessionExportHeader.
+// Unknown values are nil.
+func GetSessionExportRows(vehicle *Vehicle, from time.Time, to time.Time) [][]any {
+	rows := [][]any{}
+	for _, e := range GetDB().GetChargingSessionsBetween(vehicle.VIN, from, to) {
+		row := []any{
+			vehicle.VIN,
+			vehicle.DisplayName,
+			e.StartedAt.In(time.Local).Format(sessionExportTimeLayout),
+			nil,
+			nil,
+			nil,
+			roundTo(e.EnergySolar+e.EnergyGrid, 3),
+			roundTo(e.EnergySolar, 3),
+			roundTo(e.EnergyGrid, 3),
+			getSessionSource(e),
+			nil,
+			nil,
+			"no",
+		}
+		if e.EndedAt != nil {
+			row[3] = e.EndedAt.In(time.Local).Format(sessionExportTimeLayout)
+		}
+		if e.StartSoC >= 0 {
+			row[4] = e.StartSoC
+		}
+		if e.EndSoC >= 0 {
+			row[5] = e.EndSoC
+		}
+		if e.GridPrice != nil {
+			row[10] = roundTo(*e.GridPrice, 4)
+		}
+		if e.Cost != nil {
+			row[11] = roundTo(*e.Cost, 2)
+		}
+		if e.Measured {
+			row[12] = "yes"
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func SessionExportFileName(vehicle *Vehicle, from time.Time, to time.Time, format SessionExportFormat) string {
+	return fmt.Sprintf("chargebot-sessions-%s-%s-%s.%s", vehicle.VIN,
+		from.In(time.Local).Format("20060102"), to.Add(-time.Second).In(time.Local).Format("20060102"), format)
+}
+
+// csvEscapeFormula prefixes text starting like a formula with a quote, so spreadsheet applications don't evaluate it,
+// i.e. a vehicle named "=HYPERLINK(...)"
+func csvEscapeFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func WriteSessionExport(w io.Writer, format SessionExportFormat, rows [][]any) error {
+	if format == SessionExportXLSX {
+		return WriteXLSX(w, "Charging sessions", SessionExportHeader, rows)
+	}
+	c := csv.NewWriter(w)
+	c.Write(SessionExportHeader)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			switch v := value.(type) {
+			case nil:
+				record[i] = ""
+			case float64:
+				record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			case string:
+				record[i] = csvEscapeFormula(v)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		c.Write(record)
+	}
+	c.Flush()
+	return c.Error()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createSessionExportTestData(t *testing.T) *Vehicle {
+	setDigestReferencePrice(t, 0)
+	start := time.Date(2024, 5, 31, 22, 0, 0, 0, time.Local)
+	GlobalMockTime.CurTime = start.UTC()
+	v := createDigestTestVehicle()
+	cc := newChargingSessionTestController()
+
+	// before the period
+	StartChargingSession(v, 20)
+	GlobalMockTime.CurTime = start.Add(time.Hour).UTC()
+	EndChargingSession(v, 30)
+
+	// one hour on grid at 0.25 and one hour on solar
+	start = time.Date(2024, 6, 10, 18, 0, 0, 0, time.Local)
+	GlobalMockTime.CurTime = start.UTC()
+	StartChargingSession(v, 40)
+	SetTibberTestPrice(v.VIN, start.UTC(), 0.25)
+	startTestCharging(cc, v, ChargeStateChargingOnGrid, 16, start.UTC())
+	stopTestCharging(cc, v, start.Add(time.Hour).UTC())
+	startTestCharging(cc, v, ChargeStateChargingOnSolar, 8, start.Add(time.Hour).UTC())
+	stopTestCharging(cc, v, start.Add(2*time.Hour).UTC())
+	GlobalMockTime.CurTime = start.Add(3 * time.Hour).UTC()
+	EndChargingSession(v, 70)
+
+	// still plugged in
+	GlobalMockTime.CurTime = time.Date(2024, 6, 30, 23, 0, 0, 0, time.Local).UTC()
+	StartChargingSession(v, 60)
+	// updated by the charge controller's tick
+	RefreshChargingSession(v)
+	return v
+}
+
+func TestSessionExport_ParseRange(t *testing.T) {
+	from, to, err := ParseSessionExportRange("2024-06-01", "2024-06-30")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local).UTC(), from)
+	assert.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.Local).UTC(), to)
+
+	_, _, err = ParseSessionExportRange("2024-06-30", "2024-06-01")
+	assert.NotNil(t, err)
+	_, _, err = ParseSessionExportRange("", "2024-06-01")
+	assert.NotNil(t, err)
+	_, _, err = ParseSessionExportRange("2024-06-01", "30.06.2024")
+	assert.NotNil(t, err)
+}
+
+func TestSessionExport_CSV(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	v := createSessionExportTestData(t)
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions_export/"+v.VIN+"?from=2024-06-01&to=2024-06-30", readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment; filename=\"chargebot-sessions-123-20240601-20240630.csv\"", res.Header().Get("Content-Disposition"))
+
+	records, err := csv.NewReader(res.Body).ReadAll()
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, SessionExportHeader, records[0])
+	assert.Equal(t, []string{"123", "Model 3", "2024-06-10 18:00", "2024-06-10 21:00", "40", "70", "16.56", "5.52", "11.04", "mixed", "0.25", "2.76", "no"}, records[1])
+	assert.Equal(t, []string{"123", "Model 3", "2024-06-30 23:00", "", "60", "", "0", "0", "0", "", "", "0", "no"}, records[2])
+}
+
+func TestSessionExport_XLSX(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	v := createSessionExportTestData(t)
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions_export/"+v.VIN+"?from=2024-06-10&to=2024-06-10&format=xlsx", readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", res.Header().Get("Content-Type"))
+
+	body := res.Body.Bytes()
+	z, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.Nil(t, err)
+	files := map[string]string{}
+	for _, f := range z.File {
+		r, _ := f.Open()
+		content, _ := io.ReadAll(r)
+		files[f.Name] = string(content)
+	}
+	assert.Contains(t, files, "[Content_Types].xml")
+	assert.Contains(t, files, "xl/workbook.xml")
+	assert.Contains(t, files["xl/workbook.xml"], `<sheet name="Charging sessions"`)
+	sheet := files["xl/worksheets/sheet1.xml"]
+	assert.Contains(t, sheet, `<c r="A1" s="1" t="inlineStr"><is><t>VIN</t></is></c>`)
+	assert.Contains(t, sheet, `<c r="C2" s="0" t="inlineStr"><is><t>2024-06-10 18:00</t></is></c>`)
+	assert.Contains(t, sheet, `<c r="E2" s="0"><v>40</v></c>`)
+	assert.Contains(t, sheet, `<c r="G2" s="0"><v>16.56</v></c>`)
+	assert.Contains(t, sheet, `<c r="L2" s="0"><v>2.76</v></c>`)
+	assert.Equal(t, 2, strings.Count(sheet, "<row "))
+}
+
+func TestSessionExport_CSVFormula(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteSessionExport(&b, SessionExportCSV, [][]any{{"=HYPERLINK(\"x\")", "+1", "-1", "@SUM(A1)", "Model 3", "", -1.5, 40}})
+	assert.Nil(t, err)
+	r := csv.NewReader(&b)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"'=HYPERLINK(\"x\")", "'+1", "'-1", "'@SUM(A1)", "Model 3", "", "-1.5", "40"}, records[1])
+}
+
+func TestSessionExport_BadRequest(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	v := createDigestTestVehicle()
+
+	res := executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions_export/"+v.VIN+"?from=2024-06-01&to=2024-06-30&format=pdf", readKey, nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions_export/"+v.VIN+"?from=2024-06-01", readKey, nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/tesla/sessions_export/unknown?from=2024-06-01&to=2024-06-30", readKey, nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestXLSX_ColumnName(t *testing.T) {
+	assert.Equal(t, "A", xlsxColumnName(0))
+	assert.Equal(t, "Z", xlsxColumnName(25))
+	assert.Equal(t, "AA", xlsxColumnName(26))
+	assert.Equal(t, "AZ", xlsxColumnName(51))
+	assert.Equal(t, "BA", xlsxColumnName(52))
+}
+
+func TestXLSX_Escape(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteXLSX(&b, "A & B", []string{"<name>"}, [][]any{{"x & y"}, {nil}, {1.5}})
+	assert.Nil(t, err)
+	z, _ := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	for _, f := range z.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			r, _ := f.Open()
+			content, _ := io.ReadAll(r)
+			assert.Contains(t, string(content), "&lt;name&gt;")
+			assert.Contains(t, string(content), "x &amp; y")
+			assert.Contains(t, string(content), `<row r="3"></row>`)
+			assert.Contains(t, string(content), `<c r="A4" s="0"><v>1.5</v></c>`)
+		}
+	}
+}
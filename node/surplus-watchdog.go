@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	SurplusStaleActionStop    = "stop"
+	SurplusStaleActionHold    = "hold"
+	SurplusStaleActionMinimum = "min"
+)
+
+// getSurplusAge returns the age of the latest surplus record, or nil if no surplus has been recorded yet
+func (c *ChargeController) getSurplusAge() *time.Duration {
+	surpluses := GetDB().GetLatestSurplusRecords(1)
+	if len(surpluses) == 0 {
+		return nil
+	}
+	age := c.Time.UTCNow().Sub(surpluses[0].Timestamp)
+	return &age
+}
+
+// isSurplusOutdated checks whether the latest surplus record is too old to be used for charging decisions
+func (c *ChargeController) isSurplusOutdated() bool {
+	age := c.getSurplusAge()
+	return age == nil || *age >= time.Minute*time.Duration(MaxSurplusSampleAgeMinutes)
+}
+
+// isSurplusStale checks whether the surplus source has been silent for longer than the watchdog allows
+func (c *ChargeController) isSurplusStale() bool {
+	if GetConfig().SurplusStaleMinutes <= 0 {
+		return false
+	}
+	age := c.getSurplusAge()
+	return age == nil || *age >= time.Minute*time.Duration(GetConfig().SurplusStaleMinutes)
+}
+
+// checkStaleSurplus holds a solar charging session while surplus data is missing,
+// and puts it into the configured safe state once the watchdog considers the data stale
+func (c *ChargeController) checkStaleSurplus(vehicle *Vehicle, state *VehicleState) {
+	if !c.isChargingRequired(state.SoC, vehicle.TargetSoC) {
+		c.stopChargingTargetReached(vehicle, state)
+		return
+	}
+	if !c.isSurplusStale() {
+		LogDebug(fmt.Sprintf("checkStaleSurplus() - no recent surplus data, holding charging process of vehicle %s", vehicle.VIN))
+		return
+	}
+
+	action := GetConfig().SurplusStaleAction
+	if !state.SurplusStale {
+		GetDB().SetVehicleStateSurplusStale(vehicle.VIN, true)
+		LogChargingEvent(vehicle.VIN, LogEventSurplusStale, fmt.Sprintf("no surplus data for %d minutes, action: %s", GetConfig().SurplusStaleMinutes, action))
+		msg := fmt.Sprintf("No surplus data received for %d minutes while %s is charging on solar power. Check your surplus source.", GetConfig().SurplusStaleMinutes, vehicle.DisplayName)
+		SendPushNotification(NotificationCategoryError, msg)
+		SendWebhookEvent(WebhookEventSurplusStale, vehicle, msg, map[string]any{"action": action})
+	}
+
+	switch action {
+	case SurplusStaleActionStop:
+		c.stopCharging(vehicle, state)
+	case SurplusStaleActionMinimum:
+		amps := min(GetConfig().SurplusStaleMinAmps, vehicle.MaxAmps)
+		if amps > 0 && state.Amps != amps {
+			if err := GetTeslaAPI().Wakeup(vehicle.VIN); err != nil {
+				LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("could not init session with car: %s", err.Error()))
+				return
+			}
+			if err := GetTeslaAPI().SetChargeAmps(vehicle.VIN, amps); err != nil {
+				LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, "could not set charge amps: "+err.Error())
+				return
+			}
+			GetDB().SetVehicleStateAmps(vehicle.VIN, amps)
+			StartChargingInterval(vehicle, state.Charging, amps)
+			LogChargingEvent(vehicle.VIN, LogEventSetChargingAmps, fmt.Sprintf("charge amps set to %d", amps))
+		}
+	}
+}
+
+// onSurplusRecovered resumes regular surplus charging after the surplus source has recovered
+func (c *ChargeController) onSurplusRecovered(vehicle *Vehicle, state *VehicleState) {
+	GetDB().SetVehicleStateSurplusStale(vehicle.VIN, false)
+	state.SurplusStale = false
+	LogChargingEvent(vehicle.VIN, LogEventSurplusRecovered, "")
+	msg := fmt.Sprintf("Surplus data is available again, resuming surplus charging for %s.", vehicle.DisplayName)
+	SendPushNotification(NotificationCategoryInfo, msg)
+	SendWebhookEvent(WebhookEventSurplusRecovered, vehicle, msg, nil)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupSurplusWatchdogTest(t *testing.T) (*Vehicle, *ChargeController) {
+	v := &Vehicle{
+		VIN:             "123",
+		Enabled:         true,
+		TargetSoC:       70,
+		MaxAmps:         16,
+		NumPhases:       3,
+		SurplusCharging: true,
+		MinSurplus:      2000,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 50)
+	GetDB().SetVehicleStateChargeLimit(v.VIN, 70)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateChargingOnSolar)
+	GetDB().SetVehicleStateAmps(v.VIN, 10)
+	GetDB().LogChargingEvent(v.VIN, LogEventChargeStart, "")
+	GetDB().RecordSurplus(1000)
+	cc := NewTestChargeController()
+
+	api, _ := TeslaAPIInstance.(*TeslaAPIMock)
+	api.On("SetChargeAmps", mock.Anything, mock.Anything).Return(nil)
+	api.On("ChargeStart", mock.Anything).Return(nil)
+	api.On("ChargeStop", mock.Anything).Return(nil)
+	api.On("Wakeup", mock.Anything).Return(nil)
+	UpdateTeslaAPIMockData(api, v.VIN, 50, "Charging")
+
+	t.Cleanup(func() {
+		GetConfig().SurplusStaleMinutes = 10
+		GetConfig().SurplusStaleAction = SurplusStaleActionStop
+	})
+	return v, cc
+}
+
+func TestSurplusWatchdog_Stop(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v, cc := setupSurplusWatchdogTest(t)
+
+	// surplus data missing, but not stale yet: keep charging with current amps
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(7 * time.Minute)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnSolar, state.Charging)
+	assert.Equal(t, 10, state.Amps)
+	assert.False(t, state.SurplusStale)
+
+	// surplus data stale: stop charging
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(5 * time.Minute)
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+	assert.True(t, state.SurplusStale)
+	assert.NotNil(t, GetDB().GetLatestChargingEvent(v.VIN, LogEventSurplusStale))
+
+	// fresh surplus data: recover and resume surplus charging
+	GetDB().RecordSurplus(5000)
+	cc.OnTick()
+	state = GetDB().GetVehicleState(v.VIN)
+	assert.False(t, state.SurplusStale)
+	assert.Equal(t, ChargeStateChargingOnSolar, state.Charging)
+	assert.NotNil(t, GetDB().GetLatestChargingEvent(v.VIN, LogEventSurplusRecovered))
+}
+
+func TestSurplusWatchdog_Hold(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v, cc := setupSurplusWatchdogTest(t)
+	GetConfig().SurplusStaleAction = SurplusStaleActionHold
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(30 * time.Minute)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnSolar, state.Charging)
+	assert.Equal(t, 10, state.Amps)
+	assert.True(t, state.SurplusStale)
+}
+
+func TestSurplusWatchdog_Minimum(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v, cc := setupSurplusWatchdogTest(t)
+	GetConfig().SurplusStaleAction = SurplusStaleActionMinimum
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(30 * time.Minute)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateChargingOnSolar, state.Charging)
+	assert.Equal(t, GetConfig().SurplusStaleMinAmps, state.Amps)
+	assert.True(t, state.SurplusStale)
+}
+
+func TestSurplusWatchdog_TargetReached(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v, cc := setupSurplusWatchdogTest(t)
+	GetConfig().SurplusStaleAction = SurplusStaleActionHold
+	GetDB().SetVehicleStateSoC(v.VIN, 70)
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(7 * time.Minute)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+}
+
+func TestSurplusWatchdog_Disabled(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	v, cc := setupSurplusWatchdogTest(t)
+	GetConfig().SurplusStaleMinutes = 0
+	GetConfig().SurplusStaleAction = SurplusStaleActionHold
+
+	// without the watchdog, missing surplus data is handled by the regular charging process
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(30 * time.Minute)
+	cc.OnTick()
+	state := GetDB().GetVehicleState(v.VIN)
+	assert.Equal(t, ChargeStateNotCharging, state.Charging)
+	assert.False(t, state.SurplusStale)
+	assert.Nil(t, GetDB().GetLatestChargingEvent(v.VIN, LogEventSurplusStale))
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TelegramBotPollTimeout is the number of seconds Telegram holds a getUpdates request open
+const TelegramBotPollTimeout = 50
+
+// TelegramBotRetryDelay is the delay after a failed getUpdates request
+const TelegramBotRetryDelay time.Duration = time.Second * 10
+
+// TelegramBotMaxPauseHours limits /pause to one week
+const TelegramBotMaxPauseHours = 168
+
+// TelegramBotNumPrices is the number of upcoming hours listed by /prices
+const TelegramBotNumPrices = 24
+
+type TelegramChat struct {
+	ID int64 `json:"id"`
+}
+
+type TelegramIncomingMessage struct {
+	MessageID int64        `json:"message_id"`
+	Chat      TelegramChat `json:"chat"`
+	Text      string       `json:"text"`
+}
+
+type TelegramCallbackQuery struct {
+	ID      string                   `json:"id"`
+	Data    string                   `json:"data"`
+	Message *TelegramIncomingMessage `json:"message"`
+}
+
+type TelegramUpdate struct {
+	UpdateID      int64                    `json:"update_id"`
+	Message       *TelegramIncomingMessage `json:"message"`
+	CallbackQuery *TelegramCallbackQuery   `json:"callback_query"`
+}
+
+type TelegramInlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+type TelegramInlineKeyboardMarkup struct {
+	InlineKeyboard [][]TelegramInlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type TelegramGetUpdatesRequest struct {
+	Offset         int64    `json:"offset"`
+	Timeout        int      `json:"timeout"`
+	AllowedUpdates []string `json:"allowed_updates"`
+}
+
+type TelegramEditMessageText struct {
+	ChatID    string `json:"chat_id"`
+	MessageID int64  `json:"message_id"`
+	Text      string `json:"text"`
+}
+
+type TelegramAnswerCallbackQuery struct {
+	CallbackQueryID string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+}
+
+type TelegramBotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+type TelegramSetMyCommands struct {
+	Commands []TelegramBotCommand `json:"commands"`
+}
+
+var TelegramBotCommands = []TelegramBotCommand{
+	{"status", "SoC, charging state and next plan"},
+	{"charge", "Charge now, optionally to X %: /charge 90"},
+	{"pause", "Pause charging for N hours: /pause 3"},
+	{"resume", "Resume a paused vehicle"},
+	{"enable", "Enable charge control"},
+	{"disable", "Disable charge control"},
+	{"prices", "Upcoming grid prices"},
+	{"help", "List all commands"},
+}
+
+// TelegramBot answers commands sent by the configured TELEGRAM_CHAT_ID, using long polling
+type TelegramBot struct {
+	Offset int64
+	Time   Time
+}
+
+var TelegramBotInstance *TelegramBot = nil
+
+func InitTelegramBot() {
+	c := GetConfig()
+	if !c.TelegramBot || c.TelegramToken == "" || c.TelegramChatID == "" {
+		return
+	}
+	TelegramBotInstance = &TelegramBot{
+		Time: new(RealTime),
+	}
+	if err := callTelegramAPI("setMyCommands", &TelegramSetMyCommands{Commands: TelegramBotCommands}, nil); err != nil {
+		log.Println("Could not set Telegram bot commands:", err)
+	}
+	go TelegramBotInstance.Poll()
+}
+
+func (b *TelegramBot) Poll() {
+	log.Println("Telegram bot listening for commands...")
+	for {
+		var updates []*TelegramUpdate
+		req := &TelegramGetUpdatesRequest{
+			Offset:         b.Offset,
+			Timeout:        TelegramBotPollTimeout,
+			AllowedUpdates: []string{"message", "callback_query"},
+		}
+		if err := callTelegramAPI("getUpdates", req, &updates); err != nil {
+			log.Println("Could not get Telegram updates:", err)
+			time.Sleep(TelegramBotRetryDelay)
+			continue
+		}
+		for _, update := range updates {
+			b.Offset = update.UpdateID + 1
+			b.HandleUpdate(update)
+		}
+	}
+}
+
+func (b *TelegramBot) HandleUpdate(update *TelegramUpdate) {
+	if update.Message != nil {
+		if !b.isAuthorized(update.Message.Chat) {
+			log.Printf("Ignoring Telegram message from unauthorized chat %d\n", update.Message.Chat.ID)
+			return
+		}
+		b.handleCommand(update.Message.Text)
+	}
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		if !b.isAuthorized(update.CallbackQuery.Message.Chat) {
+			log.Printf("Ignoring Telegram callback from unauthorized chat %d\n", update.CallbackQuery.Message.Chat.ID)
+			return
+		}
+		b.handleCallback(update.CallbackQuery)
+	}
+}
+
+func (b *TelegramBot) isAuthorized(chat TelegramChat) bool {
+	return strconv.FormatInt(chat.ID, 10) == GetConfig().TelegramChatID
+}
+
+func (b *TelegramBot) reply(text string, keyboard *TelegramInlineKeyboardMarkup) {
+	msg := &TelegramMessage{
+		ChatID:      GetConfig().TelegramChatID,
+		Text:        text,
+		ReplyMarkup: keyboard,
+	}
+	if err := callTelegramAPI("sendMessage", msg, nil); err != nil {
+		log.Println("Could not send Telegram reply:", err)
+	}
+}
+
+// confirm asks for confirmation of an action, the callback data is passed to handleCallback
+func (b *TelegramBot) confirm(text string, data string) {
+	b.reply(text, &TelegramInlineKeyboardMarkup{
+		InlineKeyboard: [][]TelegramInlineKeyboardButton{{
+			{Text: "Confirm", CallbackData: data},
+			{Text: "Cancel", CallbackData: "cancel"},
+		}},
+	})
+}
+
+func (b *TelegramBot) handleCommand(text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		b.reply("Send /help for a list of commands.", nil)
+		return
+	}
+	// in groups, commands are suffixed with the bot's name, i.e. /status@chargebot
+	command := strings.ToLower(strings.SplitN(fields[0], "@", 2)[0])
+	args := fields[1:]
+	switch command {
+	case "/start", "/help":
+		b.commandHelp()
+	case "/status":
+		b.commandStatus()
+	case "/charge":
+		b.commandCharge(args)
+	case "/pause":
+		b.commandPause(args)
+	case "/resume":
+		b.commandVehicleAction("resume", "Resume charging of %s?", args)
+	case "/enable":
+		b.commandVehicleAction("enable", "Enable charge control for %s?", args)
+	case "/disable":
+		b.commandVehicleAction("disable", "Disable charge control for %s?", args)
+	case "/prices":
+		b.commandPrices()
+	default:
+		b.reply("Unknown command. Send /help for a list of commands.", nil)
+	}
+}
+
+func (b *TelegramBot) commandHelp() {
+	lines := []string{"Commands (add the vehicle's name if you have more than one):"}
+	for _, c := range TelegramBotCommands {
+		lines = append(lines, fmt.Sprintf("/%s - %s", c.Command, c.Description))
+	}
+	b.reply(strings.Join(lines, "\n"), nil)
+}
+
+func (b *TelegramBot) commandStatus() {
+	vehicles := GetDB().GetVehicles()
+	if len(vehicles) == 0 {
+		b.reply("No vehicles configured.", nil)
+		return
+	}
+	blocks := []string{}
+	for _, vehicle := range vehicles {
+		blocks = append(blocks, b.getVehicleStatus(vehicle))
+	}
+	b.reply(strings.Join(blocks, "\n\n"), nil)
+}
+
+func (b *TelegramBot) getVehicleStatus(vehicle *Vehicle) string {
+	lines := []string{vehicle.DisplayName}
+	state := GetDB().GetVehicleState(vehicle.VIN)
+	if state == nil {
+		return vehicle.DisplayName + "\nNo data received yet."
+	}
+	lines = append(lines, fmt.Sprintf("SoC: %d %% (target %d %%)", state.SoC, vehicle.TargetSoC))
+	switch {
+	case !state.PluggedIn:
+		lines = append(lines, "Not plugged in")
+	case state.Charging == ChargeStateChargingOnSolar:
+		lines = append(lines, fmt.Sprintf("Charging on solar power with %d amps", state.Amps))
+	case state.Charging == ChargeStateChargingOnGrid:
+		lines = append(lines, fmt.Sprintf("Charging on grid with %d amps", state.Amps))
+	default:
+		lines = append(lines, "Plugged in, not charging")
+	}
+	lines = append(lines, "Next: "+b.getNextPlan(vehicle, state))
+	return strings.Join(lines, "\n")
+}
+
+// getNextPlan describes what the charge controller is going to do next.
+// Planned grid hours are an estimate based on the currently known prices.
+func (b *TelegramBot) getNextPlan(vehicle *Vehicle, state *VehicleState) string {
+	now := b.Time.UTCNow()
+	targetSoC := vehicle.TargetSoC
+	if state.ChargeNow && state.ChargeNowSoC > 0 {
+		targetSoC = state.ChargeNowSoC
+	}
+	switch {
+	case state.ChargeNow && !isTelegramChargeTargetReached(state, targetSoC):
+		return fmt.Sprintf("charging now to %d %%", targetSoC)
+	case state.PausedUntil != nil && now.Before(*state.PausedUntil):
+		return "paused until " + b.formatTime(*state.PausedUntil)
+	case !vehicle.Enabled:
+		return "charge control disabled"
+	case state.Charging != ChargeStateNotCharging:
+		return fmt.Sprintf("charging until %d %%", targetSoC)
+	case !state.PluggedIn:
+		return "waiting to be plugged in"
+	case state.SoC >= targetSoC-1:
+		return "target SoC reached"
+	}
+	plans := []string{}
+	if vehicle.SurplusCharging {
+		plans = append(plans, fmt.Sprintf("charging on solar surplus above %d W", vehicle.MinSurplus))
+	}
+	if vehicle.LowcostCharging {
+		plans = append(plans, b.getGridPlan(vehicle, state))
+	}
+	if len(plans) == 0 {
+		return "neither solar nor grid charging enabled"
+	}
+	return strings.Join(plans, ", ")
+}
+
+func (b *TelegramBot) getGridPlan(vehicle *Vehicle, state *VehicleState) string {
+	cc := NewChargeController()
+	cc.Time = b.Time
+	prices := cc.getUpcomingGridPrices(vehicle)
+	if vehicle.GridStrategy != GridStrategyNoDeparturePriceLimit {
+		if departure, err := cc.getNextDeparture(vehicle); err == nil {
+			prices = cc.getGridPricesBefore(prices, *departure)
+		}
+	}
+	if vehicle.GridStrategy != GridStrategyDepartureNoPriceLimit {
+		prices = slices.DeleteFunc(prices, func(price *GridPrice) bool {
+			return price.Total*100 > float32(vehicle.MaxPrice)
+		})
+	}
+	required := int(math.Ceil(float64(cc.getEstimatedChargeDurationMinutes(vehicle, state)) / 60))
+	if len(prices) == 0 || required == 0 {
+		return "no suitable grid prices known yet"
+	}
+	prices = prices[:min(required, len(prices))]
+	slices.SortFunc(prices, func(a, b *GridPrice) int {
+		return a.StartsAt.Compare(b.StartsAt)
+	})
+	hours := []string{}
+	for _, price := range prices {
+		hours = append(hours, b.formatTime(price.StartsAt))
+	}
+	return "charging on grid at " + strings.Join(hours, ", ")
+}
+
+func (b *TelegramBot) commandCharge(args []string) {
+	soc := 0
+	if len(args) > 0 {
+		if value, err := strconv.Atoi(strings.TrimSuffix(args[0], "%")); err == nil {
+			if value < 1 || value > 100 {
+				b.reply("The target SoC must be between 1 and 100 %.", nil)
+				return
+			}
+			soc = value
+			args = args[1:]
+		}
+	}
+	vehicle := b.findVehicle(args, "/charge 90")
+	if vehicle == nil {
+		return
+	}
+	if soc == 0 {
+		soc = vehicle.TargetSoC
+	}
+	if state := GetDB().GetVehicleState(vehicle.VIN); isTelegramChargeTargetReached(state, soc) {
+		b.reply(fmt.Sprintf("%s is already charged to %d %%, no need to charge to %d %%.", vehicle.DisplayName, state.SoC, soc), nil)
+		return
+	}
+	b.confirm(fmt.Sprintf("Charge %s now to %d %%?", vehicle.DisplayName, soc), fmt.Sprintf("charge:%s:%d", vehicle.VIN, soc))
+}
+
+// isTelegramChargeTargetReached checks whether the vehicle's known SoC already reaches the target,
+// the same way the charge controller decides whether charging is required
+func isTelegramChargeTargetReached(state *VehicleState, targetSoC int) bool {
+	return state != nil && state.SoC >= 0 && state.SoC >= targetSoC-1
+}
+
+func (b *TelegramBot) commandPause(args []string) {
+	hours := 0
+	if len(args) > 0 {
+		hours, _ = strconv.Atoi(strings.TrimSuffix(strings.ToLower(args[0]), "h"))
+	}
+	if hours < 1 || hours > TelegramBotMaxPauseHours {
+		b.reply(fmt.Sprintf("Add the number of hours between 1 and %d, i.e. /pause 3", TelegramBotMaxPauseHours), nil)
+		return
+	}
+	vehicle := b.findVehicle(args[1:], "/pause 3")
+	if vehicle == nil {
+		return
+	}
+	b.confirm(fmt.Sprintf("Pause charging of %s for %d hours?", vehicle.DisplayName, hours), fmt.Sprintf("pause:%s:%d", vehicle.VIN, hours))
+}
+
+func (b *TelegramBot) commandVehicleAction(action string, question string, args []string) {
+	vehicle := b.findVehicle(args, "/"+action)
+	if vehicle == nil {
+		return
+	}
+	b.confirm(fmt.Sprintf(question, vehicle.DisplayName), action+":"+vehicle.VIN)
+}
+
+func (b *TelegramBot) commandPrices() {
+	blocks := []string{}
+	for _, vehicle := range GetDB().GetVehicles() {
+		if !vehicle.LowcostCharging || vehicle.GridProvider != GridProviderTibber {
+			continue
+		}
+		prices := GetDB().GetUpcomingTibberPrices(vehicle.VIN, false)
+		if len(prices) == 0 {
+			continue
+		}
+		lines := []string{"Grid prices for " + vehicle.DisplayName + ":"}
+		for _, price := range prices[:min(TelegramBotNumPrices, len(prices))] {
+			marker := ""
+			if price.Total*100 <= float32(vehicle.MaxPrice) {
+				marker = " *"
+			}
+			lines = append(lines, fmt.Sprintf("%s  %.1f ct%s", b.formatTime(price.StartsAt), price.Total*100, marker))
+		}
+		lines = append(lines, fmt.Sprintf("* at or below your maximum of %d ct", vehicle.MaxPrice))
+		blocks = append(blocks, strings.Join(lines, "\n"))
+	}
+	if len(blocks) == 0 {
+		b.reply("No upcoming grid prices known.", nil)
+		return
+	}
+	b.reply(strings.Join(blocks, "\n\n"), nil)
+}
+
+// findVehicle returns the vehicle named by args (display name or VIN).
+// Without args, the only vehicle is used. Otherwise, the user is asked to name the vehicle.
+func (b *TelegramBot) findVehicle(args []string, example string) *Vehicle {
+	vehicles := GetDB().GetVehicles()
+	if len(vehicles) == 0 {
+		b.reply("No vehicles configured.", nil)
+		return nil
+	}
+	name := strings.Join(args, " ")
+	if name == "" && len(vehicles) == 1 {
+		return vehicles[0]
+	}
+	names := []string{}
+	for _, vehicle := range vehicles {
+		if name != "" && (strings.EqualFold(vehicle.DisplayName, name) || strings.EqualFold(vehicle.VIN, name)) {
+			return vehicle
+		}
+		names = append(names, vehicle.DisplayName)
+	}
+	b.reply(fmt.Sprintf("Please add one of your vehicles (%s), i.e. %s %s", strings.Join(names, ", "), example, vehicles[0].DisplayName), nil)
+	return nil
+}
+
+func (b *TelegramBot) handleCallback(query *TelegramCallbackQuery) {
+	result := b.executeAction(query.Data)
+	if err := callTelegramAPI("answerCallbackQuery", &TelegramAnswerCallbackQuery{CallbackQueryID: query.ID}, nil); err != nil {
+		log.Println("Could not answer Telegram callback:", err)
+	}
+	// replace the question, so the buttons can't be pressed again
+	edit := &TelegramEditMessageText{
+		ChatID:    GetConfig().TelegramChatID,
+		MessageID: query.Message.MessageID,
+		Text:      result,
+	}
+	if err := callTelegramAPI("editMessageText", edit, nil); err != nil {
+		log.Println("Could not edit Telegram message:", err)
+	}
+}
+
+// executeAction runs a confirmed action, data is "<action>:<vin>[:<value>]"
+func (b *TelegramBot) executeAction(data string) string {
+	parts := strings.Split(data, ":")
+	if parts[0] == "cancel" {
+		return "Cancelled."
+	}
+	if len(parts) < 2 {
+		return "Unknown action."
+	}
+	vehicle := GetDB().GetVehicleByVIN(parts[1])
+	if vehicle == nil {
+		return "Vehicle not found."
+	}
+	value := 0
+	if len(parts) > 2 {
+		value, _ = strconv.Atoi(parts[2])
+	}
+	defer GetMqttPublisher().PublishVehicle(vehicle.VIN)
+	switch parts[0] {
+	case "charge":
+		if state := GetDB().GetVehicleState(vehicle.VIN); isTelegramChargeTargetReached(state, value) {
+			return fmt.Sprintf("%s is already charged to %d %%, no need to charge to %d %%.", vehicle.DisplayName, state.SoC, value)
+		}
+		GetDB().SetVehicleStateChargeNowSoC(vehicle.VIN, true, value)
+		GetDB().SetVehicleStatePausedUntil(vehicle.VIN, nil)
+		log.Printf("Charge now to %d %% for vehicle %s set via Telegram\n", value, vehicle.VIN)
+		return fmt.Sprintf("%s is going to charge now to %d %% (once plugged in).", vehicle.DisplayName, value)
+	case "pause":
+		until := b.Time.UTCNow().Add(time.Hour * time.Duration(value))
+		GetDB().SetVehicleStatePausedUntil(vehicle.VIN, &until)
+		GetDB().SetVehicleStateChargeNow(vehicle.VIN, false)
+		log.Printf("Charging of vehicle %s paused for %d hours via Telegram\n", vehicle.VIN, value)
+		return fmt.Sprintf("Charging of %s paused until %s.", vehicle.DisplayName, b.formatTime(until))
+	case "resume":
+		GetDB().SetVehicleStatePausedUntil(vehicle.VIN, nil)
+		log.Printf("Charging of vehicle %s resumed via Telegram\n", vehicle.VIN)
+		return fmt.Sprintf("Charging of %s resumed.", vehicle.DisplayName)
+	case "enable", "disable":
+		vehicle.Enabled = (parts[0] == "enable")
+		GetDB().CreateUpdateVehicle(vehicle)
+		log.Printf("Updated enabled of vehicle %s to %t via Telegram\n", vehicle.VIN, vehicle.Enabled)
+		return fmt.Sprintf("Charge control for %s %sd.", vehicle.DisplayName, parts[0])
+	}
+	return "Unknown action."
+}
+
+func (b *TelegramBot) formatTime(t time.Time) string {
+	return t.In(time.Local).Format("Mon 15:04")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type telegramTestCall struct {
+	method  string
+	payload map[string]any
+}
+
+func newTelegramTestBot(t *testing.T) (*TelegramBot, *[]telegramTestCall) {
+	calls := &[]telegramTestCall{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		call := telegramTestCall{method: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]}
+		json.Unmarshal(body, &call.payload)
+		*calls = append(*calls, call)
+		w.Write([]byte(`{"ok": true, "result": true}`))
+	}))
+	t.Cleanup(server.Close)
+	apiURL, token, chatID := TelegramAPIURL, GetConfig().TelegramToken, GetConfig().TelegramChatID
+	t.Cleanup(func() {
+		TelegramAPIURL = apiURL
+		GetConfig().TelegramToken = token
+		GetConfig().TelegramChatID = chatID
+	})
+	TelegramAPIURL = server.URL
+	GetConfig().TelegramToken = "test-token"
+	GetConfig().TelegramChatID = "42"
+	return &TelegramBot{Time: GlobalMockTime}, calls
+}
+
+func newTelegramTestMessage(chatID int64, text string) *TelegramUpdate {
+	return &TelegramUpdate{
+		Message: &TelegramIncomingMessage{MessageID: 1, Chat: TelegramChat{ID: chatID}, Text: text},
+	}
+}
+
+func newTelegramTestCallback(chatID int64, data string) *TelegramUpdate {
+	return &TelegramUpdate{
+		CallbackQuery: &TelegramCallbackQuery{
+			ID:      "cb",
+			Data:    data,
+			Message: &TelegramIncomingMessage{MessageID: 2, Chat: TelegramChat{ID: chatID}},
+		},
+	}
+}
+
+func createTelegramTestVehicle() *Vehicle {
+	v := &Vehicle{
+		VIN:             "123",
+		DisplayName:     "Model Y",
+		Enabled:         true,
+		TargetSoC:       70,
+		MaxAmps:         16,
+		NumPhases:       3,
+		SurplusCharging: true,
+		MinSurplus:      2000,
+	}
+	GetDB().CreateUpdateVehicle(v)
+	GetDB().SetVehicleStateSoC(v.VIN, 50)
+	GetDB().SetVehicleStatePluggedIn(v.VIN, true)
+	GetDB().SetVehicleStateCharging(v.VIN, ChargeStateNotCharging)
+	return v
+}
+
+func TestTelegramBot_Unauthorized(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	createTelegramTestVehicle()
+
+	bot.HandleUpdate(newTelegramTestMessage(666, "/status"))
+	bot.HandleUpdate(newTelegramTestCallback(666, "disable:123"))
+	assert.Len(t, *calls, 0)
+	assert.True(t, GetDB().GetVehicleByVIN("123").Enabled)
+}
+
+func TestTelegramBot_Status(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	createTelegramTestVehicle()
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/status@chargebot"))
+	assert.Len(t, *calls, 1)
+	assert.Equal(t, "sendMessage", (*calls)[0].method)
+	assert.Equal(t, "42", (*calls)[0].payload["chat_id"])
+	text := (*calls)[0].payload["text"].(string)
+	assert.Contains(t, text, "Model Y")
+	assert.Contains(t, text, "SoC: 50 % (target 70 %)")
+	assert.Contains(t, text, "Plugged in, not charging")
+	assert.Contains(t, text, "Next: charging on solar surplus above 2000 W")
+}
+
+func TestTelegramBot_ChargeConfirmed(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	createTelegramTestVehicle()
+	until := GlobalMockTime.CurTime.Add(time.Hour)
+	GetDB().SetVehicleStatePausedUntil("123", &until)
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/charge 90%"))
+	assert.Len(t, *calls, 1)
+	assert.Equal(t, "Charge Model Y now to 90 %?", (*calls)[0].payload["text"])
+	keyboard := (*calls)[0].payload["reply_markup"].(map[string]any)["inline_keyboard"].([]any)[0].([]any)
+	assert.Equal(t, "charge:123:90", keyboard[0].(map[string]any)["callback_data"])
+	assert.Equal(t, "cancel", keyboard[1].(map[string]any)["callback_data"])
+	assert.False(t, GetDB().GetVehicleState("123").ChargeNow)
+
+	bot.HandleUpdate(newTelegramTestCallback(42, "charge:123:90"))
+	state := GetDB().GetVehicleState("123")
+	assert.True(t, state.ChargeNow)
+	assert.Equal(t, 90, state.ChargeNowSoC)
+	assert.Nil(t, state.PausedUntil)
+	assert.Equal(t, "answerCallbackQuery", (*calls)[1].method)
+	assert.Equal(t, "editMessageText", (*calls)[2].method)
+	assert.Equal(t, float64(2), (*calls)[2].payload["message_id"])
+	assert.Contains(t, (*calls)[2].payload["text"], "charge now to 90 %")
+}
+
+func TestTelegramBot_ChargeTargetReached(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	createTelegramTestVehicle()
+	GetDB().SetVehicleStateSoC("123", 70)
+
+	// the request is rejected instead of being confirmed
+	bot.HandleUpdate(newTelegramTestMessage(42, "/charge 60"))
+	assert.Len(t, *calls, 1)
+	assert.Equal(t, "Model Y is already charged to 70 %, no need to charge to 60 %.", (*calls)[0].payload["text"])
+	assert.Nil(t, (*calls)[0].payload["reply_markup"])
+
+	// a confirmation sent before the target has been reached isn't applied anymore
+	bot.HandleUpdate(newTelegramTestCallback(42, "charge:123:60"))
+	assert.False(t, GetDB().GetVehicleState("123").ChargeNow)
+	assert.Contains(t, (*calls)[2].payload["text"], "already charged to 70 %")
+
+	// a pending charge now request doesn't show as charging once its target is reached
+	GetDB().SetVehicleStateChargeNowSoC("123", true, 60)
+	bot.HandleUpdate(newTelegramTestMessage(42, "/status"))
+	text := (*calls)[3].payload["text"].(string)
+	assert.Contains(t, text, "Next: target SoC reached")
+	assert.NotContains(t, text, "charging now")
+}
+
+func TestTelegramBot_Cancel(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	createTelegramTestVehicle()
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/disable"))
+	bot.HandleUpdate(newTelegramTestCallback(42, "cancel"))
+	assert.True(t, GetDB().GetVehicleByVIN("123").Enabled)
+	assert.Equal(t, "Cancelled.", (*calls)[2].payload["text"])
+
+	bot.HandleUpdate(newTelegramTestCallback(42, "disable:123"))
+	assert.False(t, GetDB().GetVehicleByVIN("123").Enabled)
+	bot.HandleUpdate(newTelegramTestCallback(42, "enable:123"))
+	assert.True(t, GetDB().GetVehicleByVIN("123").Enabled)
+}
+
+func TestTelegramBot_PauseAndResume(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	createTelegramTestVehicle()
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/pause"))
+	assert.Contains(t, (*calls)[0].payload["text"], "Add the number of hours")
+	bot.HandleUpdate(newTelegramTestMessage(42, "/pause 3 model y"))
+	assert.Equal(t, "Pause charging of Model Y for 3 hours?", (*calls)[1].payload["text"])
+
+	bot.HandleUpdate(newTelegramTestCallback(42, "pause:123:3"))
+	state := GetDB().GetVehicleState("123")
+	assert.Equal(t, GlobalMockTime.CurTime.Add(3*time.Hour).Truncate(time.Second), state.PausedUntil.Truncate(time.Second))
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/status"))
+	assert.Contains(t, (*calls)[len(*calls)-1].payload["text"], "Next: paused until")
+
+	bot.HandleUpdate(newTelegramTestCallback(42, "resume:123"))
+	assert.Nil(t, GetDB().GetVehicleState("123").PausedUntil)
+}
+
+func TestTelegramBot_MultipleVehicles(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	createTelegramTestVehicle()
+	GetDB().CreateUpdateVehicle(&Vehicle{VIN: "456", DisplayName: "Model 3", TargetSoC: 80})
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/enable"))
+	assert.Contains(t, (*calls)[0].payload["text"], "Please add one of your vehicles (Model 3, Model Y)")
+	bot.HandleUpdate(newTelegramTestMessage(42, "/charge Model 3"))
+	assert.Equal(t, "Charge Model 3 now to 80 %?", (*calls)[1].payload["text"])
+}
+
+func TestTelegramBot_Prices(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+	v := createTelegramTestVehicle()
+	v.LowcostCharging = true
+	v.GridProvider = GridProviderTibber
+	v.MaxPrice = 20
+	GetDB().CreateUpdateVehicle(v)
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/prices"))
+	assert.Equal(t, "No upcoming grid prices known.", (*calls)[0].payload["text"])
+
+	now := GlobalMockTime.CurTime
+	SetTibberTestPrice(v.VIN, now, 0.25)
+	SetTibberTestPrice(v.VIN, now.Add(time.Hour), 0.15)
+	bot.HandleUpdate(newTelegramTestMessage(42, "/prices"))
+	text := (*calls)[1].payload["text"].(string)
+	assert.Contains(t, text, "Grid prices for Model Y:")
+	assert.Contains(t, text, "25.0 ct\n")
+	assert.Contains(t, text, "15.0 ct *")
+}
+
+func TestTelegramBot_UnknownCommand(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	bot, calls := newTelegramTestBot(t)
+
+	bot.HandleUpdate(newTelegramTestMessage(42, "/foo"))
+	assert.Contains(t, (*calls)[0].payload["text"], "Unknown command")
+	bot.HandleUpdate(newTelegramTestMessage(42, "/help"))
+	assert.Contains(t, (*calls)[1].payload["text"], "/pause - Pause charging for N hours")
+}
@@ -190,8 +190,18 @@ func (t *TelemetryPoller) processState(telemetryState *PersistedTelemetryState)
 		}
 	}
 
+	measuredAt := time.Now().UTC()
+	if telemetryState.UTC > 0 {
+		measuredAt = time.Unix(telemetryState.UTC, 0).UTC()
+	}
+	if telemetryState.Charging && telemetryState.Amps > 0 {
+		RecordChargingSessionMeasurement(vehicle, telemetryState.Amps, measuredAt)
+	}
 	if oldState.Amps != telemetryState.Amps {
-		GetDB().SetVehicleStateAmps(vehicle.VIN, telemetryState.Amps)
+		// ignore amps measured before chargebot's latest amps command, as telemetry lags behind
+		if !IsTelemetryAmpsOutdated(vehicle.VIN, measuredAt) {
+			GetDB().SetVehicleStateAmps(vehicle.VIN, telemetryState.Amps)
+		}
 	}
 	if oldState.SoC != telemetryState.SoC {
 		GetDB().SetVehicleStateSoC(vehicle.VIN, telemetryState.SoC)
@@ -205,6 +215,7 @@ func (t *TelemetryPoller) processState(telemetryState *PersistedTelemetryState)
 		now := time.Now().UTC()
 		if event.Timestamp.Before(now.Add(-5 * time.Minute)) {
 			GetDB().SetVehicleStateCharging(vehicle.VIN, ChargeStateNotCharging)
+			EndChargingInterval(vehicle)
 		}
 	}
 	if oldState.IsHome != telemetryState.IsHome {
@@ -250,7 +261,7 @@ func (t *TelemetryPoller) processState(telemetryState *PersistedTelemetryState)
 				log.Println(err)
 				return
 			}
-			GetDB().LogChargingEvent(vehicle.VIN, LogEventVehicleUpdateData, "")
+			LogChargingEvent(vehicle.VIN, LogEventVehicleUpdateData, "")
 			cableConnected := (strings.ToLower(data.ChargeState.ConnectedChargeCable) == "iec" || strings.ToLower(data.ChargeState.ConnectedChargeCable) == "sae")
 			if oldState.PluggedIn && !cableConnected {
 				OnVehicleUnplugged(vehicle, oldState)
@@ -109,7 +109,7 @@ func (a *TeslaAPIProxy) ListVehicles() ([]TeslaAPIVehicleEntity, error) {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	resp, err := a.sendRequest("list_vehicles", payload)
+	resp, err := a.sendRequest("list_vehicles", "list_vehicles", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +132,7 @@ func (a *TeslaAPIProxy) ChargeStart(vin string) error {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	_, err := a.sendRequest(vin+"/charge_start", payload)
+	_, err := a.sendRequest("charge_start", vin+"/charge_start", payload)
 	if err != nil {
 		return err
 	}
@@ -150,7 +150,7 @@ func (a *TeslaAPIProxy) ChargeStop(vin string) error {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	_, err := a.sendRequest(vin+"/charge_stop", payload)
+	_, err := a.sendRequest("charge_stop", vin+"/charge_stop", payload)
 	if err != nil {
 		return err
 	}
@@ -171,7 +171,7 @@ func (a *TeslaAPIProxy) SetChargeLimit(vin string, limitPercent int) error {
 		ChargeLimit: limitPercent,
 	}
 
-	_, err := a.sendRequest(vin+"/set_charge_limit", payload)
+	_, err := a.sendRequest("set_charge_limit", vin+"/set_charge_limit", payload)
 	if err != nil {
 		return err
 	}
@@ -192,7 +192,7 @@ func (a *TeslaAPIProxy) SetChargeAmps(vin string, amps int) error {
 		Amps: amps,
 	}
 
-	_, err := a.sendRequest(vin+"/set_charge_amps", payload)
+	_, err := a.sendRequest("set_charge_amps", vin+"/set_charge_amps", payload)
 	if err != nil {
 		return err
 	}
@@ -210,7 +210,7 @@ func (a *TeslaAPIProxy) GetVehicleData(vin string) (*TeslaAPIVehicleData, error)
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	resp, err := a.sendRequest(vin+"/vehicle_data", payload)
+	resp, err := a.sendRequest("vehicle_data", vin+"/vehicle_data", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -233,10 +233,11 @@ func (a *TeslaAPIProxy) Wakeup(vin string) error {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	_, err := a.sendRequest(vin+"/wakeup", payload)
+	_, err := a.sendRequest("wakeup", vin+"/wakeup", payload)
 	if err != nil {
 		return err
 	}
+	MetricsWakeup(vin)
 
 	// wait a few seconds to assure vehicle is online
 	time.Sleep(20 * time.Second)
@@ -254,7 +255,7 @@ func (a *TeslaAPIProxy) CreateTelemetryConfig(vin string) error {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	_, err := a.sendRequest(vin+"/create_telemetry_config", payload)
+	_, err := a.sendRequest("create_telemetry_config", vin+"/create_telemetry_config", payload)
 	if err != nil {
 		return err
 	}
@@ -272,7 +273,7 @@ func (a *TeslaAPIProxy) DeleteTelemetryConfig(vin string) error {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	_, err := a.sendRequest(vin+"/delete_telemetry_config", payload)
+	_, err := a.sendRequest("delete_telemetry_config", vin+"/delete_telemetry_config", payload)
 	if err != nil {
 		return err
 	}
@@ -290,7 +291,7 @@ func (a *TeslaAPIProxy) RegisterVehicle(vin string) error {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	_, err := a.sendRequest("vehicle_add/"+vin, payload)
+	_, err := a.sendRequest("vehicle_add", "vehicle_add/"+vin, payload)
 	if err != nil {
 		return err
 	}
@@ -308,7 +309,7 @@ func (a *TeslaAPIProxy) UnregisterVehicle(vin string) error {
 		AccessToken: a.GetOrRefreshAccessToken(),
 	}
 
-	_, err := a.sendRequest("vehicle_delete/"+vin, payload)
+	_, err := a.sendRequest("vehicle_delete", "vehicle_delete/"+vin, payload)
 	if err != nil {
 		return err
 	}
@@ -321,7 +322,7 @@ func (a *TeslaAPIProxy) GetTelemetryState(vin string) (*PersistedTelemetryState,
 		Password: GetConfig().TokenPassword,
 	}
 
-	resp, err := a.sendRequest(vin+"/state", payload)
+	resp, err := a.sendRequest("state", vin+"/state", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -334,7 +335,13 @@ func (a *TeslaAPIProxy) GetTelemetryState(vin string) (*PersistedTelemetryState,
 	return &m, nil
 }
 
-func (a *TeslaAPIProxy) sendRequest(endpoint string, payload interface{}) (*http.Response, error) {
+// sendRequest posts the payload to the command server's endpoint, the method names the request in the metrics
+func (a *TeslaAPIProxy) sendRequest(method string, endpoint string, payload interface{}) (resp *http.Response, err error) {
+	start := time.Now()
+	defer func() {
+		MetricsTeslaAPIRequest(method, start, err)
+	}()
+
 	json, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
@@ -343,7 +350,7 @@ func (a *TeslaAPIProxy) sendRequest(endpoint string, payload interface{}) (*http
 	target := GetConfig().CmdEndpoint + "/" + endpoint
 	r, _ := http.NewRequest("POST", target, bytes.NewReader(json))
 
-	resp, err := RetryHTTPJSONRequest(r, "")
+	resp, err = RetryHTTPJSONRequest(r, "")
 	if err != nil {
 		log.Println(err)
 		return nil, err
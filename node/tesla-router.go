@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	. "github.com/virtualzone/chargebot/goshared"
@@ -13,6 +14,20 @@ type VehicleWithState struct {
 	State   *VehicleState `json:"state"`
 }
 
+type NodeHealth struct {
+	Mqtt *MqttHealth `json:"mqtt"`
+}
+
+type ChargingSessionPage struct {
+	Sessions []*ChargingSession `json:"sessions"`
+	Page     int                `json:"page"`
+	PerPage  int                `json:"per_page"`
+	Total    int                `json:"total"`
+}
+
+// ChargingSessionsMaxPerPage limits the page size of /sessions
+const ChargingSessionsMaxPerPage = 100
+
 type TeslaRouter struct {
 }
 
@@ -25,7 +40,13 @@ func (router *TeslaRouter) SetupRoutes(s *mux.Router) {
 	s.HandleFunc("/vehicle_delete/{vin}", router.deleteVehicle).Methods("DELETE")
 	s.HandleFunc("/state/{vin}", router.getVehicleState).Methods("GET")
 	s.HandleFunc("/surplus", router.getLatestSurpluses).Methods("GET")
+	s.HandleFunc("/surplus_history/{resolution}", router.getSurplusHistory).Methods("GET")
 	s.HandleFunc("/events/{vin}", router.getLatestChargingEvents).Methods("GET")
+	s.HandleFunc("/price_health/{vin}", router.getPriceSourceHealth).Methods("GET")
+	s.HandleFunc("/digest/{vin}", router.getDigest).Methods("GET")
+	s.HandleFunc("/sessions/{vin}", router.getChargingSessions).Methods("GET")
+	s.HandleFunc("/sessions_export/{vin}", router.exportChargingSessions).Methods("GET")
+	s.HandleFunc("/health", router.getHealth).Methods("GET")
 	s.HandleFunc("/permanent_error", router.getPermanentError).Methods("GET")
 	s.HandleFunc("/resolve_permanent_error", router.resolvePermanentError).Methods("POST")
 }
@@ -40,10 +61,18 @@ func (router *TeslaRouter) listVehicles(w http.ResponseWriter, r *http.Request)
 	SendJSON(w, list)
 }
 
+// hideVehicleSecrets removes the Tibber token, as read-only keys can read the vehicles
+func hideVehicleSecrets(r *http.Request, v *Vehicle) {
+	if !HasFullScope(r) {
+		v.TibberToken = ""
+	}
+}
+
 func (router *TeslaRouter) myVehicles(w http.ResponseWriter, r *http.Request) {
 	res := []VehicleWithState{}
 	list := GetDB().GetVehicles()
 	for _, v := range list {
+		hideVehicleSecrets(r, v)
 		s := GetDB().GetVehicleState(v.VIN)
 		item := VehicleWithState{
 			Vehicle: v,
@@ -63,6 +92,7 @@ func (router *TeslaRouter) myVehicleByVIN(w http.ResponseWriter, r *http.Request
 		SendNotFound(w)
 		return
 	}
+	hideVehicleSecrets(r, v)
 
 	s := GetDB().GetVehicleState(v.VIN)
 	item := VehicleWithState{
@@ -101,24 +131,28 @@ func (router *TeslaRouter) addVehicle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	e := &Vehicle{
-		VIN:             vehicle.VIN,
-		DisplayName:     vehicle.DisplayName,
-		Enabled:         false,
-		TargetSoC:       70,
-		MaxAmps:         16,
-		NumPhases:       3,
-		SurplusCharging: true,
-		MinChargeTime:   15,
-		MinSurplus:      2000,
-		LowcostCharging: false,
-		MaxPrice:        20,
-		GridProvider:    "tibber",
-		GridStrategy:    1,
-		DepartDays:      "12345",
-		DepartTime:      "07:00",
-		TibberToken:     "",
+		VIN:              vehicle.VIN,
+		DisplayName:      vehicle.DisplayName,
+		Enabled:          false,
+		TargetSoC:        70,
+		MaxAmps:          16,
+		NumPhases:        3,
+		SurplusCharging:  true,
+		MinChargeTime:    15,
+		MinSurplus:       2000,
+		LowcostCharging:  false,
+		MaxPrice:         20,
+		GridProvider:     "tibber",
+		GridStrategy:     1,
+		GridOptimization: GridOptimizationCost,
+		CarbonWeight:     50,
+		DepartDays:       "12345",
+		DepartTime:       "07:00",
+		TibberToken:      "",
 	}
 	GetDB().CreateUpdateVehicle(e)
+	GetMqttPublisher().PublishDiscovery(e)
+	GetMqttPublisher().PublishVehicle(e.VIN)
 
 	if err := GetTeslaAPI().CreateTelemetryConfig(e.VIN); err != nil {
 		log.Printf("Could not enroll vehicle %s in fleet telemetry: %s\n", e.VIN, err.Error())
@@ -159,25 +193,30 @@ func (router *TeslaRouter) updateVehicle(w http.ResponseWriter, r *http.Request)
 	//eOld := GetDB().GetVehicleByVIN(vehicle.VIN)
 
 	e := &Vehicle{
-		VIN:             vehicle.VIN,
-		DisplayName:     vehicle.DisplayName,
-		Enabled:         m.Enabled,
-		TargetSoC:       m.TargetSoC,
-		MaxAmps:         m.MaxAmps,
-		NumPhases:       m.NumPhases,
-		SurplusCharging: m.SurplusCharging,
-		MinChargeTime:   m.MinChargeTime,
-		MinSurplus:      m.MinSurplus,
-		SurplusBuffer:   m.SurplusBuffer,
-		LowcostCharging: m.LowcostCharging,
-		MaxPrice:        m.MaxPrice,
-		GridProvider:    m.GridProvider,
-		GridStrategy:    m.GridStrategy,
-		DepartDays:      m.DepartDays,
-		DepartTime:      m.DepartTime,
-		TibberToken:     m.TibberToken,
+		VIN:               vehicle.VIN,
+		DisplayName:       vehicle.DisplayName,
+		Enabled:           m.Enabled,
+		TargetSoC:         m.TargetSoC,
+		MaxAmps:           m.MaxAmps,
+		NumPhases:         m.NumPhases,
+		SurplusCharging:   m.SurplusCharging,
+		MinChargeTime:     m.MinChargeTime,
+		MinSurplus:        m.MinSurplus,
+		SurplusBuffer:     m.SurplusBuffer,
+		LowcostCharging:   m.LowcostCharging,
+		MaxPrice:          m.MaxPrice,
+		GridProvider:      m.GridProvider,
+		GridStrategy:      m.GridStrategy,
+		DepartDays:        m.DepartDays,
+		DepartTime:        m.DepartTime,
+		GridFallbackHours: m.GridFallbackHours,
+		GridOptimization:  m.GridOptimization,
+		CarbonWeight:      m.CarbonWeight,
+		TibberToken:       m.TibberToken,
 	}
 	GetDB().CreateUpdateVehicle(e)
+	GetMqttPublisher().PublishDiscovery(e)
+	GetMqttPublisher().PublishVehicle(e.VIN)
 
 	// If vehicle was not enabled, but is enabled now, update current SoC
 	/*
@@ -234,6 +273,7 @@ func (router *TeslaRouter) deleteVehicle(w http.ResponseWriter, r *http.Request)
 	}
 
 	GetDB().DeleteVehicle(vehicle.VIN)
+	GetMqttPublisher().RemoveVehicle(e)
 
 	GetTeslaAPI().UnregisterVehicle(vehicle.VIN)
 
@@ -260,6 +300,27 @@ func (router *TeslaRouter) getLatestSurpluses(w http.ResponseWriter, r *http.Req
 	SendJSON(w, res)
 }
 
+func (router *TeslaRouter) getSurplusHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	resolution := vars["resolution"]
+	if resolution != SurplusResolutionMinute && resolution != SurplusResolutionHour {
+		SendBadRequest(w)
+		return
+	}
+	days := 1
+	if s := r.URL.Query().Get("days"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 {
+			SendBadRequest(w)
+			return
+		}
+		days = i
+	}
+	now := GetDB().Time.UTCNow()
+	res := GetDB().GetSurplusAggregates(resolution, now.AddDate(0, 0, days*-1), now)
+	SendJSON(w, res)
+}
+
 func (router *TeslaRouter) getLatestChargingEvents(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vin := vars["vin"]
@@ -268,6 +329,111 @@ func (router *TeslaRouter) getLatestChargingEvents(w http.ResponseWriter, r *htt
 	SendJSON(w, res)
 }
 
+func (router *TeslaRouter) getPriceSourceHealth(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vin := vars["vin"]
+
+	vehicle := GetDB().GetVehicleByVIN(vin)
+	if vehicle == nil {
+		SendNotFound(w)
+		return
+	}
+
+	SendJSON(w, GetPriceSourceHealthWithCoverage(vehicle))
+}
+
+func (router *TeslaRouter) getDigest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vin := vars["vin"]
+
+	vehicle := GetDB().GetVehicleByVIN(vin)
+	if vehicle == nil {
+		SendNotFound(w)
+		return
+	}
+	period := DigestPeriodDaily
+	if s := r.URL.Query().Get("period"); s != "" {
+		period = DigestPeriod(s)
+	}
+	if period != DigestPeriodDaily && period != DigestPeriodWeekly {
+		SendBadRequest(w)
+		return
+	}
+
+	SendJSON(w, ComputeDigest(vehicle, period, GetDB().Time.UTCNow()))
+}
+
+func (router *TeslaRouter) getChargingSessions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vin := vars["vin"]
+
+	vehicle := GetDB().GetVehicleByVIN(vin)
+	if vehicle == nil {
+		SendNotFound(w)
+		return
+	}
+	res := &ChargingSessionPage{
+		Page:    1,
+		PerPage: 20,
+	}
+	for param, target := range map[string]*int{"page": &res.Page, "per_page": &res.PerPage} {
+		if s := r.URL.Query().Get(param); s != "" {
+			i, err := strconv.Atoi(s)
+			if err != nil || i <= 0 {
+				SendBadRequest(w)
+				return
+			}
+			*target = i
+		}
+	}
+	res.PerPage = min(res.PerPage, ChargingSessionsMaxPerPage)
+
+	res.Sessions = GetDB().GetChargingSessions(vin, res.PerPage, (res.Page-1)*res.PerPage)
+	res.Total = GetDB().GetNumChargingSessions(vin)
+	SendJSON(w, res)
+}
+
+func (router *TeslaRouter) exportChargingSessions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vin := vars["vin"]
+
+	vehicle := GetDB().GetVehicleByVIN(vin)
+	if vehicle == nil {
+		SendNotFound(w)
+		return
+	}
+	format := SessionExportFormat(r.URL.Query().Get("format"))
+	if format == "" {
+		format = SessionExportCSV
+	}
+	if format != SessionExportCSV && format != SessionExportXLSX {
+		SendBadRequest(w)
+		return
+	}
+	from, to, err := ParseSessionExportRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		SendBadRequest(w)
+		return
+	}
+
+	rows := GetSessionExportRows(vehicle, from, to)
+	if format == SessionExportXLSX {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+SessionExportFileName(vehicle, from, to, format)+"\"")
+	if err := WriteSessionExport(w, format, rows); err != nil {
+		log.Println(err)
+	}
+}
+
+func (router *TeslaRouter) getHealth(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, &NodeHealth{
+		Mqtt: GetMqttSubscriber().Health(),
+	})
+}
+
 func (router *TeslaRouter) getPermanentError(w http.ResponseWriter, r *http.Request) {
 	val := GetDB().GetSetting(SettingsPermanentError)
 	SendJSON(w, val == "1")
@@ -275,5 +441,6 @@ func (router *TeslaRouter) getPermanentError(w http.ResponseWriter, r *http.Requ
 
 func (router *TeslaRouter) resolvePermanentError(w http.ResponseWriter, r *http.Request) {
 	GetDB().SetSetting(SettingsPermanentError, "")
+	GetMqttPublisher().PublishPermanentError(false)
 	SendJSON(w, true)
 }
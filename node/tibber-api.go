@@ -8,9 +8,13 @@ import (
 	"time"
 )
 
+var TibberAPIEndpoint string = "https://api.tibber.com/v1-beta/gql"
+
 type GridPrice struct {
-	Total    float32   `json:"total"`
-	StartsAt time.Time `json:"startsAt"`
+	Total           float32   `json:"total"`
+	StartsAt        time.Time `json:"startsAt"`
+	CarbonIntensity *float32  `json:"carbonIntensity,omitempty"`
+	Score           float32   `json:"-"`
 }
 
 type TibberPriceInfo struct {
@@ -23,12 +27,19 @@ type TibberSubscription struct {
 	PriceInfo TibberPriceInfo `json:"priceInfo"`
 }
 
+type TibberHomeFeatures struct {
+	RealTimeConsumptionEnabled bool `json:"realTimeConsumptionEnabled"`
+}
+
 type TibberHomes struct {
+	ID           string             `json:"id"`
+	Features     TibberHomeFeatures `json:"features"`
 	Subscription TibberSubscription `json:"currentSubscription"`
 }
 
 type TibberViewer struct {
-	Homes []TibberHomes `json:"homes"`
+	WebsocketSubscriptionURL string        `json:"websocketSubscriptionUrl"`
+	Homes                    []TibberHomes `json:"homes"`
 }
 
 type TibberData struct {
@@ -40,7 +51,7 @@ type TibberResponse struct {
 }
 
 func TibberAPIGetPrices(token string) (*TibberPriceInfo, error) {
-	target := "https://api.tibber.com/v1-beta/gql"
+	target := TibberAPIEndpoint
 	data := `{ "query": "{viewer {homes {currentSubscription {priceInfo {current {total startsAt} today {total startsAt} tomorrow {total startsAt} } }}}}" }`
 	r, _ := http.NewRequest("POST", target, strings.NewReader(data))
 
@@ -59,3 +70,32 @@ func TibberAPIGetPrices(token string) (*TibberPriceInfo, error) {
 	}
 	return &m.Data.Viewer.Homes[0].Subscription.PriceInfo, nil
 }
+
+func TibberAPIGetLiveMeasurementHome(token string, homeID string) (string, string, error) {
+	target := TibberAPIEndpoint
+	data := `{ "query": "{viewer {websocketSubscriptionUrl homes {id features {realTimeConsumptionEnabled}}}}" }`
+	r, _ := http.NewRequest("POST", target, strings.NewReader(data))
+
+	resp, err := RetryHTTPJSONRequest(r, token)
+	if err != nil {
+		return "", "", err
+	}
+
+	var m TibberResponse
+	if err := UnmarshalValidateBody(resp.Body, &m); err != nil {
+		return "", "", err
+	}
+	if m.Data.Viewer.WebsocketSubscriptionURL == "" {
+		return "", "", errors.New("no websocket subscription url found")
+	}
+	for _, home := range m.Data.Viewer.Homes {
+		if homeID != "" && home.ID != homeID {
+			continue
+		}
+		if !home.Features.RealTimeConsumptionEnabled {
+			continue
+		}
+		return home.ID, m.Data.Viewer.WebsocketSubscriptionURL, nil
+	}
+	return "", "", errors.New("no home with real time consumption enabled found")
+}
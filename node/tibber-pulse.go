@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const TibberPulseMinReconnectDelay time.Duration = time.Second * 5
+const TibberPulseMaxReconnectDelay time.Duration = time.Minute * 5
+
+type TibberLiveMeasurement struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Power           float64   `json:"power"`
+	PowerProduction float64   `json:"powerProduction"`
+}
+
+type TibberWebsocketPayload struct {
+	Data struct {
+		LiveMeasurement *TibberLiveMeasurement `json:"liveMeasurement"`
+	} `json:"data"`
+}
+
+type TibberWebsocketMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type TibberPulseSubscriber struct {
+	Interrupt    chan os.Signal
+	Time         Time
+	samples      []int
+	lastRecorded time.Time
+	mutex        sync.Mutex
+	// gorilla/websocket supports one concurrent writer only
+	writeMutex sync.Mutex
+}
+
+func NewTibberPulseSubscriber() *TibberPulseSubscriber {
+	return &TibberPulseSubscriber{
+		Interrupt: make(chan os.Signal, 1),
+		Time:      new(RealTime),
+		samples:   []int{},
+	}
+}
+
+func (t *TibberPulseSubscriber) Listen() {
+	if !GetConfig().TibberPulse {
+		return
+	}
+
+	token := t.getToken()
+	if token == "" {
+		log.Println("Tibber Pulse enabled, but no Tibber token found - set TIBBER_PULSE_TOKEN or configure a vehicle with a Tibber token")
+		return
+	}
+
+	log.Println("Initializing Tibber Pulse subscriber...")
+
+	go func() {
+		delay := TibberPulseMinReconnectDelay
+		for {
+			received, interrupted := t.connectAndListen(token)
+			if interrupted {
+				return
+			}
+			if received {
+				// the subscription delivered data before, so start over with the minimum delay
+				delay = TibberPulseMinReconnectDelay
+			}
+			log.Printf("Tibber Pulse connection lost, reconnecting in %s...\n", delay)
+			select {
+			case <-t.Interrupt:
+				return
+			case <-time.After(delay):
+			}
+			delay = delay * 2
+			if delay > TibberPulseMaxReconnectDelay {
+				delay = TibberPulseMaxReconnectDelay
+			}
+		}
+	}()
+}
+
+func (t *TibberPulseSubscriber) getToken() string {
+	if GetConfig().TibberPulseToken != "" {
+		return GetConfig().TibberPulseToken
+	}
+	for _, vehicle := range GetDB().GetVehicles() {
+		if vehicle.TibberToken != "" {
+			return vehicle.TibberToken
+		}
+	}
+	return ""
+}
+
+func (t *TibberPulseSubscriber) dial(token string) (*websocket.Conn, string, error) {
+	homeID, endpoint, err := TibberAPIGetLiveMeasurementHome(token, GetConfig().TibberPulseHomeID)
+	if err != nil {
+		return nil, "", err
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     []string{"graphql-transport-ws"},
+	}
+	header := http.Header{}
+	header.Set("User-Agent", "chargebot.io")
+	c, _, err := dialer.Dial(endpoint, header)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, homeID, nil
+}
+
+func (t *TibberPulseSubscriber) writeJSON(c *websocket.Conn, v interface{}) error {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	return c.WriteJSON(v)
+}
+
+func (t *TibberPulseSubscriber) writeClose(c *websocket.Conn) error {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	return c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func (t *TibberPulseSubscriber) subscribe(c *websocket.Conn, token string, homeID string) error {
+	initPayload, _ := json.Marshal(map[string]string{"token": token})
+	if err := t.writeJSON(c, TibberWebsocketMessage{Type: "connection_init", Payload: initPayload}); err != nil {
+		return err
+	}
+	var ack TibberWebsocketMessage
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if err := c.ReadJSON(&ack); err != nil {
+		return err
+	}
+	c.SetReadDeadline(time.Time{})
+	if ack.Type != "connection_ack" {
+		return errors.New("expected connection_ack, got " + ack.Type)
+	}
+	query := map[string]string{
+		"query": "subscription { liveMeasurement(homeId: \"" + homeID + "\") { timestamp power powerProduction } }",
+	}
+	subscribePayload, _ := json.Marshal(query)
+	return t.writeJSON(c, TibberWebsocketMessage{ID: "1", Type: "subscribe", Payload: subscribePayload})
+}
+
+// connectAndListen returns whether any live measurement was received and whether it was interrupted
+func (t *TibberPulseSubscriber) connectAndListen(token string) (bool, bool) {
+	c, homeID, err := t.dial(token)
+	if err != nil {
+		log.Println("Error connecting to Tibber Pulse:", err)
+		return false, false
+	}
+	defer c.Close()
+
+	if err := t.subscribe(c, token, homeID); err != nil {
+		log.Println("Error subscribing to Tibber Pulse:", err)
+		return false, false
+	}
+	log.Printf("Subscribed to Tibber Pulse live measurements for home %s\n", homeID)
+
+	done := make(chan struct{})
+	var received atomic.Bool
+	go func() {
+		defer close(done)
+		for {
+			var msg TibberWebsocketMessage
+			if err := c.ReadJSON(&msg); err != nil {
+				log.Println("Error reading from Tibber Pulse:", err)
+				return
+			}
+			switch msg.Type {
+			case "next":
+				var payload TibberWebsocketPayload
+				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+					log.Println("Error unmarshalling Tibber Pulse message:", err)
+					continue
+				}
+				if payload.Data.LiveMeasurement != nil {
+					received.Store(true)
+					t.processMeasurement(payload.Data.LiveMeasurement)
+				}
+			case "ping":
+				t.writeJSON(c, TibberWebsocketMessage{Type: "pong"})
+			case "error", "complete":
+				log.Printf("Tibber Pulse subscription ended (%s): %s\n", msg.Type, msg.Payload)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return received.Load(), false
+		case <-t.Interrupt:
+			if err := t.writeClose(c); err != nil {
+				log.Println("Error writing Tibber Pulse websocket close:", err)
+				return received.Load(), true
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+			return received.Load(), true
+		}
+	}
+}
+
+func (t *TibberPulseSubscriber) getSurplus(m *TibberLiveMeasurement) int {
+	// power is the current grid import, powerProduction the current grid export
+	return int(math.Round(m.PowerProduction - m.Power))
+}
+
+func (t *TibberPulseSubscriber) processMeasurement(m *TibberLiveMeasurement) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.samples = append(t.samples, t.getSurplus(m))
+
+	// Pulse sends a reading every few seconds, so record the average per interval only
+	now := t.Time.UTCNow()
+	interval := time.Second * time.Duration(GetConfig().TibberPulseInterval)
+	if now.Sub(t.lastRecorded) < interval {
+		return
+	}
+	sum := 0
+	for _, sample := range t.samples {
+		sum += sample
+	}
+	surplus := int(math.Round(float64(sum) / float64(len(t.samples))))
+	// Pulse is located at the grid connection point
+	RecordGridPower(surplus * -1)
+	t.samples = []int{}
+	t.lastRecorded = now
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTibberPulse_processMeasurement(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	GetConfig().TibberPulseInterval = 30
+
+	s := NewTibberPulseSubscriber()
+	s.Time = GlobalMockTime
+
+	// first reading is recorded immediately
+	s.processMeasurement(&TibberLiveMeasurement{Power: 0, PowerProduction: 3000})
+	records := GetDB().GetLatestSurplusRecords(10)
+	assert.Len(t, records, 1)
+	assert.Equal(t, 3000, records[0].SurplusWatts)
+
+	// readings within the interval are averaged
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(10 * time.Second)
+	s.processMeasurement(&TibberLiveMeasurement{Power: 0, PowerProduction: 2000})
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(25 * time.Second)
+	s.processMeasurement(&TibberLiveMeasurement{Power: 1000, PowerProduction: 0})
+	records = GetDB().GetLatestSurplusRecords(10)
+	assert.Len(t, records, 2)
+	assert.Equal(t, 500, records[0].SurplusWatts)
+}
+
+func TestTibberPulse_connectAndListen(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	GetConfig().TibberPulseInterval = 0
+	GetConfig().TibberPulseHomeID = ""
+
+	upgrader := websocket.Upgrader{Subprotocols: []string{"graphql-transport-ws"}}
+	sendData := true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var msg TibberWebsocketMessage
+		c.ReadJSON(&msg)
+		assert.Equal(t, "connection_init", msg.Type)
+		assert.Contains(t, string(msg.Payload), "token123")
+		c.WriteJSON(TibberWebsocketMessage{Type: "connection_ack"})
+		c.ReadJSON(&msg)
+		assert.Equal(t, "subscribe", msg.Type)
+		assert.Contains(t, string(msg.Payload), "home2")
+		c.WriteJSON(TibberWebsocketMessage{Type: "ping"})
+		c.ReadJSON(&msg)
+		assert.Equal(t, "pong", msg.Type)
+		if !sendData {
+			c.WriteJSON(TibberWebsocketMessage{ID: "1", Type: "complete"})
+			return
+		}
+		c.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","type":"next","payload":{"data":{"liveMeasurement":{"timestamp":"2024-06-01T12:00:00+02:00","power":0,"powerProduction":4200}}}}`))
+		c.WriteJSON(TibberWebsocketMessage{ID: "1", Type: "complete"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/gql", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+		w.Write([]byte(`{"data":{"viewer":{"websocketSubscriptionUrl":"` + wsURL + `","homes":[{"id":"home1","features":{"realTimeConsumptionEnabled":false}},{"id":"home2","features":{"realTimeConsumptionEnabled":true}}]}}}`))
+	})
+
+	defaultEndpoint := TibberAPIEndpoint
+	TibberAPIEndpoint = server.URL + "/gql"
+	defer func() { TibberAPIEndpoint = defaultEndpoint }()
+
+	s := NewTibberPulseSubscriber()
+	received, interrupted := s.connectAndListen("token123")
+	assert.True(t, received)
+	assert.False(t, interrupted)
+
+	records := GetDB().GetLatestSurplusRecords(10)
+	assert.Len(t, records, 1)
+	assert.Equal(t, 4200, records[0].SurplusWatts)
+
+	// a subscription ending before any data arrived doesn't reset the reconnect delay
+	sendData = false
+	received, interrupted = s.connectAndListen("token123")
+	assert.False(t, received)
+	assert.False(t, interrupted)
+}
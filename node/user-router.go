@@ -9,9 +9,10 @@ import (
 type UserRouter struct{}
 
 type SurplusRecordingRequest struct {
-	SurplusWatts        int `json:"surplus_watts"`
-	InverterActivePower int `json:"inverter_active_power_watts"`
-	Consumption         int `json:"consumption_watts"`
+	SurplusWatts        int  `json:"surplus_watts"`
+	InverterActivePower int  `json:"inverter_active_power_watts"`
+	Consumption         int  `json:"consumption_watts"`
+	GridPower           *int `json:"grid_power_watts"`
 }
 
 type SurplusRecordingResponse struct {
@@ -36,15 +37,23 @@ func (router *UserRouter) recordSurplus(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if m.GridPower != nil {
+		RecordGridPower(*m.GridPower)
+	} else {
+		GetDB().RecordSurplus(m.GetSurplus())
+	}
+	SendJSON(w, true)
+}
+
+// GetSurplus returns SurplusWatts if set, otherwise the inverter's active power minus consumption
+func (m *SurplusRecordingRequest) GetSurplus() int {
 	surplus := m.SurplusWatts
 	if surplus == 0 {
 		if m.InverterActivePower != 0 || m.Consumption != 0 {
 			surplus = m.InverterActivePower - m.Consumption
 		}
 	}
-
-	GetDB().RecordSurplus(surplus)
-	SendJSON(w, true)
+	return surplus
 }
 
 func (router *UserRouter) updateVehiclePlugState(w http.ResponseWriter, r *http.Request, pluggedIn bool) {
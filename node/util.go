@@ -26,15 +26,22 @@ func IsCurrentHourUTC(now *time.Time, ts *time.Time) bool {
 	return false
 }
 
+// LogChargingEvent stores the event and emits it via MQTT and metrics
+func LogChargingEvent(vin string, eventType int, text string) {
+	GetDB().LogChargingEvent(vin, eventType, text)
+	GetMqttPublisher().PublishChargingEvent(vin, eventType, text)
+	MetricsChargingEvent(vin, eventType)
+}
+
 func UpdateVehicleDataSaveSoC(vehicle *Vehicle) (int, *TeslaAPIVehicleData) {
 	data, err := GetTeslaAPI().GetVehicleData(vehicle.VIN)
 	if err != nil {
 		log.Println(err)
-		GetDB().LogChargingEvent(vehicle.VIN, LogEventVehicleUpdateData, err.Error())
+		LogChargingEvent(vehicle.VIN, LogEventVehicleUpdateData, err.Error())
 		return 0, nil
 	} else {
 		GetDB().SetVehicleStateSoC(vehicle.VIN, data.ChargeState.BatteryLevel)
-		GetDB().LogChargingEvent(vehicle.VIN, LogEventVehicleUpdateData, fmt.Sprintf("vehicle SoC updated: %d", data.ChargeState.BatteryLevel))
+		LogChargingEvent(vehicle.VIN, LogEventVehicleUpdateData, fmt.Sprintf("vehicle SoC updated: %d", data.ChargeState.BatteryLevel))
 		return data.ChargeState.BatteryLevel, data
 	}
 }
@@ -78,6 +85,11 @@ func RetryHTTPJSONRequest(req *http.Request, authToken string) (*http.Response,
 	return RetryHTTPRequest(req)
 }
 
+// DelayBetweenHTTPRetries is the delay before retrying a failed request
+var DelayBetweenHTTPRetries time.Duration = time.Second * 2
+
+// RetryHTTPRequest sends the request up to three times. Each attempt is sent as a new request
+// with a fresh copy of the body, as the previous attempt has consumed it.
 func RetryHTTPRequest(req *http.Request) (*http.Response, error) {
 	isRetryCode := func(code int) bool {
 		retryCodes := []int{405, 408, 412}
@@ -87,16 +99,25 @@ func RetryHTTPRequest(req *http.Request) (*http.Response, error) {
 	client := &http.Client{
 		Timeout: time.Second * 60,
 	}
-	retryCounter := 1
 	var resp *http.Response
 	var err error
-	for retryCounter <= 3 {
-		resp, err = client.Do(req)
-		if err != nil || (resp != nil && isRetryCode(resp.StatusCode)) {
-			time.Sleep(2 * time.Second)
-			retryCounter++
-		} else {
-			retryCounter = 999
+	for attempt := 1; attempt <= 3; attempt++ {
+		r := req
+		if attempt > 1 {
+			time.Sleep(DelayBetweenHTTPRetries)
+			r = req.Clone(req.Context())
+			if req.GetBody != nil {
+				if r.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		resp, err = client.Do(r)
+		if err == nil && !isRetryCode(resp.StatusCode) {
+			break
+		}
+		if err == nil && attempt < 3 {
+			resp.Body.Close()
 		}
 	}
 	return resp, err
@@ -126,12 +147,22 @@ func LogDebug(s string) {
 func OnVehicleUnplugged(vehicle *Vehicle, oldState *VehicleState) {
 	// vehicle got plugged out
 	GetDB().SetVehicleStatePluggedIn(vehicle.VIN, false)
-	GetDB().LogChargingEvent(vehicle.VIN, LogEventVehicleUnplug, "")
+	LogChargingEvent(vehicle.VIN, LogEventVehicleUnplug, "")
+	soc := -1
+	if oldState != nil {
+		soc = oldState.SoC
+	}
+	EndChargingInterval(vehicle)
+	EndChargingSession(vehicle, soc)
 	if oldState != nil && oldState.Charging != ChargeStateNotCharging {
 		// Vehicle got unplugged while charging
 		GetDB().SetVehicleStateCharging(vehicle.VIN, ChargeStateNotCharging)
 	}
-	SendPushNotification(fmt.Sprintf("%s unplugged.", vehicle.DisplayName))
+	GetDB().SetVehicleStateChargeNow(vehicle.VIN, false)
+	GetDB().SetVehicleStateSurplusStale(vehicle.VIN, false)
+	msg := fmt.Sprintf("%s unplugged.", vehicle.DisplayName)
+	SendPushNotification(NotificationCategoryPlug, msg)
+	SendWebhookEvent(WebhookEventUnplugged, vehicle, msg, nil)
 }
 
 func OnVehiclePluggedIn(vehicle *Vehicle) {
@@ -145,8 +176,15 @@ func OnVehiclePluggedIn(vehicle *Vehicle) {
 			}
 		}
 		GetDB().SetVehicleStatePluggedIn(vehicle.VIN, true)
-		GetDB().LogChargingEvent(vehicle.VIN, LogEventVehiclePlugIn, "")
-		SendPushNotification(fmt.Sprintf("%s plugged in.", vehicle.DisplayName))
+		LogChargingEvent(vehicle.VIN, LogEventVehiclePlugIn, "")
+		soc := -1
+		if state := GetDB().GetVehicleState(vehicle.VIN); state != nil {
+			soc = state.SoC
+		}
+		StartChargingSession(vehicle, soc)
+		msg := fmt.Sprintf("%s plugged in.", vehicle.DisplayName)
+		SendPushNotification(NotificationCategoryPlug, msg)
+		SendWebhookEvent(WebhookEventPluggedIn, vehicle, msg, nil)
 	}()
 }
 
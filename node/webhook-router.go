@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// WebhookDeliveriesLimit is the number of most recent deliveries returned for a webhook
+const WebhookDeliveriesLimit = 100
+
+type WebhookRouter struct {
+}
+
+type WebhookRequest struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Secret  *string           `json:"secret"`
+	Events  []WebhookEvent    `json:"events"`
+	Headers map[string]string `json:"headers"`
+	Enabled bool              `json:"enabled"`
+}
+
+type WebhookErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (router *WebhookRouter) SetupRoutes(s *mux.Router) {
+	s.HandleFunc("/events", router.listEvents).Methods("GET")
+	s.HandleFunc("/list", router.list).Methods("GET")
+	s.HandleFunc("/create", router.create).Methods("POST")
+	s.HandleFunc("/update/{id}", router.update).Methods("PUT")
+	s.HandleFunc("/delete/{id}", router.delete).Methods("DELETE")
+	s.HandleFunc("/test/{id}", router.test).Methods("POST")
+	s.HandleFunc("/deliveries/{id}", router.listDeliveries).Methods("GET")
+	s.HandleFunc("/redeliver/{id}", router.redeliver).Methods("POST")
+}
+
+func (router *WebhookRouter) listEvents(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, WebhookEvents)
+}
+
+func (router *WebhookRouter) list(w http.ResponseWriter, r *http.Request) {
+	// custom headers might contain credentials, so read-only keys can't list webhooks
+	if !HasFullScope(r) {
+		SendForbidden(w)
+		return
+	}
+	SendJSON(w, GetDB().GetWebhooks())
+}
+
+func (router *WebhookRouter) create(w http.ResponseWriter, r *http.Request) {
+	var m WebhookRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	webhook := &Webhook{}
+	if err := router.apply(webhook, &m); err != nil {
+		router.sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	GetDB().CreateWebhook(webhook)
+	SendJSON(w, webhook)
+}
+
+func (router *WebhookRouter) update(w http.ResponseWriter, r *http.Request) {
+	webhook := router.getWebhook(r)
+	if webhook == nil {
+		SendNotFound(w)
+		return
+	}
+	var m WebhookRequest
+	if err := UnmarshalBody(r.Body, &m); err != nil {
+		SendBadRequest(w)
+		return
+	}
+	if err := router.apply(webhook, &m); err != nil {
+		router.sendError(w, http.StatusBadRequest, err)
+		return
+	}
+	GetDB().UpdateWebhook(webhook)
+	SendJSON(w, webhook)
+}
+
+func (router *WebhookRouter) delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		SendBadRequest(w)
+		return
+	}
+	if !GetDB().DeleteWebhook(id) {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, true)
+}
+
+func (router *WebhookRouter) test(w http.ResponseWriter, r *http.Request) {
+	webhook := router.getWebhook(r)
+	if webhook == nil {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, SendWebhookTest(webhook))
+}
+
+func (router *WebhookRouter) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhook := router.getWebhook(r)
+	if webhook == nil {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, GetDB().GetWebhookDeliveries(webhook.ID, WebhookDeliveriesLimit))
+}
+
+// redeliver schedules a delivery for another series of attempts, i.e. after it failed permanently
+func (router *WebhookRouter) redeliver(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		SendBadRequest(w)
+		return
+	}
+	if !GetDB().ResetWebhookDelivery(id) {
+		SendNotFound(w)
+		return
+	}
+	triggerWebhookDeliveries()
+	SendJSON(w, true)
+}
+
+func (router *WebhookRouter) getWebhook(r *http.Request) *Webhook {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil
+	}
+	return GetDB().GetWebhook(id)
+}
+
+// apply copies the request to the webhook; the secret is kept unless a new one is supplied
+func (router *WebhookRouter) apply(webhook *Webhook, m *WebhookRequest) error {
+	webhook.Name = m.Name
+	webhook.URL = m.URL
+	if m.Secret != nil {
+		webhook.Secret = *m.Secret
+	}
+	webhook.Events = m.Events
+	if webhook.Events == nil {
+		webhook.Events = []WebhookEvent{}
+	}
+	webhook.Headers = m.Headers
+	if webhook.Headers == nil {
+		webhook.Headers = make(map[string]string)
+	}
+	webhook.Enabled = m.Enabled
+	return ValidateWebhook(webhook)
+}
+
+func (router *WebhookRouter) sendError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&WebhookErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebhookSignatureHeader = "X-Chargebot-Signature"
+	WebhookEventHeader     = "X-Chargebot-Event"
+	WebhookDeliveryHeader  = "X-Chargebot-Delivery"
+)
+
+// WebhookRetryBaseDelay is the delay after the first failed attempt, doubled with each further attempt
+const WebhookRetryBaseDelay time.Duration = time.Second * 30
+
+// WebhookRetryMaxDelay caps the exponential backoff between two attempts
+const WebhookRetryMaxDelay time.Duration = time.Hour
+
+// WebhookDeliveryInterval is the interval in which pending retries are checked
+const WebhookDeliveryInterval time.Duration = time.Second * 30
+
+var WebhookEvents = []WebhookEvent{
+	WebhookEventPluggedIn,
+	WebhookEventUnplugged,
+	WebhookEventChargeStarted,
+	WebhookEventChargeStopped,
+	WebhookEventAmpsChanged,
+	WebhookEventTargetReached,
+	WebhookEventPermanentError,
+	WebhookEventSurplusStale,
+	WebhookEventSurplusRecovered,
+	WebhookEventPriceCoverage,
+}
+
+// WebhookPayload is the JSON body posted to the webhook targets
+type WebhookPayload struct {
+	Event       WebhookEvent   `json:"event"`
+	Timestamp   time.Time      `json:"timestamp"`
+	VIN         string         `json:"vin,omitempty"`
+	DisplayName string         `json:"display_name,omitempty"`
+	Message     string         `json:"message"`
+	Data        map[string]any `json:"data,omitempty"`
+}
+
+var TickerWebhookDelivery *time.Ticker = nil
+
+// webhookDeliverAsync sends deliveries in the background, so the charge controller isn't blocked by slow targets
+var webhookDeliverAsync = true
+
+// webhookMutex guards webhookInFlight, it's never held during HTTP requests
+var webhookMutex sync.Mutex
+
+// webhookInFlight contains the IDs of the webhooks which are currently being delivered to
+var webhookInFlight = map[int]bool{}
+
+func InitPeriodicWebhookDelivery() {
+	TickerWebhookDelivery = time.NewTicker(WebhookDeliveryInterval)
+	go func() {
+		for {
+			<-TickerWebhookDelivery.C
+			ProcessWebhookDeliveries()
+		}
+	}()
+}
+
+func IsValidWebhookEvent(event WebhookEvent) bool {
+	return slices.Contains(WebhookEvents, event)
+}
+
+// ValidateWebhook checks the user supplied webhook configuration
+func ValidateWebhook(e *Webhook) error {
+	e.Name = strings.TrimSpace(e.Name)
+	target, err := url.Parse(strings.TrimSpace(e.URL))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("url must be a valid http or https URL")
+	}
+	e.URL = target.String()
+	if e.Name == "" {
+		e.Name = target.Host
+	}
+	for _, event := range e.Events {
+		if !IsValidWebhookEvent(event) {
+			return fmt.Errorf("unknown event '%s'", event)
+		}
+	}
+	for name := range e.Headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid header name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// IsSubscribed checks whether the webhook wants to receive the event, no event filter means all events
+func (e *Webhook) IsSubscribed(event WebhookEvent) bool {
+	if event == WebhookEventTest {
+		// test events are sent on request, even if the webhook is disabled
+		return true
+	}
+	return e.Enabled && (len(e.Events) == 0 || slices.Contains(e.Events, event))
+}
+
+// SendWebhookEvent queues the event for all webhooks subscribed to it and starts delivering it.
+// The vehicle is optional.
+func SendWebhookEvent(event WebhookEvent, vehicle *Vehicle, msg string, data map[string]any) {
+	payload := &WebhookPayload{
+		Event:     event,
+		Timestamp: GetDB().Time.UTCNow(),
+		Message:   msg,
+		Data:      data,
+	}
+	if vehicle != nil {
+		payload.VIN = vehicle.VIN
+		payload.DisplayName = vehicle.DisplayName
+	}
+	body, _ := json.Marshal(payload)
+	num := 0
+	for _, webhook := range GetDB().GetWebhooks() {
+		if webhook.IsSubscribed(event) {
+			GetDB().CreateWebhookDelivery(webhook.ID, event, string(body))
+			num++
+		}
+	}
+	if num > 0 {
+		triggerWebhookDeliveries()
+	}
+}
+
+// SendWebhookTest queues a test event for a single webhook, regardless of its event filter
+func SendWebhookTest(webhook *Webhook) *WebhookDelivery {
+	body, _ := json.Marshal(&WebhookPayload{
+		Event:     WebhookEventTest,
+		Timestamp: GetDB().Time.UTCNow(),
+		Message:   "This is a test event from chargebot.",
+	})
+	delivery := GetDB().CreateWebhookDelivery(webhook.ID, WebhookEventTest, string(body))
+	triggerWebhookDeliveries()
+	return delivery
+}
+
+func triggerWebhookDeliveries() {
+	if webhookDeliverAsync {
+		go ProcessWebhookDeliveries()
+	} else {
+		ProcessWebhookDeliveries()
+	}
+}
+
+// webhookResult is the outcome of posting a delivery, done marks the last result of a webhook's batch
+type webhookResult struct {
+	webhookID    int
+	delivery     *WebhookDelivery
+	responseCode int
+	err          error
+	done         bool
+}
+
+// ProcessWebhookDeliveries attempts all pending deliveries which are due.
+// Each webhook's deliveries are posted in order by their own goroutine, so a slow or unreachable target
+// doesn't delay the others. Webhooks still being delivered to by a previous call are skipped.
+func ProcessWebhookDeliveries() {
+	batches := claimWebhookDeliveries()
+	if len(batches) == 0 {
+		return
+	}
+	results := make(chan *webhookResult)
+	var wg sync.WaitGroup
+	for webhook, deliveries := range batches {
+		wg.Add(1)
+		go func(webhook *Webhook, deliveries []*WebhookDelivery) {
+			defer wg.Done()
+			postWebhookDeliveries(webhook, deliveries, results)
+		}(webhook, deliveries)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	for res := range results {
+		if res.done {
+			webhookMutex.Lock()
+			delete(webhookInFlight, res.webhookID)
+			webhookMutex.Unlock()
+			continue
+		}
+		finishWebhookDelivery(res.delivery, res.responseCode, res.err, true)
+	}
+}
+
+// claimWebhookDeliveries groups the due deliveries by webhook and marks the webhooks as in flight.
+// Deliveries which can't be sent anymore are given up right away.
+func claimWebhookDeliveries() map[*Webhook][]*WebhookDelivery {
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	webhooks := make(map[int]*Webhook)
+	res := make(map[*Webhook][]*WebhookDelivery)
+	for _, delivery := range GetDB().GetDueWebhookDeliveries(GetDB().Time.UTCNow()) {
+		if webhookInFlight[delivery.WebhookID] {
+			continue
+		}
+		webhook, ok := webhooks[delivery.WebhookID]
+		if !ok {
+			webhook = GetDB().GetWebhook(delivery.WebhookID)
+			webhooks[delivery.WebhookID] = webhook
+		}
+		if webhook == nil {
+			finishWebhookDelivery(delivery, 0, errors.New("webhook not found"), false)
+		} else if !webhook.IsSubscribed(delivery.Event) {
+			finishWebhookDelivery(delivery, 0, errors.New("webhook is disabled or no longer subscribed to the event"), false)
+		} else {
+			res[webhook] = append(res[webhook], delivery)
+		}
+	}
+	for webhook := range res {
+		webhookInFlight[webhook.ID] = true
+	}
+	return res
+}
+
+// postWebhookDeliveries posts the deliveries in order and stops at the first failure,
+// the remaining deliveries stay pending for the next run
+func postWebhookDeliveries(webhook *Webhook, deliveries []*WebhookDelivery, results chan<- *webhookResult) {
+	for _, delivery := range deliveries {
+		code, err := postWebhook(webhook, delivery)
+		results <- &webhookResult{webhookID: webhook.ID, delivery: delivery, responseCode: code, err: err}
+		if err != nil {
+			break
+		}
+	}
+	results <- &webhookResult{webhookID: webhook.ID, done: true}
+}
+
+func finishWebhookDelivery(delivery *WebhookDelivery, responseCode int, err error, retry bool) {
+	now := GetDB().Time.UTCNow()
+	delivery.Attempts++
+	delivery.ResponseCode = responseCode
+	retry = retry && delivery.Attempts < GetConfig().WebhookMaxAttempts
+	if err == nil {
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.Error = ""
+		GetDB().SetWebhookDeliveryResult(delivery, now, nil)
+		return
+	}
+	delivery.Error = err.Error()
+	if !retry {
+		log.Printf("Giving up delivering event %s to webhook %d after %d attempts: %s\n", delivery.Event, delivery.WebhookID, delivery.Attempts, delivery.Error)
+		delivery.Status = WebhookDeliveryFailed
+		GetDB().SetWebhookDeliveryResult(delivery, now, nil)
+		return
+	}
+	next := now.Add(GetWebhookRetryDelay(delivery.Attempts))
+	GetDB().SetWebhookDeliveryResult(delivery, now, &next)
+}
+
+func webhookChargeSource(source ChargeState) string {
+	if source == ChargeStateChargingOnGrid {
+		return "grid"
+	}
+	return "solar"
+}
+
+// GetWebhookRetryDelay returns the exponential backoff after the given number of failed attempts
+func GetWebhookRetryDelay(attempts int) time.Duration {
+	delay := WebhookRetryBaseDelay
+	for i := 1; i < attempts && delay < WebhookRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, WebhookRetryMaxDelay)
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 of the payload
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	r, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for name, value := range webhook.Headers {
+		r.Header.Set(name, value)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", "chargebot")
+	r.Header.Set(WebhookEventHeader, string(delivery.Event))
+	r.Header.Set(WebhookDeliveryHeader, strconv.Itoa(delivery.ID))
+	if webhook.Secret != "" {
+		r.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhookPayload(webhook.Secret, body))
+	}
+	client := &http.Client{
+		Timeout: time.Second * time.Duration(GetConfig().WebhookTimeout),
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
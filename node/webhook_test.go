@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookTestTarget struct {
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	codes    []int
+}
+
+func newWebhookTestTarget(t *testing.T, codes ...int) (*webhookTestTarget, *httptest.Server) {
+	target := &webhookTestTarget{codes: codes}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target.mutex.Lock()
+		defer target.mutex.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		target.requests = append(target.requests, r)
+		target.bodies = append(target.bodies, body)
+		code := http.StatusOK
+		if len(target.codes) > 0 {
+			code = target.codes[0]
+			target.codes = target.codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(server.Close)
+	return target, server
+}
+
+func createTestWebhook(url string, events ...WebhookEvent) *Webhook {
+	webhook := &Webhook{
+		Name:    "Test",
+		URL:     url,
+		Secret:  "webhook-secret",
+		Events:  events,
+		Headers: map[string]string{"X-Custom": "custom-value"},
+		Enabled: true,
+	}
+	GetDB().CreateWebhook(webhook)
+	return webhook
+}
+
+func TestWebhook_DeliverSigned(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	target, server := newWebhookTestTarget(t)
+	webhook := createTestWebhook(server.URL, WebhookEventChargeStarted)
+	vehicle := &Vehicle{VIN: "123", DisplayName: "Model Y"}
+
+	SendWebhookEvent(WebhookEventUnplugged, vehicle, "Model Y unplugged.", nil)
+	assert.Len(t, target.requests, 0)
+
+	SendWebhookEvent(WebhookEventChargeStarted, vehicle, "Model Y started charging.", map[string]any{"amps": 16})
+	assert.Len(t, target.requests, 1)
+	r := target.requests[0]
+	assert.Equal(t, "custom-value", r.Header.Get("X-Custom"))
+	assert.Equal(t, string(WebhookEventChargeStarted), r.Header.Get(WebhookEventHeader))
+	assert.Equal(t, "sha256="+SignWebhookPayload("webhook-secret", target.bodies[0]), r.Header.Get(WebhookSignatureHeader))
+
+	var payload WebhookPayload
+	assert.Nil(t, json.Unmarshal(target.bodies[0], &payload))
+	assert.Equal(t, WebhookEventChargeStarted, payload.Event)
+	assert.Equal(t, "123", payload.VIN)
+	assert.Equal(t, "Model Y started charging.", payload.Message)
+	assert.Equal(t, float64(16), payload.Data["amps"])
+
+	deliveries := GetDB().GetWebhookDeliveries(webhook.ID, 10)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, WebhookDeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusOK, deliveries[0].ResponseCode)
+	assert.Nil(t, deliveries[0].NextAttempt)
+}
+
+func TestWebhook_Disabled(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	target, server := newWebhookTestTarget(t)
+	webhook := createTestWebhook(server.URL)
+	webhook.Enabled = false
+	GetDB().UpdateWebhook(webhook)
+
+	SendWebhookEvent(WebhookEventPluggedIn, nil, "plugged in", nil)
+	assert.Len(t, target.requests, 0)
+
+	// test events are delivered anyway
+	SendWebhookTest(webhook)
+	assert.Len(t, target.requests, 1)
+	assert.Equal(t, string(WebhookEventTest), target.requests[0].Header.Get(WebhookEventHeader))
+}
+
+func TestWebhook_Retry(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	target, server := newWebhookTestTarget(t, http.StatusInternalServerError, http.StatusBadGateway)
+	webhook := createTestWebhook(server.URL)
+
+	SendWebhookEvent(WebhookEventPluggedIn, nil, "plugged in", nil)
+	delivery := GetDB().GetWebhookDeliveries(webhook.ID, 10)[0]
+	assert.Equal(t, WebhookDeliveryPending, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, delivery.ResponseCode)
+	assert.Equal(t, "unexpected status code 500", delivery.Error)
+	assert.Equal(t, GlobalMockTime.CurTime.Add(WebhookRetryBaseDelay).Truncate(time.Second), delivery.NextAttempt.Truncate(time.Second))
+
+	// not due yet
+	ProcessWebhookDeliveries()
+	assert.Len(t, target.requests, 1)
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(WebhookRetryBaseDelay)
+	ProcessWebhookDeliveries()
+	assert.Len(t, target.requests, 2)
+	delivery = GetDB().GetWebhookDelivery(delivery.ID)
+	assert.Equal(t, WebhookDeliveryPending, delivery.Status)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Equal(t, GlobalMockTime.CurTime.Add(WebhookRetryBaseDelay*2).Truncate(time.Second), delivery.NextAttempt.Truncate(time.Second))
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(WebhookRetryBaseDelay * 2)
+	ProcessWebhookDeliveries()
+	assert.Len(t, target.requests, 3)
+	delivery = GetDB().GetWebhookDelivery(delivery.ID)
+	assert.Equal(t, WebhookDeliveryDelivered, delivery.Status)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Equal(t, "", delivery.Error)
+	// the same delivery ID is sent with each attempt
+	assert.Equal(t, target.requests[0].Header.Get(WebhookDeliveryHeader), target.requests[2].Header.Get(WebhookDeliveryHeader))
+}
+
+func TestWebhook_SlowTarget(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	release := make(chan bool)
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slowServer.Close)
+	fast, fastServer := newWebhookTestTarget(t)
+	slowWebhook := createTestWebhook(slowServer.URL)
+	fastWebhook := createTestWebhook(fastServer.URL)
+	GetDB().CreateWebhookDelivery(slowWebhook.ID, WebhookEventPluggedIn, "{}")
+	GetDB().CreateWebhookDelivery(slowWebhook.ID, WebhookEventUnplugged, "{}")
+	GetDB().CreateWebhookDelivery(fastWebhook.ID, WebhookEventPluggedIn, "{}")
+
+	done := make(chan bool)
+	go func() {
+		ProcessWebhookDeliveries()
+		done <- true
+	}()
+	// the fast target doesn't wait for the slow one
+	assert.Eventually(t, func() bool {
+		fast.mutex.Lock()
+		defer fast.mutex.Unlock()
+		return len(fast.requests) == 1
+	}, time.Second*5, time.Millisecond*10)
+	close(release)
+	<-done
+
+	for _, webhook := range []*Webhook{slowWebhook, fastWebhook} {
+		for _, delivery := range GetDB().GetWebhookDeliveries(webhook.ID, 10) {
+			assert.Equal(t, WebhookDeliveryDelivered, delivery.Status)
+		}
+	}
+	assert.Len(t, webhookInFlight, 0)
+}
+
+func TestWebhook_GiveUp(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	maxAttempts := GetConfig().WebhookMaxAttempts
+	t.Cleanup(func() {
+		GetConfig().WebhookMaxAttempts = maxAttempts
+	})
+	GetConfig().WebhookMaxAttempts = 2
+	target, server := newWebhookTestTarget(t, http.StatusInternalServerError, http.StatusInternalServerError)
+	webhook := createTestWebhook(server.URL)
+
+	SendWebhookEvent(WebhookEventPluggedIn, nil, "plugged in", nil)
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Hour)
+	ProcessWebhookDeliveries()
+	delivery := GetDB().GetWebhookDeliveries(webhook.ID, 10)[0]
+	assert.Equal(t, WebhookDeliveryFailed, delivery.Status)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Nil(t, delivery.NextAttempt)
+
+	GlobalMockTime.CurTime = GlobalMockTime.CurTime.Add(time.Hour)
+	ProcessWebhookDeliveries()
+	assert.Len(t, target.requests, 2)
+
+	// manual redelivery
+	assert.True(t, GetDB().ResetWebhookDelivery(delivery.ID))
+	ProcessWebhookDeliveries()
+	assert.Len(t, target.requests, 3)
+	assert.Equal(t, WebhookDeliveryDelivered, GetDB().GetWebhookDelivery(delivery.ID).Status)
+}
+
+func TestWebhook_RetryDelay(t *testing.T) {
+	assert.Equal(t, time.Second*30, GetWebhookRetryDelay(1))
+	assert.Equal(t, time.Minute, GetWebhookRetryDelay(2))
+	assert.Equal(t, time.Minute*4, GetWebhookRetryDelay(4))
+	assert.Equal(t, time.Hour, GetWebhookRetryDelay(20))
+}
+
+func TestWebhook_EncryptedAtRest(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	webhook := createTestWebhook("https://example.com/hook")
+
+	raw := GetDB().getRawWebhookSecrets()[webhook.ID]
+	assert.True(t, IsEncryptedSecret(raw[0]))
+	assert.True(t, IsEncryptedSecret(raw[1]))
+	assert.NotContains(t, raw[1], "custom-value")
+
+	webhook = GetDB().GetWebhook(webhook.ID)
+	assert.Equal(t, "webhook-secret", webhook.Secret)
+	assert.Equal(t, "custom-value", webhook.Headers["X-Custom"])
+}
+
+func TestWebhook_Router(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	resetAuthConfig(t)
+	GetConfig().AuthEnabled = true
+	readKey, _, _ := CreateAPIKey("read", APIKeyScopeRead)
+	fullKey, _, _ := CreateAPIKey("full", APIKeyScopeFull)
+	target, server := newWebhookTestTarget(t)
+
+	res := executeTestRequest(newHTTPRequest("POST", "/api/1/webhooks/create", fullKey, strings.NewReader(`{"url": "ftp://example.com"}`)))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/webhooks/create", fullKey, strings.NewReader(`{"url": "https://example.com", "events": ["unknown"]}`)))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/webhooks/create", readKey, strings.NewReader(`{"url": "`+server.URL+`"}`)))
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/webhooks/create", fullKey, strings.NewReader(`{"url": "`+server.URL+`", "secret": "s3cret", "events": ["charge_started"], "headers": {"Authorization": "Bearer token"}, "enabled": true}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.NotContains(t, res.Body.String(), "s3cret")
+	var webhook Webhook
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &webhook))
+	assert.True(t, webhook.HasSecret)
+	assert.Equal(t, "127.0.0.1", strings.Split(webhook.Name, ":")[0])
+
+	// headers might contain credentials
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/webhooks/list", readKey, nil))
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/webhooks/list", fullKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "Bearer token")
+
+	// the secret is kept if not supplied on update
+	res = executeTestRequest(newHTTPRequest("PUT", "/api/1/webhooks/update/"+strconv.Itoa(webhook.ID), fullKey, strings.NewReader(`{"name": "Home Assistant", "url": "`+server.URL+`", "enabled": true}`)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	stored := GetDB().GetWebhook(webhook.ID)
+	assert.Equal(t, "Home Assistant", stored.Name)
+	assert.Equal(t, "s3cret", stored.Secret)
+	assert.Len(t, stored.Events, 0)
+
+	res = executeTestRequest(newHTTPRequest("POST", "/api/1/webhooks/test/"+strconv.Itoa(webhook.ID), fullKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Len(t, target.requests, 1)
+	res = executeTestRequest(newHTTPRequest("GET", "/api/1/webhooks/deliveries/"+strconv.Itoa(webhook.ID), readKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"status":"delivered"`)
+
+	res = executeTestRequest(newHTTPRequest("DELETE", "/api/1/webhooks/delete/"+strconv.Itoa(webhook.ID), fullKey, nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Nil(t, GetDB().GetWebhook(webhook.ID))
+	assert.Len(t, GetDB().GetWebhookDeliveries(webhook.ID, 10), 0)
+	res = executeTestRequest(newHTTPRequest("DELETE", "/api/1/webhooks/delete/"+strconv.Itoa(webhook.ID), fullKey, nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
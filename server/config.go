@@ -29,6 +29,7 @@ type Config struct {
 	AuthFieldEmail     string
 	AuthFieldUsername  string
 	InitDBOnly         bool
+	MetricsToken       string `json:"-"`
 }
 
 var _configInstance *Config
@@ -75,6 +76,7 @@ func (c *Config) ReadConfig() {
 	c.AuthFieldEmail = c.getEnv("AUTH_FIELD_EMAIL", "email")
 	c.AuthFieldUsername = c.getEnv("AUTH_FIELD_USERNAME", "preferred_username")
 	c.InitDBOnly = (c.getEnv("INIT_DB_ONLY", "0") == "1")
+	c.MetricsToken = c.getEnv("METRICS_TOKEN", "")
 }
 
 func (c *Config) Print() {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	. "github.com/virtualzone/chargebot/goshared"
+)
+
+type DBMigration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// DBMigrations lists all schema changes in the order they are applied.
+// Never modify or reorder existing migrations, always append new ones.
+var DBMigrations = []*DBMigration{
+	{1, "initial schema", MigrateExec(`
+create table if not exists auth_codes(id text primary key, ts text);
+create table if not exists users(id text primary key, tesla_user_id text default '', home_lat real default 0.0, home_lng real default 0.0, home_radius real default 100);
+create table if not exists vehicles(vin text primary key, user_id text);
+create table if not exists api_tokens(token text primary key, user_id text, passhash text);
+create table if not exists telemetry_state(vin text primary key, plugged_in int, charging int, soc int, amps int, charge_limit int, is_home int, ts int);
+`)},
+	{2, "add users.region", MigrateAddColumn("users", "region", "text default 'eu'")},
+	{3, "add logs", MigrateExec(`
+create table if not exists logs(vehicle_vin text, ts text, event_id int, details text);
+`)},
+}
+
+func GetLatestSchemaVersion() int {
+	return DBMigrations[len(DBMigrations)-1].Version
+}
+
+func (db *DB) GetSchemaVersion() int {
+	var num int
+	if err := db.GetConnection().QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'schema_version'").Scan(&num); err != nil {
+		log.Panicln(err)
+	}
+	if num == 0 {
+		return 0
+	}
+	var version sql.NullInt64
+	if err := db.GetConnection().QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		log.Panicln(err)
+	}
+	return int(version.Int64)
+}
+
+func (db *DB) GetPendingMigrations() []*DBMigration {
+	version := db.GetSchemaVersion()
+	res := []*DBMigration{}
+	for _, m := range DBMigrations {
+		if m.Version > version {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func (db *DB) PrintPendingMigrations() {
+	version := db.GetSchemaVersion()
+	pending := db.GetPendingMigrations()
+	fmt.Printf("Current schema version: %d, latest schema version: %d\n", version, GetLatestSchemaVersion())
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations.")
+		return
+	}
+	for _, m := range pending {
+		fmt.Printf("%4d  %s\n", m.Version, m.Description)
+	}
+}
+
+// Migrate applies all pending migrations, each in its own transaction
+func (db *DB) Migrate() {
+	if _, err := db.GetConnection().Exec("create table if not exists schema_version(version int primary key, description text, applied_at text)"); err != nil {
+		log.Panicln(err)
+	}
+	version := db.GetSchemaVersion()
+	latest := GetLatestSchemaVersion()
+	if version > latest {
+		log.Panicf("Database schema version %d is newer than version %d supported by this release\n", version, latest)
+	}
+	for _, m := range db.GetPendingMigrations() {
+		log.Printf("Migrating database to schema version %d (%s)...\n", m.Version, m.Description)
+		if err := db.applyMigration(m); err != nil {
+			log.Panicf("Migration to schema version %d failed: %s\n", m.Version, err.Error())
+		}
+	}
+}
+
+func (db *DB) applyMigration(m *DBMigration) error {
+	return ApplyMigration(db.GetConnection(), m.Version, m.Description, m.Up, db.formatSqliteDatetime(db.Time.UTCNow()))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// schema created by InitDBStructure before schema versioning was introduced
+const legacyDBSchema = `
+create table if not exists auth_codes(id text primary key, ts text);
+create table if not exists users(id text primary key, tesla_user_id text default '', home_lat real default 0.0, home_lng real default 0.0, home_radius real default 100, region text default 'eu');
+create table if not exists vehicles(vin text primary key, user_id text);
+create table if not exists api_tokens(token text primary key, user_id text, passhash text);
+create table if not exists telemetry_state(vin text primary key, plugged_in int, charging int, soc int, amps int, charge_limit int, is_home int, ts int);
+insert into users values ('u1', 't1', 1.0, 2.0, 100, 'na');
+insert into vehicles values ('123', 'u1');
+`
+
+func newMigrationTestDB(t *testing.T) *DB {
+	dbFile := GetConfig().DBFile
+	GetConfig().DBFile = filepath.Join(t.TempDir(), "chargebot.db")
+	db := &DB{Time: GlobalMockTime}
+	db.Connect()
+	t.Cleanup(func() {
+		db.GetConnection().Close()
+		GetConfig().DBFile = dbFile
+	})
+	return db
+}
+
+// migrateStepwise applies every pending migration on its own and checks the resulting schema version
+func migrateStepwise(t *testing.T, db *DB) {
+	migrations := DBMigrations
+	t.Cleanup(func() {
+		DBMigrations = migrations
+	})
+	for i, m := range migrations {
+		DBMigrations = migrations[:i+1]
+		db.Migrate()
+		assert.Equal(t, m.Version, db.GetSchemaVersion())
+	}
+	assert.Len(t, db.GetPendingMigrations(), 0)
+}
+
+func TestDBMigrations_Empty(t *testing.T) {
+	db := newMigrationTestDB(t)
+	assert.Equal(t, 0, db.GetSchemaVersion())
+	assert.Len(t, db.GetPendingMigrations(), len(DBMigrations))
+
+	migrateStepwise(t, db)
+
+	db.Migrate()
+	assert.Equal(t, GetLatestSchemaVersion(), db.GetSchemaVersion())
+}
+
+func TestDBMigrations_Legacy(t *testing.T) {
+	db := newMigrationTestDB(t)
+	_, err := db.GetConnection().Exec(legacyDBSchema)
+	assert.Nil(t, err)
+
+	migrateStepwise(t, db)
+
+	var region string
+	err = db.GetConnection().QueryRow("select region from users where id = 'u1'").Scan(&region)
+	assert.Nil(t, err)
+	assert.Equal(t, "na", region)
+
+	var num int
+	err = db.GetConnection().QueryRow("select count(*) from vehicles").Scan(&num)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, num)
+}
+
+func TestDBMigrations_NewerVersion(t *testing.T) {
+	db := newMigrationTestDB(t)
+	db.Migrate()
+	_, err := db.GetConnection().Exec("insert into schema_version (version, description, applied_at) values (?, 'future', '')", GetLatestSchemaVersion()+1)
+	assert.Nil(t, err)
+	assert.Panics(t, func() {
+		db.Migrate()
+	})
+}
+
+func TestDB_LogChargingEvent(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+
+	GetDB().LogChargingEvent("123", 1, "test")
+
+	var num int
+	err := GetDB().GetConnection().QueryRow("select count(*) from logs where vehicle_vin = '123'").Scan(&num)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, num)
+}
@@ -68,6 +68,11 @@ func (db *DB) GetConnection() *sql.DB {
 	return db.Connection
 }
 
+func (db *DB) Ping() error {
+	var res int
+	return db.GetConnection().QueryRow("select 1").Scan(&res)
+}
+
 func (db *DB) ResetDBStructure() {
 	log.Println("Resetting database...")
 	_, err := db.GetConnection().Exec(`
@@ -76,6 +81,8 @@ drop table if exists users;
 drop table if exists vehicles;
 drop table if exists api_tokens;
 drop table if exists telemetry_state;
+drop table if exists logs;
+drop table if exists schema_version;
 `)
 	if err != nil {
 		log.Panicln(err)
@@ -84,19 +91,7 @@ drop table if exists telemetry_state;
 
 func (db *DB) InitDBStructure() {
 	log.Println("Initializing database structure...")
-	_, err := db.GetConnection().Exec(`
-create table if not exists auth_codes(id text primary key, ts text);
-create table if not exists users(id text primary key, tesla_user_id text default '', home_lat real default 0.0, home_lng real default 0.0, home_radius real default 100);
-create table if not exists vehicles(vin text primary key, user_id text);
-create table if not exists api_tokens(token text primary key, user_id text, passhash text);
-create table if not exists telemetry_state(vin text primary key, plugged_in int, charging int, soc int, amps int, charge_limit int, is_home int, ts int);
-`)
-	if err != nil {
-		log.Panicln(err)
-	}
-	if _, err := db.GetConnection().Exec(`alter table users add column region text default 'eu';`); err != nil {
-		log.Println(err)
-	}
+	db.Migrate()
 }
 
 func (db *DB) CreateAuthCode() string {
@@ -196,6 +196,9 @@ func InitHTTPRouter() {
 		route.SetupRoutes(subRouter)
 	}
 
+	router.Handle("/metrics", MetricsHandler()).Methods("GET")
+	router.HandleFunc("/healthz", HealthHandler).Methods("GET")
+
 	if GetConfig().DevProxy {
 		target, _ := url.Parse("http://localhost:3000")
 		proxy := httputil.NewSingleHostReverseProxy(target)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 )
@@ -12,9 +13,16 @@ func GetTeslaAPI() TeslaAPI {
 }
 
 func main() {
+	pendingMigrations := flag.Bool("pending-migrations", false, "print pending database migrations and exit")
+	flag.Parse()
+
 	log.Println("Starting chargebot.io backend...")
 	GetConfig().ReadConfig()
 	GetDB().Connect()
+	if *pendingMigrations {
+		GetDB().PrintPendingMigrations()
+		return
+	}
 	if GetConfig().Reset {
 		GetDB().ResetDBStructure()
 	}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricUserRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_server_user_requests_total",
+		Help: "Number of requests to the node API by route and status code.",
+	}, []string{"route", "code"})
+	metricUserRequestDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chargebot_server_user_request_duration_seconds",
+		Help:    "Latency of requests to the node API by route.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12), // 10ms to 20s
+	}, []string{"route"})
+	metricSessionCacheHits = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "chargebot_server_session_cache_hits_total",
+		Help: "Number of vehicle command sessions taken from the cache.",
+	})
+	metricSessionCacheMisses = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "chargebot_server_session_cache_misses_total",
+		Help: "Number of vehicle command sessions which had to be initialized.",
+	})
+	metricWebsocketConnections = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "chargebot_server_websocket_connections",
+		Help: "Number of nodes connected via websocket.",
+	})
+	metricTelemetryUpdates = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_server_telemetry_updates_total",
+		Help: "Number of telemetry updates received via RPC, by result (ok, unknown_vehicle).",
+	}, []string{"result"})
+	metricFleetAPIRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_server_fleet_api_requests_total",
+		Help: "Number of Tesla Fleet API requests by region and method.",
+	}, []string{"region", "method"})
+	metricFleetAPIErrors = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "chargebot_server_fleet_api_errors_total",
+		Help: "Number of failed Tesla Fleet API requests by region and method.",
+	}, []string{"region", "method"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(collectors.NewGoCollector())
+	metricsRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// MetricsHandler serves the metrics, protected by METRICS_TOKEN if set
+func MetricsHandler() http.Handler {
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := GetConfig().MetricsToken; token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			SendUnauthorized(w)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// MetricsUserRequestMiddleware counts requests by route template, so tokens and VINs don't end up in labels
+func MetricsUserRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		labels := prometheus.Labels{"route": route}
+		handler := promhttp.InstrumentHandlerCounter(metricUserRequests.MustCurryWith(labels), next)
+		if !strings.HasSuffix(route, "/ws") {
+			// a websocket's duration is the connection's lifetime, not a request latency
+			handler = promhttp.InstrumentHandlerDuration(metricUserRequestDuration.MustCurryWith(labels), handler)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func MetricsSessionCache(hit bool) {
+	if hit {
+		metricSessionCacheHits.Inc()
+	} else {
+		metricSessionCacheMisses.Inc()
+	}
+}
+
+func MetricsTelemetryUpdate(result string) {
+	metricTelemetryUpdates.WithLabelValues(result).Inc()
+}
+
+// MetricsFleetAPIRequest records a Fleet API request; the region is taken from the audience host,
+// i.e. "fleet-api.prd.eu.vn.cloud.tesla.com"
+func MetricsFleetAPIRequest(r *http.Request, method string, resp *http.Response, err error) {
+	region := "unknown"
+	parts := strings.Split(r.URL.Hostname(), ".")
+	if len(parts) > 2 && IsValidAudienceRegionCode(parts[2]) {
+		region = parts[2]
+	}
+	metricFleetAPIRequests.WithLabelValues(region, method).Inc()
+	if err != nil || resp == nil || resp.StatusCode >= 400 {
+		metricFleetAPIErrors.WithLabelValues(region, method).Inc()
+	}
+}
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// HealthHandler checks the database and the OIDC provider
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	res := &HealthResponse{
+		Status: "ok",
+		Checks: map[string]string{},
+	}
+	checks := map[string]func() error{
+		"db":   GetDB().Ping,
+		"oidc": GetOIDCProvider().Ping,
+	}
+	for name, check := range checks {
+		if err := check(); err != nil {
+			res.Status = "error"
+			res.Checks[name] = err.Error()
+		} else {
+			res.Checks[name] = "ok"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	SendJSON(w, res)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_Endpoint(t *testing.T) {
+	t.Cleanup(func() {
+		GetConfig().MetricsToken = ""
+	})
+
+	res := executeTestRequest(newHTTPRequest("GET", "/metrics", "", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "chargebot_server_websocket_connections 0")
+
+	GetConfig().MetricsToken = "secret"
+	res = executeTestRequest(newHTTPRequest("GET", "/metrics", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	res = executeTestRequest(newHTTPRequest("GET", "/metrics", "secret", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestMetrics_UserRequests(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	before := testutil.ToFloat64(metricUserRequests.WithLabelValues("/api/1/user/{token}/ping", "401"))
+
+	req := newHTTPRequest("POST", "/api/1/user/"+uuid.NewString()+"/ping", "", strings.NewReader(`{"password": "1234"}`))
+	res := executeTestRequest(req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+	assert.Equal(t, before+1, testutil.ToFloat64(metricUserRequests.WithLabelValues("/api/1/user/{token}/ping", "401")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metricUserRequestDuration, "chargebot_server_user_request_duration_seconds"))
+}
+
+func TestMetrics_FleetAPIRequest(t *testing.T) {
+	okResp := &http.Response{StatusCode: http.StatusOK}
+	failedResp := &http.Response{StatusCode: http.StatusUnauthorized}
+	eu, _ := http.NewRequest("GET", GetAudienceURL("eu")+"/api/1/vehicles", nil)
+	na, _ := http.NewRequest("GET", GetAudienceURL("na")+"/api/1/vehicles", nil)
+
+	MetricsFleetAPIRequest(eu, "list_vehicles", okResp, nil)
+	MetricsFleetAPIRequest(eu, "list_vehicles", failedResp, nil)
+	MetricsFleetAPIRequest(na, "list_vehicles", nil, errors.New("timeout"))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(metricFleetAPIRequests.WithLabelValues("eu", "list_vehicles")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricFleetAPIErrors.WithLabelValues("eu", "list_vehicles")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricFleetAPIErrors.WithLabelValues("na", "list_vehicles")))
+}
+
+func TestMetrics_TelemetryUpdate(t *testing.T) {
+	t.Cleanup(ResetTestDB)
+	before := testutil.ToFloat64(metricTelemetryUpdates.WithLabelValues("unknown_vehicle"))
+	var reply bool
+	new(VehicleStateTelemetry).Update(&TelemetryState{VIN: "unknown"}, &reply)
+	assert.Equal(t, before+1, testutil.ToFloat64(metricTelemetryUpdates.WithLabelValues("unknown_vehicle")))
+}
+
+func TestHealth(t *testing.T) {
+	res := executeTestRequest(newHTTPRequest("GET", "/healthz", "", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"status": "ok", "checks": {"db": "ok", "oidc": "ok"}}`, res.Body.String())
+}
+
+func TestHealth_OIDCNotInitialized(t *testing.T) {
+	OIDCTestingMode = false
+	t.Cleanup(func() {
+		OIDCTestingMode = true
+	})
+	res := executeTestRequest(newHTTPRequest("GET", "/healthz", "", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.JSONEq(t, `{"status": "error", "checks": {"db": "ok", "oidc": "provider not initialized"}}`, res.Body.String())
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -61,6 +63,29 @@ func (op *OIDCProvider) Init() {
 	op.States = []string{}
 }
 
+// Ping checks whether the provider's discovery document can be retrieved
+func (op *OIDCProvider) Ping() error {
+	if OIDCTestingMode {
+		return nil
+	}
+	if op.Provider == nil {
+		return errors.New("provider not initialized")
+	}
+	ctx, cancel := context.WithTimeout(op.Context, 5*time.Second)
+	defer cancel()
+	wellKnown := strings.TrimSuffix(GetConfig().AuthURL, "/") + "/.well-known/openid-configuration"
+	r, _ := http.NewRequestWithContext(ctx, "GET", wellKnown, nil)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (op *OIDCProvider) GetUserForSubject(subject string) *User {
 	user := GetDB().GetUser(subject)
 	return user
@@ -170,7 +170,7 @@ func (a *TeslaAPIImpl) InitSession(accessToken string, vin string) (*vehicle.Veh
 func (a *TeslaAPIImpl) ListVehicles(audience string, accessToken string) ([]TeslaAPIVehicleEntity, error) {
 	r, _ := http.NewRequest("GET", audience+"/api/1/vehicles", nil)
 
-	resp, err := RetryHTTPJSONRequest(r, accessToken)
+	resp, err := a.sendFleetAPIRequest(r, accessToken, "list_vehicles")
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -232,7 +232,7 @@ func (a *TeslaAPIImpl) GetVehicleData(audience string, accessToken string, vin s
 	target := audience + "/api/1/vehicles/" + vin + "/vehicle_data"
 	r, _ := http.NewRequest("GET", target, nil)
 
-	resp, err := RetryHTTPJSONRequest(r, accessToken)
+	resp, err := a.sendFleetAPIRequest(r, accessToken, "vehicle_data")
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -254,7 +254,7 @@ func (a *TeslaAPIImpl) Wakeup(audience string, accessToken string, vin string) e
 	target := audience + "/api/1/vehicles/" + vin + "/wake_up"
 	r, _ := http.NewRequest("POST", target, nil)
 
-	_, err := RetryHTTPJSONRequest(r, accessToken)
+	_, err := a.sendFleetAPIRequest(r, accessToken, "wake_up")
 	if err != nil {
 		// TODO
 		log.Println(err)
@@ -291,7 +291,7 @@ func (a *TeslaAPIImpl) CreateTelemetryConfig(audience string, accessToken string
 	target := audience + "/api/1/vehicles/fleet_telemetry_config"
 	r, _ := http.NewRequest("POST", target, bytes.NewReader(json))
 
-	resp, err := RetryHTTPJSONRequest(r, accessToken)
+	resp, err := a.sendFleetAPIRequest(r, accessToken, "create_telemetry_config")
 	if err != nil {
 		log.Println(err)
 		return err
@@ -307,7 +307,7 @@ func (a *TeslaAPIImpl) DeleteTelemetryConfig(audience string, accessToken string
 	target := audience + "/api/1/vehicles/" + vin + "/fleet_telemetry_config"
 	r, _ := http.NewRequest("DELETE", target, nil)
 
-	_, err := RetryHTTPJSONRequest(r, accessToken)
+	_, err := a.sendFleetAPIRequest(r, accessToken, "delete_telemetry_config")
 	if err != nil {
 		log.Println(err)
 		return err
@@ -320,7 +320,7 @@ func (a *TeslaAPIImpl) GetTelemetryConfig(audience string, accessToken string, v
 	target := audience + "/api/1/vehicles/" + vin + "/fleet_telemetry_config"
 	r, _ := http.NewRequest("GET", target, nil)
 
-	resp, err := RetryHTTPJSONRequest(r, accessToken)
+	resp, err := a.sendFleetAPIRequest(r, accessToken, "get_telemetry_config")
 	if err != nil {
 		log.Println(err)
 		return err
@@ -331,3 +331,10 @@ func (a *TeslaAPIImpl) GetTelemetryConfig(audience string, accessToken string, v
 
 	return nil
 }
+
+// sendFleetAPIRequest sends a request to the Fleet API and records it in the metrics
+func (a *TeslaAPIImpl) sendFleetAPIRequest(r *http.Request, accessToken string, method string) (*http.Response, error) {
+	resp, err := RetryHTTPJSONRequest(r, accessToken)
+	MetricsFleetAPIRequest(r, method, resp, err)
+	return resp, err
+}
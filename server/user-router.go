@@ -27,6 +27,7 @@ type AuthenticatedUserRequest struct {
 func (router *UserRouter) SetupRoutes(s *mux.Router) {
 	router.VINToSessionCache = NewInMemoryCache(5 * time.Minute)
 	router.WebsocketUpgrader = websocket.Upgrader{}
+	s.Use(MetricsUserRequestMiddleware)
 	s.HandleFunc("/{token}/ping", router.ping).Methods("POST")
 	s.HandleFunc("/{token}/ws", router.websocket).Methods("GET")
 	s.HandleFunc("/{token}/list_vehicles", router.listVehicles).Methods("POST")
@@ -45,6 +46,7 @@ func (router *UserRouter) SetupRoutes(s *mux.Router) {
 
 func (router *UserRouter) getOrInitSession(accessToken, vin string) (*vehicle.Vehicle, error) {
 	session := router.VINToSessionCache.Get(vin)
+	MetricsSessionCache(session != nil)
 	if session != nil {
 		return session.(*vehicle.Vehicle), nil
 	}
@@ -75,6 +77,8 @@ func (router *UserRouter) websocket(w http.ResponseWriter, r *http.Request) {
 		log.Print("upgrade:", err)
 		return
 	}
+	metricWebsocketConnections.Inc()
+	defer metricWebsocketConnections.Dec()
 
 	vars := mux.Vars(r)
 	token := vars["token"]
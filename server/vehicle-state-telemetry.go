@@ -30,8 +30,10 @@ func (t *VehicleStateTelemetry) updateVehicleState(telemetryState *TelemetryStat
 	vehicle := GetDB().GetVehicleByVIN(telemetryState.VIN)
 	if vehicle == nil {
 		log.Printf("could not find vehicle by vin for telemetry data: %s\n", telemetryState.VIN)
+		MetricsTelemetryUpdate("unknown_vehicle")
 		return
 	}
+	MetricsTelemetryUpdate("ok")
 
 	user := GetDB().GetUser(vehicle.UserID)
 	isVehicleHome := IsVehicleHome(telemetryState, user)